@@ -6,8 +6,17 @@ exports.handler = async (event) => {
     if (!urlQueryParam) { return { statusCode: 400, body: JSON.stringify({ error: 'URL parameter is missing' }), headers: { 'Content-Type': 'application/json' } }; }
     const baseUrl = urlQueryParam.includes('data/v4') ? 'https://open.example.com/' : 'https://api.example.com/';
     const fullUrl = urlQueryParam.includes('https://') ? decodeURIComponent(urlQueryParam) : `${baseUrl}${urlQueryParam}`;
+    const skipHeaders = ['host', 'connection', 'content-length', 'content-type', 'accept-encoding', 'user-agent', 'via'];
     const headers = {};
-    const options = { method: 'GET', headers };
+    for (const [name, value] of Object.entries(event.headers || {})) {
+      const lower = name.toLowerCase();
+      if (skipHeaders.includes(lower) || lower.startsWith('x-amzn-') || lower.startsWith('x-forwarded-')) { continue; }
+      headers[name] = value;
+    }
+    const method = event.requestContext && event.requestContext.http ? event.requestContext.http.method : (event.httpMethod || 'GET');
+    const body = event.body ? Buffer.from(event.body, event.isBase64Encoded ? 'base64' : 'utf8') : null;
+    if (body) { headers['Content-Type'] = (event.headers && event.headers['content-type']) || 'application/octet-stream'; headers['Content-Length'] = body.length; }
+    const options = { method, headers };
     const response = await new Promise((resolve, reject) => {
       const req = https.request(fullUrl, options, (res) => {
         let data = '';
@@ -15,6 +24,7 @@ exports.handler = async (event) => {
         res.on('end', () => resolve({ statusCode: res.statusCode, body: data, headers: { 'Content-Type': 'application/json' } }));
       });
       req.on('error', (error) => reject(error));
+      if (body) { req.write(body); }
       req.end();
     });
     return response;
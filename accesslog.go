@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+type accessLogEntry struct {
+	RemoteAddr string  `json:"remote_addr"`
+	Time       string  `json:"time"`
+	Method     string  `json:"method"`
+	URI        string  `json:"uri"`
+	Protocol   string  `json:"protocol"`
+	Status     int     `json:"status"`
+	Bytes      int     `json:"bytes"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+	RequestID  string  `json:"request_id,omitempty"`
+}
+
+// withAccessLog wraps handler to print one line per request in the
+// -access-log-format: clf, combined (clf plus referer and user agent, as
+// Apache writes them) or json.
+func withAccessLog(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if config.AccessLogFormat == "" {
+		return handler
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		start := time.Now()
+		handler(ctx)
+
+		// A streamed body has no known size, and Body would read all of it
+		// into memory.
+		size := -1
+		if !ctx.Response.IsBodyStream() {
+			size = len(ctx.Response.Body())
+		}
+		fmt.Println(formatAccessLog(config.AccessLogFormat, accessLogEntry{
+			RemoteAddr: ctx.RemoteIP().String(),
+			Time:       start.Format(time.RFC3339),
+			Method:     string(ctx.Method()),
+			URI:        string(ctx.RequestURI()),
+			Protocol:   string(ctx.Request.Header.Protocol()),
+			Status:     ctx.Response.StatusCode(),
+			Bytes:      size,
+			Referer:    string(ctx.Referer()),
+			UserAgent:  string(ctx.UserAgent()),
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			RequestID:  currentRequestID(ctx),
+		}, start))
+	}
+}
+
+func formatAccessLog(format string, entry accessLogEntry, start time.Time) string {
+	if format == "json" {
+		line, err := jsonLine.Marshal(entry)
+		if err != nil {
+			return ""
+		}
+		return string(line)
+	}
+
+	size := "-"
+	if entry.Bytes > 0 {
+		size = strconv.Itoa(entry.Bytes)
+	}
+	line := fmt.Sprintf("%s - - [%s] %s %d %s", entry.RemoteAddr, start.Format(clfTimeFormat),
+		strconv.Quote(entry.Method+" "+entry.URI+" "+entry.Protocol), entry.Status, size)
+	if format == "combined" {
+		line += " " + clfQuote(entry.Referer) + " " + clfQuote(entry.UserAgent)
+	}
+	return line
+}
+
+// clfQuote quotes a header value for a combined log line, "-" when empty.
+func clfQuote(value string) string {
+	if value == "" {
+		value = "-"
+	}
+	return strconv.Quote(value)
+}
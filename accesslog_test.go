@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestFormatAccessLog(t *testing.T) {
+	start := time.Date(2026, time.October, 14, 15, 32, 50, 0, time.FixedZone("", 2*3600))
+	entry := accessLogEntry{
+		RemoteAddr: "10.0.0.7",
+		Time:       start.Format(time.RFC3339),
+		Method:     "GET",
+		URI:        "/?url=http://a.example/x",
+		Protocol:   "HTTP/1.1",
+		Status:     200,
+		Bytes:      54,
+		Referer:    "https://app.example/",
+		UserAgent:  `curl/7.88.1 "test"`,
+		DurationMS: 1.5,
+		RequestID:  "req-1",
+	}
+	empty := entry
+	empty.Bytes, empty.Referer, empty.UserAgent, empty.RequestID = 0, "", "", ""
+
+	tests := []struct {
+		format string
+		entry  accessLogEntry
+		want   string
+	}{
+		{"clf", entry, `10.0.0.7 - - [14/Oct/2026:15:32:50 +0200] "GET /?url=http://a.example/x HTTP/1.1" 200 54`},
+		{"combined", entry, `10.0.0.7 - - [14/Oct/2026:15:32:50 +0200] "GET /?url=http://a.example/x HTTP/1.1" 200 54 "https://app.example/" "curl/7.88.1 \"test\""`},
+		{"combined", empty, `10.0.0.7 - - [14/Oct/2026:15:32:50 +0200] "GET /?url=http://a.example/x HTTP/1.1" 200 - "-" "-"`},
+		{"json", entry, `{"remote_addr":"10.0.0.7","time":"2026-10-14T15:32:50+02:00","method":"GET","uri":"/?url=http://a.example/x","protocol":"HTTP/1.1","status":200,"bytes":54,"referer":"https://app.example/","user_agent":"curl/7.88.1 \"test\"","duration_ms":1.5,"request_id":"req-1"}`},
+		{"json", empty, `{"remote_addr":"10.0.0.7","time":"2026-10-14T15:32:50+02:00","method":"GET","uri":"/?url=http://a.example/x","protocol":"HTTP/1.1","status":200,"bytes":0,"duration_ms":1.5}`},
+	}
+	for _, tt := range tests {
+		if got := formatAccessLog(tt.format, tt.entry, start); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	tests := []struct {
+		format string
+		stream bool
+		want   string // pattern of the line, the timestamp left out
+	}{
+		{"", false, ""},
+		{"clf", false, `^192\.0\.2\.10 - - \[[^]]+\] "POST /\?url=a\.example/x HTTP/1\.1" 201 11$`},
+		{"combined", false, `^192\.0\.2\.10 - - \[[^]]+\] "POST /\?url=a\.example/x HTTP/1\.1" 201 11 "https://app\.example/" "tester/1\.0"$`},
+		{"combined", true, `^192\.0\.2\.10 - - \[[^]]+\] "POST /\?url=a\.example/x HTTP/1\.1" 201 - "https://app\.example/" "tester/1\.0"$`},
+		{"json", false, `^\{"remote_addr":"192\.0\.2\.10","time":"[^"]+","method":"POST","uri":"/\?url=a\.example/x","protocol":"HTTP/1\.1","status":201,"bytes":11,"referer":"https://app\.example/","user_agent":"tester/1\.0","duration_ms":[0-9.]+,"request_id":"req-1"\}$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			setup(t)
+			config.AccessLogFormat = tt.format
+			handler := withAccessLog(func(ctx *fasthttp.RequestCtx) {
+				ctx.SetStatusCode(fasthttp.StatusCreated)
+				ctx.Response.Header.Set(requestIDHeader, "req-1")
+				if tt.stream {
+					ctx.SetBodyStream(strings.NewReader("streamed"), -1)
+					return
+				}
+				ctx.SetBodyString(`{"ok":true}`)
+			})
+			var req fasthttp.Request
+			req.SetRequestURI("/?url=a.example/x")
+			req.Header.SetMethod(fasthttp.MethodPost)
+			req.Header.SetReferer("https://app.example/")
+			req.Header.SetUserAgent("tester/1.0")
+			var ctx fasthttp.RequestCtx
+			ctx.Init(&req, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 50000}, nil)
+
+			line := strings.TrimSuffix(captureOutput(t, func() { handler(&ctx) }), "\n")
+			if tt.want == "" {
+				if line != "" {
+					t.Errorf("logged %q without -access-log-format", line)
+				}
+				return
+			}
+			if !regexp.MustCompile(tt.want).MatchString(line) {
+				t.Errorf("line = %s\nwant %s", line, tt.want)
+			}
+			if tt.stream && !ctx.Response.IsBodyStream() {
+				t.Error("logging read the streamed body")
+			}
+		})
+	}
+}
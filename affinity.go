@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// affinityID names a server in the affinity cookie without revealing its
+// URL.
+func affinityID(serverURL string) string {
+	sum := sha256.Sum256([]byte(serverURL))
+	return hex.EncodeToString(sum[:8])
+}
+
+func affinitySignature(id string) string {
+	mac := hmac.New(sha256.New, []byte(config.AffinitySecret))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// affinityServer returns the server ID carried by the request's affinity
+// cookie, or "" without a cookie or with one whose signature does not match
+// -affinity-secret.
+func affinityServer(ctx *fasthttp.RequestCtx) string {
+	if config.AffinityCookie == "" {
+		return ""
+	}
+	id, signature, ok := strings.Cut(string(ctx.Request.Header.Cookie(config.AffinityCookie)), ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(affinitySignature(id))) {
+		return ""
+	}
+	return id
+}
+
+// preferAffinity moves the server named by the affinity cookie to position
+// first, so it gets the first attempt. A server that is not among servers,
+// e.g. because it is unhealthy or cooling down, leaves the rotation as it is.
+func preferAffinity(ctx *fasthttp.RequestCtx, servers []Server, first int) []Server {
+	id := affinityServer(ctx)
+	if id == "" {
+		return servers
+	}
+	for i, server := range servers {
+		if affinityID(server.URL) == id {
+			ordered := append([]Server(nil), servers...)
+			ordered[first], ordered[i] = ordered[i], ordered[first]
+			return ordered
+		}
+	}
+	return servers
+}
+
+// setAffinityCookie pins the client to the server that answered, unless its
+// cookie already does.
+func setAffinityCookie(ctx *fasthttp.RequestCtx, serverURL string) {
+	if config.AffinityCookie == "" {
+		return
+	}
+	id := affinityID(serverURL)
+	if affinityServer(ctx) == id {
+		return
+	}
+
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	cookie.SetKey(config.AffinityCookie)
+	cookie.SetValue(id + "." + affinitySignature(id))
+	cookie.SetPath("/")
+	cookie.SetHTTPOnly(true)
+	cookie.SetSameSite(fasthttp.CookieSameSiteLaxMode)
+	ctx.Response.Header.SetCookie(cookie)
+}
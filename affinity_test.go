@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestAffinityServer(t *testing.T) {
+	setup(t)
+	config.AffinityCookie = "srv"
+	config.AffinitySecret = "secret"
+	id := affinityID("http://a.example")
+	valid := id + "." + affinitySignature(id)
+	config.AffinitySecret = "other"
+	otherSecret := id + "." + affinitySignature(id)
+	config.AffinitySecret = "secret"
+
+	tests := []struct {
+		name   string
+		cookie string
+		want   string
+	}{
+		{"signed", valid, id},
+		{"no cookie", "", ""},
+		{"no signature", id, ""},
+		{"bad signature", id + ".00", ""},
+		{"signed with another secret", otherSecret, ""},
+		{"other server", affinityID("http://b.example") + "." + affinitySignature(id), ""},
+	}
+	for _, tt := range tests {
+		var ctx fasthttp.RequestCtx
+		if tt.cookie != "" {
+			ctx.Request.Header.SetCookie("srv", tt.cookie)
+		}
+		if got := affinityServer(&ctx); got != tt.want {
+			t.Errorf("%s: affinityServer = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	config.AffinityCookie = ""
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetCookie("srv", valid)
+	if got := affinityServer(&ctx); got != "" {
+		t.Errorf("affinityServer without -affinity-cookie = %q", got)
+	}
+}
+
+// affinityCookie returns the value of the srv cookie resp sets, "" for none.
+func affinityCookie(resp *fasthttp.Response) string {
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	cookie.SetKey("srv")
+	if !resp.Header.Cookie(cookie) {
+		return ""
+	}
+	return string(cookie.Value())
+}
+
+func TestAffinity(t *testing.T) {
+	setup(t)
+	config.AffinityCookie = "srv"
+	config.AffinitySecret = "secret"
+	config.Cooldown = time.Minute
+	var down atomic.Bool
+	pinned := newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		if down.Load() {
+			ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+			return
+		}
+		ctx.SetContentType("application/json")
+		fmt.Fprintf(ctx, `{"server":"http://%s"}`, ctx.Host())
+	})
+	writeServers(t, pinned, namedBackend(t), namedBackend(t))
+
+	resp := proxyGet(t, target("api.example.com/items/0"))
+	if servedBy(t, resp) != pinned {
+		t.Fatalf("first request went to %s, want the first server %s", servedBy(t, resp), pinned)
+	}
+	cookie := affinityCookie(resp)
+	if cookie == "" {
+		t.Fatal("no affinity cookie set")
+	}
+
+	// Without the cookie the rotation moves on; with it every request goes
+	// to the same server, and the cookie is not set again.
+	for i := 1; i <= 4; i++ {
+		resp := proxyGet(t, target(fmt.Sprintf("api.example.com/items/%d", i)), "Cookie", "srv="+cookie)
+		if got := servedBy(t, resp); got != pinned {
+			t.Errorf("request %d with the cookie went to %s, want %s", i, got, pinned)
+		}
+		if got := affinityCookie(resp); got != "" {
+			t.Errorf("request %d set the cookie again: %s", i, got)
+		}
+	}
+	if other := servedBy(t, proxyGet(t, target("api.example.com/items/5"))); other == pinned {
+		t.Errorf("request without the cookie went to %s too", other)
+	}
+	// A tampered cookie counts as none, so a fresh one is set.
+	resp = proxyGet(t, target("api.example.com/items/6"), "Cookie", "srv="+affinityID(pinned)+".00")
+	if id := affinityID(servedBy(t, resp)); affinityCookie(resp) != id+"."+affinitySignature(id) {
+		t.Errorf("request with a tampered cookie got cookie %q, want a fresh one for %s", affinityCookie(resp), servedBy(t, resp))
+	}
+
+	// A cache hit names no server.
+	if resp := proxyGet(t, target("api.example.com/items/0")); affinityCookie(resp) != "" {
+		t.Errorf("cache hit set the cookie: %s", affinityCookie(resp))
+	}
+
+	// The pinned server getting rate limited moves the client to the one that
+	// answered, and it stays there while the pinned server cools down.
+	down.Store(true)
+	resp = proxyGet(t, target("api.example.com/items/7"), "Cookie", "srv="+cookie)
+	fallback := servedBy(t, resp)
+	if fallback == pinned {
+		t.Fatalf("request went to the pinned server while it was down")
+	}
+	moved := affinityCookie(resp)
+	if moved == "" || moved == cookie {
+		t.Fatalf("cookie after the fallback = %q, want one for %s", moved, fallback)
+	}
+	if got := servedBy(t, proxyGet(t, target("api.example.com/items/8"), "Cookie", "srv="+moved)); got != fallback {
+		t.Errorf("request with the moved cookie went to %s, want %s", got, fallback)
+	}
+}
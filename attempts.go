@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// attemptRecord describes one upstream attempt made while serving a request.
+type attemptRecord struct {
+	ID         string  `json:"id"`
+	Server     string  `json:"server"`
+	Outcome    string  `json:"outcome"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+func isRateLimitError(err error) bool {
+	return strings.Contains(err.Error(), "Ratelimit") || strings.Contains(err.Error(), "CAPTCHA")
+}
+
+func attemptOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case isRateLimitError(err):
+		return "ratelimit"
+	default:
+		statusCode, _ := parseHTTPError(err)
+		return fmt.Sprintf("error %d", statusCode)
+	}
+}
+
+func newAttemptRecord(id string, server string, started time.Time, err error) attemptRecord {
+	return attemptRecord{
+		ID:         id,
+		Server:     server,
+		Outcome:    attemptOutcome(err),
+		DurationMS: float64(time.Since(started).Microseconds()) / 1000,
+	}
+}
+
+// allRateLimited reports whether every attempt of a request was turned away
+// by a rate limit, i.e. the pool is exhausted rather than broken.
+func allRateLimited(attempts []attemptRecord) bool {
+	for _, attempt := range attempts {
+		if attempt.Outcome != "ratelimit" {
+			return false
+		}
+	}
+	return len(attempts) > 0
+}
+
+func logSlowRequest(target string, elapsed time.Duration, attempts []attemptRecord) {
+	detail, _ := jsonLine.Marshal(attempts)
+	fmt.Printf("[WARN] Slow request: target=%s elapsed=%s attempts=%s\n", target, elapsed, detail)
+}
+
+// logFailedRotation prints every server a failed request tried, in order,
+// with its outcome.
+func logFailedRotation(target string, attempts []attemptRecord) {
+	detail, _ := jsonLine.Marshal(attempts)
+	fmt.Printf("[ERROR] Request failed: target=%s attempts=%s\n", target, detail)
+}
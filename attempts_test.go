@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestSlowRequestLog(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		delay     time.Duration
+		logged    bool
+	}{
+		{"slow upstream", 20 * time.Millisecond, 50 * time.Millisecond, true},
+		{"fast upstream", time.Second, 0, false},
+		{"threshold off", 0, 50 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.SlowThreshold = tt.threshold
+			server := newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				time.Sleep(tt.delay)
+				ctx.SetBodyString(`{}`)
+			})
+			writeServers(t, server)
+
+			output := captureOutput(t, func() { proxyGet(t, target("api.example.com/slow")) })
+			logged := strings.Contains(output, "[WARN] Slow request: target=api.example.com/slow")
+			if logged != tt.logged {
+				t.Fatalf("slow request logged = %v, want %v:\n%s", logged, tt.logged, output)
+			}
+			if logged && !strings.Contains(output, `"server":"`+server+`"`) {
+				t.Errorf("slow request log does not list the attempt on %s:\n%s", server, output)
+			}
+		})
+	}
+}
+
+func TestFailedRotationLog(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		outcomes []string // logged per server, nil when nothing is logged
+	}{
+		{"all rate limited", []int{429, 429, 429}, []string{"ratelimit", "ratelimit", "ratelimit"}},
+		{"target error ends the rotation", []int{429, 404, 200}, []string{"ratelimit", "error 404"}},
+		{"success", []int{429, 200}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			var servers []string
+			for _, status := range tt.statuses {
+				servers = append(servers, statusBackend(t, status, `{}`))
+			}
+			writeServers(t, servers...)
+
+			output := captureOutput(t, func() { proxyGet(t, target("api.example.com/rotation")) })
+			const prefix = "[ERROR] Request failed: target=api.example.com/rotation attempts="
+			start := strings.Index(output, prefix)
+			if tt.outcomes == nil {
+				if start >= 0 {
+					t.Errorf("successful request logged as failed:\n%s", output)
+				}
+				return
+			}
+			if start < 0 {
+				t.Fatalf("no rotation path logged:\n%s", output)
+			}
+			line, _, _ := strings.Cut(output[start+len(prefix):], "\n")
+			var attempts []attemptRecord
+			if err := json.Unmarshal([]byte(line), &attempts); err != nil {
+				t.Fatalf("%v: %s", err, line)
+			}
+			if len(attempts) != len(tt.outcomes) {
+				t.Fatalf("logged attempts = %+v, want %v", attempts, tt.outcomes)
+			}
+			for i, attempt := range attempts {
+				if attempt.Server != servers[i] || attempt.Outcome != tt.outcomes[i] {
+					t.Errorf("attempt %d = %s %s, want %s %s", i, attempt.Server, attempt.Outcome, servers[i], tt.outcomes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAllRateLimited(t *testing.T) {
+	tests := []struct {
+		outcomes []string
+		want     bool
+	}{
+		{nil, false},
+		{[]string{"ratelimit"}, true},
+		{[]string{"ratelimit", "ratelimit"}, true},
+		{[]string{"ratelimit", "error 404"}, false},
+		{[]string{"timeout", "ratelimit"}, false},
+	}
+	for _, tt := range tests {
+		var attempts []attemptRecord
+		for _, outcome := range tt.outcomes {
+			attempts = append(attempts, attemptRecord{Outcome: outcome})
+		}
+		if got := allRateLimited(attempts); got != tt.want {
+			t.Errorf("allRateLimited(%v) = %v, want %v", tt.outcomes, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import "fmt"
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+type startupBanner struct {
+	Event    string   `json:"event"`
+	Addr     string   `json:"addr"`
+	Version  string   `json:"version"`
+	Servers  int      `json:"servers"`
+	CacheTTL string   `json:"cache_ttl"`
+	Features []string `json:"features"`
+}
+
+// enabledFeatures lists the optional features switched on by the flags, for
+// the startup banner.
+func enabledFeatures() []string {
+	features := []string{}
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"tls", config.TLSCert != ""},
+		{"cooldown", config.Cooldown > 0},
+		{"health_checks", config.HealthInterval > 0},
+		{"prewarm", config.PrewarmInterval > 0},
+		{"webhook", config.Webhook != ""},
+		{"retry_budget", config.RetryBudget > 0},
+		{"rotation_budget", config.RotationBudget > 0},
+		{"remote_cache", config.RemoteCache != ""},
+		{"cache_dedupe", config.CacheDedupe},
+		{"hash_cache_keys", config.HashCacheKeys},
+		{"stale_if_error", config.StaleIfError > 0},
+		{"prefer_cache", config.PreferCache > 0},
+		{"idempotency", config.IdempotencyWindow > 0},
+		{"quotas", len(quotaWindows) > 0},
+		{"forward_headers", config.ForwardHeaders},
+		{"forward_body", config.ForwardBody},
+		{"server_timing", config.ServerTiming},
+		{"transparent", config.Transparent},
+		{"merge", config.Merge},
+		{"debug", config.Debug},
+	} {
+		if feature.enabled {
+			features = append(features, feature.name)
+		}
+	}
+	return features
+}
+
+// printStartupBanner announces the listening proxy, as a single JSON line
+// with -log-format json so that tooling can check the configuration.
+func printStartupBanner() {
+	if config.LogFormat != "json" {
+		fmt.Printf("Server listening on %s...\n", config.Addr)
+		return
+	}
+
+	servers, _ := readServerAddresses(serversFile)
+	banner := startupBanner{
+		Event:    "startup",
+		Addr:     config.Addr,
+		Version:  version,
+		Servers:  len(servers),
+		CacheTTL: cacheLifetime().String(),
+		Features: enabledFeatures(),
+	}
+	line, err := jsonLine.Marshal(banner)
+	if err != nil {
+		fmt.Printf("Encoding the startup banner failed: %v\n", err)
+		return
+	}
+	fmt.Println(string(line))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartupBanner(t *testing.T) {
+	tests := []struct {
+		name     string
+		prepare  func()
+		servers  int
+		ttl      string
+		features []string
+	}{
+		{"defaults", func() {}, 0, "1m0s", []string{}},
+		{
+			name: "configured",
+			prepare: func() {
+				config.Addr = "unix:/run/proxy.sock"
+				config.Cooldown = 30 * time.Second
+				config.Merge = true
+				config.CacheDedupe = true
+				setCacheLifetime(5 * time.Minute)
+			},
+			servers:  2,
+			ttl:      "5m0s",
+			features: []string{"cooldown", "cache_dedupe", "merge"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.LogFormat = "json"
+			tt.prepare()
+			if tt.servers > 0 {
+				writeServers(t, "http://a.example", "http://b.example")
+			}
+
+			output := captureOutput(t, printStartupBanner)
+			var banner startupBanner
+			if err := json.Unmarshal([]byte(output), &banner); err != nil {
+				t.Fatalf("%v: %q", err, output)
+			}
+			want := startupBanner{Event: "startup", Addr: config.Addr, Version: version, Servers: tt.servers, CacheTTL: tt.ttl, Features: tt.features}
+			if fmt.Sprint(banner) != fmt.Sprint(want) {
+				t.Errorf("banner = %+v, want %+v", banner, want)
+			}
+			if strings.Count(output, "\n") != 1 || !strings.HasSuffix(output, "\n") {
+				t.Errorf("banner is not a single line: %q", output)
+			}
+		})
+	}
+}
+
+func TestStartupBannerText(t *testing.T) {
+	setup(t)
+	if output := captureOutput(t, printStartupBanner); output != "Server listening on :9001...\n" {
+		t.Errorf("banner = %q", output)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+type batchRequest struct {
+	URLs []string `json:"urls"`
+}
+
+type batchResult struct {
+	URL         string `json:"url"`
+	Status      string `json:"status"`
+	Code        int    `json:"code,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// batchDeadlineKey is the user value carrying the time by which a batch URL
+// must be done, see requestDeadline.
+const batchDeadlineKey = "batchDeadline"
+
+// batchFetches tracks the fetches of every batch, including those still
+// winding down after their batch was answered without them.
+var batchFetches sync.WaitGroup
+
+// handleBatch serves POST /batch. Every URL goes through handleRequests
+// concurrently and is charged to the client's quota on its own; results that
+// are not ready when -batch-timeout expires are reported with status
+// "timeout" and the rest are returned as they are. The response status
+// summarizes the batch, see batchStatus.
+func handleBatch(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		sendJSONErrorResponse(ctx, "Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	var batch batchRequest
+	if err := json.Unmarshal(ctx.PostBody(), &batch); err != nil || len(batch.URLs) == 0 {
+		sendJSONErrorResponse(ctx, "Request body must be a JSON object with a non-empty urls array", fasthttp.StatusBadRequest)
+		return
+	}
+	if len(batch.URLs) > config.BatchMaxURLs {
+		sendJSONErrorResponse(ctx, fmt.Sprintf("A batch may contain at most %d URLs", config.BatchMaxURLs), fasthttp.StatusBadRequest)
+		return
+	}
+
+	type indexedResult struct {
+		index  int
+		result batchResult
+	}
+
+	client := quotaClient(ctx)
+	batchDeadline := time.Now().Add(config.BatchTimeout)
+	done := make(chan indexedResult, len(batch.URLs))
+	for i, target := range batch.URLs {
+		// The parent ctx is recycled once this handler returns, possibly
+		// before a slow fetch finishes, so each fetch gets its own headers.
+		header := &fasthttp.RequestHeader{}
+		ctx.Request.Header.CopyTo(header)
+
+		batchFetches.Add(1)
+		go func(i int, target string) {
+			defer batchFetches.Done()
+			done <- indexedResult{index: i, result: fetchBatchURL(header, target, client, batchDeadline)}
+		}(i, target)
+	}
+
+	results := make([]batchResult, len(batch.URLs))
+	pending := len(batch.URLs)
+
+	deadline := time.NewTimer(time.Until(batchDeadline))
+	defer deadline.Stop()
+
+collect:
+	for pending > 0 {
+		select {
+		case r := <-done:
+			results[r.index] = r.result
+			pending--
+		case <-deadline.C:
+			break collect
+		}
+	}
+
+	for i, target := range batch.URLs {
+		if results[i].Status == "" {
+			results[i] = batchResult{URL: target, Status: "timeout", Code: fasthttp.StatusGatewayTimeout}
+		}
+	}
+
+	sendJSONResponse(ctx, batchResponse{Results: results}, batchStatus(results))
+}
+
+// batchStatus is 200 when every URL succeeded and 207 when some did. When all
+// failed it is their common status code, or 502 if they failed differently.
+func batchStatus(results []batchResult) int {
+	succeeded, failedCode, mixed := 0, 0, false
+	for _, result := range results {
+		if result.Status == "ok" {
+			succeeded++
+			continue
+		}
+		if failedCode != 0 && failedCode != result.Code {
+			mixed = true
+		}
+		failedCode = result.Code
+	}
+
+	switch {
+	case succeeded == len(results):
+		return fasthttp.StatusOK
+	case succeeded > 0:
+		return fasthttp.StatusMultiStatus
+	case !mixed && failedCode >= 400:
+		return failedCode
+	default:
+		return fasthttp.StatusBadGateway
+	}
+}
+
+// fetchBatchURL fetches one URL of a batch for client. The fetch gives up
+// at deadline, when the batch stops waiting for it, so no sub-request keeps
+// the servers busy after its batch has been answered.
+func fetchBatchURL(header *fasthttp.RequestHeader, target string, client string, deadline time.Time) batchResult {
+	var sub fasthttp.RequestCtx
+	header.CopyTo(&sub.Request.Header)
+	sub.Request.Header.SetMethod(fasthttp.MethodGet)
+	sub.Request.Header.SetContentLength(0)
+	sub.Request.SetRequestURI(fmt.Sprintf("/?url=%s", url.QueryEscape(target)))
+	sub.SetUserValue(batchDeadlineKey, deadline)
+
+	if enforceClientQuota(&sub, client) {
+		handleRequests(&sub)
+	}
+
+	result := batchResult{
+		URL:         target,
+		Status:      "ok",
+		Code:        sub.Response.StatusCode(),
+		ContentType: string(sub.Response.Header.ContentType()),
+		Body:        string(sub.Response.Body()),
+	}
+	if result.Code != fasthttp.StatusOK {
+		result.Status = "error"
+	}
+	return result
+}
+
+// requestDeadline returns the time by which the request must be done, which
+// only batch URLs have.
+func requestDeadline(ctx *fasthttp.RequestCtx) (time.Time, bool) {
+	deadline, ok := ctx.UserValue(batchDeadlineKey).(time.Time)
+	return deadline, ok
+}
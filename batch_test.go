@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestBatchPartialTimeout(t *testing.T) {
+	setup(t)
+	config.BatchTimeout = 100 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		if strings.Contains(string(ctx.QueryArgs().Peek("url")), "slow") {
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+		}
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"ok":true}`)
+	}))
+
+	// The slow fetch is still winding down after its batch was answered.
+	t.Cleanup(batchFetches.Wait)
+
+	start := time.Now()
+	resp := proxyDo(t, fasthttp.MethodPost, "/batch", `{"urls":["api.example.com/a","api.example.com/slow","api.example.com/b"]}`)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("batch took %s with a %s deadline", elapsed, config.BatchTimeout)
+	}
+	if resp.StatusCode() != fasthttp.StatusMultiStatus {
+		t.Errorf("status = %d, want 207", resp.StatusCode())
+	}
+
+	var batch batchResponse
+	if err := json.Unmarshal(resp.Body(), &batch); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		url, status string
+		code        int
+	}{
+		{"api.example.com/a", "ok", fasthttp.StatusOK},
+		{"api.example.com/slow", "timeout", fasthttp.StatusGatewayTimeout},
+		{"api.example.com/b", "ok", fasthttp.StatusOK},
+	}
+	if len(batch.Results) != len(want) {
+		t.Fatalf("results = %+v", batch.Results)
+	}
+	for i, w := range want {
+		got := batch.Results[i]
+		// A fetch cut off right at the deadline may report its own 504
+		// before the batch gives up on it.
+		if got.URL != w.url || got.Code != w.code || (got.Status != w.status && !(w.status == "timeout" && got.Status == "error")) {
+			t.Errorf("result %d = %+v, want %s %s %d", i, got, w.url, w.status, w.code)
+		}
+	}
+}
+
+func TestBatchStatus(t *testing.T) {
+	ok := batchResult{Status: "ok", Code: 200}
+	timeout := batchResult{Status: "timeout", Code: 504}
+	notFound := batchResult{Status: "error", Code: 404}
+	tests := []struct {
+		name    string
+		results []batchResult
+		want    int
+	}{
+		{"all ok", []batchResult{ok, ok}, fasthttp.StatusOK},
+		{"some failed", []batchResult{ok, timeout}, fasthttp.StatusMultiStatus},
+		{"all timed out", []batchResult{timeout, timeout}, fasthttp.StatusGatewayTimeout},
+		{"failed differently", []batchResult{timeout, notFound}, fasthttp.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := batchStatus(tt.results); got != tt.want {
+				t.Errorf("batchStatus = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchTopLevelStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		urls  string
+		want  int
+		codes []int
+	}{
+		{"all succeed", `["api.example.com/a","api.example.com/b"]`, fasthttp.StatusOK, []int{200, 200}},
+		{"mixed", `["api.example.com/a","api.example.com/missing"]`, fasthttp.StatusMultiStatus, []int{200, 404}},
+		{"all fail the same way", `["api.example.com/missing","api.example.com/missing-too"]`, fasthttp.StatusNotFound, []int{404, 404}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			t.Cleanup(batchFetches.Wait)
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				if strings.Contains(string(ctx.QueryArgs().Peek("url")), "missing") {
+					ctx.SetStatusCode(fasthttp.StatusNotFound)
+				}
+				ctx.SetContentType("application/json")
+				ctx.SetBodyString(`{}`)
+			}))
+
+			resp := proxyDo(t, fasthttp.MethodPost, "/batch", `{"urls":`+tt.urls+`}`)
+			if resp.StatusCode() != tt.want {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode(), tt.want, resp.Body())
+			}
+			var batch batchResponse
+			if err := json.Unmarshal(resp.Body(), &batch); err != nil {
+				t.Fatal(err)
+			}
+			if len(batch.Results) != len(tt.codes) {
+				t.Fatalf("results = %+v", batch.Results)
+			}
+			for i, code := range tt.codes {
+				if batch.Results[i].Code != code {
+					t.Errorf("result %d = %+v, want code %d", i, batch.Results[i], code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// bodyBuffers are reused for reading and decompressing upstream bodies and
+// for compressing cache values. Whatever outlives the request is copied out
+// of the buffer before it is released.
+var bodyBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func acquireBodyBuffer() *bytes.Buffer {
+	return bodyBuffers.Get().(*bytes.Buffer)
+}
+
+// releaseBodyBuffer returns buf to the pool unless it grew beyond
+// -pooled-buffer-max, so one huge body does not stay pinned in memory.
+func releaseBodyBuffer(buf *bytes.Buffer) {
+	if config.PooledBufferMax <= 0 || buf.Cap() > config.PooledBufferMax {
+		return
+	}
+	buf.Reset()
+	bodyBuffers.Put(buf)
+}
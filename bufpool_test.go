@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestPooledBuffersNotAliased(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+	}{
+		{"pooled", 1 << 20},
+		{"not pooled", 0},
+		{"too large to pool", 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.PooledBufferMax = tt.max
+			first := strings.Repeat("first ", 1000)
+			second := strings.Repeat("other ", 1000)
+
+			compressed, ok := compressCacheValue(first, true)
+			if !ok {
+				t.Fatal("value not compressed")
+			}
+			decompressed, err := gunzipString(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Reusing the pool for other bodies must leave earlier results alone.
+			other, _ := compressCacheValue(second, true)
+			gunzipString(other)
+			var resp fasthttp.Response
+			resp.Header.Set(fasthttp.HeaderContentEncoding, "gzip")
+			resp.Header.SetContentType("application/json")
+			resp.SetBody(gzipped(t, second))
+			body, err := decodeUpstreamBody(&resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if decompressed != first {
+				t.Errorf("decompressed value changed after the buffer was reused")
+			}
+			if gunzipped, _ := gunzipString(compressed); gunzipped != first {
+				t.Errorf("compressed value changed after the buffer was reused")
+			}
+			if string(body) != second {
+				t.Errorf("decoded body = %.20q, want %.20q", body, second)
+			}
+		})
+	}
+}
+
+// BenchmarkBodyBuffers compares the allocations of decompressing upstream
+// bodies and compressing and decompressing cache values with and without
+// the buffer pool.
+func BenchmarkBodyBuffers(b *testing.B) {
+	value := strings.Repeat(`{"id":1,"name":"example","tags":["a","b"]},`, 2000)
+	upstream := gzipped(b, value)
+	for _, bm := range []struct {
+		name string
+		max  int
+	}{
+		{"pooled", 1 << 20},
+		{"unpooled", 0},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			setup(b)
+			config.PooledBufferMax = bm.max
+			var resp fasthttp.Response
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp.Reset()
+				resp.Header.Set(fasthttp.HeaderContentEncoding, "gzip")
+				resp.Header.SetContentType("application/json")
+				resp.SetBody(upstream)
+				body, err := decodeUpstreamBody(&resp)
+				if err != nil {
+					b.Fatal(err)
+				}
+				compressed, _ := compressCacheValue(string(body), true)
+				if _, err := gunzipString(compressed); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
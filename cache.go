@@ -0,0 +1,652 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+type cachedData struct {
+	// Key is the key the entry was stored under. It is only kept with
+	// -hash-cache-keys, where the map is keyed by a hash of it.
+	Key         string
+	Value       string
+	ContentType string
+	Headers     []headerField
+	// StatusCode and Location are set for cached redirects, see
+	// -cache-redirects.
+	StatusCode int
+	Location   string
+	Hash       string
+	Size       int
+	Compressed bool
+	StoredAt   time.Time
+	ExpiresAt  time.Time
+	// Hits counts how often the entry was served. It is shared by the copies
+	// of the entry read out of the map, and starts over when the entry is
+	// stored again.
+	Hits *atomic.Int64
+	// LastUsed is when the entry was last served or stored, in Unix
+	// nanoseconds, for -cache-max-per-host. It is shared like Hits.
+	LastUsed *atomic.Int64
+}
+
+// cacheBlob is a response body shared by every cache entry whose body hashes
+// to the same value when -cache-dedupe is enabled.
+type cacheBlob struct {
+	Value      string
+	Compressed bool
+	refs       int
+}
+
+// cacheShardCount is the number of stripes the cache map is split into. Each
+// has its own lock, so requests for different keys rarely wait on each other.
+const cacheShardCount = 32
+
+type cacheShard struct {
+	sync.RWMutex
+	data map[string]cachedData
+}
+
+var cache = struct {
+	shards [cacheShardCount]*cacheShard
+	// lifetime is the default TTL in nanoseconds, see cacheLifetime.
+	lifetime atomic.Int64
+}{shards: newCacheShards()}
+
+// cacheLifetime is the default TTL of an entry, -cache-ttl or the cache_ttl
+// of -settings-file, which a reload may change while requests read it.
+func cacheLifetime() time.Duration {
+	return time.Duration(cache.lifetime.Load())
+}
+
+func setCacheLifetime(ttl time.Duration) {
+	cache.lifetime.Store(int64(ttl))
+}
+
+// cacheBlobs holds the -cache-dedupe bodies of every shard, so identical
+// bodies are stored once wherever their keys fall. It is only ever locked
+// after a shard, never the other way round.
+var cacheBlobs = struct {
+	sync.Mutex
+	blobs map[string]*cacheBlob
+}{blobs: make(map[string]*cacheBlob)}
+
+func newCacheShards() [cacheShardCount]*cacheShard {
+	var shards [cacheShardCount]*cacheShard
+	for i := range shards {
+		shards[i] = &cacheShard{data: make(map[string]cachedData)}
+	}
+	return shards
+}
+
+// shardFor returns the shard holding the entry stored under the storage key.
+func shardFor(stored string) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(stored))
+	return cache.shards[h.Sum32()%cacheShardCount]
+}
+
+// cacheEntryCount returns the number of entries in all shards, expired ones
+// included.
+func cacheEntryCount() int {
+	count := 0
+	for _, shard := range cache.shards {
+		shard.RLock()
+		count += len(shard.data)
+		shard.RUnlock()
+	}
+	return count
+}
+
+// cacheDisabled is the runtime kill switch toggled through /cache/disable and
+// /cache/enable. Entries are kept while it is set and served again once the
+// cache is re-enabled.
+var cacheDisabled atomic.Bool
+
+// cacheOff reports whether the cache is switched off, at runtime or by
+// -cache-ttl=0, in which case nothing is looked up or stored.
+func cacheOff() bool {
+	return cacheDisabled.Load() || cacheLifetime() <= 0
+}
+
+func cacheKey(target string) string {
+	return target
+}
+
+const namespaceHeader = "X-Cache-Namespace"
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var errInvalidNamespace = errors.New("Cache namespace must be 1 to 64 letters, digits, '.', '_' or '-'")
+
+// requestCacheKey is cacheKey within the namespace the request picked, with
+// the X-Cache-Namespace header taking precedence over the ns parameter.
+// Entries in different namespaces never see each other.
+func requestCacheKey(ctx *fasthttp.RequestCtx, target string) (string, error) {
+	key := cacheKey(target) + headerFingerprint(&ctx.Request.Header)
+
+	namespace := requestNamespace(ctx)
+	if namespace == "" {
+		return key, nil
+	}
+	if !namespacePattern.MatchString(namespace) {
+		return "", errInvalidNamespace
+	}
+	return "ns:" + namespace + " " + key, nil
+}
+
+// proxyCacheKey returns the key handleRequests caches the response to a
+// request under: requestCacheKey for the method and body of outbound, or for
+// a request repeating an Idempotency-Key the key of that one, which
+// idempotent reports.
+func proxyCacheKey(ctx *fasthttp.RequestCtx, target string, outbound upstreamRequest) (key string, idempotent bool, err error) {
+	if key := idempotencyCacheKey(ctx, target); key != "" {
+		return key, true, nil
+	}
+	key, err = requestCacheKey(ctx, target)
+	if err != nil {
+		return "", false, err
+	}
+	return outbound.cacheKey(key), false, nil
+}
+
+// requestNamespace returns the cache namespace a request picked, or "".
+func requestNamespace(ctx *fasthttp.RequestCtx) string {
+	if namespace := string(ctx.Request.Header.Peek(namespaceHeader)); namespace != "" {
+		return namespace
+	}
+	return proxyQuery(ctx).Get("ns")
+}
+
+// headerFingerprint returns the key suffix for the -cache-key-headers of a
+// request. The values are hashed so that credentials such as Authorization
+// never show up in cache keys, with SHA-256 so that no two tenants can end up
+// sharing an entry; a missing header counts as an empty one.
+func headerFingerprint(h *fasthttp.RequestHeader) string {
+	if config.CacheKeyHeaders == "" {
+		return ""
+	}
+
+	sum := sha256.New()
+	for _, name := range strings.Split(config.CacheKeyHeaders, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		sum.Write([]byte(strings.ToLower(name)))
+		sum.Write([]byte{0})
+		sum.Write(h.Peek(name))
+		sum.Write([]byte{0})
+	}
+	return " headers:" + hex.EncodeToString(sum.Sum(nil))
+}
+
+// cacheKeyHash maps a cache key to its 64-bit storage key with
+// -hash-cache-keys.
+var cacheKeyHash = func(key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// storageKey returns the key of key's entry in its shard.
+func storageKey(key string) string {
+	if !config.HashCacheKeys {
+		return key
+	}
+	return cacheKeyHash(key)
+}
+
+// storedFor reports whether data was stored for key rather than for another
+// key with the same hash. Lookups treat such collisions as a miss; they are
+// counted by cacheStore when one key's entry replaces the other's.
+func storedFor(data cachedData, key string) bool {
+	return data.Key == "" || data.Key == key
+}
+
+// cacheEntry returns the metadata of a fresh entry without resolving its body.
+func cacheEntry(key string) (cachedData, bool) {
+	if cacheOff() {
+		return cachedData{}, false
+	}
+
+	stored := storageKey(key)
+	shard := shardFor(stored)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	data, ok := shard.data[stored]
+	if !ok || !storedFor(data, key) || time.Now().After(data.ExpiresAt) {
+		return cachedData{}, false
+	}
+	return data, true
+}
+
+// cacheHasEntry reports whether key has an entry at all, fresh or expired.
+func cacheHasEntry(key string) bool {
+	if cacheOff() {
+		return false
+	}
+
+	stored := storageKey(key)
+	shard := shardFor(stored)
+	shard.RLock()
+	defer shard.RUnlock()
+	data, ok := shard.data[stored]
+	return ok && storedFor(data, key)
+}
+
+// Cache tiers a hit can come from, see setCacheTier. Entries loaded with
+// -cache-import live in memory like any other.
+const (
+	cacheTierMemory = "memory"
+	cacheTierPeer   = "peer"
+)
+
+// setCacheTier counts a cache hit by the tier that served it, the local
+// memory cache or the -remote-cache peer, and with -cache-tier-header reports
+// it in X-Cache-Tier.
+func setCacheTier(ctx *fasthttp.RequestCtx, tier string) {
+	if tier == cacheTierPeer {
+		stats.CachePeerHits.Add(1)
+	} else {
+		stats.CacheMemoryHits.Add(1)
+	}
+	if config.CacheTierHeader {
+		ctx.Response.Header.Set("X-Cache-Tier", tier)
+	}
+}
+
+// setCDNCacheStatus reports the cache decision in a CDN-Cache-Status header
+// when -cdn-cache-status is set: HIT, MISS, STALE or REVALIDATED.
+func setCDNCacheStatus(ctx *fasthttp.RequestCtx, status string) {
+	if config.CDNCacheStatus {
+		ctx.Response.Header.Set("CDN-Cache-Status", status)
+	}
+}
+
+func cacheGet(key string) (upstreamResponse, bool) {
+	return cacheLookup(key, 0)
+}
+
+// cacheGetStale also returns entries that expired less than maxStale ago,
+// as long as they were stored less than -max-stale-age ago.
+func cacheGetStale(key string, maxStale time.Duration) (upstreamResponse, bool) {
+	return cacheLookup(key, maxStale)
+}
+
+// staleDeadline is the time after which data is a miss for a lookup that
+// accepts entries up to maxStale past their expiry. -max-stale-age brings it
+// forward to that long after the entry was stored, but never before expiry,
+// so fresh entries are unaffected.
+func staleDeadline(data cachedData, maxStale time.Duration) time.Time {
+	deadline := data.ExpiresAt.Add(maxStale)
+	if maxStale <= 0 || config.MaxStaleAge <= 0 {
+		return deadline
+	}
+	if limit := data.StoredAt.Add(config.MaxStaleAge); limit.Before(deadline) {
+		deadline = limit
+	}
+	if deadline.Before(data.ExpiresAt) {
+		return data.ExpiresAt
+	}
+	return deadline
+}
+
+func cacheLookup(key string, maxStale time.Duration) (upstreamResponse, bool) {
+	if cacheOff() {
+		return upstreamResponse{}, false
+	}
+
+	stored := storageKey(key)
+	shard := shardFor(stored)
+	shard.RLock()
+	data, ok := shard.data[stored]
+	if !ok || !storedFor(data, key) || time.Now().After(staleDeadline(data, maxStale)) {
+		shard.RUnlock()
+		return upstreamResponse{}, false
+	}
+
+	value := data.Value
+	if data.Hash != "" {
+		blob, ok := lookupBlob(data.Hash)
+		if !ok {
+			shard.RUnlock()
+			return upstreamResponse{}, false
+		}
+		value = blob.Value
+	}
+	shard.RUnlock()
+
+	if data.Compressed {
+		decompressed, err := gunzipString(value)
+		if err != nil {
+			fmt.Printf("Failed to decompress cached value for %s: %v\n", key, err)
+			return upstreamResponse{}, false
+		}
+		value = decompressed
+	}
+
+	data.LastUsed.Store(time.Now().UnixNano())
+	return upstreamResponse{Body: value, ContentType: data.ContentType, StatusCode: data.StatusCode, Location: data.Location, Headers: data.Headers, CacheHits: data.Hits.Add(1)}, true
+}
+
+// cacheLastUsed returns when key's entry was last used, and false when there
+// is no entry stored for key.
+func cacheLastUsed(key string) (int64, bool) {
+	stored := storageKey(key)
+	shard := shardFor(stored)
+	shard.RLock()
+	defer shard.RUnlock()
+	data, ok := shard.data[stored]
+	if !ok || !storedFor(data, key) {
+		return 0, false
+	}
+	return data.LastUsed.Load(), true
+}
+
+// cacheSweepInterval is how often startCacheSweeper looks for expired
+// entries.
+const cacheSweepInterval = time.Minute
+
+// startCacheSweeper periodically drops the entries that can no longer be
+// served, not even as stale, so they do not sit in memory until their key
+// is requested again.
+func startCacheSweeper() {
+	go func() {
+		ticker := time.NewTicker(cacheSweepInterval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			if removed := sweepExpired(now); removed > 0 {
+				fmt.Printf("Cache sweep removed %d expired entries\n", removed)
+			}
+			pruneHostKeys()
+			sweepIdempotency(now)
+		}
+	}()
+}
+
+// sweepExpired removes the entries past their stale deadline and returns how
+// many there were. Shards are swept one at a time, so lookups only ever wait
+// for the shard being swept.
+func sweepExpired(now time.Time) int {
+	maxStale := max(config.StaleIfError, config.PreferCache)
+	removed := 0
+	for _, shard := range cache.shards {
+		shard.Lock()
+		for stored, data := range shard.data {
+			if now.After(staleDeadline(data, maxStale)) {
+				releaseBlob(data.Hash)
+				delete(shard.data, stored)
+				removed++
+			}
+		}
+		shard.Unlock()
+	}
+	return removed
+}
+
+// cacheEvict removes key's entry.
+func cacheEvict(key string) {
+	stored := storageKey(key)
+	shard := shardFor(stored)
+	shard.Lock()
+	defer shard.Unlock()
+	if data, ok := shard.data[stored]; ok && storedFor(data, key) {
+		releaseBlob(data.Hash)
+		delete(shard.data, stored)
+	}
+}
+
+func cacheSet(key string, resp upstreamResponse) {
+	cacheSetTTL(key, key, resp, 0)
+}
+
+// cacheSetTTL stores resp for ttl, or when ttl is zero for the TTL that
+// baseCacheTTL gives target, weighted by body size and extended while the
+// target is rate limited.
+func cacheSetTTL(key string, target string, resp upstreamResponse, ttl time.Duration) {
+	if cacheOff() {
+		return
+	}
+
+	if ttl <= 0 {
+		ttl = rateLimitedTTL(target, sizeWeightedTTL(baseCacheTTL(target), len(resp.Body)))
+	}
+
+	now := time.Now()
+	cacheStore(key, resp, now, now.Add(ttl))
+	capHostEntries(target, key)
+	remoteCacheSet(key, resp, now, now.Add(ttl))
+}
+
+func cacheStore(key string, resp upstreamResponse, now time.Time, expiresAt time.Time) {
+	if cacheLifetime() <= 0 {
+		return
+	}
+
+	var entryKey string
+	if config.HashCacheKeys {
+		entryKey = key
+	}
+
+	// The cache is shared by every client, so one client's cookies must not
+	// be replayed to the others.
+	resp.Headers = withoutHeader(resp.Headers, "Set-Cookie")
+
+	data := cachedData{
+		Key:         entryKey,
+		ContentType: resp.ContentType,
+		Headers:     resp.Headers,
+		StatusCode:  resp.StatusCode,
+		Location:    resp.Location,
+		Size:        len(resp.Body),
+		StoredAt:    now,
+		ExpiresAt:   expiresAt,
+		Hits:        new(atomic.Int64),
+		LastUsed:    lastUsed(now),
+	}
+
+	// Bodies are compressed before any lock is taken, so a large body only
+	// holds up its own request.
+	value := resp.Body
+	compress := config.CacheCompressThreshold > 0 && len(value) >= config.CacheCompressThreshold
+	var blob *cacheBlob
+	if !config.CacheDedupe {
+		data.Value, data.Compressed = compressCacheValue(value, compress)
+	} else {
+		sum := sha256.Sum256([]byte(value))
+		data.Hash = hex.EncodeToString(sum[:])
+		if _, ok := lookupBlob(data.Hash); !ok {
+			blob = &cacheBlob{}
+			blob.Value, blob.Compressed = compressCacheValue(value, compress)
+		}
+	}
+
+	stored := storageKey(key)
+	shard := shardFor(stored)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if old, ok := shard.data[stored]; ok {
+		releaseBlob(old.Hash)
+		if !storedFor(old, key) {
+			stats.CacheCollisions.Add(1)
+			fmt.Printf("Cache key hash collision, replacing the entry for %s\n", old.Key)
+		}
+	}
+
+	if !config.CacheDedupe {
+		if data.Compressed {
+			countCompressed(len(value), len(data.Value))
+		}
+		shard.data[stored] = data
+		return
+	}
+
+	cacheBlobs.Lock()
+	existing, ok := cacheBlobs.blobs[data.Hash]
+	switch {
+	case ok:
+		blob = existing
+	case blob == nil:
+		// The blob was dropped since it was looked up; this is rare enough
+		// to compress under the lock.
+		blob = &cacheBlob{}
+		blob.Value, blob.Compressed = compressCacheValue(value, compress)
+		fallthrough
+	default:
+		if blob.Compressed {
+			countCompressed(len(value), len(blob.Value))
+		}
+		cacheBlobs.blobs[data.Hash] = blob
+	}
+	blob.refs++
+	data.Compressed = blob.Compressed
+	cacheBlobs.Unlock()
+
+	shard.data[stored] = data
+}
+
+func lastUsed(now time.Time) *atomic.Int64 {
+	used := new(atomic.Int64)
+	used.Store(now.UnixNano())
+	return used
+}
+
+// ttlSizeBucket scales the cache TTL of bodies of at least MinSize bytes.
+type ttlSizeBucket struct {
+	MinSize    int
+	Multiplier float64
+}
+
+var ttlSizeBuckets []ttlSizeBucket
+
+// parseTTLSizeBuckets parses -cache-ttl-size-buckets, a comma-separated list
+// of size:multiplier pairs such as "10240:2,1048576:5".
+func parseTTLSizeBuckets(spec string) ([]ttlSizeBucket, error) {
+	var buckets []ttlSizeBucket
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		size, multiplier, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid TTL size bucket %q, expected size:multiplier", part)
+		}
+		minSize, err := strconv.Atoi(size)
+		if err != nil || minSize < 0 {
+			return nil, fmt.Errorf("invalid size in TTL size bucket %q", part)
+		}
+		factor, err := strconv.ParseFloat(multiplier, 64)
+		if err != nil || factor <= 0 {
+			return nil, fmt.Errorf("invalid multiplier in TTL size bucket %q", part)
+		}
+		buckets = append(buckets, ttlSizeBucket{MinSize: minSize, Multiplier: factor})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].MinSize < buckets[j].MinSize })
+	return buckets, nil
+}
+
+// sizeWeightedTTL applies the largest bucket a body of size bytes falls into,
+// capped at -max-cache-ttl.
+func sizeWeightedTTL(base time.Duration, size int) time.Duration {
+	ttl := base
+	for _, bucket := range ttlSizeBuckets {
+		if size < bucket.MinSize {
+			break
+		}
+		ttl = time.Duration(float64(base) * bucket.Multiplier)
+	}
+
+	if config.MaxCacheTTL > 0 && ttl > config.MaxCacheTTL && ttl > base {
+		ttl = config.MaxCacheTTL
+	}
+	return ttl
+}
+
+// compressCacheValue gzips value when compress is set and doing so actually
+// saves space, falling back to the raw value otherwise.
+func compressCacheValue(value string, compress bool) (string, bool) {
+	if !compress {
+		return value, false
+	}
+
+	buf := acquireBodyBuffer()
+	defer releaseBodyBuffer(buf)
+	w := gzip.NewWriter(buf)
+	if _, err := io.WriteString(w, value); err != nil {
+		return value, false
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(value) {
+		return value, false
+	}
+	return buf.String(), true
+}
+
+// countCompressed counts a stored compressed body of raw bytes that takes
+// up stored bytes.
+func countCompressed(raw, stored int) {
+	stats.CacheCompressedEntries.Add(1)
+	stats.CacheCompressedRawBytes.Add(int64(raw))
+	stats.CacheCompressedBytes.Add(int64(stored))
+}
+
+func gunzipString(value string) (string, error) {
+	r, err := gzip.NewReader(strings.NewReader(value))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	buf := acquireBodyBuffer()
+	defer releaseBodyBuffer(buf)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// releaseBlob drops one reference to a shared body and frees it once no
+// entry points at it. The caller must hold the lock of the entry's shard.
+func releaseBlob(hash string) {
+	if hash == "" {
+		return
+	}
+
+	cacheBlobs.Lock()
+	defer cacheBlobs.Unlock()
+	blob, ok := cacheBlobs.blobs[hash]
+	if !ok {
+		return
+	}
+	blob.refs--
+	if blob.refs <= 0 {
+		delete(cacheBlobs.blobs, hash)
+	}
+}
+
+// lookupBlob returns the shared body with the given hash. Blobs are never
+// changed once stored, only dropped, so the result may be read unlocked.
+func lookupBlob(hash string) (*cacheBlob, bool) {
+	cacheBlobs.Lock()
+	defer cacheBlobs.Unlock()
+	blob, ok := cacheBlobs.blobs[hash]
+	return blob, ok
+}
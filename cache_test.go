@@ -0,0 +1,806 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func blobCount() int {
+	cacheBlobs.Lock()
+	defer cacheBlobs.Unlock()
+	return len(cacheBlobs.blobs)
+}
+
+func TestCacheDedupe(t *testing.T) {
+	tests := []struct {
+		name   string
+		dedupe bool
+		blobs  int
+	}{
+		{"identical bodies share a blob", true, 1},
+		{"dedupe off", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.CacheDedupe = tt.dedupe
+			var requests atomic.Int64
+			writeServers(t, countingBackend(t, `{"mirrored":true}`, &requests))
+
+			urls := []string{"mirror-a.example.com/file", "mirror-b.example.com/file"}
+			for _, url := range urls {
+				proxyGet(t, target(url))
+			}
+			if got := blobCount(); got != tt.blobs {
+				t.Errorf("blobs = %d, want %d", got, tt.blobs)
+			}
+			if got := cacheEntryCount(); got != len(urls) {
+				t.Errorf("cache entries = %d, want %d", got, len(urls))
+			}
+
+			for _, url := range urls {
+				if body := string(proxyGet(t, target(url)).Body()); body != `{"mirrored":true}` {
+					t.Errorf("cached body of %s = %q", url, body)
+				}
+			}
+			if got := requests.Load(); got != int64(len(urls)) {
+				t.Errorf("upstream requests = %d, want %d", got, len(urls))
+			}
+		})
+	}
+}
+
+func TestCacheDedupeReleasesBlob(t *testing.T) {
+	setup(t)
+	config.CacheDedupe = true
+	resp := upstreamResponse{Body: "same body", ContentType: "text/plain"}
+	cacheSet("a", resp)
+	cacheSet("b", resp)
+
+	cacheEvict("a")
+	if got := blobCount(); got != 1 {
+		t.Fatalf("blobs after evicting one of two entries = %d, want 1", got)
+	}
+	if cached, ok := cacheGet("b"); !ok || cached.Body != "same body" {
+		t.Errorf("remaining entry = %q, %v", cached.Body, ok)
+	}
+	cacheEvict("b")
+	if got := blobCount(); got != 0 {
+		t.Errorf("blobs after evicting both entries = %d, want 0", got)
+	}
+}
+
+func TestCacheCompression(t *testing.T) {
+	text := strings.Repeat(`{"field":"value"},`, 1000)
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name       string
+		threshold  int
+		dedupe     bool
+		body       string
+		compressed bool
+	}{
+		{"large text body", 1024, false, text, true},
+		{"large text body, deduplicated", 1024, true, text, true},
+		{"below the threshold", len(text) + 1, false, text, false},
+		{"compression off", 0, false, text, false},
+		{"incompressible body", 1024, false, string(random), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.CacheCompressThreshold = tt.threshold
+			config.CacheDedupe = tt.dedupe
+			cacheSet("key", upstreamResponse{Body: tt.body, ContentType: "application/json"})
+
+			data, ok := cacheEntry("key")
+			if !ok {
+				t.Fatal("entry not stored")
+			}
+			if data.Compressed != tt.compressed {
+				t.Errorf("compressed = %v, want %v", data.Compressed, tt.compressed)
+			}
+			if got := stats.CacheCompressedEntries.Load(); got != int64(btoi(tt.compressed)) {
+				t.Errorf("compressed entries stat = %d", got)
+			}
+			if tt.compressed {
+				if raw, stored := stats.CacheCompressedRawBytes.Load(), stats.CacheCompressedBytes.Load(); raw != int64(len(tt.body)) || stored >= raw {
+					t.Errorf("compressed stats: raw %d, stored %d bytes for a %d byte body", raw, stored, len(tt.body))
+				}
+			}
+
+			cached, ok := cacheGet("key")
+			if !ok || cached.Body != tt.body {
+				t.Errorf("cached body differs from the stored one (found %v, %d bytes)", ok, len(cached.Body))
+			}
+		})
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestSizeWeightedTTL(t *testing.T) {
+	buckets, err := parseTTLSizeBuckets("1048576:5, 10240:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		size   int
+		maxTTL time.Duration
+		want   time.Duration
+	}{
+		{"small body", 100, time.Hour, time.Minute},
+		{"first bucket", 10240, time.Hour, 2 * time.Minute},
+		{"largest bucket", 2 << 20, time.Hour, 5 * time.Minute},
+		{"capped", 2 << 20, 3 * time.Minute, 3 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			ttlSizeBuckets = buckets
+			config.MaxCacheTTL = tt.maxTTL
+			if got := sizeWeightedTTL(time.Minute, tt.size); got != tt.want {
+				t.Errorf("sizeWeightedTTL = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSizeWeightedExpiry(t *testing.T) {
+	setup(t)
+	ttlSizeBuckets, _ = parseTTLSizeBuckets("10240:3")
+	cacheSet("small", upstreamResponse{Body: "{}"})
+	cacheSet("large", upstreamResponse{Body: strings.Repeat("x", 20000)})
+
+	small, _ := cacheEntry("small")
+	large, _ := cacheEntry("large")
+	smallTTL, largeTTL := small.ExpiresAt.Sub(small.StoredAt), large.ExpiresAt.Sub(large.StoredAt)
+	if smallTTL != cacheLifetime() || largeTTL != 3*cacheLifetime() {
+		t.Errorf("TTLs = %s for the small and %s for the large body, want %s and %s", smallTTL, largeTTL, cacheLifetime(), 3*cacheLifetime())
+	}
+}
+
+func TestParseTTLSizeBuckets(t *testing.T) {
+	for _, spec := range []string{"10240", "x:2", "-1:2", "100:0", "100:x"} {
+		if _, err := parseTTLSizeBuckets(spec); err == nil {
+			t.Errorf("parseTTLSizeBuckets(%q) accepted", spec)
+		}
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	tests := []struct {
+		name       string
+		window     time.Duration
+		expiredAgo time.Duration
+		upstream   int
+		stale      bool
+		status     int
+	}{
+		{"server error within the window", time.Minute, 10 * time.Second, fasthttp.StatusInternalServerError, true, fasthttp.StatusOK},
+		{"rate limited within the window", time.Minute, 10 * time.Second, fasthttp.StatusTooManyRequests, true, fasthttp.StatusOK},
+		{"expired too long ago", time.Minute, 2 * time.Minute, fasthttp.StatusInternalServerError, false, 0},
+		{"disabled", 0, 10 * time.Second, fasthttp.StatusInternalServerError, false, 0},
+		{"target error passed on", time.Minute, 10 * time.Second, fasthttp.StatusNotFound, false, fasthttp.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.StaleIfError = tt.window
+			writeServers(t, statusBackend(t, tt.upstream, `{"fresh":false}`))
+			now := time.Now()
+			cacheStore(cacheKey("api.example.com/stale"), upstreamResponse{Body: `{"stale":true}`, ContentType: "application/json"}, now.Add(-time.Hour), now.Add(-tt.expiredAgo))
+
+			resp := proxyGet(t, target("api.example.com/stale"))
+			served := string(resp.Body()) == `{"stale":true}`
+			if served != tt.stale {
+				t.Errorf("served the stale entry = %v, want %v: %d %s", served, tt.stale, resp.StatusCode(), resp.Body())
+			}
+			if warning := string(resp.Header.Peek("Warning")); tt.stale != (warning != "") {
+				t.Errorf("Warning = %q", warning)
+			}
+			if tt.status != 0 && resp.StatusCode() != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode(), tt.status)
+			}
+			if tt.status == 0 && resp.StatusCode() < 500 {
+				t.Errorf("status = %d, want the upstream failure", resp.StatusCode())
+			}
+		})
+	}
+}
+
+func TestStaleDeadline(t *testing.T) {
+	setup(t)
+	stored := time.Date(2026, time.October, 14, 12, 0, 0, 0, time.UTC)
+	data := cachedData{StoredAt: stored, ExpiresAt: stored.Add(time.Hour)}
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		maxStale time.Duration
+		want     time.Time
+	}{
+		{"no cap", 0, 30 * time.Minute, stored.Add(90 * time.Minute)},
+		{"fresh lookup", time.Minute, 0, stored.Add(time.Hour)},
+		{"cap after the stale window", 2 * time.Hour, 30 * time.Minute, stored.Add(90 * time.Minute)},
+		{"cap inside the stale window", 70 * time.Minute, 30 * time.Minute, stored.Add(70 * time.Minute)},
+		{"cap before expiry", 10 * time.Minute, 30 * time.Minute, stored.Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		config.MaxStaleAge = tt.maxAge
+		if got := staleDeadline(data, tt.maxStale); !got.Equal(tt.want) {
+			t.Errorf("%s: deadline = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMaxStaleAge(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		prefer   bool // -prefer-cache rather than -stale-if-error
+		upstream int
+		stale    bool
+	}{
+		{"stale-if-error without a cap", 0, false, fasthttp.StatusInternalServerError, true},
+		{"stale-if-error within the cap", 3 * time.Hour, false, fasthttp.StatusInternalServerError, true},
+		{"stale-if-error beyond the cap", time.Hour, false, fasthttp.StatusInternalServerError, false},
+		{"rate limited beyond the cap", time.Hour, false, fasthttp.StatusTooManyRequests, false},
+		{"prefer-cache within the cap", 3 * time.Hour, true, fasthttp.StatusOK, true},
+		{"prefer-cache beyond the cap", time.Hour, true, fasthttp.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			t.Cleanup(preferCacheRefreshes.Wait)
+			config.MaxStaleAge = tt.maxAge
+			if tt.prefer {
+				config.PreferCache = 10 * time.Minute
+			} else {
+				config.StaleIfError = 10 * time.Minute
+			}
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				ctx.SetStatusCode(tt.upstream)
+				ctx.SetContentType("application/json")
+				ctx.SetBodyString(`{"fresh":true}`)
+			}))
+			// Stored two hours ago, expired a minute ago.
+			now := time.Now()
+			cacheStore(cacheKey("api.example.com/old"), upstreamResponse{Body: `{"stale":true}`, ContentType: "application/json"}, now.Add(-2*time.Hour), now.Add(-time.Minute))
+
+			resp := proxyGet(t, target("api.example.com/old"))
+			if served := string(resp.Body()) == `{"stale":true}`; served != tt.stale {
+				t.Errorf("served the stale entry = %v, want %v: %d %s", served, tt.stale, resp.StatusCode(), resp.Body())
+			}
+			if tt.stale {
+				return
+			}
+			if tt.prefer && string(resp.Body()) != `{"fresh":true}` {
+				t.Errorf("response = %d %s, want the fresh one", resp.StatusCode(), resp.Body())
+			}
+			if !tt.prefer && resp.StatusCode() < 400 {
+				t.Errorf("status = %d, want the upstream failure", resp.StatusCode())
+			}
+		})
+	}
+}
+
+func TestCDNCacheStatus(t *testing.T) {
+	tests := []struct {
+		name         string
+		disabled     bool
+		entry        time.Duration // expiry of a stored entry relative to now, 0 for none
+		staleIfError bool
+		preferCache  bool
+		upstream     int
+		want         string
+	}{
+		{"nothing cached", false, 0, false, false, fasthttp.StatusOK, "MISS"},
+		{"fresh entry", false, time.Minute, false, false, fasthttp.StatusOK, "HIT"},
+		{"expired entry refetched", false, -time.Second, false, false, fasthttp.StatusOK, "REVALIDATED"},
+		{"expired entry served on error", false, -time.Second, true, false, fasthttp.StatusTooManyRequests, "STALE"},
+		{"expired entry served with -prefer-cache", false, -time.Second, false, true, fasthttp.StatusOK, "STALE"},
+		{"header off", true, time.Minute, false, false, fasthttp.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.CDNCacheStatus = !tt.disabled
+			if tt.staleIfError {
+				config.StaleIfError = time.Minute
+			}
+			if tt.preferCache {
+				config.PreferCache = time.Minute
+				t.Cleanup(preferCacheRefreshes.Wait)
+			}
+			writeServers(t, statusBackend(t, tt.upstream, `{}`))
+			if tt.entry != 0 {
+				now := time.Now()
+				cacheStore(cacheKey("api.example.com/status"), upstreamResponse{Body: `{}`}, now.Add(-time.Hour), now.Add(tt.entry))
+			}
+
+			resp := proxyGet(t, target("api.example.com/status"))
+			if got := string(resp.Header.Peek("CDN-Cache-Status")); got != tt.want {
+				t.Errorf("CDN-Cache-Status = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheNamespace(t *testing.T) {
+	setup(t)
+	var requests atomic.Int64
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("application/json")
+		fmt.Fprintf(ctx, `{"fetch":%d}`, requests.Add(1))
+	}))
+
+	steps := []struct {
+		name   string
+		header string
+		param  string
+		want   string // the fetch whose response is served
+	}{
+		{"no namespace", "", "", `{"fetch":1}`},
+		{"header", "team-a", "", `{"fetch":2}`},
+		{"header again", "team-a", "", `{"fetch":2}`},
+		{"same namespace as a parameter", "", "team-a", `{"fetch":2}`},
+		{"header wins over the parameter", "team-b", "team-a", `{"fetch":3}`},
+		{"no namespace again", "", "", `{"fetch":1}`},
+	}
+	for _, step := range steps {
+		uri := target("api.example.com/ns")
+		if step.param != "" {
+			uri += "&ns=" + step.param
+		}
+		var headers []string
+		if step.header != "" {
+			headers = []string{namespaceHeader, step.header}
+		}
+		resp := proxyGet(t, uri, headers...)
+		if string(resp.Body()) != step.want {
+			t.Errorf("%s: body = %s, want %s", step.name, resp.Body(), step.want)
+		}
+	}
+}
+
+func TestInvalidCacheNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+	}{
+		{"space", "team a"},
+		{"slash", "team/a"},
+		{"too long", strings.Repeat("a", 65)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			var requests atomic.Int64
+			writeServers(t, countingBackend(t, `{}`, &requests))
+
+			resp := proxyGet(t, target("api.example.com/ns"), namespaceHeader, tt.namespace)
+			if resp.StatusCode() != fasthttp.StatusBadRequest || !strings.Contains(string(resp.Body()), `"invalid_namespace"`) {
+				t.Errorf("status = %d: %s, want invalid_namespace", resp.StatusCode(), resp.Body())
+			}
+			if requests.Load() != 0 {
+				t.Errorf("request with an invalid namespace reached the server")
+			}
+		})
+	}
+}
+
+func TestHashedCacheKeyCollision(t *testing.T) {
+	tests := []struct {
+		name       string
+		hashed     bool
+		fetches    int64
+		collisions int64
+	}{
+		{"hashed", true, 3, 2},
+		{"unhashed", false, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.HashCacheKeys = tt.hashed
+			hash := cacheKeyHash
+			cacheKeyHash = func(string) string { return "same" }
+			t.Cleanup(func() { cacheKeyHash = hash })
+			var requests atomic.Int64
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				requests.Add(1)
+				ctx.SetContentType("application/json")
+				fmt.Fprintf(ctx, `{"path":%q}`, ctx.QueryArgs().Peek("url"))
+			}))
+
+			// Each target alternately evicts the other's entry when hashed.
+			for _, path := range []string{"/a", "/b", "/a"} {
+				resp := proxyGet(t, target("api.example.com"+path))
+				if want := fmt.Sprintf(`{"path":"api.example.com%s"}`, path); string(resp.Body()) != want {
+					t.Errorf("%s: body = %s, want %s", path, resp.Body(), want)
+				}
+			}
+			if got := requests.Load(); got != tt.fetches {
+				t.Errorf("server requests = %d, want %d", got, tt.fetches)
+			}
+			if got := snapshotStats().Cache.Collisions; got != tt.collisions {
+				t.Errorf("cache_collisions = %d, want %d", got, tt.collisions)
+			}
+		})
+	}
+}
+
+func TestStoredFor(t *testing.T) {
+	tests := []struct {
+		name string
+		data cachedData
+		key  string
+		want bool
+	}{
+		{"unhashed entry", cachedData{}, "a", true},
+		{"same key", cachedData{Key: "a"}, "a", true},
+		{"other key", cachedData{Key: "b"}, "a", false},
+	}
+	for _, tt := range tests {
+		if got := storedFor(tt.data, tt.key); got != tt.want {
+			t.Errorf("%s: storedFor = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCacheKeyHeaders(t *testing.T) {
+	for _, list := range []string{"Authorization,Accept-Language", " authorization , accept-language ,"} {
+		t.Run(list, func(t *testing.T) {
+			setup(t)
+			config.CacheKeyHeaders = list
+			var requests atomic.Int64
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				ctx.SetContentType("application/json")
+				fmt.Fprintf(ctx, `{"fetch":%d}`, requests.Add(1))
+			}))
+
+			steps := []struct {
+				name    string
+				headers []string
+				want    string
+			}{
+				{"tenant a", []string{"Authorization", "Bearer a", "Accept-Language", "en"}, `{"fetch":1}`},
+				{"tenant a again", []string{"Authorization", "Bearer a", "Accept-Language", "en"}, `{"fetch":1}`},
+				{"tenant b", []string{"Authorization", "Bearer b", "Accept-Language", "en"}, `{"fetch":2}`},
+				{"other locale", []string{"Authorization", "Bearer a", "Accept-Language", "de"}, `{"fetch":3}`},
+				{"unlisted header", []string{"Authorization", "Bearer a", "Accept-Language", "en", "X-Other", "1"}, `{"fetch":1}`},
+				{"without the headers", nil, `{"fetch":4}`},
+				{"without them again", nil, `{"fetch":4}`},
+			}
+			for _, step := range steps {
+				if body := string(proxyGet(t, target("api.example.com/tenant"), step.headers...).Body()); body != step.want {
+					t.Errorf("%s: body = %s, want %s", step.name, body, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderFingerprint(t *testing.T) {
+	setup(t)
+	fingerprint := func(token string) string {
+		var h fasthttp.RequestHeader
+		h.Set("Authorization", token)
+		return headerFingerprint(&h)
+	}
+	if got := fingerprint("secret-token"); got != "" {
+		t.Errorf("fingerprint = %q without -cache-key-headers", got)
+	}
+
+	config.CacheKeyHeaders = "Authorization"
+	a, b := fingerprint("secret-token"), fingerprint("other-token")
+	if a == b || a != fingerprint("secret-token") {
+		t.Errorf("fingerprints %q and %q", a, b)
+	}
+	if strings.Contains(a, "secret-token") {
+		t.Errorf("fingerprint %q contains the header value", a)
+	}
+}
+
+func TestCacheShards(t *testing.T) {
+	setup(t)
+	now := time.Now()
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("api.example.com/shard/%d", i)
+		expiresAt := now.Add(time.Minute)
+		if i%4 == 0 {
+			expiresAt = now.Add(-time.Hour)
+		}
+		cacheStore(key, upstreamResponse{Body: key}, now.Add(-time.Hour), expiresAt)
+	}
+
+	used := 0
+	for _, shard := range cache.shards {
+		shard.RLock()
+		for stored := range shard.data {
+			if shardFor(stored) != shard {
+				t.Errorf("%s is in the wrong shard", stored)
+			}
+		}
+		if len(shard.data) > 0 {
+			used++
+		}
+		shard.RUnlock()
+	}
+	if used < cacheShardCount/2 {
+		t.Errorf("200 keys use only %d of %d shards", used, cacheShardCount)
+	}
+	if got := cacheEntryCount(); got != 200 {
+		t.Errorf("cacheEntryCount = %d, want 200", got)
+	}
+
+	if removed := sweepExpired(now); removed != 50 {
+		t.Errorf("sweep removed %d entries, want the 50 expired ones", removed)
+	}
+	cacheEvict("api.example.com/shard/1")
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("api.example.com/shard/%d", i)
+		_, ok := cacheGet(key)
+		if want := i%4 != 0 && i != 1; ok != want {
+			t.Errorf("%s cached = %v, want %v", key, ok, want)
+		}
+	}
+	if got := cacheEntryCount(); got != 149 {
+		t.Errorf("cacheEntryCount = %d after the sweep and eviction, want 149", got)
+	}
+}
+
+func TestCacheShardsConcurrent(t *testing.T) {
+	setup(t)
+	config.CacheDedupe = true
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("api.example.com/concurrent/%d", (g*7+i)%50)
+				switch i % 4 {
+				case 0:
+					cacheSet(key, upstreamResponse{Body: fmt.Sprintf("body %d", i%3)})
+				case 1:
+					cacheEvict(key)
+				case 2:
+					sweepExpired(time.Now())
+				default:
+					if resp, ok := cacheGet(key); ok && !strings.HasPrefix(resp.Body, "body ") {
+						t.Errorf("%s = %q", key, resp.Body)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// Every blob is still referenced by an entry, and every entry's blob
+	// exists.
+	refs := make(map[string]int)
+	for _, shard := range cache.shards {
+		shard.RLock()
+		for _, data := range shard.data {
+			refs[data.Hash]++
+		}
+		shard.RUnlock()
+	}
+	cacheBlobs.Lock()
+	defer cacheBlobs.Unlock()
+	if len(cacheBlobs.blobs) != len(refs) {
+		t.Errorf("%d blobs for %d distinct bodies", len(cacheBlobs.blobs), len(refs))
+	}
+	for hash, n := range refs {
+		if blob := cacheBlobs.blobs[hash]; blob == nil || blob.refs != n {
+			t.Errorf("blob %s has %v, want %d references", hash, blob, n)
+		}
+	}
+}
+
+// BenchmarkCacheContention compares the sharded cache with the single lock
+// it replaced, simulated by holding one RWMutex around every call, under a
+// parallel mix of nine lookups to one store. Run it with -cpu 1,4,8 to see
+// the difference grow with the number of cores.
+func BenchmarkCacheContention(b *testing.B) {
+	setup(b)
+	const keys = 1024
+	for i := 0; i < keys; i++ {
+		cacheSet(fmt.Sprintf("api.example.com/bench/%d", i), upstreamResponse{Body: `{"ok":true}`})
+	}
+	var single sync.RWMutex
+	benchmarks := []struct {
+		name         string
+		lock, unlock func(write bool)
+	}{
+		{"sharded", func(bool) {}, func(bool) {}},
+		{"single-mutex", func(write bool) {
+			if write {
+				single.Lock()
+			} else {
+				single.RLock()
+			}
+		}, func(write bool) {
+			if write {
+				single.Unlock()
+			} else {
+				single.RUnlock()
+			}
+		}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			var seed atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(seed.Add(1)))
+				for pb.Next() {
+					key := fmt.Sprintf("api.example.com/bench/%d", rnd.Intn(keys))
+					write := rnd.Intn(10) == 0
+					bm.lock(write)
+					if write {
+						cacheSet(key, upstreamResponse{Body: `{"ok":true}`})
+					} else {
+						cacheGet(key)
+					}
+					bm.unlock(write)
+				}
+			})
+		})
+	}
+}
+
+func TestCacheTTLZero(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		headers []string
+		cached  bool
+	}{
+		{"default TTL", time.Minute, nil, true},
+		{"caching off", 0, nil, false},
+		{"per-request TTL with caching off", 0, []string{"X-Cache-TTL", "30s"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.CacheTTL = tt.ttl
+			setCacheLifetime(tt.ttl)
+			var requests atomic.Int64
+			writeServers(t, countingBackend(t, `{"n":1}`, &requests))
+
+			for i := 0; i < 2; i++ {
+				if resp := proxyGet(t, target("api.example.com/ttl"), tt.headers...); string(resp.Body()) != `{"n":1}` {
+					t.Fatalf("request %d = %d %s", i, resp.StatusCode(), resp.Body())
+				}
+			}
+			want := int64(2)
+			if tt.cached {
+				want = 1
+			}
+			if got := requests.Load(); got != want {
+				t.Errorf("server requests = %d, want %d", got, want)
+			}
+
+			now := time.Now()
+			cacheStore(cacheKey("api.example.com/stored"), upstreamResponse{Body: `{}`}, now, now.Add(time.Hour))
+			if _, ok := cacheGet(cacheKey("api.example.com/stored")); ok != tt.cached {
+				t.Errorf("entry stored directly found = %v, want %v", ok, tt.cached)
+			}
+			entries := 0
+			if tt.cached {
+				entries = 2
+			}
+			if got := cacheEntryCount(); got != entries {
+				t.Errorf("cache entries = %d, want %d", got, entries)
+			}
+
+			var snapshot statsSnapshot
+			if err := json.Unmarshal(proxyGet(t, "/stats").Body(), &snapshot); err != nil {
+				t.Fatal(err)
+			}
+			if snapshot.Cache.Disabled == tt.cached {
+				t.Errorf("disabled in /stats = %v with -cache-ttl %s", snapshot.Cache.Disabled, tt.ttl)
+			}
+		})
+	}
+}
+
+// peerCache is a -remote-cache peer holding a fresh entry for each of keys.
+func peerCache(t *testing.T, keys ...string) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		if !ctx.IsGet() {
+			return
+		}
+		key := string(ctx.QueryArgs().Peek("key"))
+		for _, k := range keys {
+			if k != key {
+				continue
+			}
+			now := time.Now()
+			entry, _ := json.Marshal(cacheExportEntry{Key: key, ContentType: "application/json", Body: []byte(`{"from":"peer"}`), StoredAt: now, ExpiresAt: now.Add(time.Hour)})
+			ctx.SetBody(entry)
+			return
+		}
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	})
+}
+
+func TestCacheTier(t *testing.T) {
+	tests := []struct {
+		name   string
+		header bool
+		peer   bool     // the peer holds the entry
+		stale  string   // memory holds a stale entry, served with -prefer-cache or -stale-if-error
+		tiers  []string // X-Cache-Tier of each request, "" for none
+		memory int64
+		peers  int64
+	}{
+		{"fetched then memory", true, false, "", []string{"", cacheTierMemory}, 1, 0},
+		{"peer then memory", true, true, "", []string{cacheTierPeer, cacheTierMemory}, 1, 1},
+		{"preferred stale entry", true, false, "prefer-cache", []string{cacheTierMemory}, 1, 0},
+		{"stale entry on error", true, false, "stale-if-error", []string{cacheTierMemory}, 1, 0},
+		{"counted without the header", false, true, "", []string{"", ""}, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			t.Cleanup(remoteCacheStores.Wait)
+			t.Cleanup(preferCacheRefreshes.Wait)
+			config.CacheTierHeader = tt.header
+			key := cacheKey("api.example.com/tier")
+			var peerKeys []string
+			if tt.peer {
+				peerKeys = append(peerKeys, key)
+			}
+			config.RemoteCache = peerCache(t, peerKeys...)
+			var requests atomic.Int64
+			server := countingBackend(t, `{"from":"server"}`, &requests)
+			switch tt.stale {
+			case "prefer-cache":
+				config.PreferCache = time.Minute
+			case "stale-if-error":
+				config.StaleIfError = time.Minute
+				server = statusBackend(t, fasthttp.StatusInternalServerError, `{"error":"down"}`)
+			}
+			if tt.stale != "" {
+				now := time.Now()
+				cacheStore(key, upstreamResponse{Body: `{"from":"memory"}`, ContentType: "application/json"}, now.Add(-time.Hour), now.Add(-time.Second))
+			}
+			writeServers(t, server)
+
+			for i, tier := range tt.tiers {
+				resp := proxyGet(t, target("api.example.com/tier"))
+				if resp.StatusCode() != fasthttp.StatusOK {
+					t.Fatalf("request %d: status = %d: %s", i, resp.StatusCode(), resp.Body())
+				}
+				if got := string(resp.Header.Peek("X-Cache-Tier")); got != tier {
+					t.Errorf("request %d: X-Cache-Tier = %q, want %q: %s", i, got, tier, resp.Body())
+				}
+			}
+			if tt.peer && requests.Load() != 0 {
+				t.Errorf("server requests = %d, want the peer's entry served", requests.Load())
+			}
+
+			tiers := snapshotStats().Cache.TierHits
+			if tiers.Memory != tt.memory || tiers.Peer != tt.peers {
+				t.Errorf("tier hits = %+v, want memory %d and peer %d", tiers, tt.memory, tt.peers)
+			}
+		})
+	}
+}
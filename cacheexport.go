@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// cacheExportEntry is one line of the newline-delimited JSON produced by
+// GET /cache/export and read by -cache-import.
+type cacheExportEntry struct {
+	Key         string        `json:"key"`
+	ContentType string        `json:"content_type,omitempty"`
+	Headers     []headerField `json:"headers,omitempty"`
+	StatusCode  int           `json:"status,omitempty"`
+	Location    string        `json:"location,omitempty"`
+	Body        []byte        `json:"body"`
+	StoredAt    time.Time     `json:"stored_at"`
+	ExpiresAt   time.Time     `json:"expires_at"`
+}
+
+func snapshotCacheEntries() []cacheExportEntry {
+	now := time.Now()
+	var entries []cacheExportEntry
+	var compressed []bool
+	for _, shard := range cache.shards {
+		shard.RLock()
+		for key, data := range shard.data {
+			if now.After(data.ExpiresAt) {
+				continue
+			}
+			value := data.Value
+			if data.Hash != "" {
+				blob, ok := lookupBlob(data.Hash)
+				if !ok {
+					continue
+				}
+				value = blob.Value
+			}
+			if data.Key != "" {
+				key = data.Key
+			}
+			entries = append(entries, cacheExportEntry{
+				Key:         key,
+				ContentType: data.ContentType,
+				Headers:     data.Headers,
+				StatusCode:  data.StatusCode,
+				Location:    data.Location,
+				Body:        []byte(value),
+				StoredAt:    data.StoredAt,
+				ExpiresAt:   data.ExpiresAt,
+			})
+			compressed = append(compressed, data.Compressed)
+		}
+		shard.RUnlock()
+	}
+
+	valid := entries[:0]
+	for i, entry := range entries {
+		if compressed[i] {
+			body, err := gunzipString(string(entry.Body))
+			if err != nil {
+				continue
+			}
+			entry.Body = []byte(body)
+		}
+		valid = append(valid, entry)
+	}
+	return valid
+}
+
+func handleCacheExport(ctx *fasthttp.RequestCtx) {
+	if !authorizeAdmin(ctx) {
+		return
+	}
+
+	entries := snapshotCacheEntries()
+
+	ctx.SetContentType("application/x-ndjson")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		encoder := jsonLine.NewEncoder(w)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				fmt.Printf("Cache export failed: %v\n", err)
+				return
+			}
+		}
+	})
+}
+
+// cacheDumpEntry describes one entry in GET /cache/dump, without its body.
+type cacheDumpEntry struct {
+	Key         string    `json:"key"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int       `json:"size"`
+	Hits        int64     `json:"hits"`
+	StoredAt    time.Time `json:"stored_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// handleCacheDump lists the fresh cache entries, most served first, to see
+// which content the cache pays off for.
+func handleCacheDump(ctx *fasthttp.RequestCtx) {
+	if !authorizeAdmin(ctx) {
+		return
+	}
+
+	now := time.Now()
+	entries := []cacheDumpEntry{}
+	for _, shard := range cache.shards {
+		shard.RLock()
+		for key, data := range shard.data {
+			if now.After(data.ExpiresAt) {
+				continue
+			}
+			if data.Key != "" {
+				key = data.Key
+			}
+			entries = append(entries, cacheDumpEntry{
+				Key:         key,
+				ContentType: data.ContentType,
+				Size:        data.Size,
+				Hits:        data.Hits.Load(),
+				StoredAt:    data.StoredAt,
+				ExpiresAt:   data.ExpiresAt,
+			})
+		}
+		shard.RUnlock()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Hits != entries[j].Hits {
+			return entries[i].Hits > entries[j].Hits
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	sendJSONResponse(ctx, entries, fasthttp.StatusOK)
+}
+
+// importCache loads a file written by /cache/export. Entries keep their
+// original expiry, so anything that expired in the meantime is skipped.
+func importCache(filePath string) (int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	now := time.Now()
+	imported := 0
+	for decoder.More() {
+		var entry cacheExportEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return imported, fmt.Errorf("entry %d: %v", imported+1, err)
+		}
+
+		if !entry.ExpiresAt.After(now) {
+			continue
+		}
+		cacheStore(entry.Key, upstreamResponse{Body: string(entry.Body), ContentType: entry.ContentType, StatusCode: entry.StatusCode, Location: entry.Location, Headers: entry.Headers}, entry.StoredAt, entry.ExpiresAt)
+		imported++
+	}
+
+	return imported, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCacheExportImport(t *testing.T) {
+	tests := []struct {
+		name     string
+		compress bool
+		dedupe   bool
+	}{
+		{"plain", false, false},
+		{"compressed", true, false},
+		{"deduplicated", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.setAdminKey("secret")
+			if tt.compress {
+				config.CacheCompressThreshold = 100
+			}
+			config.CacheDedupe = tt.dedupe
+
+			now := time.Now()
+			large := strings.Repeat(`{"a":1}`, 100)
+			cacheStore("fresh", upstreamResponse{Body: large, ContentType: "application/json"}, now, now.Add(time.Hour))
+			cacheStore("soon", upstreamResponse{Body: "{}", StatusCode: 301, Location: "/next"}, now, now.Add(200*time.Millisecond))
+			cacheStore("expired", upstreamResponse{Body: "{}"}, now.Add(-time.Hour), now.Add(-time.Minute))
+
+			if resp := proxyGet(t, "/cache/export"); resp.StatusCode() != fasthttp.StatusUnauthorized {
+				t.Errorf("export without the key: status %d, want 401", resp.StatusCode())
+			}
+			resp := proxyGet(t, "/cache/export", "X-API-Key", "secret")
+			if resp.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("export status = %d", resp.StatusCode())
+			}
+			if lines := strings.Count(string(resp.Body()), "\n"); lines != 2 {
+				t.Errorf("export has %d entries, want the 2 fresh ones:\n%s", lines, resp.Body())
+			}
+			writeFile(t, "export.ndjson", string(resp.Body()))
+
+			resetCache()
+			imported, err := importCache("export.ndjson")
+			if err != nil || imported != 2 {
+				t.Fatalf("importCache = %d, %v, want 2 entries", imported, err)
+			}
+
+			fresh, ok := cacheEntry("fresh")
+			if !ok || !fresh.ExpiresAt.Equal(now.Add(time.Hour)) {
+				t.Errorf("imported entry expires at %v (found %v), want %v", fresh.ExpiresAt, ok, now.Add(time.Hour))
+			}
+			if cached, _ := cacheGet("fresh"); cached.Body != large || cached.ContentType != "application/json" {
+				t.Errorf("imported entry = %q %q", cached.ContentType, cached.Body)
+			}
+			if cached, _ := cacheGet("soon"); cached.StatusCode != 301 || cached.Location != "/next" {
+				t.Errorf("imported redirect = %d %q", cached.StatusCode, cached.Location)
+			}
+			if _, ok := cacheEntry("expired"); ok {
+				t.Error("expired entry was imported")
+			}
+		})
+	}
+}
+
+func TestCacheImportSkipsExpired(t *testing.T) {
+	setup(t)
+	now := time.Now()
+	cacheStore("short", upstreamResponse{Body: "{}"}, now, now.Add(50*time.Millisecond))
+	config.setAdminKey("secret")
+	writeFile(t, "export.ndjson", string(proxyGet(t, "/cache/export", "X-API-Key", "secret").Body()))
+
+	// The entry expires between the export and the import.
+	time.Sleep(60 * time.Millisecond)
+	resetCache()
+	if imported, err := importCache("export.ndjson"); err != nil || imported != 0 {
+		t.Errorf("importCache = %d, %v, want nothing imported", imported, err)
+	}
+}
+
+func TestCacheHits(t *testing.T) {
+	for _, header := range []bool{false, true} {
+		t.Run(fmt.Sprintf("header %v", header), func(t *testing.T) {
+			setup(t)
+			config.CacheHitsHeader = header
+			writeServers(t, jsonBackend(t, `{}`))
+			key := cacheKey("api.example.com/hits")
+
+			for read := 0; read <= 3; read++ {
+				resp := proxyGet(t, target("api.example.com/hits"))
+				want := ""
+				if header && read > 0 {
+					want = strconv.Itoa(read)
+				}
+				if got := string(resp.Header.Peek("X-Cache-Hits")); got != want {
+					t.Errorf("read %d: X-Cache-Hits = %q, want %q", read, got, want)
+				}
+				if data, _ := cacheEntry(key); data.Hits.Load() != int64(read) {
+					t.Errorf("read %d: entry hits = %d", read, data.Hits.Load())
+				}
+			}
+
+			// Storing the entry again starts the count over.
+			cacheSet(key, upstreamResponse{Body: `{"new":true}`})
+			if data, _ := cacheEntry(key); data.Hits.Load() != 0 {
+				t.Errorf("hits after storing again = %d, want 0", data.Hits.Load())
+			}
+		})
+	}
+}
+
+func TestCacheDump(t *testing.T) {
+	setup(t)
+	config.setAdminKey("secret")
+	now := time.Now()
+	cacheStore("https://api.example.com/popular", upstreamResponse{Body: `{"a":1}`, ContentType: "application/json"}, now, now.Add(time.Hour))
+	cacheStore("https://api.example.com/rare", upstreamResponse{Body: `{}`}, now, now.Add(time.Hour))
+	cacheStore("https://api.example.com/unread", upstreamResponse{Body: `{}`}, now, now.Add(time.Hour))
+	cacheStore("https://api.example.com/expired", upstreamResponse{Body: `{}`}, now.Add(-time.Hour), now.Add(-time.Minute))
+	for i := 0; i < 3; i++ {
+		cacheGet("https://api.example.com/popular")
+	}
+	cacheGet("https://api.example.com/rare")
+
+	if resp := proxyGet(t, "/cache/dump"); resp.StatusCode() == fasthttp.StatusOK {
+		t.Errorf("dump without the admin key answered %s", resp.Body())
+	}
+	resp := proxyGet(t, "/cache/dump", "X-API-Key", "secret")
+	if resp.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+	}
+	var entries []cacheDumpEntry
+	if err := json.Unmarshal(resp.Body(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		key  string
+		hits int64
+		size int
+	}{
+		{"https://api.example.com/popular", 3, len(`{"a":1}`)},
+		{"https://api.example.com/rare", 1, 2},
+		{"https://api.example.com/unread", 0, 2},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("entries = %+v, want %d without the expired one", entries, len(want))
+	}
+	for i, w := range want {
+		if entries[i].Key != w.key || entries[i].Hits != w.hits || entries[i].Size != w.size {
+			t.Errorf("entry %d = %+v, want %s with %d hits and size %d", i, entries[i], w.key, w.hits, w.size)
+		}
+	}
+	if entries[0].ContentType != "application/json" {
+		t.Errorf("content type = %q", entries[0].ContentType)
+	}
+	if strings.Contains(string(resp.Body()), `{\"a\":1}`) {
+		t.Error("dump includes the bodies")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// logCacheKey prints the parts a request's cache key was built from with
+// -log-cache-keys, so two requests that should share an entry but miss can
+// be compared. Header values are only logged as a short hash, and query
+// parameters listed in -log-redact-params as well as URL credentials are
+// masked.
+func logCacheKey(ctx *fasthttp.RequestCtx, target string, namespace string, key string) {
+	if !config.LogCacheKeys {
+		return
+	}
+
+	var headers []string
+	if config.CacheKeyHeaders != "" {
+		for _, name := range strings.Split(config.CacheKeyHeaders, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			value := ctx.Request.Header.Peek(name)
+			if value == nil {
+				headers = append(headers, name+"=(missing)")
+				continue
+			}
+			sum := fnv.New32a()
+			sum.Write(value)
+			headers = append(headers, name+"=#"+strconv.FormatUint(uint64(sum.Sum32()), 16))
+		}
+	}
+
+	redacted := redactTarget(target)
+	stored := "(key)"
+	if config.HashCacheKeys {
+		stored = storageKey(key)
+	}
+	fmt.Printf("[DEBUG] Cache key for %s: target=%q headers=[%s] namespace=%q key=%q storage=%s\n",
+		currentRequestID(ctx), redacted, strings.Join(headers, " "), namespace, strings.Replace(key, target, redacted, 1), stored)
+}
+
+// redactTarget masks the userinfo and the -log-redact-params query values of
+// target.
+func redactTarget(target string) string {
+	if i := strings.Index(target, "://"); i >= 0 {
+		rest := target[i+len("://"):]
+		authorityEnd := strings.IndexAny(rest, "/?#")
+		if authorityEnd < 0 {
+			authorityEnd = len(rest)
+		}
+		if at := strings.LastIndex(rest[:authorityEnd], "@"); at >= 0 {
+			target = target[:i+len("://")] + "REDACTED" + rest[at:]
+		}
+	}
+
+	rest, fragment, hasFragment := strings.Cut(target, "#")
+	base, query, hasQuery := strings.Cut(rest, "?")
+	if !hasQuery {
+		return target
+	}
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		name, _, hasValue := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil && hasValue && redactedParam(unescaped) {
+			params[i] = name + "=REDACTED"
+		}
+	}
+	redacted := base + "?" + strings.Join(params, "&")
+	if hasFragment {
+		redacted += "#" + fragment
+	}
+	return redacted
+}
+
+func redactedParam(name string) bool {
+	for _, listed := range strings.Split(config.LogRedactParams, ",") {
+		if listed = strings.TrimSpace(listed); listed != "" && strings.EqualFold(listed, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRedactTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"https://api.example.com/a?q=1", "https://api.example.com/a?q=1"},
+		{"https://api.example.com/a?token=abc&q=1", "https://api.example.com/a?token=REDACTED&q=1"},
+		{"https://api.example.com/a?API_KEY=abc#frag", "https://api.example.com/a?API_KEY=REDACTED#frag"},
+		{"https://api.example.com/a?%74oken=abc", "https://api.example.com/a?%74oken=REDACTED"},
+		{"https://api.example.com/a?token", "https://api.example.com/a?token"},
+		{"https://user:pw@api.example.com/a", "https://REDACTED@api.example.com/a"},
+		{"https://api.example.com/a@b", "https://api.example.com/a@b"},
+		{"api.example.com/a?sig=1", "api.example.com/a?sig=REDACTED"},
+	}
+	setup(t)
+	for _, tt := range tests {
+		if got := redactTarget(tt.target); got != tt.want {
+			t.Errorf("redactTarget(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+// headerHash is the hash -log-cache-keys logs for a header value.
+func headerHash(value string) string {
+	sum := fnv.New32a()
+	sum.Write([]byte(value))
+	return "#" + strconv.FormatUint(uint64(sum.Sum32()), 16)
+}
+
+// cacheKeyLine returns the -log-cache-keys line in output.
+func cacheKeyLine(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "[DEBUG] Cache key for ") {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestLogCacheKeys(t *testing.T) {
+	const target = "https://user:pw@api.example.com/a?token=s3cret&q=1"
+	tests := []struct {
+		name    string
+		enabled bool
+		headers []string
+		want    []string // parts of the logged line
+	}{
+		{name: "off", enabled: false},
+		{
+			name:    "components",
+			enabled: true,
+			headers: []string{"X-Tenant", "acme", namespaceHeader, "blue"},
+			want: []string{
+				`target="https://REDACTED@api.example.com/a?token=REDACTED&q=1"`,
+				"headers=[X-Tenant=" + headerHash("acme") + " X-Missing=(missing)]",
+				`namespace="blue"`,
+			},
+		},
+		{
+			name:    "other header value",
+			enabled: true,
+			headers: []string{"X-Tenant", "globex"},
+			want:    []string{"headers=[X-Tenant=" + headerHash("globex") + " X-Missing=(missing)]", `namespace=""`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.LogCacheKeys = tt.enabled
+			config.CacheKeyHeaders = "X-Tenant, X-Missing"
+			writeServers(t, jsonBackend(t, `{}`))
+
+			output := captureOutput(t, func() {
+				proxyGet(t, "/?url="+url.QueryEscape(target), tt.headers...)
+			})
+			line := cacheKeyLine(output)
+			if !tt.enabled {
+				if line != "" {
+					t.Errorf("logged %q without -log-cache-keys", line)
+				}
+				return
+			}
+			for _, part := range tt.want {
+				if !strings.Contains(line, part) {
+					t.Errorf("line %q does not contain %s", line, part)
+				}
+			}
+			if strings.Contains(line, "s3cret") || strings.Contains(line, "pw@") || strings.Contains(line, "acme") {
+				t.Errorf("line %q shows a secret", line)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// ttlRule gives entries whose target matches Pattern their own base TTL.
+type ttlRule struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+var (
+	routeTTLRules []ttlRule
+	hostTTLRules  []ttlRule
+)
+
+// parseTTLRules parses -cache-ttl-routes and -cache-ttl-hosts, a
+// comma-separated list of pattern=ttl pairs such as "/static/*=1h,/api/*=30s".
+// The order is kept since the first matching rule wins.
+func parseTTLRules(spec string) ([]ttlRule, error) {
+	var rules []ttlRule
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, value, ok := strings.Cut(part, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid cache TTL rule %q, expected pattern=ttl", part)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in cache TTL rule %q", part)
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid TTL in cache TTL rule %q", part)
+		}
+		rules = append(rules, ttlRule{Pattern: pattern, TTL: ttl})
+	}
+	return rules, nil
+}
+
+// baseCacheTTL returns the TTL for a response from target before size
+// weighting: the first -cache-ttl-routes rule matching its path, else the first
+// -cache-ttl-hosts rule matching its host, else the global cache lifetime.
+func baseCacheTTL(target string) time.Duration {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return cacheLifetime()
+	}
+
+	for _, rule := range routeTTLRules {
+		if matchesRoute(rule.Pattern, parsed.EscapedPath()) {
+			return rule.TTL
+		}
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for _, rule := range hostTTLRules {
+		if matched, _ := path.Match(strings.ToLower(rule.Pattern), host); matched {
+			return rule.TTL
+		}
+	}
+	return cacheLifetime()
+}
+
+// matchesRoute matches a path glob, where a trailing "/*" also covers every
+// path below that prefix.
+func matchesRoute(pattern string, urlPath string) bool {
+	if urlPath == "" {
+		urlPath = "/"
+	}
+	if matched, _ := path.Match(pattern, urlPath); matched {
+		return true
+	}
+	return strings.HasSuffix(pattern, "/*") && strings.HasPrefix(urlPath, strings.TrimSuffix(pattern, "*"))
+}
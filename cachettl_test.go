@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTTLRules(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []ttlRule
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"/static/*=1h, /api/*=30s", []ttlRule{{"/static/*", time.Hour}, {"/api/*", 30 * time.Second}}, false},
+		{"/static/*", nil, true},
+		{"=1h", nil, true},
+		{"/a/[=1h", nil, true},
+		{"/a=soon", nil, true},
+		{"/a=0s", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseTTLRules(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("rules = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("rule %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBaseCacheTTL(t *testing.T) {
+	tests := []struct {
+		target string
+		want   time.Duration
+	}{
+		{"https://api.example.com/static/app.js", time.Hour},
+		{"https://api.example.com/static", 5 * time.Minute},
+		{"https://api.example.com/api/users?page=2", 30 * time.Second},
+		{"https://api.example.com/static/api/x", time.Hour},
+		{"https://CDN.example.com/other", 10 * time.Minute},
+		{"https://other.example.org/other", 5 * time.Minute},
+		{"https://cdn.example.com/api/v1", 30 * time.Second},
+		{"https://api.example.com", 2 * time.Minute},
+	}
+	setup(t)
+	setCacheLifetime(5 * time.Minute)
+	routeTTLRules = []ttlRule{{"/static/*", time.Hour}, {"/api/*", 30 * time.Second}, {"/", 2 * time.Minute}}
+	hostTTLRules = []ttlRule{{"cdn.example.com", 10 * time.Minute}}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			if got := baseCacheTTL(tt.target); got != tt.want {
+				t.Errorf("baseCacheTTL = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteTTLApplied(t *testing.T) {
+	setup(t)
+	routeTTLRules, _ = parseTTLRules("/static/*=1h,/api/*=30s")
+	writeServers(t, jsonBackend(t, `{}`))
+
+	for target, want := range map[string]time.Duration{
+		"https://api.example.com/static/logo.png": time.Hour,
+		"https://api.example.com/api/users":       30 * time.Second,
+	} {
+		proxyGet(t, "/?url="+target)
+		data, ok := cacheEntry(cacheKey(target))
+		if !ok {
+			t.Fatalf("%s not cached", target)
+		}
+		if got := data.ExpiresAt.Sub(data.StoredAt); got != want {
+			t.Errorf("%s cached for %s, want %s", target, got, want)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// APIKey can be replaced at runtime through POST /admin/apikey, so it
+	// is only read and written through adminKey and setAdminKey.
+	APIKey   string
+	apiKeyMu sync.RWMutex
+
+	MaxConcurrency int
+	PriorityHeader string
+
+	MaxInflightAttempts int
+	InflightWait        time.Duration
+
+	TargetConcurrency     int
+	TargetConcurrencyWait time.Duration
+
+	RetryBudget      int
+	RotationBudget   time.Duration
+	RetryBudgetRatio float64
+
+	GlobalBreakerThreshold float64
+	GlobalBreakerWindow    time.Duration
+	GlobalBreakerOpen      time.Duration
+	GlobalBreakerRamp      time.Duration
+
+	TransientRetries      int
+	TransientRetryBackoff time.Duration
+
+	DedupeServers       bool
+	Failover            bool
+	FailoverTags        string
+	PoolRoutes          string
+	AffinityCookie      string
+	AffinitySecret      string
+	Cooldown            time.Duration
+	ExhaustionStatus    int
+	BreakerThreshold    int
+	BreakerOpenDuration time.Duration
+	SingleServerRetries int
+	SingleServerDelay   time.Duration
+	EscalateAfter       int
+	EscalateFanout      int
+
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	HealthPath     string
+	CanaryURL      string
+	CanaryMaxAge   time.Duration
+
+	HealthStagger     time.Duration
+	HealthConcurrency int
+
+	Webhook        string
+	WebhookQueue   int
+	WebhookTimeout time.Duration
+
+	PrewarmInterval time.Duration
+	PrewarmOrder    string
+	PrewarmURL      string
+
+	LatencySLA       time.Duration
+	LatencySLAWindow time.Duration
+
+	JSONMode        string
+	LogFormat       string
+	AccessLogFormat string
+
+	ResponseMiddleware string
+	FollowRedirects    bool
+	CacheRedirects     bool
+	NoRotate           bool
+	SoftErrorPattern   string
+	IdenticalErrors    int
+	PendingPattern     string
+	PendingFields      string
+	PendingRetries     int
+	PendingRetryDelay  time.Duration
+	UpstreamErrors     string
+	ErrorTemplate      string
+	SettingsFile       string
+	ErrorTemplateType  string
+	NegotiateErrors    bool
+
+	ForwardBody      bool
+	ForwardBodyTypes string
+	CacheMethods     string
+	NoCacheCookies   string
+	ForwardHeaders   bool
+	HopByHopHeaders  string
+	HeaderCase       string
+	StripSetCookie   bool
+	NoCacheRetry     bool
+
+	MaxForwardedHeaders     int
+	MaxForwardedHeaderBytes int
+
+	TargetHeaders         string
+	TargetHeadersOverride bool
+	Fallbacks             string
+
+	UpstreamTimeout    time.Duration
+	MaxUpstreamTimeout time.Duration
+	TimeoutDecay       float64
+	MinUpstreamTimeout time.Duration
+	CacheTTL           time.Duration
+	MaxCacheTTL        time.Duration
+	StaleIfError       time.Duration
+	CDNCacheStatus     bool
+	CacheHitsHeader    bool
+	CacheTierHeader    bool
+	IdempotencyWindow  time.Duration
+	PreferCache        time.Duration
+	MaxStaleAge        time.Duration
+
+	StripParams     string
+	StrictURLParam  bool
+	RootPath        bool
+	LenientEncoding bool
+	AllowedPorts    string
+
+	NegativeDNSTTL      time.Duration
+	MaxDecompressedSize int64
+	DecompressTypes     string
+	UpstreamGzip        bool
+	MaxResponseSize     int
+	PooledBufferMax     int
+
+	BatchTimeout time.Duration
+	BatchMaxURLs int
+
+	CacheTTLSizeBuckets string
+	CacheTTLRoutes      string
+	CacheTTLHosts       string
+
+	RateLimitTTLFactor float64
+	RateLimitTTLMax    time.Duration
+	RateLimitTTLWindow time.Duration
+
+	CacheImport string
+
+	CacheDedupe            bool
+	NormalizeTrim          bool
+	NormalizeBOM           bool
+	NormalizeCharset       string
+	NormalizeBlankFields   string
+	NormalizeCacheOnly     bool
+	HashCacheKeys          bool
+	CacheKeyHeaders        string
+	LogCacheKeys           bool
+	LogRedactParams        string
+	CacheHitRatioAlarm     float64
+	CacheHitRatioWindow    time.Duration
+	CacheCompressThreshold int
+	CacheMaxPerHost        int
+
+	RemoteCache                 string
+	RemoteCacheAPIKey           string
+	RemoteCacheTimeout          time.Duration
+	RemoteCacheFailMode         string
+	RemoteCacheBreakerThreshold int
+	RemoteCacheBreakerOpen      time.Duration
+
+	Quotas         string
+	QuotaKeyHeader string
+	QuotaClients   string
+	QuotaFile      string
+
+	StatsFile     string
+	StatsInterval time.Duration
+
+	TLSCert       string
+	TLSKey        string
+	TLSMinVersion string
+	TLSCiphers    string
+
+	Addr          string
+	SocketMode    string
+	ReadTimeout   time.Duration
+	IdleTimeout   time.Duration
+	ShutdownGrace time.Duration
+	DrainGrace    time.Duration
+	SlowThreshold time.Duration
+	ServerTiming  bool
+	Debug         bool
+	Transparent   bool
+	Merge         bool
+	MergeKey      string
+	MergeServers  int
+	ForceMethod   string
+
+	SelfTest         string
+	SelfTestInstance string
+}
+
+var config Config
+
+func (c *Config) adminKey() string {
+	c.apiKeyMu.RLock()
+	defer c.apiKeyMu.RUnlock()
+	return c.APIKey
+}
+
+func (c *Config) setAdminKey(key string) {
+	c.apiKeyMu.Lock()
+	defer c.apiKeyMu.Unlock()
+	c.APIKey = key
+}
+
+func parseFlags() {
+	flag.StringVar(&config.APIKey, "api-key", "", "key required by admin endpoints in the X-API-Key header (admin endpoints are disabled when empty)")
+	flag.IntVar(&config.MaxConcurrency, "max-concurrency", 0, "maximum number of requests served upstream at once (0 = unlimited)")
+	flag.StringVar(&config.PriorityHeader, "priority-header", "X-Priority", "request header that marks a request as high priority when set to \"high\"")
+	flag.IntVar(&config.MaxInflightAttempts, "max-inflight-attempts", 0, "maximum upstream attempts in flight across all requests (0 = unlimited)")
+	flag.DurationVar(&config.InflightWait, "inflight-wait", 100*time.Millisecond, "how long an attempt waits for a free slot under -max-inflight-attempts before failing")
+	flag.IntVar(&config.TargetConcurrency, "target-concurrency", 0, "maximum requests in flight to any one target host across all clients; others get 429 (0 = unlimited)")
+	flag.DurationVar(&config.TargetConcurrencyWait, "target-concurrency-wait", 100*time.Millisecond, "how long a request waits for a free slot under -target-concurrency before getting 429")
+	flag.IntVar(&config.RetryBudget, "retry-budget", 0, "size of the token bucket that every retry on another server draws from (0 = unlimited retries)")
+	flag.Float64Var(&config.RetryBudgetRatio, "retry-budget-ratio", 0.2, "tokens added to -retry-budget for each successful request")
+	flag.DurationVar(&config.RotationBudget, "rotation-budget", 0, "stop trying further servers once this long has passed since a request's first attempt; retries are cut off at it too (0 = no limit)")
+	flag.Float64Var(&config.GlobalBreakerThreshold, "global-breaker-threshold", 0, "shed load with 503s when this share of all upstream attempts within -global-breaker-window fails, e.g. 0.5 (0 = off)")
+	flag.DurationVar(&config.GlobalBreakerWindow, "global-breaker-window", time.Minute, "rolling window for -global-breaker-threshold")
+	flag.DurationVar(&config.GlobalBreakerOpen, "global-breaker-open", 10*time.Second, "how long the global circuit sheds every request once it trips")
+	flag.DurationVar(&config.GlobalBreakerRamp, "global-breaker-ramp", 30*time.Second, "how long traffic takes to ramp back up after -global-breaker-open")
+	flag.IntVar(&config.TransientRetries, "transient-retries", 0, "retries on the same server after a connection reset or another temporary network error, before rotating")
+	flag.DurationVar(&config.TransientRetryBackoff, "transient-retry-backoff", 50*time.Millisecond, "wait before the first -transient-retries retry, doubled for each further one")
+	flag.BoolVar(&config.DedupeServers, "dedupe-servers", true, "ignore repeated server URLs in the servers file, with a warning; false keeps them, giving a repeated server a bigger share of the rotation")
+	flag.BoolVar(&config.Failover, "failover", false, "try the servers in the order of the servers file for every request instead of rotating through them")
+	flag.StringVar(&config.FailoverTags, "failover-tags", "", "comma-separated tags; requests selecting one of them with tags= use the fixed failover order")
+	flag.StringVar(&config.PoolRoutes, "pool-routes", "", "ordered comma-separated target host[/path] globs with the server pool they use, first match wins, e.g. \"api.a.com=a,*.b.com/v2/*=b\"; other targets use servers without a Pool")
+	flag.StringVar(&config.AffinityCookie, "affinity-cookie", "", "name of a signed cookie that keeps each client on the server that first answered it, while that server is available (default off)")
+	flag.StringVar(&config.AffinitySecret, "affinity-secret", "", "HMAC key signing the -affinity-cookie; required with it")
+	flag.DurationVar(&config.Cooldown, "cooldown", 0, "how long a rate-limited server is skipped (0 = no cooldown)")
+	flag.IntVar(&config.ExhaustionStatus, "exhaustion-status", 429, "status returned when every server a request tried was rate limited")
+	flag.IntVar(&config.BreakerThreshold, "breaker-threshold", 0, "consecutive failures that open a server's circuit breaker (0 = disabled)")
+	flag.DurationVar(&config.BreakerOpenDuration, "breaker-open", 30*time.Second, "how long an open breaker waits before letting a probe request through")
+	flag.IntVar(&config.SingleServerRetries, "single-server-retries", 0, "when a request can only use one server, always try it regardless of cooldown and breaker, retrying it this many times after a rate limit (0 = fail fast as with several servers)")
+	flag.DurationVar(&config.SingleServerDelay, "single-server-retry-delay", time.Second, "wait between -single-server-retries attempts")
+	flag.IntVar(&config.EscalateAfter, "escalate-after", 0, "after this many requests in a row for a target host failed on every server, send its attempts to -escalate-fanout servers at once until one succeeds (0 = disabled)")
+	flag.IntVar(&config.EscalateFanout, "escalate-fanout", 2, "number of servers an attempt for an escalated target goes to at once")
+	flag.DurationVar(&config.HealthInterval, "health-interval", 0, "how often to actively check every server (0 = no active checks)")
+	flag.DurationVar(&config.HealthTimeout, "health-timeout", 5*time.Second, "timeout for a single health check")
+	flag.StringVar(&config.HealthPath, "health-path", "", "path requested on every server by the health checks, such as /health, which must answer below 400 (empty = TCP connect only); a server's HealthPath overrides it")
+	flag.DurationVar(&config.HealthStagger, "health-stagger", 0, "spread the health checks of a round over this long, each server at its own fixed offset (at most -health-interval; 0 = all at once)")
+	flag.IntVar(&config.HealthConcurrency, "health-concurrency", 0, "maximum health checks running at the same time (0 = unlimited)")
+	flag.StringVar(&config.Webhook, "webhook", "", "URL that gets a JSON event POSTed whenever a server enters cooldown, its breaker opens or closes or a health check or canary flips")
+	flag.IntVar(&config.WebhookQueue, "webhook-queue", 100, "events waiting for -webhook delivery before new ones are dropped")
+	flag.DurationVar(&config.WebhookTimeout, "webhook-timeout", 5*time.Second, "timeout for delivering one -webhook event")
+	flag.StringVar(&config.CanaryURL, "canary-url", "", "target URL fetched through each server on every health check; servers that fail it are not used")
+	flag.DurationVar(&config.CanaryMaxAge, "canary-max-age", 0, "how long a passed canary keeps a server eligible (default 2x -health-interval)")
+	flag.DurationVar(&config.PrewarmInterval, "prewarm-interval", 0, "at startup, send a warm-up request to each server this far apart; servers take traffic once warmed (0 = no pre-warm)")
+	flag.StringVar(&config.PrewarmOrder, "prewarm-order", "", "comma-separated server URLs to warm first, in order; the rest follow in file order")
+	flag.StringVar(&config.PrewarmURL, "prewarm-url", "", "target URL fetched through each server to warm it (default: request the server root)")
+	flag.DurationVar(&config.LatencySLA, "latency-sla", 0, "demote servers whose average response time stays above this (0 = disabled)")
+	flag.DurationVar(&config.LatencySLAWindow, "latency-sla-window", 30*time.Second, "how long a server must stay over -latency-sla before it is demoted")
+	flag.StringVar(&config.LogFormat, "log-format", "text", "format of the startup banner: text, or json for a single machine-readable line")
+	flag.StringVar(&config.AccessLogFormat, "access-log-format", "", "print an access log line per request: clf, combined or json (default none)")
+	flag.StringVar(&config.UpstreamErrors, "upstream-errors", "message", "how error responses of the servers reach the client: message (the body as the JSON error message), wrap (a JSON error with the body in upstream_body) or raw (the body and content type as they are)")
+	flag.StringVar(&config.SettingsFile, "settings-file", "", "JSON file whose api_key and cache_ttl override -api-key and -cache-ttl and are re-read on every reload")
+	flag.StringVar(&config.ErrorTemplate, "error-template", "", "file whose contents replace the JSON body of error responses; {code}, {error}, {message} and {request_id} are filled in")
+	flag.StringVar(&config.ErrorTemplateType, "error-template-type", "text/html; charset=utf-8", "content type of -error-template responses")
+	flag.BoolVar(&config.NegotiateErrors, "negotiate-errors", false, "send errors as plain text or HTML to clients whose Accept header prefers text/plain or text/html")
+	flag.StringVar(&config.JSONMode, "json-mode", "compatible", "JSON serializer for responses: compatible, fastest (floats rounded to 6 digits, no HTML escaping) or indented")
+	flag.StringVar(&config.ResponseMiddleware, "response-middleware", "envelope", "comma-separated response middlewares applied in order (available: envelope, location)")
+	flag.BoolVar(&config.FollowRedirects, "follow-redirects", true, "follow upstream redirects; when false, 3xx responses are passed through to the client")
+	flag.BoolVar(&config.CacheRedirects, "cache-redirects", false, "with -follow-redirects=false, cache redirects by their own Cache-Control; without one only 301 and 308 are cached")
+	flag.BoolVar(&config.NoRotate, "no-rotate", false, "send each request to the first available server only and return its result or error as-is (per request: X-No-Rotate)")
+	flag.StringVar(&config.SoftErrorPattern, "soft-error-pattern", "", "regexp that marks a 200 response body as a failed attempt; it is not cached and the next server is tried")
+	flag.IntVar(&config.IdenticalErrors, "identical-error-threshold", 0, "stop trying further servers once this many in a row returned the same -soft-error-pattern page (0 = try them all)")
+	flag.StringVar(&config.PendingPattern, "pending-pattern", "", "regexp that marks a 200 response body as pending, i.e. to be asked for again; it is not cached")
+	flag.StringVar(&config.PendingFields, "pending-fields", "", "comma-separated JSON path=value pairs that mark a 200 response body as pending, e.g. status=pending,job.state=queued")
+	flag.IntVar(&config.PendingRetries, "pending-retries", 3, "how many times a request is retried after pending responses before the last one is reported as 503")
+	flag.DurationVar(&config.PendingRetryDelay, "pending-retry-delay", 0, "retry a pending response on the same server after this long instead of on the next server right away (0 = next server)")
+	flag.BoolVar(&config.ForwardBody, "forward-body", false, "forward the client's method and request body to the servers")
+	flag.StringVar(&config.ForwardBodyTypes, "forward-body-types", "application/json,application/x-www-form-urlencoded,text/plain", "comma-separated request content types that may be forwarded with -forward-body (\"type/*\" matches a whole type); other bodies get 415")
+	flag.StringVar(&config.CacheMethods, "cache-methods", "GET,HEAD", "comma-separated request methods whose responses are cached with -forward-body; add e.g. POST for backends where it is safe to replay")
+	flag.StringVar(&config.NoCacheCookies, "no-cache-cookies", "", "comma-separated cookie names, e.g. session cookies, whose presence makes a request skip the cache for both lookup and storage (empty = disabled)")
+	flag.BoolVar(&config.ForwardHeaders, "forward-headers", false, "forward client request headers to the servers and upstream response headers back to the client")
+	flag.StringVar(&config.HopByHopHeaders, "hop-by-hop-headers", "", "comma-separated headers stripped in both directions in addition to the standard hop-by-hop headers")
+	flag.StringVar(&config.HeaderCase, "header-case", "", "comma-separated request header names sent to the servers with exactly this casing, e.g. X-API-KEY,x-client-id")
+	flag.BoolVar(&config.StripSetCookie, "strip-set-cookie", false, "drop Set-Cookie from forwarded upstream responses")
+	flag.IntVar(&config.MaxForwardedHeaders, "max-forwarded-headers", 100, "most upstream response headers forwarded with -forward-headers; the rest are dropped with a warning (0 = unlimited)")
+	flag.IntVar(&config.MaxForwardedHeaderBytes, "max-forwarded-header-bytes", 16384, "most bytes of upstream response headers forwarded with -forward-headers; the rest are dropped with a warning (0 = unlimited)")
+	flag.BoolVar(&config.NoCacheRetry, "no-cache-retry", false, "when every server fails with an error page, retry those servers once with Cache-Control: no-cache")
+	flag.StringVar(&config.TargetHeaders, "target-headers", "", "JSON file mapping target hosts to extra request headers, e.g. {\"api.example.com\": {\"Referer\": \"https://example.com/\"}}")
+	flag.BoolVar(&config.TargetHeadersOverride, "target-headers-override", false, "let -target-headers replace headers forwarded from the client")
+	flag.StringVar(&config.Fallbacks, "fallbacks", "", "JSON file of fallback responses by target host pattern, served when every server was rate limited, e.g. [{\"Host\": \"*.example.com\", \"Body\": \"[]\"}]")
+	flag.DurationVar(&config.UpstreamTimeout, "upstream-timeout", 0, "timeout for each upstream attempt (0 = none)")
+	flag.DurationVar(&config.MaxUpstreamTimeout, "max-upstream-timeout", time.Minute, "upper bound for a per-request timeout override")
+	flag.Float64Var(&config.TimeoutDecay, "timeout-decay", 1, "multiply the upstream timeout by this for every further server tried, so later, likelier slow servers get less time (1 = same timeout for all)")
+	flag.DurationVar(&config.MinUpstreamTimeout, "min-upstream-timeout", time.Second, "lower bound for timeouts shortened by -timeout-decay")
+	flag.DurationVar(&config.CacheTTL, "cache-ttl", time.Minute, "default cache lifetime of a response (0 = caching off entirely)")
+	flag.DurationVar(&config.MaxCacheTTL, "max-cache-ttl", time.Hour, "upper bound for a per-request cache TTL override")
+	flag.BoolVar(&config.StrictURLParam, "strict-url-param", false, "reject requests with more than one url parameter instead of using the first")
+	flag.BoolVar(&config.LenientEncoding, "lenient-encoding", false, "treat a % in the target that does not start a valid escape as a literal %25 instead of rejecting the request")
+	flag.StringVar(&config.AllowedPorts, "allowed-ports", "80,443", "comma-separated ports targets may use, with http and https implying 80 and 443; others get 403 (empty = any port)")
+	flag.BoolVar(&config.RootPath, "root-path", false, "add the path \"/\" to target URLs that have none, e.g. https://example.com?q=1 becomes https://example.com/?q=1")
+	flag.StringVar(&config.StripParams, "strip-params", "", "comma-separated query parameters removed from target URLs before fetching and caching; globs allowed, e.g. \"utm_*,fbclid,gclid\"")
+	flag.BoolVar(&config.CacheHitsHeader, "cache-hits-header", false, "add an X-Cache-Hits header with how often the entry has been served to responses from the cache")
+	flag.BoolVar(&config.CDNCacheStatus, "cdn-cache-status", false, "add a CDN-Cache-Status header (HIT, MISS, STALE or REVALIDATED) to cacheable responses")
+	flag.BoolVar(&config.CacheTierHeader, "cache-tier-header", false, "add an X-Cache-Tier header (memory or peer) naming the cache tier that served a cached response")
+	flag.DurationVar(&config.StaleIfError, "stale-if-error", 0, "when the servers fail, serve a cache entry that expired up to this long ago with a Warning header (0 = disabled)")
+	flag.DurationVar(&config.PreferCache, "prefer-cache", 0, "serve cache entries that expired up to this long ago right away and refresh them in the background (0 = disabled)")
+	flag.DurationVar(&config.MaxStaleAge, "max-stale-age", 0, "never serve a stale cache entry stored longer ago than this, whatever -stale-if-error or -prefer-cache allow (0 = no cap)")
+	flag.DurationVar(&config.IdempotencyWindow, "idempotency-window", 0, "how long a response is replayed to requests repeating its Idempotency-Key header, for any method (0 = header ignored)")
+	flag.DurationVar(&config.NegativeDNSTTL, "negative-dns-ttl", 0, "resolve target hosts before proxying and cache lookup results for this long (0 = disabled)")
+	flag.Int64Var(&config.MaxDecompressedSize, "max-decompressed-size", 32<<20, "maximum size in bytes of a gzip upstream body after decompression")
+	flag.BoolVar(&config.UpstreamGzip, "upstream-gzip", false, "send Accept-Encoding: gzip to the servers for cacheable requests to save bandwidth")
+	flag.StringVar(&config.DecompressTypes, "decompress-types", "text/*,application/json", "content types of gzip upstream bodies that are decompressed; others are passed to the client still compressed")
+	flag.IntVar(&config.MaxResponseSize, "max-response-size", 0, "maximum size in bytes of an upstream body as received, with or without Content-Length (0 = unlimited)")
+	flag.IntVar(&config.PooledBufferMax, "pooled-buffer-max", 1<<20, "largest body buffer in bytes kept for reuse after a request (0 = no pooling)")
+	flag.DurationVar(&config.BatchTimeout, "batch-timeout", 10*time.Second, "overall deadline for a /batch request; unfinished URLs are reported as timed out")
+	flag.IntVar(&config.BatchMaxURLs, "batch-max-urls", 50, "maximum number of URLs in a single /batch request")
+	flag.StringVar(&config.CacheTTLRoutes, "cache-ttl-routes", "", "ordered comma-separated target path globs with their cache TTL, first match wins, e.g. \"/static/*=1h,/api/*=30s\"")
+	flag.StringVar(&config.CacheTTLHosts, "cache-ttl-hosts", "", "ordered comma-separated target host globs with their cache TTL, used when no -cache-ttl-routes rule matches, e.g. \"cdn.example.com=1h\"")
+	flag.Float64Var(&config.RateLimitTTLFactor, "rate-limit-ttl-factor", 0, "multiply the cache TTL of targets whose host has been rate limited within -rate-limit-ttl-window by this factor (0 = off)")
+	flag.DurationVar(&config.RateLimitTTLMax, "rate-limit-ttl-max", time.Hour, "upper bound for a TTL extended by -rate-limit-ttl-factor")
+	flag.DurationVar(&config.RateLimitTTLWindow, "rate-limit-ttl-window", 5*time.Minute, "how long after the last rate limit a target keeps the extended TTL")
+	flag.StringVar(&config.CacheTTLSizeBuckets, "cache-ttl-size-buckets", "", "scale the cache TTL by body size, e.g. \"10240:2,1048576:5\" (bytes:multiplier, capped at -max-cache-ttl)")
+	flag.StringVar(&config.CacheImport, "cache-import", "", "load cache entries exported by /cache/export from this file before serving")
+	flag.BoolVar(&config.HashCacheKeys, "hash-cache-keys", false, "key cache entries by a 64-bit hash of the cache key; the key itself is kept to detect collisions")
+	flag.StringVar(&config.CacheKeyHeaders, "cache-key-headers", "", "comma-separated request headers whose values are part of the cache key, e.g. \"Authorization,Accept-Language\"")
+	flag.BoolVar(&config.LogCacheKeys, "log-cache-keys", false, "log the cache key of every request and the parts it was built from, to debug unexpected cache misses")
+	flag.StringVar(&config.LogRedactParams, "log-redact-params", "api_key,apikey,key,token,access_token,auth,password,secret,signature,sig", "comma-separated target query parameters whose values -log-cache-keys masks")
+	flag.Float64Var(&config.CacheHitRatioAlarm, "cache-hit-ratio-alarm", 0, "warn, flag it in /stats and notify -webhook when the cache hit ratio over -cache-hit-ratio-window drops below this (0 = off)")
+	flag.DurationVar(&config.CacheHitRatioWindow, "cache-hit-ratio-window", 5*time.Minute, "rolling window for -cache-hit-ratio-alarm")
+	flag.BoolVar(&config.CacheDedupe, "cache-dedupe", false, "store identical response bodies once, keyed by their SHA-256")
+	flag.BoolVar(&config.NormalizeTrim, "normalize-trim", false, "trim leading and trailing whitespace from response bodies before caching")
+	flag.BoolVar(&config.NormalizeBOM, "normalize-bom", false, "strip a leading UTF-8 byte order mark from text response bodies before caching and returning them")
+	flag.StringVar(&config.NormalizeCharset, "normalize-charset", "", "transcode text responses in this charset (iso-8859-1 or windows-1252) to UTF-8 before caching and returning them")
+	flag.StringVar(&config.NormalizeBlankFields, "normalize-blank-fields", "", "comma-separated dotted JSON field paths set to null before caching, e.g. \"meta.generated_at,request_id\"")
+	flag.BoolVar(&config.NormalizeCacheOnly, "normalize-cache-only", false, "only normalize the cached copy; the response fetched for a request is returned unchanged")
+	flag.IntVar(&config.CacheCompressThreshold, "cache-compress-threshold", 0, "gzip cached bodies of at least this many bytes (0 = never)")
+	flag.IntVar(&config.CacheMaxPerHost, "cache-max-per-host", 0, "keep at most this many cache entries per target host, evicting its least recently used ones (0 = unlimited)")
+	flag.StringVar(&config.RemoteCache, "remote-cache", "", "base URL of another proxy instance used as a shared cache behind the in-memory one")
+	flag.StringVar(&config.RemoteCacheAPIKey, "remote-cache-api-key", "", "X-API-Key sent to the -remote-cache instance")
+	flag.DurationVar(&config.RemoteCacheTimeout, "remote-cache-timeout", 200*time.Millisecond, "timeout for a single remote cache lookup or store")
+	flag.StringVar(&config.RemoteCacheFailMode, "remote-cache-fail-mode", "open", "when the remote cache is failing: open (treat as a miss) or closed (reject with 503)")
+	flag.IntVar(&config.RemoteCacheBreakerThreshold, "remote-cache-breaker-threshold", 3, "consecutive remote cache failures that open its breaker")
+	flag.DurationVar(&config.RemoteCacheBreakerOpen, "remote-cache-breaker-open", 10*time.Second, "how long the remote cache breaker stays open before a probe")
+	flag.StringVar(&config.Quotas, "quotas", "", "per-client request quotas as period:limit pairs, e.g. \"1h:1000,24h:10000\" (empty = no quotas)")
+	flag.StringVar(&config.QuotaKeyHeader, "quota-key-header", "X-Client-Key", "request header carrying a -quota-clients key; requests without a known key are counted by IP")
+	flag.StringVar(&config.QuotaClients, "quota-clients", "", "JSON file of client names and their keys for -quota-key-header, e.g. {\"acme\": \"${ENV:ACME_KEY}\"} (empty = every client is counted by IP)")
+	flag.StringVar(&config.QuotaFile, "quota-file", "", "persist quota counters to this file across restarts")
+	flag.StringVar(&config.StatsFile, "stats-file", "", "write the /stats snapshot to this JSON file every -stats-interval")
+	flag.DurationVar(&config.StatsInterval, "stats-interval", time.Minute, "how often -stats-file is rewritten")
+	flag.StringVar(&config.TLSCert, "tls-cert", "", "certificate file; serve HTTPS instead of HTTP when set together with -tls-key")
+	flag.StringVar(&config.TLSKey, "tls-key", "", "private key file for -tls-cert")
+	flag.StringVar(&config.TLSMinVersion, "tls-min-version", "1.2", "minimum TLS version accepted by the HTTPS listener: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&config.TLSCiphers, "tls-ciphers", "", "comma-separated TLS 1.0-1.2 cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (default: Go's secure defaults)")
+	flag.StringVar(&config.Addr, "addr", ":9001", "address to listen on, or unix:/path/to/socket for a Unix domain socket")
+	flag.DurationVar(&config.ReadTimeout, "read-timeout", 30*time.Second, "how long a client may take to send a whole request (0 = unlimited)")
+	flag.DurationVar(&config.IdleTimeout, "idle-timeout", time.Minute, "how long an idle keep-alive connection is kept open waiting for the next request")
+	flag.StringVar(&config.SocketMode, "socket-mode", "0660", "permissions of the -addr Unix socket, in octal")
+	flag.DurationVar(&config.DrainGrace, "drain-grace", 30*time.Second, "how long a server removed by a reload keeps its state while its in-flight requests finish")
+	flag.DurationVar(&config.ShutdownGrace, "shutdown-grace", 10*time.Second, "how long to drain open connections on SIGINT/SIGTERM; a second signal exits immediately")
+	flag.DurationVar(&config.SlowThreshold, "slow-threshold", 0, "log requests that take longer than this, with per-attempt timings (0 = disabled)")
+	flag.StringVar(&config.ForceMethod, "force-method", "", "method used for every upstream request regardless of the client's, e.g. GET (a server's \"Method\" in the servers file takes precedence)")
+	flag.BoolVar(&config.Merge, "merge", false, "enable /merge, which fetches a JSON array from several servers and returns the items of all of them")
+	flag.StringVar(&config.MergeKey, "merge-key", "", "object field used to drop duplicate items in /merge (default: compare whole items)")
+	flag.IntVar(&config.MergeServers, "merge-servers", 0, "maximum number of servers /merge fetches from (0 = every eligible server)")
+	flag.BoolVar(&config.Transparent, "transparent", false, "forward the incoming path and query to the servers unchanged instead of reading a url parameter, load balancing over the pool")
+	flag.BoolVar(&config.Debug, "debug", false, "log debug details such as clients that disconnect before their response is written")
+	flag.BoolVar(&config.ServerTiming, "server-timing", false, "add a Server-Timing header with cache lookup, time to first byte, upstream and total durations")
+	flag.StringVar(&config.SelfTest, "selftest", "", "send one request for this target URL, print the result and exit")
+	flag.StringVar(&config.SelfTestInstance, "selftest-instance", "", "base URL of a running instance to send the self-test through (default: in-process)")
+	flag.Parse()
+
+	if config.HealthStagger > config.HealthInterval {
+		config.HealthStagger = config.HealthInterval
+	}
+	if config.CanaryMaxAge <= 0 {
+		config.CanaryMaxAge = 2 * config.HealthInterval
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// readStreamedBody buffers the body of a response from timedClient, whose
+// streamed bodies are not limited by the client, up to -max-response-size.
+func readStreamedBody(resp *fasthttp.Response) error {
+	stream := resp.BodyStream()
+	if stream == nil || config.MaxResponseSize <= 0 {
+		return nil
+	}
+
+	buf := acquireBodyBuffer()
+	defer releaseBodyBuffer(buf)
+	if _, err := buf.ReadFrom(io.LimitReader(stream, int64(config.MaxResponseSize)+1)); err != nil {
+		return err
+	}
+	if buf.Len() > config.MaxResponseSize {
+		resp.CloseBodyStream()
+		return fasthttp.ErrBodyTooLarge
+	}
+	resp.SetBody(buf.Bytes())
+	return nil
+}
+
+var errDecompressedTooLarge = errors.New("decompressed response exceeds the size limit")
+
+// decodeUpstreamBody returns the body of resp with a gzip Content-Encoding
+// removed when its content type is in -decompress-types. Other bodies keep
+// their encoding, which makeRequest then passes on to the client.
+func decodeUpstreamBody(resp *fasthttp.Response) ([]byte, error) {
+	if !bytes.EqualFold(resp.Header.ContentEncoding(), []byte("gzip")) {
+		return resp.Body(), nil
+	}
+	if !mediaTypeListed(string(resp.Header.ContentType()), config.DecompressTypes) {
+		return resp.Body(), nil
+	}
+
+	buf := acquireBodyBuffer()
+	defer releaseBodyBuffer(buf)
+	if err := gunzipLimited(buf, resp.Body()); err != nil {
+		return nil, err
+	}
+
+	// SetBody copies, so the result lives in resp and not in the pooled
+	// buffer.
+	resp.SetBody(buf.Bytes())
+	resp.Header.Del(fasthttp.HeaderContentEncoding)
+	return resp.Body(), nil
+}
+
+// gunzipLimited decompresses body into buf. Decompression stops at
+// -max-decompressed-size so a small gzip bomb cannot expand without bound in
+// memory.
+func gunzipLimited(buf *bytes.Buffer, body []byte) error {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	limit := config.MaxDecompressedSize
+	if _, err := buf.ReadFrom(io.LimitReader(r, limit+1)); err != nil {
+		return err
+	}
+	if int64(buf.Len()) > limit {
+		return errDecompressedTooLarge
+	}
+	return nil
+}
+
+// decodeForClient gunzips a body that was passed through compressed, for a
+// client that does not accept gzip. Cached entries are shared, so this is
+// decided per response.
+func decodeForClient(ctx *fasthttp.RequestCtx, resp *upstreamResponse) error {
+	encoded := false
+	for _, header := range resp.Headers {
+		if strings.EqualFold(header.Name, fasthttp.HeaderContentEncoding) && strings.EqualFold(header.Value, "gzip") {
+			encoded = true
+		}
+	}
+	if !encoded || ctx.Request.Header.HasAcceptEncoding("gzip") {
+		return nil
+	}
+
+	buf := acquireBodyBuffer()
+	defer releaseBodyBuffer(buf)
+	if err := gunzipLimited(buf, []byte(resp.Body)); err != nil {
+		return err
+	}
+	resp.Body = buf.String()
+	resp.Headers = withoutHeader(resp.Headers, fasthttp.HeaderContentEncoding)
+	return nil
+}
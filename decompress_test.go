@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func gzipped(t testing.TB, body string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(body))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipBomb(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		limit  int64
+		status int
+	}{
+		{"within the cap", 1000, 1 << 20, fasthttp.StatusOK},
+		{"exactly the cap", 1 << 20, 1 << 20, fasthttp.StatusOK},
+		{"bomb over the cap", 8 << 20, 1 << 20, fasthttp.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.MaxDecompressedSize = tt.limit
+			body := strings.Repeat("a", tt.size)
+			compressed := gzipped(t, body)
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				ctx.SetContentType("text/plain")
+				ctx.Response.Header.Set(fasthttp.HeaderContentEncoding, "gzip")
+				ctx.SetBody(compressed)
+			}))
+
+			resp := proxyGet(t, target("api.example.com/bomb"))
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %.200s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if tt.status == fasthttp.StatusOK {
+				if string(resp.Body()) != body || len(resp.Header.ContentEncoding()) != 0 {
+					t.Errorf("got %d bytes with Content-Encoding %q, want the %d decompressed bytes", len(resp.Body()), resp.Header.ContentEncoding(), tt.size)
+				}
+			} else if !strings.Contains(string(resp.Body()), "decompressed size limit") {
+				t.Errorf("body = %s", resp.Body())
+			}
+		})
+	}
+}
+
+func TestGunzipLimited(t *testing.T) {
+	setup(t)
+	config.MaxDecompressedSize = 1024
+	var buf bytes.Buffer
+	if err := gunzipLimited(&buf, gzipped(t, strings.Repeat("x", 1<<20))); err != errDecompressedTooLarge {
+		t.Errorf("error = %v, want errDecompressedTooLarge", err)
+	}
+	if buf.Len() > 1025 {
+		t.Errorf("decompressed %d bytes with a 1024 byte cap", buf.Len())
+	}
+}
+
+func TestBodyWithoutContentLength(t *testing.T) {
+	body := `{"data":"` + strings.Repeat("x", 10000) + `"}`
+	tests := []struct {
+		name    string
+		limit   int
+		timing  bool
+		status  int
+		flagged bool // answered with the size limit error
+	}{
+		{"no limit", 0, false, fasthttp.StatusOK, false},
+		{"under the limit", 20000, false, fasthttp.StatusOK, false},
+		{"exactly the limit", len(body), false, fasthttp.StatusOK, false},
+		{"over the limit", 5000, false, fasthttp.StatusBadGateway, true},
+		{"over the limit, streamed for -server-timing", 5000, true, fasthttp.StatusBadGateway, true},
+		{"under the limit, streamed for -server-timing", 20000, true, fasthttp.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.MaxResponseSize = tt.limit
+			upstreamClient.MaxResponseBodySize = tt.limit
+			config.ServerTiming = tt.timing
+			writeServers(t, rawBackend(t, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nConnection: close\r\n\r\n"+body))
+
+			resp := proxyGet(t, target("api.example.com/unsized"))
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %.100s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if tt.flagged {
+				if !strings.Contains(string(resp.Body()), "exceeds the size limit") {
+					t.Errorf("body = %.100s, want the size limit error", resp.Body())
+				}
+				if cacheEntryCount() != 0 {
+					t.Error("oversized response was cached")
+				}
+				return
+			}
+			if string(resp.Body()) != body {
+				t.Errorf("got %d bytes, want the full %d", len(resp.Body()), len(body))
+			}
+			if data, ok := cacheEntry(cacheKey("api.example.com/unsized")); !ok || data.Size != len(body) {
+				t.Errorf("cached size = %d, want %d", data.Size, len(body))
+			}
+		})
+	}
+}
+
+func TestDecompressTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		types       string // -decompress-types, default when empty
+		contentType string
+		acceptGzip  bool
+		decoded     bool
+	}{
+		{"json", "", "application/json", true, true},
+		{"text with charset", "", "text/html; charset=utf-8", true, true},
+		{"binary passed through", "", "application/octet-stream", true, false},
+		{"image passed through", "", "image/png", true, false},
+		{"binary for a client without gzip", "", "application/octet-stream", false, true},
+		{"configured type", "application/octet-stream", "application/octet-stream", true, true},
+		{"json not configured", "text/*", "application/json", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			if tt.types != "" {
+				config.DecompressTypes = tt.types
+			}
+			const body = "payload payload payload"
+			compressed := gzipped(t, body)
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				ctx.SetContentType(tt.contentType)
+				ctx.Response.Header.Set(fasthttp.HeaderContentEncoding, "gzip")
+				ctx.SetBody(compressed)
+			}))
+
+			var headers []string
+			if tt.acceptGzip {
+				headers = []string{fasthttp.HeaderAcceptEncoding, "gzip"}
+			}
+			// The second response comes from the cache.
+			for i := 0; i < 2; i++ {
+				resp := proxyGet(t, target("api.example.com/encoded"), headers...)
+				if resp.StatusCode() != fasthttp.StatusOK {
+					t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+				}
+				encoding := string(resp.Header.ContentEncoding())
+				if tt.decoded && (string(resp.Body()) != body || encoding != "") {
+					t.Errorf("response %d: Content-Encoding %q, body %q, want it decompressed", i, encoding, resp.Body())
+				}
+				if !tt.decoded && (!bytes.Equal(resp.Body(), compressed) || encoding != "gzip") {
+					t.Errorf("response %d: Content-Encoding %q, %d bytes, want the gzip body passed through", i, encoding, len(resp.Body()))
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamGzip(t *testing.T) {
+	tests := []struct {
+		name       string
+		flag       bool
+		method     string
+		query      string
+		clientGzip bool
+		advertised bool // whether the server is asked for gzip
+	}{
+		{"off", false, fasthttp.MethodGet, "", false, false},
+		{"cacheable request", true, fasthttp.MethodGet, "", false, true},
+		{"uncacheable request", true, fasthttp.MethodPost, "", false, false},
+		{"stream for a client without gzip", true, fasthttp.MethodGet, "&stream=1", false, false},
+		{"stream for a client with gzip", true, fasthttp.MethodGet, "&stream=1", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.UpstreamGzip = tt.flag
+			config.ForwardBody = true
+			const body = `{"items":["a","b","c"]}`
+			compressed := gzipped(t, body)
+			var acceptEncoding atomic.Value
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				acceptEncoding.Store(string(ctx.Request.Header.Peek(fasthttp.HeaderAcceptEncoding)))
+				ctx.SetContentType("application/json")
+				if ctx.Request.Header.HasAcceptEncoding("gzip") {
+					ctx.Response.Header.Set(fasthttp.HeaderContentEncoding, "gzip")
+					ctx.SetBody(compressed)
+					return
+				}
+				ctx.SetBodyString(body)
+			}))
+
+			var headers []string
+			if tt.clientGzip {
+				headers = []string{fasthttp.HeaderAcceptEncoding, "gzip"}
+			}
+			resp := proxyDo(t, tt.method, target("api.example.com/gzip")+tt.query, "", headers...)
+			if resp.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+			}
+			if advertised := acceptEncoding.Load() == "gzip"; advertised != tt.advertised {
+				t.Errorf("server got Accept-Encoding %q, want gzip: %v", acceptEncoding.Load(), tt.advertised)
+			}
+			got := resp.Body()
+			if len(resp.Header.ContentEncoding()) > 0 {
+				if !tt.clientGzip {
+					t.Errorf("client without gzip got Content-Encoding %q", resp.Header.ContentEncoding())
+				}
+				var err error
+				if got, err = resp.BodyGunzip(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(got) != body {
+				t.Errorf("body = %q, want %q", got, body)
+			}
+			if tt.advertised && tt.query == "" {
+				if cached, ok := cacheGet(cacheKey("api.example.com/gzip")); !ok || cached.Body != body {
+					t.Errorf("cached %q, %v, want the decompressed body", cached.Body, ok)
+				}
+			}
+		})
+	}
+}
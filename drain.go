@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// drainPollInterval is how often a draining server's in-flight count is
+// checked.
+const drainPollInterval = 100 * time.Millisecond
+
+// drainers tracks the goroutines started by drainServer.
+var drainers sync.WaitGroup
+
+// trackInFlight counts a request to server as in flight until the returned
+// function is called.
+func trackInFlight(server string) func() {
+	health.Lock()
+	healthFor(server).InFlight++
+	health.Unlock()
+
+	return func() {
+		health.Lock()
+		if h := healthFor(server); h.InFlight > 0 {
+			h.InFlight--
+		}
+		health.Unlock()
+	}
+}
+
+// drainRemovedServers starts draining the servers a reload dropped from the
+// servers file. Those it brought back were already let go by
+// readServerAddresses, see stopDraining.
+func drainRemovedServers(before []string, after []string) {
+	kept := make(map[string]bool, len(after))
+	for _, server := range after {
+		kept[server] = true
+	}
+	for _, server := range before {
+		if !kept[server] {
+			drainServer(server)
+		}
+	}
+}
+
+// stopDraining ends the drain of every listed server. The servers file is
+// read for every request, so a server put back into it is used again right
+// away rather than once the next reload notices.
+func stopDraining(servers []Server) {
+	health.Lock()
+	defer health.Unlock()
+	for _, server := range servers {
+		if h, ok := health.servers[server.URL]; ok && h.Draining {
+			h.Draining = false
+			fmt.Printf("Server %s is back in the servers file, no longer draining\n", server.URL)
+		}
+	}
+}
+
+// drainServer keeps a removed server out of every new selection while the
+// requests already sent to it finish. Once none are left, or -drain-grace
+// has passed, its health state is dropped. Requests still running then are
+// not cut off; they end on their own timeout.
+func drainServer(server string) {
+	health.Lock()
+	h := healthFor(server)
+	h.Draining = true
+	inFlight := h.InFlight
+	health.Unlock()
+
+	grace := config.DrainGrace
+	fmt.Printf("Server %s removed, draining %d in-flight requests for up to %s\n", server, inFlight, grace)
+	deadline := time.Now().Add(grace)
+	drainers.Add(1)
+	go func() {
+		defer drainers.Done()
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			health.Lock()
+			if !h.Draining || health.servers[server] != h {
+				health.Unlock()
+				return
+			}
+			inFlight := h.InFlight
+			expired := !time.Now().Before(deadline)
+			if inFlight == 0 || expired {
+				delete(health.servers, server)
+			}
+			health.Unlock()
+
+			switch {
+			case inFlight == 0:
+				fmt.Printf("Server %s drained\n", server)
+				return
+			case expired:
+				fmt.Printf("Drain grace of %s expired for %s with %d requests still in flight\n", grace, server, inFlight)
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// blockingBackend is namedBackend that holds every request until release is
+// closed.
+func blockingBackend(t *testing.T, release chan struct{}) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		<-release
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"server":"http://` + string(ctx.Host()) + `"}`)
+	})
+}
+
+func inFlight(server string) (int, bool) {
+	health.Lock()
+	defer health.Unlock()
+	h, ok := health.servers[server]
+	if !ok {
+		return 0, false
+	}
+	return h.InFlight, h.Draining
+}
+
+// removeServer holds a request on a blocking first server, then drops that
+// server from the servers file and reloads. It returns the server and a
+// channel with the held request's response.
+func removeServer(t *testing.T, release chan struct{}) (string, string, chan *fasthttp.Response) {
+	t.Helper()
+	removed, kept := blockingBackend(t, release), namedBackend(t)
+	writeServers(t, removed, kept)
+	if err := reloadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	held := make(chan *fasthttp.Response, 1)
+	go func() { held <- proxyGet(t, target("api.example.com/held")) }()
+	waitFor(t, "the request to reach the server", func() bool {
+		n, _ := inFlight(removed)
+		return n == 1
+	})
+
+	writeServers(t, kept)
+	if err := reloadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+	return removed, kept, held
+}
+
+func TestDrainRemovedServer(t *testing.T) {
+	setup(t)
+	t.Cleanup(drainers.Wait)
+	release := make(chan struct{})
+	var removed, kept string
+	var held chan *fasthttp.Response
+	output := captureOutput(t, func() {
+		removed, kept, held = removeServer(t, release)
+		if n, draining := inFlight(removed); n != 1 || !draining {
+			t.Errorf("removed server: in flight = %d, draining = %v, want 1 and true", n, draining)
+		}
+		if server := servedBy(t, proxyGet(t, target("api.example.com/new"))); server != kept {
+			t.Errorf("new request served by %s, want %s", server, kept)
+		}
+
+		close(release)
+		resp := <-held
+		if resp.StatusCode() != fasthttp.StatusOK || servedBy(t, resp) != removed {
+			t.Errorf("request in flight during the removal = %d %s, want it finished by %s", resp.StatusCode(), resp.Body(), removed)
+		}
+		drainers.Wait()
+	})
+	if _, ok := inFlight(removed); ok {
+		t.Error("health state of the drained server kept")
+	}
+	for _, line := range []string{"Server " + removed + " removed, draining 1 in-flight requests", "Server " + removed + " drained"} {
+		if !strings.Contains(output, line) {
+			t.Errorf("output does not contain %q:\n%s", line, output)
+		}
+	}
+}
+
+func TestDrainGraceExpires(t *testing.T) {
+	setup(t)
+	t.Cleanup(drainers.Wait)
+	config.DrainGrace = 150 * time.Millisecond
+	release := make(chan struct{})
+	var removed string
+	var held chan *fasthttp.Response
+	output := captureOutput(t, func() {
+		removed, _, held = removeServer(t, release)
+		drainers.Wait()
+	})
+	if !strings.Contains(output, "Drain grace of 150ms expired for "+removed+" with 1 requests still in flight") {
+		t.Errorf("output = %q", output)
+	}
+	if _, ok := inFlight(removed); ok {
+		t.Error("health state kept after the grace expired")
+	}
+
+	// The request is not cut off.
+	close(release)
+	if resp := <-held; resp.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("request outliving the grace = %d %s, want it finished", resp.StatusCode(), resp.Body())
+	}
+}
+
+func TestDrainStopsWhenListedAgain(t *testing.T) {
+	setup(t)
+	t.Cleanup(drainers.Wait)
+	release := make(chan struct{})
+	var removed string
+	var held chan *fasthttp.Response
+	output := captureOutput(t, func() {
+		removed, _, held = removeServer(t, release)
+		writeServers(t, removed)
+		close(release)
+		proxyGet(t, target("api.example.com/listed-again"))
+		<-held
+		drainers.Wait()
+	})
+	if _, draining := inFlight(removed); draining {
+		t.Error("server listed again is still draining")
+	}
+	if !strings.Contains(output, "Server "+removed+" is back in the servers file, no longer draining") {
+		t.Errorf("output = %q", output)
+	}
+	if strings.Contains(output, "Server "+removed+" drained") {
+		t.Error("server listed again was drained")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/valyala/fasthttp"
+)
+
+type echoOptions struct {
+	Timeout  string `json:"timeout,omitempty"`
+	CacheTTL string `json:"cache_ttl,omitempty"`
+	NoCache  bool   `json:"no_cache,omitempty"`
+	Server   string `json:"server,omitempty"`
+}
+
+type echoResponse struct {
+	RawQuery         string      `json:"raw_query"`
+	ProxyParams      url.Values  `json:"proxy_params,omitempty"`
+	URLParam         string      `json:"url_param"`
+	DecodedURL       string      `json:"decoded_url"`
+	DecodeError      string      `json:"decode_error,omitempty"`
+	UpstreamEndpoint string      `json:"upstream_endpoint,omitempty"`
+	Tags             []string    `json:"tags,omitempty"`
+	Options          echoOptions `json:"options"`
+	OptionsError     string      `json:"options_error,omitempty"`
+	Candidates       []string    `json:"candidates"`
+	NoCandidates     string      `json:"no_candidates_reason,omitempty"`
+	CacheKey         string      `json:"cache_key,omitempty"`
+	Cached           bool        `json:"cached"`
+}
+
+// handleEcho serves /echo and debug=echo: it runs the same parsing as a proxied
+// request and reports each step as JSON, without contacting any server.
+func handleEcho(ctx *fasthttp.RequestCtx) {
+	if !authorizeAdmin(ctx) {
+		return
+	}
+	rawQuery := string(ctx.QueryArgs().QueryString())
+	rest, params := splitProxyParams(rawQuery)
+	params.Del("debug")
+	param, _ := urlParam(rest)
+
+	echo := echoResponse{
+		RawQuery:   rawQuery,
+		URLParam:   param,
+		Tags:       requestTags(ctx),
+		Candidates: []string{},
+	}
+	if len(params) > 0 {
+		echo.ProxyParams = params
+	}
+
+	decodedURL, err := targetURL(ctx)
+	echo.DecodedURL = decodedURL
+	if err != nil {
+		echo.DecodeError = err.Error()
+	} else if decodedURL == "" {
+		echo.DecodeError = "missing URL parameter"
+	}
+
+	opts, err := parseRequestOptions(ctx)
+	if err != nil {
+		echo.OptionsError = err.Error()
+	}
+
+	if echo.DecodeError == "" {
+		echo.UpstreamEndpoint = Server{}.endpoint(decodedURL)
+		// The cache key is the one handleRequests would use, method, body
+		// and Idempotency-Key included.
+		outbound, err := newUpstreamRequest(ctx, decodedURL, opts)
+		if err != nil {
+			echo.DecodeError = err.Error()
+		} else if key, idempotent, err := proxyCacheKey(ctx, decodedURL, outbound); err != nil {
+			echo.DecodeError = err.Error()
+		} else {
+			echo.CacheKey = key
+			if !opts.NoCache && (idempotent || outbound.cacheable()) {
+				_, echo.Cached = cacheEntry(key)
+			}
+		}
+	}
+	echo.Options = echoOptions{NoCache: opts.NoCache, Server: opts.Server}
+	if opts.Timeout > 0 {
+		echo.Options.Timeout = opts.Timeout.String()
+	}
+	if opts.CacheTTL > 0 {
+		echo.Options.CacheTTL = opts.CacheTTL.String()
+	}
+
+	servers, err := readServerAddresses(serversFile)
+	if err != nil {
+		echo.NoCandidates = err.Error()
+	} else {
+		var eligible []Server
+		eligible, echo.NoCandidates = eligibleServers(servers, echo.Tags, opts.Server)
+		for _, server := range eligible {
+			echo.Candidates = append(echo.Candidates, server.URL)
+		}
+	}
+
+	sendJSONResponse(ctx, echo, fasthttp.StatusOK)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestEcho(t *testing.T) {
+	tests := []struct {
+		name     string
+		uri      string
+		param    string
+		decoded  string
+		tags     []string
+		endpoint string
+	}{
+		{
+			name:     "unencoded query kept with the target",
+			uri:      "/echo?url=https://api.example.com/search?q=a+b&page=2&tags=fast",
+			param:    "https%3A%2F%2Fapi.example.com%2Fsearch%3Fq%3Da+b&page=2",
+			decoded:  "https://api.example.com/search?q=a b&page=2",
+			tags:     []string{"fast"},
+			endpoint: "/?url=https%3A%2F%2Fapi.example.com%2Fsearch%3Fq%3Da+b%26page%3D2",
+		},
+		{
+			name:     "encoded target through debug=echo",
+			uri:      "/?url=https%3A%2F%2Fapi.example.com%2Fa%20b%3Fx%3D%252F&debug=echo",
+			param:    "https%3A%2F%2Fapi.example.com%2Fa+b%3Fx%3D%252F",
+			decoded:  "https://api.example.com/a b?x=/",
+			endpoint: "/?url=https%3A%2F%2Fapi.example.com%2Fa+b%3Fx%3D%2F",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.setAdminKey("secret")
+			var requests atomic.Int64
+			server := countingBackend(t, `{}`, &requests)
+			writeFile(t, serversFile, `[{"url":"`+server+`","tags":["fast"]}]`)
+
+			resp := proxyGet(t, tt.uri, "X-API-Key", "secret")
+			if resp.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+			}
+			var echo echoResponse
+			if err := json.Unmarshal(resp.Body(), &echo); err != nil {
+				t.Fatal(err)
+			}
+			if echo.URLParam != tt.param || echo.DecodedURL != tt.decoded || echo.UpstreamEndpoint != tt.endpoint {
+				t.Errorf("url_param = %q, decoded_url = %q, upstream_endpoint = %q\nwant %q, %q, %q", echo.URLParam, echo.DecodedURL, echo.UpstreamEndpoint, tt.param, tt.decoded, tt.endpoint)
+			}
+			if echo.DecodeError != "" || echo.CacheKey != tt.decoded || echo.Cached {
+				t.Errorf("decode_error = %q, cache_key = %q, cached = %v", echo.DecodeError, echo.CacheKey, echo.Cached)
+			}
+			if len(echo.Candidates) != 1 || echo.Candidates[0] != server {
+				t.Errorf("candidates = %v, want %s (%s)", echo.Candidates, server, echo.NoCandidates)
+			}
+			if len(echo.Tags) != len(tt.tags) || len(tt.tags) > 0 && echo.Tags[0] != tt.tags[0] {
+				t.Errorf("tags = %v, want %v", echo.Tags, tt.tags)
+			}
+			if requests.Load() != 0 {
+				t.Errorf("echo contacted the server %d times", requests.Load())
+			}
+		})
+	}
+}
+
+func TestEchoRequiresAdminKey(t *testing.T) {
+	setup(t)
+	config.setAdminKey("secret")
+	var requests atomic.Int64
+	writeServers(t, countingBackend(t, `{}`, &requests))
+
+	resp := proxyGet(t, "/echo?url=api.example.com/ping")
+	if resp.StatusCode() == fasthttp.StatusOK {
+		t.Errorf("echo without the admin key answered %s", resp.Body())
+	}
+	if requests.Load() != 0 {
+		t.Errorf("echo contacted the server %d times", requests.Load())
+	}
+}
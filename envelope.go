@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// responseEnvelope is the JSON wrapper returned instead of the raw body when a
+// request carries envelope=1. Binary bodies are base64-encoded so they survive
+// the trip through a JSON string.
+type responseEnvelope struct {
+	Status      int    `json:"status"`
+	Location    string `json:"location,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Body        string `json:"body"`
+}
+
+func newResponseEnvelope(resp upstreamResponse) responseEnvelope {
+	status := resp.StatusCode
+	if status == 0 {
+		status = 200
+	}
+
+	envelope := responseEnvelope{
+		Status:      status,
+		Location:    resp.Location,
+		ContentType: resp.ContentType,
+		Body:        resp.Body,
+	}
+
+	if !isTextContentType(resp.ContentType, resp.Body) {
+		envelope.Encoding = "base64"
+		envelope.Body = base64.StdEncoding.EncodeToString([]byte(resp.Body))
+	}
+
+	return envelope
+}
+
+func envelopeMiddleware(ctx *fasthttp.RequestCtx, resp *upstreamResponse) error {
+	if len(proxyQuery(ctx)["envelope"]) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(newResponseEnvelope(*resp))
+	if err != nil {
+		return err
+	}
+
+	resp.Body = string(body)
+	resp.ContentType = "application/json"
+	resp.StatusCode = 0
+	resp.Location = ""
+	return nil
+}
+
+// isTextContentType decides whether a body can be embedded in JSON as-is. An
+// empty content type falls back to sniffing the body.
+func isTextContentType(contentType string, body string) bool {
+	if contentType == "" {
+		contentType = http.DetectContentType([]byte(body))
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-www-form-urlencoded":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestEnvelopeBinaryRoundTrip(t *testing.T) {
+	binary := make([]byte, 256)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		encoding    string
+	}{
+		{"binary body", "application/octet-stream", string(binary), "base64"},
+		{"image", "image/png", "\x89PNG\r\n\x1a\n\x00\x00", "base64"},
+		{"json", "application/json; charset=utf-8", `{"a":1}`, ""},
+		{"vendor json", "application/vnd.api+json", `{"a":1}`, ""},
+		{"text", "text/plain", "hello", ""},
+		{"sniffed text", "", "hello", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				if tt.contentType != "" {
+					ctx.SetContentType(tt.contentType)
+				} else {
+					ctx.Response.Header.SetNoDefaultContentType(true)
+				}
+				ctx.SetBodyString(tt.body)
+			}))
+
+			resp := proxyGet(t, target("api.example.com/file")+"&envelope=1")
+			var envelope responseEnvelope
+			if err := json.Unmarshal(resp.Body(), &envelope); err != nil {
+				t.Fatalf("%q: %v", resp.Body(), err)
+			}
+			if envelope.Encoding != tt.encoding {
+				t.Errorf("encoding = %q, want %q", envelope.Encoding, tt.encoding)
+			}
+			body := envelope.Body
+			if envelope.Encoding == "base64" {
+				decoded, err := base64.StdEncoding.DecodeString(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(decoded)
+			}
+			if body != tt.body {
+				t.Errorf("body after the round trip = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
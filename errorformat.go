@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	errorFormatJSON  = "application/json"
+	errorFormatHTML  = "text/html"
+	errorFormatPlain = "text/plain"
+)
+
+// errorFormats are the formats an error can be sent in with
+// -negotiate-errors, in the order ties are broken.
+var errorFormats = []string{errorFormatJSON, errorFormatHTML, errorFormatPlain}
+
+// negotiateErrorFormat picks the error format the Accept header ranks
+// highest. Each format gets the quality of its most specific matching media
+// range; JSON wins ties, and also when nothing matches.
+func negotiateErrorFormat(accept string) string {
+	best, bestQuality := errorFormatJSON, 0.0
+	for _, format := range errorFormats {
+		if quality := acceptQuality(accept, format); quality > bestQuality {
+			best, bestQuality = format, quality
+		}
+	}
+	return best
+}
+
+func acceptQuality(accept string, mediaType string) float64 {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		accepted := strings.ToLower(strings.TrimSpace(params[0]))
+
+		matched := -1
+		switch accepted {
+		case mediaType:
+			matched = 2
+		case mainType + "/*":
+			matched = 1
+		case "*/*":
+			matched = 0
+		}
+		if matched <= specificity {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		quality, specificity = q, matched
+	}
+	return quality
+}
+
+// acceptsContentType reports whether the client's Accept header allows a
+// body of contentType; a missing header or content type allows anything.
+func acceptsContentType(ctx *fasthttp.RequestCtx, contentType string) bool {
+	accept := string(ctx.Request.Header.Peek(fasthttp.HeaderAccept))
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	return accept == "" || mediaType == "" || acceptQuality(accept, mediaType) > 0
+}
+
+// sendNegotiatedError sends a plain text or minimal HTML error when the
+// client's Accept header prefers one, and reports false when JSON should be
+// sent instead. The error code and any upstream body are included.
+func sendNegotiatedError(ctx *fasthttp.RequestCtx, errorResponse ErrorResponse) bool {
+	format := negotiateErrorFormat(string(ctx.Request.Header.Peek(fasthttp.HeaderAccept)))
+	statusCode := errorResponse.Code
+	title := fmt.Sprintf("%d %s", statusCode, fasthttp.StatusMessage(statusCode))
+	if errorResponse.Error != "" {
+		title += " (" + errorResponse.Error + ")"
+	}
+	switch format {
+	case errorFormatPlain:
+		ctx.Response.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		ctx.Response.SetStatusCode(statusCode)
+		fmt.Fprintf(ctx, "%s: %s\n", title, errorResponse.Message)
+		if errorResponse.UpstreamBody != "" {
+			fmt.Fprintf(ctx, "\n%s\n", errorResponse.UpstreamBody)
+		}
+	case errorFormatHTML:
+		ctx.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		ctx.Response.SetStatusCode(statusCode)
+		fmt.Fprintf(ctx, "<!DOCTYPE html>\n<html><head><title>%s</title></head><body><h1>%s</h1><p>%s</p>",
+			html.EscapeString(title), html.EscapeString(title), html.EscapeString(errorResponse.Message))
+		if errorResponse.UpstreamBody != "" {
+			fmt.Fprintf(ctx, "<pre>%s</pre>", html.EscapeString(errorResponse.UpstreamBody))
+		}
+		fmt.Fprint(ctx, "</body></html>\n")
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestNegotiateErrorFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", errorFormatJSON},
+		{"*/*", errorFormatJSON},
+		{"text/plain", errorFormatPlain},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", errorFormatHTML},
+		{"text/*", errorFormatHTML},
+		{"text/plain, application/json", errorFormatJSON},
+		{"application/json;q=0.5, text/plain;q=0.8", errorFormatPlain},
+		{"TEXT/PLAIN", errorFormatPlain},
+		{"text/*;q=0.9, text/html;q=0.1", errorFormatPlain},
+		{"image/png", errorFormatJSON},
+	}
+	for _, tt := range tests {
+		if got := negotiateErrorFormat(tt.accept); got != tt.want {
+			t.Errorf("negotiateErrorFormat(%q) = %s, want %s", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiatedErrors(t *testing.T) {
+	const message = "No eligible servers: all servers are excluded by X-Exclude-Servers"
+	tests := []struct {
+		name        string
+		negotiate   bool
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"json by default", true, "", "application/json", `{"message":"` + message + `","code":503,"error":"no_eligible_servers"}`},
+		{"any type", true, "*/*", "application/json", `{"message":"` + message + `","code":503,"error":"no_eligible_servers"}`},
+		{"plain text", true, "text/plain", "text/plain; charset=utf-8", "503 Service Unavailable (no_eligible_servers): " + message + "\n"},
+		{
+			"html", true, "text/html", "text/html; charset=utf-8",
+			"<!DOCTYPE html>\n<html><head><title>503 Service Unavailable (no_eligible_servers)</title></head><body><h1>503 Service Unavailable (no_eligible_servers)</h1><p>" + message + "</p></body></html>\n",
+		},
+		{"off", false, "text/plain", "application/json", `{"message":"` + message + `","code":503,"error":"no_eligible_servers"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.NegotiateErrors = tt.negotiate
+			server := jsonBackend(t, `{}`)
+			writeServers(t, server)
+
+			headers := []string{excludeServersHeader, server}
+			if tt.accept != "" {
+				headers = append(headers, fasthttp.HeaderAccept, tt.accept)
+			}
+			resp := proxyGet(t, target("api.example.com/negotiate"), headers...)
+			if resp.StatusCode() != fasthttp.StatusServiceUnavailable {
+				t.Errorf("status = %d, want 503", resp.StatusCode())
+			}
+			if ct := string(resp.Header.ContentType()); ct != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+			}
+			if string(resp.Body()) != tt.body {
+				t.Errorf("body = %q\nwant %q", resp.Body(), tt.body)
+			}
+		})
+	}
+}
+
+func TestNegotiatedUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"wrapped as plain text", "wrap", "text/plain", "text/plain; charset=utf-8", "404 Not Found (upstream_error): Upstream server returned status 404\n\n<b>gone</b>\n"},
+		{"raw body accepted", "raw", "text/html", "text/html", "<b>gone</b>"},
+		{"raw body ruled out", "raw", "application/json", "application/json", `{"message":"Upstream server returned status 404","code":404,"error":"upstream_error","upstream_body":"\u003cb\u003egone\u003c/b\u003e"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.NegotiateErrors = true
+			config.UpstreamErrors = tt.mode
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				ctx.SetStatusCode(fasthttp.StatusNotFound)
+				ctx.SetContentType("text/html")
+				ctx.SetBodyString("<b>gone</b>")
+			}))
+
+			resp := proxyGet(t, target("api.example.com/gone"), fasthttp.HeaderAccept, tt.accept)
+			if ct := string(resp.Header.ContentType()); ct != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+			}
+			if string(resp.Body()) != tt.body {
+				t.Errorf("body = %q\nwant %q", resp.Body(), tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"html"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+func loadErrorTemplate(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// sendTemplatedError answers with the -error-template body, its {code}, {error},
+// {message} and {request_id} placeholders filled in. Values are HTML- or
+// JSON-escaped when -error-template-type is one of those.
+func sendTemplatedError(ctx *fasthttp.RequestCtx, message string, errorCode string, statusCode int) {
+	id := currentRequestID(ctx)
+
+	contentType := strings.ToLower(config.ErrorTemplateType)
+	escape := func(s string) string { return s }
+	switch {
+	case strings.Contains(contentType, "html"):
+		escape = html.EscapeString
+	case strings.Contains(contentType, "json"):
+		escape = func(s string) string {
+			quoted, _ := json.Marshal(s)
+			return string(quoted[1 : len(quoted)-1])
+		}
+	}
+
+	body := strings.NewReplacer(
+		"{code}", strconv.Itoa(statusCode),
+		"{error}", escape(errorCode),
+		"{message}", escape(message),
+		"{request_id}", escape(id),
+	).Replace(loadedFiles().errorTemplate)
+
+	ctx.Response.Header.Set("Content-Type", config.ErrorTemplateType)
+	ctx.Response.SetStatusCode(statusCode)
+	ctx.WriteString(body)
+}
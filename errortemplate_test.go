@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestErrorTemplate(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		template    string
+		want        string // with {request_id} standing for the request's ID
+	}{
+		{
+			name:        "html",
+			contentType: "text/html; charset=utf-8",
+			template:    "<h1>Error {code}</h1><p>{message}</p><small>{request_id}</small>",
+			want:        "<h1>Error 404</h1><p>&lt;b&gt;&#34;gone&#34;&lt;/b&gt;</p><small>{request_id}</small>",
+		},
+		{
+			name:        "json",
+			contentType: "application/json",
+			template:    `{"status":{code},"detail":"{message}","id":"{request_id}"}`,
+			want:        `{"status":404,"detail":"\u003cb\u003e\"gone\"\u003c/b\u003e","id":"{request_id}"}`,
+		},
+		{
+			name:        "plain text",
+			contentType: "text/plain",
+			template:    "{code} {error}: {message}",
+			want:        `404 : <b>"gone"</b>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.ErrorTemplateType = tt.contentType
+			files.Store(&fileConfig{errorTemplate: tt.template})
+			writeServers(t, statusBackend(t, fasthttp.StatusNotFound, `<b>"gone"</b>`))
+
+			resp := proxyGet(t, target("api.example.com/gone"))
+			if resp.StatusCode() != fasthttp.StatusNotFound {
+				t.Errorf("status = %d, want 404", resp.StatusCode())
+			}
+			if ct := string(resp.Header.ContentType()); ct != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+			}
+			id := string(resp.Header.Peek(requestIDHeader))
+			if id == "" {
+				t.Fatal("response has no request ID")
+			}
+			if want := strings.ReplaceAll(tt.want, "{request_id}", id); string(resp.Body()) != want {
+				t.Errorf("body = %s\nwant %s", resp.Body(), want)
+			}
+		})
+	}
+}
+
+func TestErrorTemplateProxyErrors(t *testing.T) {
+	setup(t)
+	config.ErrorTemplateType = "text/plain"
+	files.Store(&fileConfig{errorTemplate: "{code} {error}"})
+	server := jsonBackend(t, `{}`)
+	writeServers(t, server)
+
+	resp := proxyGet(t, target("api.example.com/excluded"), excludeServersHeader, server)
+	if body := string(resp.Body()); resp.StatusCode() != fasthttp.StatusServiceUnavailable || body != "503 no_eligible_servers" {
+		t.Errorf("got %d %q, want the template for no_eligible_servers", resp.StatusCode(), body)
+	}
+}
+
+func TestLoadErrorTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "error.html")
+	writeFile(t, path, "<p>{message}</p>")
+	if template, err := loadErrorTemplate(path); err != nil || template != "<p>{message}</p>" {
+		t.Errorf("loadErrorTemplate = %q, %v", template, err)
+	}
+	if _, err := loadErrorTemplate(path + ".missing"); err == nil {
+		t.Error("a missing template loaded")
+	}
+}
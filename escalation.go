@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// escalations counts, by target host, the requests in a row that failed on
+// every server they tried. A host at -escalate-after or more is escalated:
+// its requests fan out to -escalate-fanout servers per attempt until one of
+// them succeeds again. Targets without a host, such as plain paths, are
+// never escalated.
+var escalations = struct {
+	sync.Mutex
+	failures map[string]int
+}{failures: make(map[string]int)}
+
+func targetEscalated(host string) bool {
+	if config.EscalateAfter <= 0 || host == "" {
+		return false
+	}
+	escalations.Lock()
+	defer escalations.Unlock()
+	return escalations.failures[host] >= config.EscalateAfter
+}
+
+// recordTargetOutcome counts a failed request towards escalating host, or on
+// success takes it back to sequential rotation.
+func recordTargetOutcome(host string, ok bool) {
+	if config.EscalateAfter <= 0 || host == "" {
+		return
+	}
+	escalations.Lock()
+	defer escalations.Unlock()
+	if ok {
+		if escalations.failures[host] >= config.EscalateAfter {
+			fmt.Printf("Target %s succeeded again, back to sequential rotation\n", host)
+		}
+		delete(escalations.failures, host)
+		return
+	}
+	escalations.failures[host]++
+	if escalations.failures[host] == config.EscalateAfter {
+		fmt.Printf("Target %s failed %d requests in a row, fanning out to %d servers per attempt\n", host, config.EscalateAfter, config.EscalateFanout)
+	}
+}
+
+type fanOutResult struct {
+	index    int
+	response upstreamResponse
+	err      error
+}
+
+// fanOutAttempt sends the attempt on servers[i] to up to -escalate-fanout
+// servers at once: servers[i] and the available servers after it, without
+// going past the remaining positions of the rotation pass. The caller has
+// already taken an attempt slot for servers[i]; the others take their own.
+//
+// The first success is returned with the index of the server that answered.
+// When all fail, the result of servers[i] is returned, so the rotation goes
+// on as after a single attempt. The health of every server but the one whose
+// result is returned is recorded here, including for the ones still running
+// after a success. skipped is the
+// number of positions after i that the rotation no longer needs to visit.
+func fanOutAttempt(servers []Server, i int, remaining int, decodedURL string, outbound upstreamRequest, primary upstreamRequest) (winner int, skipped int, response upstreamResponse, err error) {
+	indexes := []int{i}
+	for k := 1; k < remaining && len(indexes) < config.EscalateFanout; k++ {
+		skipped = k
+		j := (i + k) % len(servers)
+		if !serverAvailable(servers[j].URL) {
+			continue
+		}
+		if !acquireAttempt() {
+			releaseProbe(servers[j].URL)
+			continue
+		}
+		indexes = append(indexes, j)
+	}
+
+	results := make(chan fanOutResult, len(indexes))
+	for k, j := range indexes {
+		attempt := primary
+		if k > 0 {
+			attempt = outbound.forServer(servers[j])
+			attempt.RequestID = attemptID(primary.RequestID, k)
+			attempt.Timeout = primary.Timeout
+			fmt.Printf("Fan-out request %d: %s%s\n", j+1, servers[j].URL, servers[j].endpoint(decodedURL))
+		}
+		go func(j int, attempt upstreamRequest) {
+			start := time.Now()
+			response, err := requestWithTransientRetry(servers[j], servers[j].endpoint(decodedURL), attempt)
+			releaseAttempt()
+			if err == nil {
+				recordLatency(servers[j].URL, time.Since(start))
+			}
+			results <- fanOutResult{index: j, response: response, err: err}
+		}(j, attempt)
+	}
+
+	var failed []fanOutResult
+	var primaryResult fanOutResult
+	for received := 1; received <= len(indexes); received++ {
+		result := <-results
+		if result.err == nil {
+			// The winner is the result the rotation carries on with; every
+			// failure before it, the primary's included, is recorded here.
+			if primaryResult.err != nil {
+				failed = append(failed, primaryResult)
+			}
+			for _, f := range failed {
+				recordFanOutOutcome(servers[f.index], decodedURL, f.err)
+			}
+			go func(left int) {
+				for ; left > 0; left-- {
+					late := <-results
+					recordFanOutOutcome(servers[late.index], decodedURL, late.err)
+				}
+			}(len(indexes) - received)
+			return result.index, skipped, result.response, nil
+		}
+		if result.index == i {
+			primaryResult = result
+		} else {
+			failed = append(failed, result)
+		}
+	}
+	for _, f := range failed {
+		recordFanOutOutcome(servers[f.index], decodedURL, f.err)
+	}
+	return i, skipped, primaryResult.response, primaryResult.err
+}
+
+// recordFanOutOutcome records the health of a server whose fan-out result
+// was not the one the rotation carried on with.
+func recordFanOutOutcome(server Server, decodedURL string, err error) {
+	recordGlobalOutcome(err)
+	switch {
+	case err == nil:
+		recordSuccess(server.URL)
+	case isRateLimitError(err):
+		recordRateLimit(server.URL)
+		recordTargetRateLimit(decodedURL)
+	case isPendingError(err):
+		recordSuccess(server.URL)
+	default:
+		recordFailure(server.URL)
+	}
+}
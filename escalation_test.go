@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRecordTargetOutcome(t *testing.T) {
+	tests := []struct {
+		name      string
+		after     int
+		outcomes  []bool
+		escalated bool
+	}{
+		{"disabled", 0, []bool{false, false, false}, false},
+		{"below the threshold", 3, []bool{false, false}, false},
+		{"at the threshold", 3, []bool{false, false, false}, true},
+		{"past the threshold", 3, []bool{false, false, false, false}, true},
+		{"success in between", 3, []bool{false, false, true, false, false}, false},
+		{"success after escalating", 2, []bool{false, false, false, true}, false},
+		{"failing again", 2, []bool{false, false, true, false, false}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.EscalateAfter = tt.after
+			for _, ok := range tt.outcomes {
+				recordTargetOutcome("api.example.com", ok)
+			}
+			if got := targetEscalated("api.example.com"); got != tt.escalated {
+				t.Errorf("escalated = %v, want %v", got, tt.escalated)
+			}
+			if targetEscalated("other.example.com") {
+				t.Error("another host escalated")
+			}
+			for _, ok := range tt.outcomes {
+				recordTargetOutcome("", ok)
+			}
+			if targetEscalated("") {
+				t.Error("a target without a host escalated")
+			}
+		})
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	setup(t)
+	config.EscalateAfter = 2
+	config.EscalateFanout = 2
+	var failing atomic.Bool
+	failing.Store(true)
+	var received sync.Map // servers asked, by target
+	handler := func(ctx *fasthttp.RequestCtx) {
+		count, _ := received.LoadOrStore(string(ctx.QueryArgs().Peek("url")), new(atomic.Int64))
+		count.(*atomic.Int64).Add(1)
+		if failing.Load() {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString(`{"error":"down"}`)
+			return
+		}
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"ok":true}`)
+	}
+	writeServers(t, newBackend(t, handler), newBackend(t, handler), newBackend(t, handler))
+
+	steps := []struct {
+		target  string
+		failing bool
+		servers int64
+	}{
+		{"https://flaky.example/0", true, 1},
+		{"FLAKY.example/1", true, 1},
+		// Escalated after two failed requests in a row.
+		{"https://flaky.example/2", true, 2},
+		{"https://other.example/0", true, 1},
+		{"https://flaky.example/3", false, 2},
+		// Back to one server once a request got through.
+		{"https://flaky.example/4", false, 1},
+		{"/plain/0", true, 1},
+		{"/plain/1", true, 1},
+		{"/plain/2", true, 1},
+	}
+	for i, step := range steps {
+		failing.Store(step.failing)
+		resp := proxyGet(t, target(step.target))
+		if ok := resp.StatusCode() == fasthttp.StatusOK; ok == step.failing {
+			t.Fatalf("step %d: status = %d: %s", i, resp.StatusCode(), resp.Body())
+		}
+		asked := func() int64 {
+			count, ok := received.Load(step.target)
+			if !ok {
+				return 0
+			}
+			return count.(*atomic.Int64).Load()
+		}
+		waitFor(t, fmt.Sprintf("step %d to reach %d servers", i, step.servers), func() bool { return asked() >= step.servers })
+		if got := asked(); got != step.servers {
+			t.Errorf("step %d: %s went to %d servers, want %d", i, step.target, got, step.servers)
+		}
+	}
+}
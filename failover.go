@@ -0,0 +1,39 @@
+package main
+
+import "strings"
+
+// failoverMode reports whether a request goes down the fixed failover chain
+// instead of rotating: always with -failover, and with -failover-tags for
+// requests selecting one of those tags.
+func failoverMode(tags []string) bool {
+	if config.Failover {
+		return true
+	}
+	for _, tag := range tags {
+		for _, failoverTag := range strings.Split(config.FailoverTags, ",") {
+			if tag == strings.TrimSpace(failoverTag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// failoverOrder returns eligible in the order of configured, the servers
+// file, so that the chain is always tried from its first server down and
+// latency demotion does not reorder it.
+func failoverOrder(eligible []Server, configured []Server) []Server {
+	available := make(map[string]bool, len(eligible))
+	for _, server := range eligible {
+		available[server.URL] = true
+	}
+
+	ordered := make([]Server, 0, len(eligible))
+	for _, server := range configured {
+		if available[server.URL] {
+			ordered = append(ordered, server)
+			delete(available, server.URL)
+		}
+	}
+	return ordered
+}
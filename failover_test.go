@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// switchableBackend is a namedBackend answering with the status in status,
+// counting its requests.
+func switchableBackend(t *testing.T, status *atomic.Int64, count *atomic.Int64) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		count.Add(1)
+		ctx.SetStatusCode(int(status.Load()))
+		ctx.SetContentType("application/json")
+		fmt.Fprintf(ctx, `{"server":"http://%s"}`, ctx.Host())
+	})
+}
+
+func TestFailoverChain(t *testing.T) {
+	setup(t)
+	config.Failover = true
+	var statuses, counts [3]atomic.Int64
+	var servers []string
+	for i := range statuses {
+		statuses[i].Store(fasthttp.StatusOK)
+		servers = append(servers, switchableBackend(t, &statuses[i], &counts[i]))
+	}
+	writeServers(t, servers...)
+
+	steps := []struct {
+		name     string
+		statuses [3]int64
+		status   int
+		attempts [3]int64 // per server
+	}{
+		{"first server serves", [3]int64{200, 200, 200}, 200, [3]int64{1, 0, 0}},
+		{"and keeps serving", [3]int64{200, 200, 200}, 200, [3]int64{1, 0, 0}},
+		{"rate limit moves down the chain", [3]int64{429, 200, 200}, 200, [3]int64{1, 1, 0}},
+		{"chain starts at the top again", [3]int64{200, 200, 200}, 200, [3]int64{1, 0, 0}},
+		{"last in the chain", [3]int64{429, 429, 200}, 200, [3]int64{1, 1, 1}},
+		{"target error ends the chain", [3]int64{404, 200, 200}, 404, [3]int64{1, 0, 0}},
+	}
+	for i, step := range steps {
+		var before [3]int64
+		for j := range statuses {
+			statuses[j].Store(step.statuses[j])
+			before[j] = counts[j].Load()
+		}
+		resp := proxyGet(t, target(fmt.Sprintf("api.example.com/failover/%d", i)))
+		if resp.StatusCode() != step.status {
+			t.Errorf("%s: status = %d, want %d", step.name, resp.StatusCode(), step.status)
+		}
+		for j := range counts {
+			if got := counts[j].Load() - before[j]; got != step.attempts[j] {
+				t.Errorf("%s: server %d got %d requests, want %d", step.name, j, got, step.attempts[j])
+			}
+		}
+	}
+	if index := serverIndex.Load(); index != 0 {
+		t.Errorf("serverIndex = %d, want the rotation left alone", index)
+	}
+}
+
+func TestFailoverTags(t *testing.T) {
+	setup(t)
+	config.FailoverTags = "backup, primary"
+	a, b := namedBackend(t), namedBackend(t)
+	writeFile(t, serversFile, fmt.Sprintf(`[{"url":%q,"tags":["primary"]},{"url":%q,"tags":["primary"]}]`, a, b))
+
+	for i := 0; i < 3; i++ {
+		if got := servedBy(t, proxyGet(t, target(fmt.Sprintf("api.example.com/tagged/%d", i))+"&tags=primary")); got != a {
+			t.Errorf("failover request %d went to %s, want %s", i, got, a)
+		}
+	}
+	first := servedBy(t, proxyGet(t, target("api.example.com/untagged/1")))
+	second := servedBy(t, proxyGet(t, target("api.example.com/untagged/2")))
+	if first == second {
+		t.Errorf("requests without a failover tag both went to %s, want rotation", first)
+	}
+}
+
+func TestFailoverOrder(t *testing.T) {
+	configured := []Server{{URL: "a"}, {URL: "b"}, {URL: "c"}, {URL: "d"}}
+	eligible := []Server{{URL: "d"}, {URL: "b"}, {URL: "a"}}
+	got := failoverOrder(eligible, configured)
+	if fmt.Sprint(got) != fmt.Sprint([]Server{{URL: "a"}, {URL: "b"}, {URL: "d"}}) {
+		t.Errorf("failoverOrder = %v, want a, b, d", got)
+	}
+}
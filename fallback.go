@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// fallbackResponse is the answer for targets whose host matches Host, a
+// path.Match pattern such as "*.example.com", once every server was rate
+// limited or CAPTCHA-walled for them.
+type fallbackResponse struct {
+	Host        string
+	Status      int
+	ContentType string
+	Body        string
+}
+
+// loadFallbacks reads the -fallbacks file, a JSON array tried in order.
+func loadFallbacks(filePath string) ([]fallbackResponse, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var fallbacks []fallbackResponse
+	if err := json.Unmarshal(data, &fallbacks); err != nil {
+		return nil, err
+	}
+	for i, fallback := range fallbacks {
+		if fallback.Host == "" {
+			return nil, fmt.Errorf("fallback %d has no Host", i+1)
+		}
+		if _, err := path.Match(fallback.Host, ""); err != nil {
+			return nil, fmt.Errorf("fallback %d has an invalid Host pattern %q", i+1, fallback.Host)
+		}
+		if fallback.Status == 0 {
+			fallbacks[i].Status = fasthttp.StatusOK
+		} else if fallback.Status < 200 || fallback.Status > 599 {
+			return nil, fmt.Errorf("fallback %d for %s has an invalid Status %d", i+1, fallback.Host, fallback.Status)
+		}
+		if fallback.ContentType == "" {
+			fallbacks[i].ContentType = "application/json"
+		}
+		fallbacks[i].Host = strings.ToLower(fallback.Host)
+	}
+	return fallbacks, nil
+}
+
+// serveFallback answers with the first fallback configured for the target's
+// host, and reports whether there was one. X-Fallback tells clients the body
+// is not from the target. A target without a host, such as a plain path,
+// does not match even a "*" pattern.
+func serveFallback(ctx *fasthttp.RequestCtx, decodedURL string) bool {
+	host := targetHostKey(decodedURL)
+	if host == "" {
+		return false
+	}
+	for _, fallback := range loadedFiles().fallbacks {
+		if matched, _ := path.Match(fallback.Host, host); !matched {
+			continue
+		}
+		fmt.Printf("Every server was rate limited for %s, serving the fallback for %s\n", decodedURL, fallback.Host)
+		ctx.Response.Header.Set("X-Fallback", "true")
+		ctx.SetContentType(fallback.ContentType)
+		ctx.SetStatusCode(fallback.Status)
+		ctx.SetBodyString(fallback.Body)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestLoadFallbacks(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []fallbackResponse
+		wantErr string
+	}{
+		{"defaults", `[{"Host":"a.example","Body":"[]"}]`, []fallbackResponse{{Host: "a.example", Status: fasthttp.StatusOK, ContentType: "application/json", Body: "[]"}}, ""},
+		{"set", `[{"Host":"*.Shop.Example","Status":503,"ContentType":"text/plain","Body":"later"}]`, []fallbackResponse{{Host: "*.shop.example", Status: 503, ContentType: "text/plain", Body: "later"}}, ""},
+		{"no host", `[{"Body":"[]"}]`, nil, "fallback 1 has no Host"},
+		{"bad pattern", `[{"Host":"a.example"},{"Host":"[a"}]`, nil, `fallback 2 has an invalid Host pattern "[a"`},
+		{"bad status", `[{"Host":"a.example","Status":99}]`, nil, "invalid Status 99"},
+		{"not an array", `{`, nil, "expect ["},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			writeFile(t, "fallbacks.json", tt.content)
+			got, err := loadFallbacks("fallbacks.json")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || len(got) != len(tt.want) || got[0] != tt.want[0] {
+				t.Errorf("loadFallbacks = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFallbacks(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		servers     []int // status each server answers with
+		cooling     bool  // every server is cooling down already
+		catchAll    bool  // a "*" fallback comes last
+		status      int
+		contentType string
+		fallback    bool
+	}{
+		{"rate limited", "https://blocked.example/a", []int{429, 429}, false, false, fasthttp.StatusOK, "application/json", true},
+		{"rate limited and CAPTCHA", "https://blocked.example/a", []int{429, 403}, false, false, fasthttp.StatusOK, "application/json", true},
+		{"pattern", "https://www.Shop.example/items", []int{429}, false, false, fasthttp.StatusServiceUnavailable, "text/plain", true},
+		{"first match wins", "https://blocked.shop.example/items", []int{429}, false, false, fasthttp.StatusServiceUnavailable, "text/plain", true},
+		{"all cooling down", "https://blocked.example/a", []int{200}, true, false, fasthttp.StatusOK, "application/json", true},
+		{"no fallback for the host", "https://other.example/a", []int{429}, false, false, fasthttp.StatusTooManyRequests, "", false},
+		{"not only rate limits", "https://blocked.example/a", []int{429, 500}, false, false, fasthttp.StatusInternalServerError, "", false},
+		{"target without a scheme", "Blocked.example/a", []int{429}, false, true, fasthttp.StatusOK, "application/json", true},
+		{"plain path", "/a", []int{429}, false, true, fasthttp.StatusTooManyRequests, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.Cooldown = time.Minute
+			config.Fallbacks = "fallbacks.json"
+			fallbacks := `{"Host": "*.shop.example", "Status": 503, "ContentType": "text/plain", "Body": "try again later"},
+				{"Host": "blocked.*", "Body": "{\"items\":[]}"}`
+			if tt.catchAll {
+				fallbacks += `, {"Host": "*", "Body": "{}"}`
+			}
+			writeFile(t, config.Fallbacks, "["+fallbacks+"]")
+			if err := reloadFileConfig(); err != nil {
+				t.Fatal(err)
+			}
+			var servers []string
+			for _, status := range tt.servers {
+				body := `{"error":"failed"}`
+				if status == fasthttp.StatusForbidden {
+					body = `{"error":"CAPTCHA required"}`
+				}
+				servers = append(servers, statusBackend(t, status, body))
+			}
+			writeServers(t, servers...)
+			if tt.cooling {
+				for _, server := range servers {
+					recordRateLimit(server)
+				}
+			}
+
+			resp := proxyGet(t, target(tt.target))
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if fallback := string(resp.Header.Peek("X-Fallback")) == "true"; fallback != tt.fallback {
+				t.Errorf("X-Fallback = %q, want the fallback %v: %s", resp.Header.Peek("X-Fallback"), tt.fallback, resp.Body())
+			}
+			if tt.fallback && string(resp.Header.ContentType()) != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", resp.Header.ContentType(), tt.contentType)
+			}
+			if _, cached := cacheGet(cacheKey(tt.target)); cached {
+				t.Error("fallback cached")
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// upstreamRequest is what gets sent to a server on each attempt. Method and
+// Body are only set when -forward-body is enabled, and Headers with
+// -forward-headers; otherwise every attempt is a plain GET.
+type upstreamRequest struct {
+	Method      string
+	ContentType string
+	Body        []byte
+	Headers     []headerField
+	Timeout     time.Duration
+	// RequestID is sent as X-Request-ID so servers can log which attempt
+	// of which request they served.
+	RequestID string
+	// AcceptGzip asks the server for a gzip body, see -upstream-gzip.
+	AcceptGzip bool
+	// HTTP2 sends the request with http2Client, see Server.HTTPVersion.
+	HTTP2 bool
+	// Private is set when the client sent one of the -no-cache-cookies, so
+	// the response is neither served from nor stored in the cache.
+	Private bool
+	// Idempotent is set when the client sent an Idempotency-Key, which
+	// makes the request safe to send again whatever its method.
+	Idempotent bool
+}
+
+var errUnsupportedBodyType = errors.New("Request body content type is not accepted")
+
+// newUpstreamRequest builds the outbound request for ctx. With -forward-body
+// the client's method is passed on, and so is its body as long as its content
+// type is in -forward-body-types. Headers configured for the target's host in
+// -target-headers are added. With -upstream-gzip cacheable requests ask for
+// a gzip body.
+func newUpstreamRequest(ctx *fasthttp.RequestCtx, decodedURL string, opts requestOptions) (upstreamRequest, error) {
+	outbound := upstreamRequest{
+		Timeout:    upstreamTimeout(opts),
+		AcceptGzip: config.UpstreamGzip,
+		Private:    hasNoCacheCookie(ctx),
+		Idempotent: len(ctx.Request.Header.Peek(idempotencyHeader)) > 0,
+	}
+	if config.ForwardHeaders {
+		outbound.Headers = outboundRequestHeaders(&ctx.Request.Header)
+	}
+	outbound.Headers = withTargetHeaders(outbound.Headers, targetHostKey(decodedURL))
+	if !config.ForwardBody {
+		return outbound, nil
+	}
+
+	outbound.Method = string(ctx.Method())
+	outbound.AcceptGzip = config.UpstreamGzip && outbound.cacheable()
+	body := ctx.PostBody()
+	if len(body) == 0 {
+		return outbound, nil
+	}
+
+	contentType := string(ctx.Request.Header.ContentType())
+	if !bodyTypeAllowed(contentType) {
+		return upstreamRequest{}, errUnsupportedBodyType
+	}
+	outbound.ContentType = contentType
+	outbound.Body = append([]byte(nil), body...)
+	return outbound, nil
+}
+
+// hasNoCacheCookie reports whether the request carries a cookie named in
+// -no-cache-cookies, such as a session cookie whose responses are per user.
+func hasNoCacheCookie(ctx *fasthttp.RequestCtx) bool {
+	if config.NoCacheCookies == "" {
+		return false
+	}
+	for _, name := range strings.Split(config.NoCacheCookies, ",") {
+		if name = strings.TrimSpace(name); name != "" && len(ctx.Request.Header.Cookie(name)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func bodyTypeAllowed(contentType string) bool {
+	return mediaTypeListed(contentType, config.ForwardBodyTypes)
+}
+
+// mediaTypeListed matches the media type of contentType, ignoring parameters
+// such as charset, against a comma-separated list such as
+// -forward-body-types. Entries may end in "/*".
+func mediaTypeListed(contentType string, list string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+
+	for _, allowed := range strings.Split(list, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "" {
+			continue
+		}
+		if allowed == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheable reports whether the response may be served from and stored in the
+// cache: the method must be in -cache-methods, GET and HEAD by default, since
+// a forwarded POST or PUT is usually not safe to replay, and the request must
+// not carry any of the -no-cache-cookies.
+func (r upstreamRequest) cacheable() bool {
+	if r.Private {
+		return false
+	}
+	method := r.Method
+	if method == "" {
+		method = fasthttp.MethodGet
+	}
+	for _, allowed := range strings.Split(config.CacheMethods, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), method) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheKey returns key for the request's method. GET keeps key as it is;
+// other methods get their own entries, and a body is hashed into the key so
+// POSTs with different bodies are not served each other's responses.
+func (r upstreamRequest) cacheKey(key string) string {
+	if r.Method == "" || r.Method == fasthttp.MethodGet {
+		return key
+	}
+	key = r.Method + " " + key
+	if len(r.Body) > 0 {
+		sum := sha256.New()
+		sum.Write([]byte(r.ContentType))
+		sum.Write([]byte{0})
+		sum.Write(r.Body)
+		key += " body:" + hex.EncodeToString(sum.Sum(nil))
+	}
+	return key
+}
+
+// retrySafe reports whether the request may be sent to the same server again
+// after a network error that may have happened after the server acted on it:
+// its method is idempotent, or the client sent an Idempotency-Key.
+func (r upstreamRequest) retrySafe() bool {
+	switch r.Method {
+	case "", fasthttp.MethodGet, fasthttp.MethodHead, fasthttp.MethodPut, fasthttp.MethodDelete:
+		return true
+	}
+	return r.Idempotent
+}
+
+// withCacheBypass returns a copy of r that asks the server, and any cache
+// between it and the target, for a fresh response.
+func (r upstreamRequest) withCacheBypass() upstreamRequest {
+	r.Headers = append(append([]headerField(nil), r.Headers...),
+		headerField{Name: "Cache-Control", Value: "no-cache"},
+		headerField{Name: "Pragma", Value: "no-cache"},
+	)
+	return r
+}
+
+// forServer returns the request as sent to server: its Method from the
+// servers file, else -force-method, replaces whatever method the client used.
+// Whether the response is cached still follows the client's method. Servers
+// with HTTPVersion "2" are sent the request over HTTP/2, and a server's own
+// Headers are added with their secrets filled in.
+func (r upstreamRequest) forServer(server Server) upstreamRequest {
+	switch {
+	case server.Method != "":
+		r.Method = strings.ToUpper(server.Method)
+	case config.ForceMethod != "":
+		r.Method = strings.ToUpper(config.ForceMethod)
+	}
+	r.HTTP2 = server.HTTPVersion == httpVersion2
+	if len(server.Headers) > 0 {
+		replaced := make(map[string]bool, len(server.Headers))
+		for name := range server.Headers {
+			replaced[textproto.CanonicalMIMEHeaderKey(name)] = true
+		}
+		headers := make([]headerField, 0, len(r.Headers)+len(server.Headers))
+		for _, header := range r.Headers {
+			if !replaced[textproto.CanonicalMIMEHeaderKey(header.Name)] {
+				headers = append(headers, header)
+			}
+		}
+		for name, value := range server.Headers {
+			headers = append(headers, headerField{Name: name, Value: expandSecrets(value)})
+		}
+		r.Headers = headers
+	}
+	return r
+}
+
+func (r upstreamRequest) apply(req *fasthttp.Request) {
+	if config.HeaderCase != "" {
+		req.Header.DisableNormalizing()
+	}
+	for _, header := range r.Headers {
+		req.Header.Add(headerNameCase(header.Name), header.Value)
+	}
+	if r.RequestID != "" {
+		req.Header.Set(headerNameCase(requestIDHeader), r.RequestID)
+	}
+	if r.AcceptGzip {
+		req.Header.Set(fasthttp.HeaderAcceptEncoding, "gzip")
+	}
+	if r.Method != "" {
+		req.Header.SetMethod(r.Method)
+	}
+	if len(r.Body) > 0 {
+		req.Header.SetContentType(r.ContentType)
+		req.SetBody(r.Body)
+	}
+	if r.Timeout > 0 {
+		req.SetTimeout(r.Timeout)
+	}
+}
+
+// headerNameCase returns name as it is sent to the servers. With -header-case
+// fasthttp's normalizing is off for the outgoing request, so listed names keep
+// their configured casing and every other name is canonicalized here instead.
+func headerNameCase(name string) string {
+	if config.HeaderCase == "" {
+		return name
+	}
+	for _, listed := range strings.Split(config.HeaderCase, ",") {
+		if listed = strings.TrimSpace(listed); strings.EqualFold(listed, name) {
+			return listed
+		}
+	}
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestForwardBodyTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		types       string
+		contentType string
+		status      int
+	}{
+		{"allowed", "application/json,text/plain", "application/json; charset=utf-8", fasthttp.StatusOK},
+		{"allowed by wildcard", "text/*", "text/csv", fasthttp.StatusOK},
+		{"disallowed", "application/json", "application/xml", fasthttp.StatusUnsupportedMediaType},
+		{"missing content type", "application/json", "", fasthttp.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.ForwardBody = true
+			config.ForwardBodyTypes = tt.types
+			var received []byte
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				received = append([]byte(nil), ctx.PostBody()...)
+				ctx.SetBodyString(`{}`)
+			}))
+
+			var headers []string
+			if tt.contentType != "" {
+				headers = []string{"Content-Type", tt.contentType}
+			}
+			resp := proxyDo(t, fasthttp.MethodPost, target("api.example.com/submit"), "payload", headers...)
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if tt.status == fasthttp.StatusOK && string(received) != "payload" {
+				t.Errorf("server received body %q", received)
+			}
+			if tt.status != fasthttp.StatusOK && received != nil {
+				t.Errorf("rejected body was forwarded: %q", received)
+			}
+		})
+	}
+}
+
+func TestMediaTypeListed(t *testing.T) {
+	tests := []struct {
+		contentType string
+		list        string
+		want        bool
+	}{
+		{"application/json", "application/json", true},
+		{"Application/JSON; charset=utf-8", "application/json", true},
+		{"text/html", "text/*", true},
+		{"textual/html", "text/*", false},
+		{"application/json", " text/plain , application/json ", true},
+		{"", "text/*", false},
+		{"image/png", "", false},
+	}
+	for _, tt := range tests {
+		if got := mediaTypeListed(tt.contentType, tt.list); got != tt.want {
+			t.Errorf("mediaTypeListed(%q, %q) = %v, want %v", tt.contentType, tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestForceMethod(t *testing.T) {
+	tests := []struct {
+		name         string
+		flag         string
+		serverMethod string
+		method       string
+		want         string
+		cached       bool // whether a repeat is answered from the cache
+	}{
+		{"passthrough", "", "", fasthttp.MethodPost, fasthttp.MethodPost, false},
+		{"forced GET for a POST", "get", "", fasthttp.MethodPost, fasthttp.MethodGet, false},
+		{"forced POST for a GET", "POST", "", fasthttp.MethodGet, fasthttp.MethodPost, true},
+		{"server method", "", "PUT", fasthttp.MethodGet, fasthttp.MethodPut, true},
+		{"server method wins over the flag", "GET", "put", fasthttp.MethodPost, fasthttp.MethodPut, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			// The client's method is only passed on with -forward-body.
+			config.ForwardBody = true
+			config.ForceMethod = tt.flag
+			var methods []string
+			server := newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				methods = append(methods, string(ctx.Method()))
+				ctx.SetContentType("application/json")
+				ctx.SetBodyString(`{}`)
+			})
+			writeFile(t, serversFile, `[{"url":"`+server+`","method":"`+tt.serverMethod+`"}]`)
+
+			for i := 0; i < 2; i++ {
+				if resp := proxyDo(t, tt.method, target("api.example.com/method"), ""); resp.StatusCode() != fasthttp.StatusOK {
+					t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+				}
+			}
+			if len(methods) == 0 || methods[0] != tt.want {
+				t.Errorf("server saw %v, want %s", methods, tt.want)
+			}
+			if cached := len(methods) == 1; cached != tt.cached {
+				t.Errorf("cached = %v, want %v (server saw %v)", cached, tt.cached, methods)
+			}
+		})
+	}
+}
+
+func TestCacheable(t *testing.T) {
+	setup(t)
+	tests := []struct {
+		methods string
+		method  string
+		want    bool
+	}{
+		{"GET,HEAD", "", true},
+		{"GET,HEAD", fasthttp.MethodGet, true},
+		{"GET,HEAD", fasthttp.MethodHead, true},
+		{"GET,HEAD", fasthttp.MethodPost, false},
+		{"GET,HEAD", fasthttp.MethodPut, false},
+		{"GET,HEAD", fasthttp.MethodPatch, false},
+		{"GET,HEAD", fasthttp.MethodDelete, false},
+		{"GET, head, post", fasthttp.MethodPost, true},
+		{"GET, head, post", fasthttp.MethodHead, true},
+		{"HEAD", "", false},
+		{"", fasthttp.MethodGet, false},
+	}
+	for _, tt := range tests {
+		config.CacheMethods = tt.methods
+		if got := (upstreamRequest{Method: tt.method}).cacheable(); got != tt.want {
+			t.Errorf("%q with -cache-methods %q: cacheable = %v, want %v", tt.method, tt.methods, got, tt.want)
+		}
+	}
+}
+
+func TestRequestCacheKey(t *testing.T) {
+	post := func(contentType, body string) upstreamRequest {
+		return upstreamRequest{Method: fasthttp.MethodPost, ContentType: contentType, Body: []byte(body)}
+	}
+	tests := []struct {
+		name string
+		a, b upstreamRequest
+		same bool
+	}{
+		{"GET and no method", upstreamRequest{}, upstreamRequest{Method: fasthttp.MethodGet}, true},
+		{"GET and HEAD", upstreamRequest{}, upstreamRequest{Method: fasthttp.MethodHead}, false},
+		{"GET and POST", upstreamRequest{}, upstreamRequest{Method: fasthttp.MethodPost}, false},
+		{"same body", post("application/json", `{"q":1}`), post("application/json", `{"q":1}`), true},
+		{"other body", post("application/json", `{"q":1}`), post("application/json", `{"q":2}`), false},
+		{"other content type", post("application/json", `q=1`), post("text/plain", `q=1`), false},
+		{"body and none", post("application/json", `{}`), post("application/json", ""), false},
+	}
+	for _, tt := range tests {
+		a, b := tt.a.cacheKey("https://api.example.com/q"), tt.b.cacheKey("https://api.example.com/q")
+		if (a == b) != tt.same {
+			t.Errorf("%s: keys %q and %q, want the same = %v", tt.name, a, b, tt.same)
+		}
+	}
+	if got := (upstreamRequest{}).cacheKey("https://api.example.com/q"); got != "https://api.example.com/q" {
+		t.Errorf("GET key = %q, want the target unchanged", got)
+	}
+}
+
+func TestCacheMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods string
+		method  string
+		cached  bool
+	}{
+		{"GET by default", "GET,HEAD", fasthttp.MethodGet, true},
+		{"POST not by default", "GET,HEAD", fasthttp.MethodPost, false},
+		{"DELETE not by default", "GET,HEAD", fasthttp.MethodDelete, false},
+		{"POST when enabled", "GET,HEAD,POST", fasthttp.MethodPost, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.ForwardBody = true
+			config.CacheMethods = tt.methods
+			var requests atomic.Int64
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				n := requests.Add(1)
+				ctx.SetContentType("application/json")
+				fmt.Fprintf(ctx, `{"method":%q,"body":%q,"n":%d}`, ctx.Method(), ctx.PostBody(), n)
+			}))
+
+			send := func(body string) string {
+				t.Helper()
+				resp := proxyDo(t, tt.method, target("api.example.com/search"), body, "Content-Type", "application/json")
+				if resp.StatusCode() != fasthttp.StatusOK {
+					t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+				}
+				return string(resp.Body())
+			}
+			first := send(`{"q":"a"}`)
+			if again := send(`{"q":"a"}`); (again == first) != tt.cached {
+				t.Errorf("repeated request = %s after %s, want cached %v", again, first, tt.cached)
+			}
+			want := int64(2)
+			if tt.cached {
+				want = 1
+			}
+			if got := requests.Load(); got != want {
+				t.Errorf("server requests = %d, want %d", got, want)
+			}
+			if tt.method == fasthttp.MethodGet || !tt.cached {
+				return
+			}
+
+			// A body of its own, or a GET of the same target, is not served
+			// the cached response.
+			if other := send(`{"q":"b"}`); other == first {
+				t.Errorf("request with another body got the first response %s", other)
+			}
+			if got := string(proxyGet(t, target("api.example.com/search")).Body()); got == first {
+				t.Errorf("GET got the %s response %s", tt.method, got)
+			}
+		})
+	}
+}
+
+func TestNoCacheCookies(t *testing.T) {
+	tests := []struct {
+		name    string
+		cookies string // -no-cache-cookies
+		cookie  string // Cookie header of the request
+		cached  bool
+	}{
+		{"off", "", "session=abc", true},
+		{"no cookie", "session,auth", "", true},
+		{"other cookie", "session,auth", "theme=dark", true},
+		{"listed cookie", "session,auth", "session=abc", false},
+		{"listed among others", " session , auth ", "theme=dark; auth=xyz", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.NoCacheCookies = tt.cookies
+			config.StaleIfError = time.Hour
+			var failing atomic.Bool
+			var requests atomic.Int64
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				n := requests.Add(1)
+				if failing.Load() {
+					ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+					return
+				}
+				ctx.SetContentType("application/json")
+				fmt.Fprintf(ctx, `{"n":%d}`, n)
+			}))
+			var headers []string
+			if tt.cookie != "" {
+				headers = []string{"Cookie", tt.cookie}
+			}
+			now := time.Now()
+			cacheStore(cacheKey("api.example.com/shared"), upstreamResponse{Body: `{"shared":true}`, ContentType: "application/json"}, now, now.Add(time.Minute))
+
+			// Lookup: the shared entry.
+			if served := string(proxyGet(t, target("api.example.com/shared"), headers...).Body()) == `{"shared":true}`; served != tt.cached {
+				t.Errorf("served the cached entry = %v, want %v", served, tt.cached)
+			}
+			// Storage: a fresh response.
+			proxyGet(t, target("api.example.com/mine"), headers...)
+			if _, stored := cacheGet(cacheKey("api.example.com/mine")); stored != tt.cached {
+				t.Errorf("stored the response = %v, want %v", stored, tt.cached)
+			}
+			// Stale entries.
+			cacheStore(cacheKey("api.example.com/stale"), upstreamResponse{Body: `{"stale":true}`, ContentType: "application/json"}, now.Add(-time.Hour), now.Add(-time.Minute))
+			failing.Store(true)
+			if served := string(proxyGet(t, target("api.example.com/stale"), headers...).Body()) == `{"stale":true}`; served != tt.cached {
+				t.Errorf("served the stale entry = %v, want %v", served, tt.cached)
+			}
+		})
+	}
+}
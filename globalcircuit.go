@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// globalCircuitMinAttempts keeps a few failures in a quiet window from
+	// tripping the circuit.
+	globalCircuitMinAttempts = 20
+	// globalCircuitMinAdmit is the share of requests let through right
+	// after the circuit starts to recover.
+	globalCircuitMinAdmit = 0.1
+)
+
+// globalCircuit sheds load for every server at once when too many upstream
+// attempts fail, on top of the per-server breakers in health.go. Open, every
+// request that needs a server fails fast; half-open, a growing share of them
+// is let through over -global-breaker-ramp.
+var globalCircuit = struct {
+	sync.Mutex
+	window    rollingCounts
+	state     breakerState
+	changedAt time.Time
+	errorRate float64
+	attempts  int
+}{}
+
+// recordGlobalOutcome counts an upstream attempt and opens the circuit once
+// the error rate over -global-breaker-window reaches
+// -global-breaker-threshold. Only network errors and 5xx responses count as
+// failures: a 4xx or a pending response means the server got through to the
+// target, and rate limits are the rotation's business, so they are left out.
+func recordGlobalOutcome(err error) {
+	if config.GlobalBreakerThreshold <= 0 || err != nil && isRateLimitError(err) {
+		return
+	}
+	ok := err == nil || isPendingError(err)
+	if !ok {
+		statusCode, _ := parseHTTPError(err)
+		ok = statusCode < 500
+	}
+
+	globalCircuit.Lock()
+	defer globalCircuit.Unlock()
+
+	now := time.Now()
+	oks, attempts := globalCircuit.window.add(now, config.GlobalBreakerWindow, ok)
+	failures := attempts - oks
+	globalCircuit.errorRate = float64(failures) / float64(attempts)
+	globalCircuit.attempts = attempts
+	if attempts < globalCircuitMinAttempts || globalCircuit.errorRate < config.GlobalBreakerThreshold || globalCircuit.state == breakerOpen {
+		return
+	}
+
+	reason := fmt.Sprintf("error rate %.2f over %d attempts reached %.2f", globalCircuit.errorRate, attempts, config.GlobalBreakerThreshold)
+	fmt.Printf("[WARN] Global circuit open for %s: %s\n", config.GlobalBreakerOpen, reason)
+	emitServerEvent("", "global_circuit", globalCircuit.state.String(), breakerOpen.String(), reason)
+	globalCircuit.state = breakerOpen
+	globalCircuit.changedAt = now
+	// Recovery is judged on the attempts made after the circuit opened.
+	globalCircuit.window.reset()
+}
+
+// admitGlobalCircuit reports whether a request may go upstream, or how long
+// the client should wait before retrying when it may not.
+func admitGlobalCircuit() (bool, time.Duration) {
+	if config.GlobalBreakerThreshold <= 0 {
+		return true, 0
+	}
+
+	globalCircuit.Lock()
+	defer globalCircuit.Unlock()
+
+	now := time.Now()
+	if globalCircuit.state == breakerOpen {
+		if remaining := config.GlobalBreakerOpen - now.Sub(globalCircuit.changedAt); remaining > 0 {
+			return false, remaining
+		}
+		fmt.Printf("Global circuit half-open, ramping traffic back up over %s\n", config.GlobalBreakerRamp)
+		emitServerEvent("", "global_circuit", breakerOpen.String(), breakerHalfOpen.String(), "")
+		globalCircuit.state = breakerHalfOpen
+		globalCircuit.changedAt = now
+	}
+	if globalCircuit.state == breakerHalfOpen {
+		progress := float64(now.Sub(globalCircuit.changedAt)) / float64(config.GlobalBreakerRamp)
+		if progress < 1 {
+			return rand.Float64() < max(progress, globalCircuitMinAdmit), time.Second
+		}
+		fmt.Println("Global circuit closed")
+		emitServerEvent("", "global_circuit", breakerHalfOpen.String(), breakerClosed.String(), "")
+		globalCircuit.state = breakerClosed
+		globalCircuit.changedAt = now
+	}
+	return true, 0
+}
+
+type globalCircuitSnapshot struct {
+	State     string  `json:"state"`
+	ErrorRate float64 `json:"error_rate"`
+	Attempts  int     `json:"attempts"`
+}
+
+func globalCircuitStats() *globalCircuitSnapshot {
+	if config.GlobalBreakerThreshold <= 0 {
+		return nil
+	}
+
+	globalCircuit.Lock()
+	defer globalCircuit.Unlock()
+	return &globalCircuitSnapshot{State: globalCircuit.state.String(), ErrorRate: globalCircuit.errorRate, Attempts: globalCircuit.attempts}
+}
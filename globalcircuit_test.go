@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestGlobalCircuitOutcomes(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+		failed   bool
+	}{
+		{"success", nil, 1, false},
+		{"server error", &HTTPError{Code: fasthttp.StatusBadGateway, Body: "bad gateway"}, 1, true},
+		{"network error", errors.New("Unexpected error: connection reset"), 1, true},
+		{"client error", &HTTPError{Code: fasthttp.StatusNotFound, Body: "not found"}, 1, false},
+		{"pending", &retryableError{Code: fasthttp.StatusAccepted, Pending: true}, 1, false},
+		{"rate limited", fmt.Errorf("Ratelimit or CAPTCHA error: Unexpected status code: 429"), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.GlobalBreakerThreshold = 0.5
+			recordGlobalOutcome(tt.err)
+			snapshot := globalCircuitStats()
+			if snapshot.Attempts != tt.attempts {
+				t.Errorf("attempts = %d, want %d", snapshot.Attempts, tt.attempts)
+			}
+			if failed := snapshot.ErrorRate > 0; failed != tt.failed {
+				t.Errorf("error rate = %.2f, want a failure: %v", snapshot.ErrorRate, tt.failed)
+			}
+		})
+	}
+}
+
+// globalCircuitState returns the global circuit state reported by /stats.
+func globalCircuitState(t *testing.T) string {
+	t.Helper()
+	var snapshot statsSnapshot
+	if err := json.Unmarshal(proxyGet(t, "/stats").Body(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Upstream.GlobalCircuit == nil {
+		t.Fatal("/stats has no global_circuit")
+	}
+	return snapshot.Upstream.GlobalCircuit.State
+}
+
+func TestGlobalCircuit(t *testing.T) {
+	setup(t)
+	config.GlobalBreakerThreshold = 0.5
+	config.GlobalBreakerOpen = 100 * time.Millisecond
+	config.GlobalBreakerRamp = 100 * time.Millisecond
+	var failing atomic.Bool
+	var requests atomic.Int64
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		requests.Add(1)
+		if failing.Load() {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			return
+		}
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{}`)
+	}))
+	proxyGet(t, target("api.example.com/cached"))
+
+	failing.Store(true)
+	captureOutput(t, func() {
+		for i := 0; i < globalCircuitMinAttempts; i++ {
+			proxyGet(t, target(fmt.Sprintf("api.example.com/failing/%d", i)))
+		}
+	})
+	if state := globalCircuitState(t); state != "open" {
+		t.Fatalf("state after %d failures = %s, want open", globalCircuitMinAttempts, state)
+	}
+
+	sent := requests.Load()
+	resp := proxyGet(t, target("api.example.com/shed"))
+	if resp.StatusCode() != fasthttp.StatusServiceUnavailable || !strings.Contains(string(resp.Body()), "load_shedding") {
+		t.Errorf("while open: %d %s, want 503 load_shedding", resp.StatusCode(), resp.Body())
+	}
+	if len(resp.Header.Peek("Retry-After")) == 0 {
+		t.Error("shed request has no Retry-After")
+	}
+	if resp := proxyGet(t, target("api.example.com/cached")); resp.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("cache hit while open: status = %d, want it served", resp.StatusCode())
+	}
+	if requests.Load() != sent {
+		t.Errorf("%d requests reached the server while the circuit was open", requests.Load()-sent)
+	}
+
+	// The servers recover; after -global-breaker-open the circuit lets a
+	// share of requests through, and all of them after the ramp.
+	failing.Store(false)
+	time.Sleep(config.GlobalBreakerOpen)
+	proxyGet(t, target("api.example.com/half-open"))
+	if state := globalCircuitState(t); state != "half-open" {
+		t.Errorf("state after -global-breaker-open = %s, want half-open", state)
+	}
+	time.Sleep(config.GlobalBreakerRamp)
+	if resp := proxyGet(t, target("api.example.com/recovered")); resp.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("after the ramp: status = %d, want 200: %s", resp.StatusCode(), resp.Body())
+	}
+	if state := globalCircuitState(t); state != "closed" {
+		t.Errorf("state after the ramp = %s, want closed", state)
+	}
+}
+
+func TestGlobalCircuitRamp(t *testing.T) {
+	setup(t)
+	config.GlobalBreakerThreshold = 0.5
+	config.GlobalBreakerRamp = time.Minute
+	globalCircuit.Lock()
+	globalCircuit.state, globalCircuit.changedAt = breakerHalfOpen, time.Now()
+	globalCircuit.Unlock()
+
+	// Right after the circuit starts recovering about one in ten requests
+	// is let through.
+	admitted := 0
+	for i := 0; i < 1000; i++ {
+		if ok, _ := admitGlobalCircuit(); ok {
+			admitted++
+		}
+	}
+	if admitted < 50 || admitted > 200 {
+		t.Errorf("admitted %d of 1000 at the start of the ramp, want about 100", admitted)
+	}
+}
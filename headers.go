@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+type headerField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// standardHopByHopHeaders only apply to a single connection and are never
+// forwarded, in either direction (RFC 9110 section 7.6.1).
+var standardHopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// requestSkipHeaders are client headers that are set by the proxy itself on
+// the outbound request, or that only mean something to the proxy.
+var requestSkipHeaders = []string{
+	"Host",
+	"Content-Length",
+	"Content-Type",
+	"Accept-Encoding",
+	"X-API-Key",
+}
+
+// responseSkipHeaders are upstream headers that writeUpstreamResponse and the
+// server set themselves. The body is stored decoded, so its original length
+// and encoding no longer apply.
+var responseSkipHeaders = []string{
+	"Content-Length",
+	"Content-Type",
+	"Content-Encoding",
+	"Location",
+	"Server",
+	"Date",
+}
+
+type headerVisitor interface {
+	VisitAll(f func(key, value []byte))
+}
+
+// forwardableHeaders returns the headers of h that may be copied to the other
+// side of the proxy: everything except hop-by-hop headers (the standard set,
+// -hop-by-hop-headers and any listed in Connection) and the given skip list.
+func forwardableHeaders(h headerVisitor, skip []string) []headerField {
+	var fields []headerField
+	h.VisitAll(func(key, value []byte) {
+		fields = append(fields, headerField{Name: string(key), Value: string(value)})
+	})
+	return stripHopByHop(fields, skip)
+}
+
+// capForwardedHeaders keeps the headers from server up to
+// -max-forwarded-headers in number and -max-forwarded-header-bytes in size,
+// counted as they are written, and drops the rest with a warning. A server
+// sending a flood of headers then cannot blow up every response it answers.
+func capForwardedHeaders(fields []headerField, server string) []headerField {
+	size := 0
+	for i, field := range fields {
+		size += len(field.Name) + len(field.Value) + len(": \r\n")
+		if (config.MaxForwardedHeaders > 0 && i >= config.MaxForwardedHeaders) ||
+			(config.MaxForwardedHeaderBytes > 0 && size > config.MaxForwardedHeaderBytes) {
+			fmt.Printf("[WARN] %s sent more response headers than allowed, dropping %d of %d\n", server, len(fields)-i, len(fields))
+			return fields[:i]
+		}
+	}
+	return fields
+}
+
+func stripHopByHop(fields []headerField, skip []string) []headerField {
+	drop := make(map[string]bool)
+	add := func(name string) {
+		if name = strings.TrimSpace(name); name != "" {
+			drop[textproto.CanonicalMIMEHeaderKey(name)] = true
+		}
+	}
+	for _, name := range standardHopByHopHeaders {
+		add(name)
+	}
+	for _, name := range strings.Split(config.HopByHopHeaders, ",") {
+		add(name)
+	}
+	for _, name := range skip {
+		add(name)
+	}
+	for _, field := range fields {
+		if textproto.CanonicalMIMEHeaderKey(field.Name) == "Connection" {
+			for _, name := range strings.Split(field.Value, ",") {
+				add(name)
+			}
+		}
+	}
+
+	kept := fields[:0]
+	for _, field := range fields {
+		if !drop[textproto.CanonicalMIMEHeaderKey(field.Name)] {
+			kept = append(kept, field)
+		}
+	}
+	return kept
+}
+
+// withoutHeader returns fields minus every header called name.
+func withoutHeader(fields []headerField, name string) []headerField {
+	var kept []headerField
+	for _, field := range fields {
+		if !strings.EqualFold(field.Name, name) {
+			kept = append(kept, field)
+		}
+	}
+	return kept
+}
+
+// loadTargetHeaders reads a JSON object mapping target hosts to the headers
+// sent with requests for them, e.g. {"api.example.com": {"Referer": "..."}}.
+func loadTargetHeaders(path string) (map[string]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var byHost map[string]map[string]string
+	if err := json.Unmarshal(data, &byHost); err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]map[string]string, len(byHost))
+	for host, fields := range byHost {
+		for name, value := range fields {
+			if err := checkSecrets(value); err != nil {
+				return nil, fmt.Errorf("header %s of %s: %v", name, host, err)
+			}
+		}
+		headers[strings.ToLower(host)] = fields
+	}
+	return headers, nil
+}
+
+// withTargetHeaders adds the -target-headers configured for host to fields.
+// Headers the client sent itself are kept unless -target-headers-override is
+// set.
+func withTargetHeaders(fields []headerField, host string) []headerField {
+	configured := loadedFiles().targetHeaders[strings.ToLower(host)]
+	if len(configured) == 0 {
+		return fields
+	}
+
+	for name, value := range configured {
+		canonical := textproto.CanonicalMIMEHeaderKey(name)
+		present := false
+		for _, field := range fields {
+			if textproto.CanonicalMIMEHeaderKey(field.Name) == canonical {
+				present = true
+			}
+		}
+		if present && !config.TargetHeadersOverride {
+			continue
+		}
+
+		kept := fields[:0]
+		for _, field := range fields {
+			if textproto.CanonicalMIMEHeaderKey(field.Name) != canonical {
+				kept = append(kept, field)
+			}
+		}
+		fields = append(kept, headerField{Name: canonical, Value: expandSecrets(value)})
+	}
+	return fields
+}
+
+// outboundRequestHeaders returns the client's headers to send to the servers
+// with -forward-headers, minus the proxy's own option and control headers and
+// its -affinity-cookie.
+func outboundRequestHeaders(h headerVisitor) []headerField {
+	skip := append([]string{optionsHeader, config.PriorityHeader, namespaceHeader, idempotencyHeader, excludeServersHeader}, requestSkipHeaders...)
+	if config.QuotaKeyHeader != "" {
+		skip = append(skip, config.QuotaKeyHeader)
+	}
+	for _, header := range optionHeaders {
+		skip = append(skip, header)
+	}
+	fields := forwardableHeaders(h, skip)
+	if config.AffinityCookie != "" {
+		fields = withoutCookie(fields, config.AffinityCookie)
+	}
+	return fields
+}
+
+// withoutCookie removes the cookie called name from the Cookie headers in
+// fields, and drops a Cookie header left empty by that.
+func withoutCookie(fields []headerField, name string) []headerField {
+	var kept []headerField
+	for _, field := range fields {
+		if !strings.EqualFold(field.Name, "Cookie") {
+			kept = append(kept, field)
+			continue
+		}
+		var cookies []string
+		for _, cookie := range strings.Split(field.Value, ";") {
+			cookie = strings.TrimSpace(cookie)
+			if cookieName, _, _ := strings.Cut(cookie, "="); cookie != "" && cookieName != name {
+				cookies = append(cookies, cookie)
+			}
+		}
+		if len(cookies) > 0 {
+			kept = append(kept, headerField{Name: field.Name, Value: strings.Join(cookies, "; ")})
+		}
+	}
+	return kept
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestStripHopByHop(t *testing.T) {
+	tests := []struct {
+		name   string
+		custom string
+		skip   []string
+		fields []headerField
+		want   []string
+	}{
+		{
+			name:   "standard headers",
+			fields: []headerField{{"Keep-Alive", "timeout=5"}, {"Transfer-Encoding", "chunked"}, {"te", "trailers"}, {"Upgrade", "h2c"}, {"Accept", "*/*"}},
+			want:   []string{"Accept"},
+		},
+		{
+			name:   "custom headers",
+			custom: "X-Internal, x-trace-hop",
+			fields: []headerField{{"X-Internal", "1"}, {"X-Trace-Hop", "2"}, {"X-Public", "3"}},
+			want:   []string{"X-Public"},
+		},
+		{
+			name:   "listed in Connection",
+			fields: []headerField{{"Connection", "close, X-Session"}, {"X-Session", "abc"}, {"X-Other", "def"}},
+			want:   []string{"X-Other"},
+		},
+		{
+			name:   "skip list",
+			skip:   []string{"Host"},
+			fields: []headerField{{"Host", "proxy.test"}, {"Accept", "*/*"}},
+			want:   []string{"Accept"},
+		},
+		{
+			name:   "nothing to strip",
+			custom: " , ",
+			fields: []headerField{{"Accept", "*/*"}, {"X-Custom", "1"}},
+			want:   []string{"Accept", "X-Custom"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.HopByHopHeaders = tt.custom
+			var got []string
+			for _, field := range stripHopByHop(tt.fields, tt.skip) {
+				got = append(got, field.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHopByHopStrippedBothWays(t *testing.T) {
+	setup(t)
+	config.ForwardHeaders = true
+	config.HopByHopHeaders = "X-Internal"
+
+	var received fasthttp.RequestHeader
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.Request.Header.CopyTo(&received)
+		ctx.Response.Header.Set("X-Internal", "upstream")
+		ctx.Response.Header.Set("Proxy-Authenticate", "Basic")
+		ctx.Response.Header.Set("X-Upstream", "kept")
+		ctx.SetBodyString(`{}`)
+	}))
+
+	resp := proxyGet(t, target("api.example.com/headers"),
+		"X-Internal", "client", "Proxy-Authorization", "Basic abc", "Keep-Alive", "timeout=5", "X-Client", "kept")
+	if resp.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+	}
+
+	for _, name := range []string{"X-Internal", "Proxy-Authorization", "Keep-Alive"} {
+		if value := received.Peek(name); len(value) > 0 {
+			t.Errorf("server got %s: %s", name, value)
+		}
+	}
+	if string(received.Peek("X-Client")) != "kept" {
+		t.Errorf("server did not get X-Client:\n%s", received.Header())
+	}
+	for _, name := range []string{"X-Internal", "Proxy-Authenticate"} {
+		if value := resp.Header.Peek(name); len(value) > 0 {
+			t.Errorf("client got %s: %s", name, value)
+		}
+	}
+	if string(resp.Header.Peek("X-Upstream")) != "kept" {
+		t.Errorf("client did not get X-Upstream:\n%s", resp.Header.Header())
+	}
+}
+
+func TestTargetHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		client   string // Referer sent by the client
+		override bool
+		referer  string
+		auth     string
+	}{
+		{"configured host", "https://API.example.com/a", "", false, "https://example.com/", "Bearer s3cret"},
+		{"other host", "https://other.example.com/a", "", false, "", ""},
+		{"host without a scheme", "api.example.com/a", "", false, "https://example.com/", "Bearer s3cret"},
+		{"host and port without a scheme", "API.example.com:443/a", "", false, "https://example.com/", "Bearer s3cret"},
+		{"plain path", "/a", "", false, "", ""},
+		{"client header kept", "https://api.example.com/a", "https://client.example/", false, "https://client.example/", "Bearer s3cret"},
+		{"client header overridden", "https://api.example.com/a", "https://client.example/", true, "https://example.com/", "Bearer s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			t.Setenv("TARGET_TOKEN", "s3cret")
+			config.ForwardHeaders = true
+			config.TargetHeadersOverride = tt.override
+			writeFile(t, "target-headers.json", `{"api.example.com": {"Referer": "https://example.com/", "authorization": "Bearer ${ENV:TARGET_TOKEN}"}}`)
+			configured, err := loadTargetHeaders("target-headers.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			files.Store(&fileConfig{targetHeaders: configured})
+
+			var received fasthttp.RequestHeader
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				ctx.Request.Header.CopyTo(&received)
+				ctx.SetBodyString(`{}`)
+			}))
+
+			var headers []string
+			if tt.client != "" {
+				headers = []string{"Referer", tt.client}
+			}
+			if status := proxyGet(t, target(tt.target), headers...).StatusCode(); status != fasthttp.StatusOK {
+				t.Fatalf("status = %d", status)
+			}
+			if got := string(received.Peek("Referer")); got != tt.referer {
+				t.Errorf("Referer = %q, want %q", got, tt.referer)
+			}
+			if got := string(received.Peek("Authorization")); got != tt.auth {
+				t.Errorf("Authorization = %q, want %q", got, tt.auth)
+			}
+		})
+	}
+}
+
+func TestLoadTargetHeadersUnsetSecret(t *testing.T) {
+	writeFile(t, "target-headers.json", `{"api.example.com": {"Authorization": "Bearer ${ENV:UNSET_TARGET_TOKEN}"}}`)
+	if _, err := loadTargetHeaders("target-headers.json"); err == nil {
+		t.Error("reference to an unset variable accepted")
+	}
+}
+
+func TestSetCookieForwarding(t *testing.T) {
+	cookies := []string{"session=abc; Path=/", "theme=dark", "session=def; Path=/api"}
+	tests := []struct {
+		name  string
+		strip bool
+		want  []string
+	}{
+		{"every cookie passes through", false, cookies},
+		{"-strip-set-cookie", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.ForwardHeaders = true
+			config.StripSetCookie = tt.strip
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				for _, cookie := range cookies {
+					ctx.Response.Header.Add("Set-Cookie", cookie)
+				}
+				ctx.SetBodyString(`{}`)
+			}))
+
+			for _, source := range []string{"upstream", "cache"} {
+				resp := proxyGet(t, target("api.example.com/cookies"))
+				var got []string
+				resp.Header.VisitAll(func(key, value []byte) {
+					if string(key) == "Set-Cookie" {
+						got = append(got, string(value))
+					}
+				})
+				want := tt.want
+				// Cookies are never stored, so cache hits carry none.
+				if source == "cache" {
+					want = nil
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: Set-Cookie = %q, want %q", source, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderCase(t *testing.T) {
+	tests := []struct {
+		headerCase string
+		want       []string // header lines the server receives
+	}{
+		{"", []string{"X-Client-Id: abc", "X-Other: kept", "X-Request-Id: req-1.1"}},
+		{"x-client-id", []string{"x-client-id: abc", "X-Other: kept", "X-Request-Id: req-1.1"}},
+		{"X-CLIENT-ID, X-REQUEST-ID", []string{"X-CLIENT-ID: abc", "X-Other: kept", "X-REQUEST-ID: req-1.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.headerCase, func(t *testing.T) {
+			setup(t)
+			config.ForwardHeaders = true
+			config.HeaderCase = tt.headerCase
+			var raw atomic.Value
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				raw.Store(string(ctx.Request.Header.RawHeaders()))
+				ctx.SetBodyString(`{}`)
+			}))
+
+			resp := proxyGet(t, target("api.example.com/case"), "X-Client-Id", "abc", "X-Other", "kept", requestIDHeader, "req-1")
+			if resp.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+			}
+			received, _ := raw.Load().(string)
+			for _, line := range tt.want {
+				if !strings.Contains(received, "\r\n"+line+"\r\n") {
+					t.Errorf("server did not get %q:\n%s", line, received)
+				}
+			}
+		})
+	}
+}
+
+func TestCapForwardedHeaders(t *testing.T) {
+	fields := []headerField{{"A", "1"}, {"Bb", "22"}, {"Ccc", "333"}, {"Dddd", "4444"}}
+	tests := []struct {
+		name     string
+		maxCount int
+		maxBytes int
+		want     int
+	}{
+		{"unlimited", 0, 0, 4},
+		{"under both limits", 10, 1000, 4},
+		{"count", 2, 0, 2},
+		{"count exactly reached", 4, 0, 4},
+		// The headers take 6, 8, 10 and 12 bytes as "Name: value\r\n".
+		{"bytes", 0, 20, 2},
+		{"bytes exactly reached", 0, 24, 3},
+		{"first header too large", 0, 5, 0},
+		{"count before bytes", 1, 20, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.MaxForwardedHeaders = tt.maxCount
+			config.MaxForwardedHeaderBytes = tt.maxBytes
+			var got []headerField
+			output := captureOutput(t, func() { got = capForwardedHeaders(fields, "http://a.example") })
+			if !reflect.DeepEqual(got, fields[:tt.want]) {
+				t.Errorf("kept %v, want %v", got, fields[:tt.want])
+			}
+			if warned := strings.Contains(output, "[WARN] http://a.example sent more response headers than allowed"); warned != (tt.want < len(fields)) {
+				t.Errorf("warning logged = %v: %q", warned, output)
+			}
+		})
+	}
+}
+
+func TestMaxForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxCount int
+		maxBytes int
+		stream   bool
+		want     int
+	}{
+		{"default limits", 100, 16384, false, 100},
+		{"count", 10, 0, false, 10},
+		{"bytes", 0, 20 * len("X-Flood-000: value\r\n"), false, 20},
+		{"streamed", 10, 0, true, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.ForwardHeaders = true
+			config.MaxForwardedHeaders = tt.maxCount
+			config.MaxForwardedHeaderBytes = tt.maxBytes
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				for i := 0; i < 150; i++ {
+					ctx.Response.Header.Add(fmt.Sprintf("X-Flood-%03d", i), "value")
+				}
+				ctx.SetContentType("application/json")
+				ctx.SetBodyString(`{"ok":true}`)
+			}))
+
+			uri := target("api.example.com/flood")
+			if tt.stream {
+				uri += "&stream=1"
+			}
+			resp := proxyGet(t, uri)
+			if resp.StatusCode() != fasthttp.StatusOK || string(resp.Body()) != `{"ok":true}` {
+				t.Fatalf("response = %d %s, want the body despite the headers", resp.StatusCode(), resp.Body())
+			}
+			flood := 0
+			resp.Header.VisitAll(func(key, value []byte) {
+				if strings.HasPrefix(string(key), "X-Flood-") {
+					flood++
+				}
+			})
+			if flood != tt.want {
+				t.Errorf("forwarded %d of the headers, want %d", flood, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type serverHealth struct {
+	ConsecutiveFailures int
+	CooldownUntil       time.Time
+	Breaker             breakerState
+	OpenedAt            time.Time
+	probing             bool
+
+	// Results of the active checks in healthcheck.go.
+	CheckFailed    bool
+	CanaryFailed   bool
+	CanaryPassedAt time.Time
+	LastCheckedAt  time.Time
+
+	// Warming is set while the server waits for its -prewarm-interval slot.
+	Warming bool
+
+	// InFlight counts the requests sent to the server that have not
+	// finished, and Draining is set once a reload removed it, see drain.go.
+	InFlight int
+	Draining bool
+
+	// Latency tracking for -latency-sla, see latency.go.
+	Latency          time.Duration
+	LatencySampledAt time.Time
+	SlowSince        time.Time
+	Demoted          bool
+}
+
+// failedActiveCheck reports whether the last active health check failed or,
+// with -canary-url set, the server has not passed a canary recently. A server
+// not checked yet counts as passing, so traffic is not held up while the
+// first round runs.
+func (h *serverHealth) failedActiveCheck(now time.Time) bool {
+	if config.HealthInterval <= 0 || h.LastCheckedAt.IsZero() {
+		return false
+	}
+	if h.CheckFailed {
+		return true
+	}
+	return config.CanaryURL != "" && now.Sub(h.CanaryPassedAt) > config.CanaryMaxAge
+}
+
+var health = struct {
+	sync.Mutex
+	servers map[string]*serverHealth
+}{servers: make(map[string]*serverHealth)}
+
+func healthFor(server string) *serverHealth {
+	h, ok := health.servers[server]
+	if !ok {
+		h = &serverHealth{}
+		health.servers[server] = h
+	}
+	return h
+}
+
+const (
+	unavailableCooldown  = "cooldown"
+	unavailableUnhealthy = "unhealthy"
+	unavailableWarming   = "warming"
+	unavailableDraining  = "draining"
+)
+
+// serverUnavailableReason reports why server cannot take a request right now,
+// or "" if it can. Unlike serverAvailable it never claims a half-open probe.
+func serverUnavailableReason(server string) string {
+	health.Lock()
+	defer health.Unlock()
+
+	h := healthFor(server)
+	now := time.Now()
+
+	if h.Draining {
+		return unavailableDraining
+	}
+	if h.Warming {
+		return unavailableWarming
+	}
+	if now.Before(h.CooldownUntil) {
+		return unavailableCooldown
+	}
+	if h.failedActiveCheck(now) {
+		return unavailableUnhealthy
+	}
+
+	switch h.Breaker {
+	case breakerOpen:
+		if now.Sub(h.OpenedAt) < config.BreakerOpenDuration {
+			return unavailableUnhealthy
+		}
+	case breakerHalfOpen:
+		if h.probing {
+			return unavailableUnhealthy
+		}
+	}
+
+	return ""
+}
+
+// shortestCooldown returns how long until the first of servers that is
+// cooling down becomes available again, or 0 if none is.
+func shortestCooldown(servers []Server) time.Duration {
+	health.Lock()
+	defer health.Unlock()
+
+	now := time.Now()
+	var shortest time.Duration
+	for _, server := range servers {
+		remaining := healthFor(server.URL).CooldownUntil.Sub(now)
+		if remaining > 0 && (shortest == 0 || remaining < shortest) {
+			shortest = remaining
+		}
+	}
+	return shortest
+}
+
+// serverAvailable reports whether a request may be sent to server now. An
+// open breaker moves to half-open once BreakerOpenDuration has passed and
+// lets a single probe request through.
+func serverAvailable(server string) bool {
+	health.Lock()
+	defer health.Unlock()
+
+	h := healthFor(server)
+	now := time.Now()
+
+	if h.Draining || h.Warming || now.Before(h.CooldownUntil) || h.failedActiveCheck(now) {
+		return false
+	}
+
+	switch h.Breaker {
+	case breakerOpen:
+		if now.Sub(h.OpenedAt) < config.BreakerOpenDuration {
+			return false
+		}
+		h.Breaker = breakerHalfOpen
+		h.probing = true
+		return true
+	case breakerHalfOpen:
+		if h.probing {
+			return false
+		}
+		h.probing = true
+	}
+
+	return true
+}
+
+// releaseProbe gives back the half-open probe claimed by serverAvailable
+// when no request was sent to server after all, so a later request can
+// probe it instead.
+func releaseProbe(server string) {
+	health.Lock()
+	defer health.Unlock()
+
+	healthFor(server).probing = false
+}
+
+func recordSuccess(server string) {
+	health.Lock()
+	defer health.Unlock()
+
+	h := healthFor(server)
+	if h.Breaker != breakerClosed {
+		emitServerEvent(server, "breaker", h.Breaker.String(), breakerClosed.String(), "request succeeded")
+	}
+	h.ConsecutiveFailures = 0
+	h.CooldownUntil = time.Time{}
+	h.Breaker = breakerClosed
+	h.OpenedAt = time.Time{}
+	h.probing = false
+}
+
+func recordRateLimit(server string) {
+	health.Lock()
+	defer health.Unlock()
+
+	h := healthFor(server)
+	h.probing = false
+	if config.Cooldown > 0 {
+		now := time.Now()
+		if !now.Before(h.CooldownUntil) {
+			emitServerEvent(server, "cooldown", "available", "cooldown", "rate limited")
+		}
+		h.CooldownUntil = now.Add(config.Cooldown)
+	}
+}
+
+func recordFailure(server string) {
+	health.Lock()
+	defer health.Unlock()
+
+	h := healthFor(server)
+	h.ConsecutiveFailures++
+	h.probing = false
+
+	if h.Breaker == breakerHalfOpen || (config.BreakerThreshold > 0 && h.ConsecutiveFailures >= config.BreakerThreshold) {
+		if h.Breaker != breakerOpen {
+			emitServerEvent(server, "breaker", h.Breaker.String(), breakerOpen.String(), fmt.Sprintf("%d consecutive failures", h.ConsecutiveFailures))
+		}
+		h.Breaker = breakerOpen
+		h.OpenedAt = time.Now()
+	}
+}
+
+type serverStats struct {
+	Breaker             string  `json:"breaker"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+	InFlight            int     `json:"in_flight"`
+	Unavailable         string  `json:"unavailable,omitempty"`
+	LatencyMs           float64 `json:"latency_ms,omitempty"`
+	Demoted             bool    `json:"demoted,omitempty"`
+}
+
+// serverStatsSnapshot returns the health of every server that has been
+// tried or checked so far, by server URL.
+func serverStatsSnapshot() map[string]serverStats {
+	health.Lock()
+	snapshot := make(map[string]serverStats, len(health.servers))
+	for server, h := range health.servers {
+		snapshot[server] = serverStats{
+			Breaker:             h.Breaker.String(),
+			ConsecutiveFailures: h.ConsecutiveFailures,
+			InFlight:            h.InFlight,
+			LatencyMs:           float64(h.Latency) / float64(time.Millisecond),
+			Demoted:             h.Demoted,
+		}
+	}
+	health.Unlock()
+
+	for server, s := range snapshot {
+		s.Unavailable = serverUnavailableReason(server)
+		snapshot[server] = s
+	}
+	return snapshot
+}
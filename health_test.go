@@ -0,0 +1,209 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRecordSuccessResetsHealth(t *testing.T) {
+	tests := []struct {
+		name   string
+		before serverHealth
+	}{
+		{"after cooldown", serverHealth{ConsecutiveFailures: 2, CooldownUntil: time.Now().Add(-time.Millisecond)}},
+		{"half-open probe", serverHealth{ConsecutiveFailures: 3, Breaker: breakerOpen, OpenedAt: time.Now().Add(-time.Minute)}},
+		{"already half-open", serverHealth{ConsecutiveFailures: 1, Breaker: breakerHalfOpen}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			const server = "http://server.test"
+			health.Lock()
+			h := tt.before
+			health.servers[server] = &h
+			health.Unlock()
+
+			if !serverAvailable(server) {
+				t.Fatal("server not available after its cooldown or breaker timeout")
+			}
+			recordSuccess(server)
+
+			health.Lock()
+			defer health.Unlock()
+			got := *health.servers[server]
+			if got.ConsecutiveFailures != 0 || !got.CooldownUntil.IsZero() || got.Breaker != breakerClosed || !got.OpenedAt.IsZero() || got.probing {
+				t.Errorf("health after success = %+v, want it reset", got)
+			}
+		})
+	}
+}
+
+func TestSuccessAfterBreakerOpenResetsHealth(t *testing.T) {
+	setup(t)
+	config.BreakerThreshold = 2
+	config.BreakerOpenDuration = 20 * time.Millisecond
+
+	var failing atomic.Bool
+	failing.Store(true)
+	server := newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		if failing.Load() {
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			return
+		}
+		ctx.SetBodyString(`{}`)
+	})
+	writeServers(t, server)
+
+	for i := 0; i < 2; i++ {
+		proxyGet(t, target("api.example.com/x"))
+	}
+	if reason := serverUnavailableReason(server); reason != unavailableUnhealthy {
+		t.Fatalf("unavailable reason after two failures = %q, want %q", reason, unavailableUnhealthy)
+	}
+
+	time.Sleep(config.BreakerOpenDuration)
+	failing.Store(false)
+	if resp := proxyGet(t, target("api.example.com/y")); resp.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("status after the breaker timeout = %d, want 200", resp.StatusCode())
+	}
+
+	stats := serverStatsSnapshot()[server]
+	if stats.Breaker != "closed" || stats.ConsecutiveFailures != 0 || stats.Unavailable != "" {
+		t.Errorf("server stats after the probe succeeded = %+v, want a healthy server", stats)
+	}
+}
+
+func TestAllServersCoolingDown(t *testing.T) {
+	tests := []struct {
+		name       string
+		cooldowns  []time.Duration // remaining per server, 0 for available
+		unhealthy  int             // index of a server with an open breaker, -1 for none
+		status     int
+		retryAfter string
+	}{
+		{"all cooling down", []time.Duration{30 * time.Second, 9500 * time.Millisecond, 20 * time.Second}, -1, fasthttp.StatusTooManyRequests, "10"},
+		{"one available", []time.Duration{30 * time.Second, 0, 20 * time.Second}, -1, fasthttp.StatusOK, ""},
+		{"cooling down or unhealthy", []time.Duration{30 * time.Second, 0, 20 * time.Second}, 1, fasthttp.StatusServiceUnavailable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.Cooldown = time.Minute
+			var requests atomic.Int64
+			var servers []string
+			for range tt.cooldowns {
+				servers = append(servers, countingBackend(t, `{}`, &requests))
+			}
+			writeServers(t, servers...)
+			health.Lock()
+			for i, remaining := range tt.cooldowns {
+				if remaining > 0 {
+					healthFor(servers[i]).CooldownUntil = time.Now().Add(remaining)
+				}
+			}
+			if tt.unhealthy >= 0 {
+				h := healthFor(servers[tt.unhealthy])
+				h.Breaker, h.OpenedAt = breakerOpen, time.Now()
+			}
+			health.Unlock()
+
+			resp := proxyGet(t, target("api.example.com/cooling"))
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if got := string(resp.Header.Peek("Retry-After")); got != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+			if tt.status == fasthttp.StatusOK {
+				return
+			}
+			if requests.Load() != 0 {
+				t.Errorf("servers got %d requests", requests.Load())
+			}
+			if tt.status == fasthttp.StatusTooManyRequests && !strings.Contains(string(resp.Body()), `"all_servers_cooling_down"`) {
+				t.Errorf("body = %s, want error code all_servers_cooling_down", resp.Body())
+			}
+		})
+	}
+}
+
+func TestAllTaggedServersCoolingDown(t *testing.T) {
+	setup(t)
+	config.Cooldown = time.Minute
+	var requests atomic.Int64
+	fast, slow := countingBackend(t, `{}`, &requests), countingBackend(t, `{}`, &requests)
+	writeFile(t, serversFile, `[{"url":"`+fast+`","tags":["fast"]},{"url":"`+slow+`"}]`)
+	health.Lock()
+	healthFor(fast).CooldownUntil = time.Now().Add(5 * time.Second)
+	healthFor(slow).CooldownUntil = time.Now().Add(2 * time.Second)
+	health.Unlock()
+
+	resp := proxyGet(t, target("api.example.com/cooling")+"&tags=fast")
+	if resp.StatusCode() != fasthttp.StatusTooManyRequests || string(resp.Header.Peek("Retry-After")) != "5" {
+		t.Errorf("status = %d, Retry-After = %q, want 429 after the tagged server's 5s", resp.StatusCode(), resp.Header.Peek("Retry-After"))
+	}
+}
+
+func TestSingleServerRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		retries     int
+		servers     int
+		limited     int64 // rate limits before the server answers
+		cooling     bool  // the server is cooling down before the request
+		breakerOpen bool
+		status      int
+		requests    int64
+	}{
+		{"fail fast", 0, 1, 1, false, false, fasthttp.StatusTooManyRequests, 1},
+		{"retried until answered", 3, 1, 2, false, false, fasthttp.StatusOK, 3},
+		{"retries used up", 2, 1, 5, false, false, fasthttp.StatusTooManyRequests, 3},
+		{"cooling down refused", 0, 1, 0, true, false, fasthttp.StatusTooManyRequests, 0},
+		{"cooling down tried", 1, 1, 0, true, false, fasthttp.StatusOK, 1},
+		{"open breaker refused", 0, 1, 0, false, true, fasthttp.StatusServiceUnavailable, 0},
+		{"open breaker tried", 1, 1, 0, false, true, fasthttp.StatusOK, 1},
+		{"not with several servers", 3, 2, 5, false, false, fasthttp.StatusTooManyRequests, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.Cooldown = time.Minute
+			config.SingleServerRetries = tt.retries
+			config.SingleServerDelay = time.Millisecond
+			var requests atomic.Int64
+			var servers []string
+			for i := 0; i < tt.servers; i++ {
+				servers = append(servers, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+					if requests.Add(1) <= tt.limited {
+						ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+						return
+					}
+					ctx.SetContentType("application/json")
+					ctx.SetBodyString(`{}`)
+				}))
+			}
+			writeServers(t, servers...)
+			health.Lock()
+			h := healthFor(servers[0])
+			if tt.cooling {
+				h.CooldownUntil = time.Now().Add(time.Minute)
+			}
+			if tt.breakerOpen {
+				h.Breaker, h.OpenedAt = breakerOpen, time.Now()
+			}
+			health.Unlock()
+
+			resp := proxyGet(t, target("api.example.com/lone"))
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("server requests = %d, want %d", got, tt.requests)
+			}
+		})
+	}
+}
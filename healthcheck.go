@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// startHealthChecks probes every server once right away and then every
+// -health-interval. A probe is a TCP connect to the server, or a GET of its
+// health path when it has one, and, when -canary-url is set, a real fetch of
+// the canary through the server, which catches servers that accept
+// connections but can no longer proxy.
+func startHealthChecks() {
+	if config.HealthInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.HealthInterval)
+		defer ticker.Stop()
+
+		for {
+			runHealthChecks()
+			<-ticker.C
+		}
+	}()
+}
+
+func runHealthChecks() {
+	servers, err := readServerAddresses(serversFile)
+	if err != nil {
+		fmt.Printf("Health check: cannot read servers: %v\n", err)
+		return
+	}
+
+	var slots chan struct{}
+	if config.HealthConcurrency > 0 {
+		slots = make(chan struct{}, config.HealthConcurrency)
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server Server) {
+			defer wg.Done()
+			time.Sleep(healthCheckOffset(server.URL))
+			if slots != nil {
+				slots <- struct{}{}
+				defer func() { <-slots }()
+			}
+			checkServer(server)
+		}(server)
+	}
+	wg.Wait()
+}
+
+// healthCheckOffset is how long into each round server is probed: a fixed
+// point within -health-stagger derived from its URL, so the probes of a large
+// pool are spread out rather than fired at once, and each server is still
+// checked about every -health-interval.
+func healthCheckOffset(server string) time.Duration {
+	if config.HealthStagger <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(server))
+	return time.Duration(h.Sum64() % uint64(config.HealthStagger))
+}
+
+func checkServer(server Server) {
+	var checkErr error
+	if path := server.healthPath(); path != "" {
+		checkErr = probeHTTP(server, path)
+	} else {
+		checkErr = probeTCP(server.URL)
+	}
+
+	var canaryErr error
+	if checkErr == nil && config.CanaryURL != "" {
+		_, canaryErr = makeRequest(server.URL, server.endpoint(config.CanaryURL), upstreamRequest{Timeout: config.HealthTimeout})
+	}
+
+	recordHealthCheck(server.URL, checkErr, canaryErr)
+}
+
+func probeTCP(serverURL string) error {
+	parsed, err := url.Parse(serverURL)
+	if err != nil {
+		return err
+	}
+
+	addr := parsed.Host
+	if parsed.Port() == "" {
+		port := "80"
+		if parsed.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(parsed.Hostname(), port)
+	}
+
+	conn, err := fasthttp.DialTimeout(addr, config.HealthTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeHTTP requests path on server, with the server's headers, and fails
+// unless it answers below 400.
+func probeHTTP(server Server, path string) error {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(server.URL + path)
+	for name, value := range server.Headers {
+		req.Header.Set(name, expandSecrets(value))
+	}
+	var err error
+	if server.HTTPVersion == httpVersion2 {
+		err = doHTTP2(req, resp, config.HealthTimeout)
+	} else {
+		err = upstreamClient.DoTimeout(req, resp, config.HealthTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	if statusCode := resp.StatusCode(); statusCode >= 400 {
+		return fmt.Errorf("%s answered with status %d", path, statusCode)
+	}
+	return nil
+}
+
+func recordHealthCheck(server string, checkErr error, canaryErr error) {
+	health.Lock()
+	defer health.Unlock()
+
+	h := healthFor(server)
+	now := time.Now()
+	h.LastCheckedAt = now
+
+	if failed := checkErr != nil; failed != h.CheckFailed {
+		h.CheckFailed = failed
+		if failed {
+			fmt.Printf("Health check failed for %s: %v\n", server, checkErr)
+			emitServerEvent(server, "health", "healthy", "unhealthy", checkErr.Error())
+		} else {
+			fmt.Printf("Health check recovered for %s\n", server)
+			emitServerEvent(server, "health", "unhealthy", "healthy", "")
+		}
+	}
+
+	if config.CanaryURL == "" || checkErr != nil {
+		return
+	}
+
+	if canaryErr == nil {
+		h.CanaryPassedAt = now
+	}
+	if failed := canaryErr != nil; failed != h.CanaryFailed {
+		h.CanaryFailed = failed
+		if failed {
+			fmt.Printf("Canary failed for %s: %v\n", server, canaryErr)
+			emitServerEvent(server, "canary", "passing", "failing", canaryErr.Error())
+		} else {
+			fmt.Printf("Canary passed for %s\n", server)
+			emitServerEvent(server, "canary", "failing", "passing", "")
+		}
+	}
+}
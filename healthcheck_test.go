@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCanaryExcludesServer(t *testing.T) {
+	tests := []struct {
+		name      string
+		canaryURL string
+		excluded  bool
+	}{
+		{"canary fails", "canary.example.com/check", true},
+		{"no canary", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.HealthInterval = time.Hour
+			config.CanaryURL = tt.canaryURL
+			config.CanaryMaxAge = time.Hour
+			served := func(ctx *fasthttp.RequestCtx) {
+				ctx.SetContentType("application/json")
+				ctx.SetBodyString(`{"server":"http://` + string(ctx.Host()) + `"}`)
+			}
+			good := tcpBackend(t, served)
+			// The broken server accepts connections but cannot proxy the
+			// canary.
+			broken := tcpBackend(t, func(ctx *fasthttp.RequestCtx) {
+				if strings.Contains(string(ctx.QueryArgs().Peek("url")), "canary") {
+					ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+					return
+				}
+				served(ctx)
+			})
+			writeServers(t, good, broken)
+
+			runHealthChecks()
+			if err := probeTCP(broken); err != nil {
+				t.Fatalf("TCP probe of the broken server failed: %v", err)
+			}
+			if excluded := serverUnavailableReason(broken) == unavailableUnhealthy; excluded != tt.excluded {
+				t.Errorf("broken server excluded = %v, want %v", excluded, tt.excluded)
+			}
+			if reason := serverUnavailableReason(good); reason != "" {
+				t.Errorf("good server unavailable: %s", reason)
+			}
+
+			used := map[string]bool{}
+			for _, path := range []string{"a", "b", "c", "d"} {
+				used[servedBy(t, proxyGet(t, target("api.example.com/"+path)))] = true
+			}
+			if used[broken] != !tt.excluded || !used[good] {
+				t.Errorf("servers used = %v", used)
+			}
+		})
+	}
+}
+
+func TestFailedActiveCheck(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		h      serverHealth
+		canary bool
+		want   bool
+	}{
+		{"not checked yet", serverHealth{CheckFailed: true}, true, false},
+		{"check failed", serverHealth{LastCheckedAt: now, CheckFailed: true}, false, true},
+		{"check passed", serverHealth{LastCheckedAt: now}, false, false},
+		{"canary passed recently", serverHealth{LastCheckedAt: now, CanaryPassedAt: now}, true, false},
+		{"canary passed long ago", serverHealth{LastCheckedAt: now, CanaryPassedAt: now.Add(-2 * time.Hour)}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.HealthInterval = time.Minute
+			config.CanaryMaxAge = time.Hour
+			if tt.canary {
+				config.CanaryURL = "canary.example.com"
+			}
+			if got := tt.h.failedActiveCheck(now); got != tt.want {
+				t.Errorf("failedActiveCheck = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthCheckOffset(t *testing.T) {
+	setup(t)
+	if offset := healthCheckOffset("http://a.test"); offset != 0 {
+		t.Errorf("offset without -health-stagger = %s", offset)
+	}
+
+	config.HealthStagger = time.Second
+	buckets := make([]int, 10)
+	for i := 0; i < 100; i++ {
+		server := fmt.Sprintf("http://server%d.test", i)
+		offset := healthCheckOffset(server)
+		if offset < 0 || offset >= config.HealthStagger {
+			t.Fatalf("offset of %s = %s, want within -health-stagger", server, offset)
+		}
+		if again := healthCheckOffset(server); again != offset {
+			t.Errorf("offset of %s changed from %s to %s", server, offset, again)
+		}
+		buckets[offset/(config.HealthStagger/10)]++
+	}
+	for i, n := range buckets {
+		if n == 0 {
+			t.Errorf("no probe in the %d. tenth of the stagger: %v", i+1, buckets)
+		}
+	}
+}
+
+// probeRecorder is a health endpoint that notes when each server was probed
+// and how many probes ran at once.
+type probeRecorder struct {
+	sync.Mutex
+	probedAt      map[string]time.Duration
+	running, peak int
+	start         time.Time
+}
+
+func (r *probeRecorder) backend(t *testing.T, delay time.Duration) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		r.Lock()
+		r.probedAt["http://"+string(ctx.Host())] = time.Since(r.start)
+		r.running++
+		r.peak = max(r.peak, r.running)
+		r.Unlock()
+		time.Sleep(delay)
+		r.Lock()
+		r.running--
+		r.Unlock()
+	})
+}
+
+func TestHealthCheckRound(t *testing.T) {
+	tests := []struct {
+		name        string
+		stagger     time.Duration
+		concurrency int
+		peak        int
+	}{
+		{"all at once", 0, 0, 6},
+		{"bounded", 0, 2, 2},
+		{"staggered", 300 * time.Millisecond, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.HealthPath = "/health"
+			config.HealthStagger = tt.stagger
+			config.HealthConcurrency = tt.concurrency
+			recorder := &probeRecorder{probedAt: map[string]time.Duration{}}
+			var servers []string
+			for i := 0; i < 6; i++ {
+				servers = append(servers, recorder.backend(t, 50*time.Millisecond))
+			}
+			writeServers(t, servers...)
+
+			recorder.start = time.Now()
+			runHealthChecks()
+			recorder.Lock()
+			defer recorder.Unlock()
+			if len(recorder.probedAt) != len(servers) {
+				t.Fatalf("probed %d of %d servers", len(recorder.probedAt), len(servers))
+			}
+			if tt.peak > 0 && recorder.peak != tt.peak {
+				t.Errorf("peak concurrent probes = %d, want %d", recorder.peak, tt.peak)
+			}
+			if tt.stagger == 0 {
+				return
+			}
+			for _, server := range servers {
+				offset, probed := healthCheckOffset(server), recorder.probedAt[server]
+				if probed < offset || probed > offset+100*time.Millisecond {
+					t.Errorf("%s probed after %s, want at its offset %s", server, probed, offset)
+				}
+			}
+		})
+	}
+}
+
+func TestServerHealthPath(t *testing.T) {
+	tests := []struct {
+		flag   string
+		server string
+		want   string
+	}{
+		{"", "", ""},
+		{"/health", "", "/health"},
+		{"", "/ping", "/ping"},
+		{"/health", "/ping", "/ping"},
+	}
+	for _, tt := range tests {
+		setup(t)
+		config.HealthPath = tt.flag
+		if got := (Server{HealthPath: tt.server}).healthPath(); got != tt.want {
+			t.Errorf("-health-path %q, HealthPath %q: healthPath = %q, want %q", tt.flag, tt.server, got, tt.want)
+		}
+	}
+}
+
+func TestServersFileHealthPath(t *testing.T) {
+	setup(t)
+	writeFile(t, serversFile, `[{"url":"http://a.example","HealthPath":"ping"}]`)
+	if _, err := parseServerAddresses(serversFile); err == nil || !strings.Contains(err.Error(), "must start with /") {
+		t.Errorf("error = %v, want a HealthPath without / rejected", err)
+	}
+}
+
+func TestHealthPaths(t *testing.T) {
+	setup(t)
+	config.HealthInterval = time.Hour
+	config.HealthPath = "/health"
+	var mu sync.Mutex
+	probed := make(map[string][]string)
+	// healthAt answers the probe at path only, with the X-Token header when
+	// token is set.
+	healthAt := func(path, token string) string {
+		var self string
+		self = newBackend(t, func(ctx *fasthttp.RequestCtx) {
+			mu.Lock()
+			probed[self] = append(probed[self], string(ctx.Path()))
+			mu.Unlock()
+			if string(ctx.Path()) != path || string(ctx.Request.Header.Peek("X-Token")) != token {
+				ctx.SetStatusCode(fasthttp.StatusNotFound)
+			}
+		})
+		return self
+	}
+	flagPath := healthAt("/health", "")
+	ownPath := healthAt("/ping", "t0ken")
+	wrongPath := healthAt("/status", "")
+	writeFile(t, serversFile, fmt.Sprintf(`[{"url":%q},{"url":%q,"HealthPath":"/ping","Headers":{"X-Token":"t0ken"}},{"url":%q,"HealthPath":"/missing"}]`, flagPath, ownPath, wrongPath))
+
+	runHealthChecks()
+	tests := []struct {
+		server    string
+		path      string
+		unhealthy bool
+	}{
+		{flagPath, "/health", false},
+		{ownPath, "/ping", false},
+		{wrongPath, "/missing", true},
+	}
+	for _, tt := range tests {
+		mu.Lock()
+		paths := probed[tt.server]
+		mu.Unlock()
+		if len(paths) != 1 || paths[0] != tt.path {
+			t.Errorf("%s probed at %q, want %s", tt.server, paths, tt.path)
+		}
+		if unhealthy := serverUnavailableReason(tt.server) == unavailableUnhealthy; unhealthy != tt.unhealthy {
+			t.Errorf("%s unhealthy = %v, want %v", tt.server, unhealthy, tt.unhealthy)
+		}
+	}
+}
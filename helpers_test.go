@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// ownFlags are the flags registered by parseFlags, as opposed to those of
+// the testing package, which setup leaves alone.
+var ownFlags = map[string]bool{}
+
+// backends are the in-memory servers of the running test, by the host:port
+// the upstream clients dial for them.
+var backends sync.Map
+
+var backendCount atomic.Int64
+
+// proxyListener serves the proxy's handler chain for the running test.
+var proxyListener *fasthttputil.InmemoryListener
+
+func TestMain(m *testing.M) {
+	known := map[string]bool{}
+	flag.VisitAll(func(f *flag.Flag) { known[f.Name] = true })
+	parseFlags()
+	flag.VisitAll(func(f *flag.Flag) {
+		if !known[f.Name] {
+			ownFlags[f.Name] = true
+		}
+	})
+
+	for _, client := range []*fasthttp.Client{upstreamClient, timedClient, streamingClient, remoteCacheClient, webhookClient} {
+		client.Dial = dialBackend
+	}
+
+	// servers.txt and the other files are read from the working directory.
+	dir, err := os.MkdirTemp("", "proxy-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := os.Chdir(dir); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func dialBackend(addr string) (net.Conn, error) {
+	if ln, ok := backends.Load(addr); ok {
+		return ln.(*fasthttputil.InmemoryListener).Dial()
+	}
+	return fasthttp.Dial(addr)
+}
+
+// setup puts the flags and every piece of state derived from them or built
+// up by requests back to how a fresh start with default flags has them, and
+// serves the proxy for proxyDo.
+func setup(t testing.TB) {
+	t.Helper()
+	flag.VisitAll(func(f *flag.Flag) {
+		if ownFlags[f.Name] {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	config.setAdminKey("")
+
+	upstreamLimiter = nil
+	attemptSlots = nil
+	initRetryBudget()
+	upstreamClient.MaxResponseBodySize = 0
+	json, jsonLine = jsoniter.ConfigCompatibleWithStandardLibrary, jsoniter.ConfigCompatibleWithStandardLibrary
+	responseChain, _ = buildResponseChain(config.ResponseMiddleware)
+	softErrorPattern = nil
+	pendingPattern = nil
+	pendingFields, _ = parsePendingFields(config.PendingFields)
+	allowedPorts, _ = parseAllowedPorts(config.AllowedPorts)
+	setCacheLifetime(config.CacheTTL)
+	ttlSizeBuckets = nil
+	routeTTLRules, hostTTLRules = nil, nil
+	poolRoutes = nil
+	quotaWindows = nil
+	quotaClientNames = nil
+	files.Store(&fileConfig{})
+	serverIndex.Store(0)
+
+	resetCache()
+	cacheDisabled.Store(false)
+	health.Lock()
+	health.servers = make(map[string]*serverHealth)
+	health.Unlock()
+	escalations.Lock()
+	escalations.failures = make(map[string]int)
+	escalations.Unlock()
+	globalCircuit.Lock()
+	globalCircuit.window.reset()
+	globalCircuit.state, globalCircuit.changedAt = breakerClosed, time.Time{}
+	globalCircuit.errorRate, globalCircuit.attempts = 0, 0
+	globalCircuit.Unlock()
+	hitRatio.Lock()
+	hitRatio.window.reset()
+	hitRatio.alarm, hitRatio.ratio, hitRatio.lookups = false, 0, 0
+	hitRatio.Unlock()
+	targetSlots.Lock()
+	targetSlots.hosts = make(map[string]*targetSlot)
+	targetSlots.Unlock()
+	quotas.Lock()
+	quotas.usage = make(map[string][]quotaUsage)
+	quotas.Unlock()
+	rateLimitedTargets.Lock()
+	rateLimitedTargets.until = make(map[string]time.Time)
+	rateLimitedTargets.Unlock()
+	remoteCacheBreaker.Lock()
+	remoteCacheBreaker.state, remoteCacheBreaker.failures = breakerClosed, 0
+	remoteCacheBreaker.openedAt, remoteCacheBreaker.probing = time.Time{}, false
+	remoteCacheBreaker.Unlock()
+	for _, counter := range []*atomic.Int64{&remoteCacheStats.Hits, &remoteCacheStats.Misses, &remoteCacheStats.Errors, &remoteCacheStats.ShortCircuits} {
+		counter.Store(0)
+	}
+	dnsCache.Lock()
+	dnsCache.entries = make(map[string]dnsCacheEntry)
+	dnsCache.Unlock()
+	targetRateLimits.Lock()
+	targetRateLimits.counts = make(map[string]int64)
+	targetRateLimits.Unlock()
+	resetStats()
+
+	os.Remove(serversFile)
+
+	proxyListener = fasthttputil.NewInmemoryListener()
+	server := &fasthttp.Server{Handler: withAccessLog(handleRoutes)}
+	go server.Serve(proxyListener)
+	ln := proxyListener
+	t.Cleanup(func() { ln.Close() })
+}
+
+// resetCache empties the cache and what is kept alongside it.
+func resetCache() {
+	for _, shard := range cache.shards {
+		shard.Lock()
+		shard.data = make(map[string]cachedData)
+		shard.Unlock()
+	}
+	cacheBlobs.Lock()
+	cacheBlobs.blobs = make(map[string]*cacheBlob)
+	cacheBlobs.Unlock()
+	cacheHostKeys.Lock()
+	cacheHostKeys.keys = make(map[string]map[string]bool)
+	cacheHostKeys.Unlock()
+	reportedDuplicates.Lock()
+	reportedDuplicates.list = ""
+	reportedDuplicates.Unlock()
+	idempotencyResponses.Lock()
+	idempotencyResponses.entries = make(map[string]idempotentResponse)
+	idempotencyResponses.Unlock()
+}
+
+// newBackend serves handler in memory and returns the URL the proxy reaches
+// it at, to be listed with writeServers.
+func newBackend(t testing.TB, handler fasthttp.RequestHandler) string {
+	t.Helper()
+	host := fmt.Sprintf("backend%d.test", backendCount.Add(1))
+	ln := fasthttputil.NewInmemoryListener()
+	backends.Store(host+":80", ln)
+	server := &fasthttp.Server{Handler: handler}
+	go server.Serve(ln)
+	t.Cleanup(func() {
+		backends.Delete(host + ":80")
+		ln.Close()
+	})
+	return "http://" + host
+}
+
+// tcpBackend is newBackend on a real TCP listener, for the probes that dial
+// servers themselves.
+func tcpBackend(t testing.TB, handler fasthttp.RequestHandler) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fasthttp.Server{Handler: handler}
+	go server.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return "http://" + ln.Addr().String()
+}
+
+// rawBackend is a backend that answers every request with the raw response
+// bytes and closes the connection, for responses fasthttp would not write.
+func rawBackend(t testing.TB, response string) string {
+	t.Helper()
+	host := fmt.Sprintf("backend%d.test", backendCount.Add(1))
+	ln := fasthttputil.NewInmemoryListener()
+	backends.Store(host+":80", ln)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var req fasthttp.Request
+				if err := req.Read(bufio.NewReader(conn)); err == nil {
+					io.WriteString(conn, response)
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		backends.Delete(host + ":80")
+		ln.Close()
+	})
+	return "http://" + host
+}
+
+// jsonBackend is a backend answering every request with body as JSON.
+func jsonBackend(t testing.TB, body string) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(body)
+	})
+}
+
+// statusBackend is a backend answering every request with status and body.
+func statusBackend(t testing.TB, status int, body string) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(status)
+		ctx.SetBodyString(body)
+	})
+}
+
+// namedBackend is a backend answering with its own URL, for tests checking
+// which server a request went to.
+func namedBackend(t testing.TB) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("application/json")
+		fmt.Fprintf(ctx, `{"server":"http://%s"}`, ctx.Host())
+	})
+}
+
+// servedBy returns the server named in a namedBackend response.
+func servedBy(t testing.TB, resp *fasthttp.Response) string {
+	t.Helper()
+	var body struct{ Server string }
+	if err := json.Unmarshal(resp.Body(), &body); err != nil {
+		t.Fatalf("unexpected response %d %q: %v", resp.StatusCode(), resp.Body(), err)
+	}
+	return body.Server
+}
+
+// countingBackend is jsonBackend that also counts the requests it gets.
+func countingBackend(t testing.TB, body string, count *atomic.Int64) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		count.Add(1)
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(body)
+	})
+}
+
+// writeServers writes the servers file with one URL per line.
+func writeServers(t testing.TB, urls ...string) {
+	t.Helper()
+	writeFile(t, serversFile, strings.Join(urls, "\n")+"\n")
+}
+
+func writeFile(t testing.TB, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// proxyDo sends a request to the proxy served by setup, with headers given
+// as name, value pairs.
+func proxyDo(t testing.TB, method string, uri string, body string, headers ...string) *fasthttp.Response {
+	t.Helper()
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI("http://proxy.test" + uri)
+	req.Header.SetMethod(method)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	if body != "" {
+		req.SetBodyString(body)
+	}
+
+	ln := proxyListener
+	client := &fasthttp.Client{DisablePathNormalizing: true, Dial: func(string) (net.Conn, error) { return ln.Dial() }}
+	resp := &fasthttp.Response{}
+	if err := client.DoTimeout(req, resp, 10*time.Second); err != nil {
+		t.Fatalf("%s %s: %v", method, uri, err)
+	}
+	return resp
+}
+
+func proxyGet(t testing.TB, uri string, headers ...string) *fasthttp.Response {
+	t.Helper()
+	return proxyDo(t, fasthttp.MethodGet, uri, "", headers...)
+}
+
+// target returns the proxy URI fetching targetURL.
+func target(targetURL string) string {
+	return "/?url=" + targetURL
+}
+
+// captureOutput returns what fn printed to stdout.
+func captureOutput(t testing.TB, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		done <- buf.Bytes()
+	}()
+
+	defer func() {
+		os.Stdout = stdout
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// hitRatioMinLookups keeps a handful of lookups after a quiet period from
+// raising the alarm.
+const hitRatioMinLookups = 20
+
+// hitRatio tracks cache lookups over the rolling -cache-hit-ratio-window.
+var hitRatio = struct {
+	sync.Mutex
+	window  rollingCounts
+	alarm   bool
+	ratio   float64
+	lookups int
+}{}
+
+// recordCacheLookup counts a cache lookup of a cacheable request and raises
+// or clears the alarm when the hit ratio over the window crosses
+// -cache-hit-ratio-alarm.
+func recordCacheLookup(hit bool) {
+	if config.CacheHitRatioAlarm <= 0 {
+		return
+	}
+
+	hitRatio.Lock()
+	defer hitRatio.Unlock()
+
+	hits, lookups := hitRatio.window.add(time.Now(), config.CacheHitRatioWindow, hit)
+	hitRatio.ratio = float64(hits) / float64(lookups)
+	hitRatio.lookups = lookups
+	if lookups < hitRatioMinLookups {
+		return
+	}
+
+	low := hitRatio.ratio < config.CacheHitRatioAlarm
+	if low == hitRatio.alarm {
+		return
+	}
+	hitRatio.alarm = low
+	if low {
+		reason := fmt.Sprintf("hit ratio %.2f over %d lookups is below %.2f", hitRatio.ratio, lookups, config.CacheHitRatioAlarm)
+		fmt.Printf("[WARN] Cache hit ratio alarm: %s in the last %v\n", reason, config.CacheHitRatioWindow)
+		emitServerEvent("", "cache_hit_ratio", "ok", "low", reason)
+	} else {
+		fmt.Printf("Cache hit ratio back to %.2f\n", hitRatio.ratio)
+		emitServerEvent("", "cache_hit_ratio", "low", "ok", "")
+	}
+}
+
+type hitRatioSnapshot struct {
+	Ratio   float64 `json:"ratio"`
+	Lookups int     `json:"lookups"`
+	Alarm   bool    `json:"alarm"`
+}
+
+func hitRatioStats() *hitRatioSnapshot {
+	if config.CacheHitRatioAlarm <= 0 {
+		return nil
+	}
+
+	hitRatio.Lock()
+	defer hitRatio.Unlock()
+	return &hitRatioSnapshot{Ratio: hitRatio.ratio, Lookups: hitRatio.lookups, Alarm: hitRatio.alarm}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCacheHitRatioAlarm(t *testing.T) {
+	setup(t)
+	config.CacheHitRatioAlarm = 0.5
+	config.CacheHitRatioWindow = time.Minute
+	events := make(chan serverEvent, 10)
+	webhookBackend(t, events, func(*fasthttp.RequestCtx) {})
+	writeServers(t, jsonBackend(t, `{}`))
+
+	steps := []struct {
+		name    string
+		misses  int // requests for new targets
+		hits    int // repeats of the first target
+		alarm   bool
+		logged  string
+		event   string // new state sent to the webhook
+		lookups int
+	}{
+		{"too few lookups", 19, 0, false, "", "", 19},
+		{"low ratio", 1, 0, true, "[WARN] Cache hit ratio alarm: hit ratio 0.00 over 20 lookups is below 0.50", "low", 20},
+		{"still low", 0, 10, true, "", "", 30},
+		{"recovered", 0, 10, false, "Cache hit ratio back to 0.50", "ok", 40},
+	}
+	next := 0
+	for _, step := range steps {
+		output := captureOutput(t, func() {
+			for i := 0; i < step.misses; i++ {
+				proxyGet(t, target(fmt.Sprintf("api.example.com/ratio/%d", next)))
+				next++
+			}
+			for i := 0; i < step.hits; i++ {
+				proxyGet(t, target("api.example.com/ratio/0"))
+			}
+		})
+		got := snapshotStats().Cache.HitRatio
+		if got == nil || got.Alarm != step.alarm || got.Lookups != step.lookups {
+			t.Errorf("%s: hit_ratio = %+v, want alarm %v over %d lookups", step.name, got, step.alarm, step.lookups)
+		}
+		if step.logged != "" && !strings.Contains(output, step.logged) {
+			t.Errorf("%s: output does not contain %q:\n%s", step.name, step.logged, output)
+		}
+		if step.event == "" {
+			continue
+		}
+		select {
+		case event := <-events:
+			if event.Kind != "cache_hit_ratio" || event.NewState != step.event {
+				t.Errorf("%s: event = %+v, want cache_hit_ratio %s", step.name, event, step.event)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: no webhook event", step.name)
+		}
+	}
+}
+
+func TestCacheHitRatioOff(t *testing.T) {
+	setup(t)
+	recordCacheLookup(false)
+	if got := snapshotStats().Cache.HitRatio; got != nil {
+		t.Errorf("hit_ratio = %+v without -cache-hit-ratio-alarm", got)
+	}
+}
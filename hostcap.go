@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// cacheHostKeys holds the cache keys stored for each target host, so
+// -cache-max-per-host can find a host's entries without scanning every shard.
+// It is locked before a shard, never the other way round. Keys whose entry
+// expired, was evicted or was replaced by a colliding one are dropped by
+// pruneHostKeys.
+var cacheHostKeys = struct {
+	sync.Mutex
+	keys map[string]map[string]bool
+}{keys: make(map[string]map[string]bool)}
+
+// capHostEntries records that key was stored for target and, once the
+// target's host has more than -cache-max-per-host entries, evicts the ones
+// used least recently, so one host cannot crowd the others out of the cache.
+func capHostEntries(target string, key string) {
+	if config.CacheMaxPerHost <= 0 {
+		return
+	}
+	host := targetHostKey(target)
+	if host == "" {
+		return
+	}
+
+	cacheHostKeys.Lock()
+	defer cacheHostKeys.Unlock()
+	keys := cacheHostKeys.keys[host]
+	if keys == nil {
+		keys = make(map[string]bool)
+		cacheHostKeys.keys[host] = keys
+	}
+	keys[key] = true
+	if len(keys) <= config.CacheMaxPerHost {
+		return
+	}
+
+	type candidate struct {
+		key      string
+		lastUsed int64
+	}
+	var candidates []candidate
+	for k := range keys {
+		lastUsed, ok := cacheLastUsed(k)
+		if !ok {
+			delete(keys, k)
+			continue
+		}
+		candidates = append(candidates, candidate{key: k, lastUsed: lastUsed})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].lastUsed != candidates[j].lastUsed {
+			return candidates[i].lastUsed < candidates[j].lastUsed
+		}
+		return candidates[i].key < candidates[j].key
+	})
+	evict := len(candidates) - config.CacheMaxPerHost
+	if evict <= 0 {
+		return
+	}
+	for _, c := range candidates[:evict] {
+		cacheEvict(c.key)
+		delete(keys, c.key)
+	}
+	stats.CacheHostEvictions.Add(int64(evict))
+	fmt.Printf("Cache limit reached for %s, evicted %d of its entries, least recently used first\n", host, evict)
+}
+
+// pruneHostKeys forgets the keys that no longer have an entry, and the hosts
+// left without any, so hosts that stay under -cache-max-per-host do not keep
+// the keys of entries long gone.
+func pruneHostKeys() {
+	cacheHostKeys.Lock()
+	defer cacheHostKeys.Unlock()
+	for host, keys := range cacheHostKeys.keys {
+		for key := range keys {
+			if _, ok := cacheLastUsed(key); !ok {
+				delete(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			delete(cacheHostKeys.keys, host)
+		}
+	}
+}
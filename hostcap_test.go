@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCapHostEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		steps   []string // "store <target>" or "get <target>", a moment apart
+		evicted []string
+	}{
+		{"under the limit", 2, []string{"store https://a.example/1", "store https://a.example/2"}, nil},
+		{"least recently stored", 2, []string{"store https://a.example/1", "store https://a.example/2", "store https://a.example/3"}, []string{"https://a.example/1"}},
+		{"least recently served", 2, []string{"store https://a.example/1", "store https://a.example/2", "get https://a.example/1", "store https://a.example/3"}, []string{"https://a.example/2"}},
+		{"stored again", 2, []string{"store https://a.example/1", "store https://a.example/2", "store https://a.example/1"}, nil},
+		{"other hosts untouched", 2, []string{"store https://b.example/1", "store https://a.example/1", "store https://a.example/2", "store https://a.example/3", "store https://c.example/1"}, []string{"https://a.example/1"}},
+		{"host case", 2, []string{"store https://A.example/1", "store https://a.example/2", "store https://a.EXAMPLE/3"}, []string{"https://A.example/1"}},
+		{"without a scheme", 2, []string{"store a.example/1", "store https://a.example/2", "store a.example:8080/3"}, []string{"a.example/1"}},
+		{"off", 0, []string{"store https://a.example/1", "store https://a.example/2", "store https://a.example/3"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.CacheMaxPerHost = tt.max
+			stored := make(map[string]bool)
+			for _, step := range tt.steps {
+				action, target, _ := strings.Cut(step, " ")
+				if action == "get" {
+					cacheGet(cacheKey(target))
+				} else {
+					cacheSet(cacheKey(target), upstreamResponse{Body: `{}`})
+					stored[target] = true
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			evicted := make(map[string]bool)
+			for _, target := range tt.evicted {
+				evicted[target] = true
+			}
+			for target := range stored {
+				if _, ok := cacheGet(cacheKey(target)); ok == evicted[target] {
+					t.Errorf("%s cached = %v, want %v", target, ok, !evicted[target])
+				}
+			}
+			if got := stats.CacheHostEvictions.Load(); got != int64(len(tt.evicted)) {
+				t.Errorf("host evictions = %d, want %d", got, len(tt.evicted))
+			}
+		})
+	}
+}
+
+func TestPruneHostKeys(t *testing.T) {
+	setup(t)
+	config.CacheMaxPerHost = 10
+	cacheSet(cacheKey("https://a.example/1"), upstreamResponse{Body: `{}`})
+	cacheSet(cacheKey("https://a.example/2"), upstreamResponse{Body: `{}`})
+	cacheSet(cacheKey("https://b.example/1"), upstreamResponse{Body: `{}`})
+	cacheEvict(cacheKey("https://a.example/1"))
+	cacheEvict(cacheKey("https://b.example/1"))
+
+	pruneHostKeys()
+	cacheHostKeys.Lock()
+	defer cacheHostKeys.Unlock()
+	if _, ok := cacheHostKeys.keys["b.example"]; ok {
+		t.Error("host without entries still tracked")
+	}
+	if keys := cacheHostKeys.keys["a.example"]; len(keys) != 1 || !keys[cacheKey("https://a.example/2")] {
+		t.Errorf("keys of a.example = %v, want only the one still cached", keys)
+	}
+}
+
+func TestCacheMaxPerHost(t *testing.T) {
+	setup(t)
+	config.CacheMaxPerHost = 2
+	var requests atomic.Int64
+	writeServers(t, countingBackend(t, `{}`, &requests))
+
+	// The runaway host fills its share; the other one was cached first.
+	for _, uri := range []string{
+		"https://quiet.example/1",
+		"https://runaway.example/1",
+		"https://runaway.example/2",
+		"https://runaway.example/3",
+		"https://runaway.example/4",
+	} {
+		proxyGet(t, target(uri))
+		time.Sleep(time.Millisecond)
+	}
+	before := requests.Load()
+	proxyGet(t, target("https://quiet.example/1"))
+	proxyGet(t, target("https://runaway.example/4"))
+	if got := requests.Load(); got != before {
+		t.Errorf("%d upstream requests for entries that should still be cached", got-before)
+	}
+	proxyGet(t, target("https://runaway.example/1"))
+	if got := requests.Load(); got != before+1 {
+		t.Errorf("evicted entry fetched %d times, want once", got-before)
+	}
+
+	var snapshot statsSnapshot
+	if err := json.Unmarshal(proxyGet(t, "/stats").Body(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	// Refetching runaway.example/1 evicted another of its entries.
+	if snapshot.Cache.HostEvictions != 3 {
+		t.Errorf("host_evictions = %d, want 3", snapshot.Cache.HostEvictions)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	httpVersion11 = "1.1"
+	httpVersion2  = "2"
+)
+
+// http2Client serves the servers with HTTPVersion "2". fasthttp only speaks
+// HTTP/1.1, so these go through net/http, which negotiates HTTP/2 over TLS
+// and multiplexes requests on one connection per server. Compression is off
+// so Accept-Encoding and Content-Encoding are handled as for fasthttp.
+var http2Client = &http.Client{
+	Transport: &http.Transport{ForceAttemptHTTP2: true, DisableCompression: true},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if !config.FollowRedirects {
+			return http.ErrUseLastResponse
+		}
+		for _, visited := range via {
+			if visited.URL.String() == req.URL.String() {
+				return errRedirectLoop
+			}
+		}
+		if len(via) >= maxUpstreamRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxUpstreamRedirects)
+		}
+		return nil
+	},
+}
+
+// http2ConnectionHeaders are not allowed in HTTP/2 requests.
+var http2ConnectionHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Host":              true,
+	"Content-Length":    true,
+}
+
+// checkHTTPVersion rejects versions other than 1.1 and 2. HTTP/2 needs an
+// https URL, since there is no cleartext HTTP/2 client to fall back on.
+func (s Server) checkHTTPVersion() error {
+	switch s.HTTPVersion {
+	case "", httpVersion11:
+		return nil
+	case httpVersion2:
+		if !strings.HasPrefix(strings.ToLower(s.URL), "https://") {
+			return fmt.Errorf("server %s uses HTTPVersion 2, which needs an https URL", s.URL)
+		}
+		return nil
+	}
+	return fmt.Errorf("server %s has HTTPVersion %q, want %q or %q", s.URL, s.HTTPVersion, httpVersion11, httpVersion2)
+}
+
+// doHTTP2 sends req with http2Client and copies the answer into resp, so
+// makeRequest handles it like any other response. The body is cut off at
+// -max-response-size the way fasthttp does it.
+func doHTTP2(req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	incoming, err := sendHTTP2(ctx, req, resp)
+	if err != nil {
+		return err
+	}
+	defer incoming.Body.Close()
+
+	body := io.Reader(incoming.Body)
+	if config.MaxResponseSize > 0 {
+		body = io.LimitReader(incoming.Body, int64(config.MaxResponseSize)+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if config.MaxResponseSize > 0 && len(data) > config.MaxResponseSize {
+		return fasthttp.ErrBodyTooLarge
+	}
+	resp.SetBody(data)
+	return nil
+}
+
+// doHTTP2Stream is doHTTP2 for streamed requests: resp gets the body as a
+// stream, which resp.CloseBodyStream closes, like the streaming client's.
+func doHTTP2Stream(req *fasthttp.Request, resp *fasthttp.Response) error {
+	incoming, err := sendHTTP2(context.Background(), req, resp)
+	if err != nil {
+		return err
+	}
+	resp.SetBodyStream(incoming.Body, int(incoming.ContentLength))
+	return nil
+}
+
+// sendHTTP2 sends req with http2Client and copies the status and headers of
+// the answer into resp. The caller must close the returned body.
+func sendHTTP2(ctx context.Context, req *fasthttp.Request, resp *fasthttp.Response) (*http.Response, error) {
+	outgoing, err := http.NewRequestWithContext(ctx, string(req.Header.Method()), req.URI().String(), bytes.NewReader(req.Body()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.VisitAll(func(key, value []byte) {
+		if name := http.CanonicalHeaderKey(string(key)); !http2ConnectionHeaders[name] {
+			outgoing.Header.Add(name, string(value))
+		}
+	})
+
+	incoming, err := http2Client.Do(outgoing)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.SetStatusCode(incoming.StatusCode)
+	for name, values := range incoming.Header {
+		for _, value := range values {
+			resp.Header.Add(name, value)
+		}
+	}
+	return incoming, nil
+}
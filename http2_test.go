@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCheckHTTPVersion(t *testing.T) {
+	tests := []struct {
+		url     string
+		version string
+		wantErr string
+	}{
+		{"http://a.example", "", ""},
+		{"http://a.example", "1.1", ""},
+		{"https://a.example", "2", ""},
+		{"HTTPS://a.example", "2", ""},
+		{"http://a.example", "2", "needs an https URL"},
+		{"https://a.example", "3", `HTTPVersion "3"`},
+		{"https://a.example", "2.0", `HTTPVersion "2.0"`},
+	}
+	for _, tt := range tests {
+		err := Server{URL: tt.url, HTTPVersion: tt.version}.checkHTTPVersion()
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s with HTTPVersion %q: error = %v, want %q", tt.url, tt.version, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServersFileHTTPVersion(t *testing.T) {
+	setup(t)
+	writeFile(t, serversFile, `[{"url":"http://a.example","HTTPVersion":"2"}]`)
+	if _, err := parseServerAddresses(serversFile); err == nil || !strings.Contains(err.Error(), "needs an https URL") {
+		t.Errorf("error = %v, want HTTP/2 over http rejected", err)
+	}
+}
+
+// http2Backend serves handler over https with HTTP/2, trusted by
+// http2Client for the test.
+func http2Backend(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	transport := http2Client.Transport
+	trusting := transport.(*http.Transport).Clone()
+	trusting.TLSClientConfig.RootCAs = roots
+	http2Client.Transport = trusting
+	t.Cleanup(func() {
+		trusting.CloseIdleConnections()
+		http2Client.Transport = transport
+	})
+	return server.URL
+}
+
+func TestHTTPVersionPerServer(t *testing.T) {
+	setup(t)
+	var protos sync.Map
+	h2 := http2Backend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos.Store(r.URL.Query().Get("url"), r.Proto)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"proto":%q}`, r.Proto)
+	}))
+	h1 := func(ctx *fasthttp.RequestCtx) {
+		protos.Store(string(ctx.QueryArgs().Peek("url")), string(ctx.Request.Header.Protocol()))
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"proto":"HTTP/1.1"}`)
+	}
+	writeFile(t, serversFile, `[{"url":"`+newBackend(t, h1)+`"},{"url":"`+h2+`","HTTPVersion":"2"},{"url":"`+newBackend(t, h1)+`","HTTPVersion":"1.1"}]`)
+
+	// The rotation sends one request to each server in turn.
+	want := []string{"HTTP/1.1", "HTTP/2.0", "HTTP/1.1", "HTTP/1.1", "HTTP/2.0", "HTTP/1.1"}
+	for i, proto := range want {
+		item := fmt.Sprintf("api.example.com/items/%d", i)
+		resp := proxyGet(t, target(item))
+		if resp.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("request %d: status = %d: %s", i, resp.StatusCode(), resp.Body())
+		}
+		if got, _ := protos.Load(item); got != proto {
+			t.Errorf("request %d arrived over %v, want %s", i, got, proto)
+		}
+		if body := string(resp.Body()); body != fmt.Sprintf(`{"proto":%q}`, proto) {
+			t.Errorf("request %d: body = %s", i, body)
+		}
+	}
+}
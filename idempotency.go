@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotencyInFlight holds a channel per idempotency key that is being
+// served right now. It is closed once the response has been stored.
+var idempotencyInFlight = struct {
+	sync.Mutex
+	keys map[string]chan struct{}
+}{keys: make(map[string]chan struct{})}
+
+// idempotencyResponses holds the responses replayed to requests repeating an
+// Idempotency-Key for -idempotency-window. They are kept apart from the
+// response cache, so -cache-ttl 0 or the cache kill switch do not turn
+// replays off with it.
+var idempotencyResponses = struct {
+	sync.Mutex
+	entries map[string]idempotentResponse
+}{entries: make(map[string]idempotentResponse)}
+
+type idempotentResponse struct {
+	response  upstreamResponse
+	expiresAt time.Time
+}
+
+func idempotencyGet(key string) (upstreamResponse, bool) {
+	idempotencyResponses.Lock()
+	defer idempotencyResponses.Unlock()
+	entry, ok := idempotencyResponses.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return upstreamResponse{}, false
+	}
+	return entry.response, true
+}
+
+func idempotencySet(key string, resp upstreamResponse) {
+	idempotencyResponses.Lock()
+	defer idempotencyResponses.Unlock()
+	idempotencyResponses.entries[key] = idempotentResponse{response: resp, expiresAt: time.Now().Add(config.IdempotencyWindow)}
+}
+
+// sweepIdempotency drops the responses whose window has passed.
+func sweepIdempotency(now time.Time) {
+	idempotencyResponses.Lock()
+	defer idempotencyResponses.Unlock()
+	for key, entry := range idempotencyResponses.entries {
+		if now.After(entry.expiresAt) {
+			delete(idempotencyResponses.entries, key)
+		}
+	}
+}
+
+// idempotencyCacheKey returns the key of idempotencyResponses for a request
+// carrying an Idempotency-Key header, or "" without one or with -idempotency-window
+// unset. The method and target are part of the key, so reusing a key for a
+// different request does not return an unrelated response.
+func idempotencyCacheKey(ctx *fasthttp.RequestCtx, decodedURL string) string {
+	if config.IdempotencyWindow <= 0 {
+		return ""
+	}
+	key := string(ctx.Request.Header.Peek(idempotencyHeader))
+	if key == "" {
+		return ""
+	}
+	return "idempotency:" + key + " " + string(ctx.Method()) + " " + decodedURL
+}
+
+// beginIdempotent waits while another request with the same key is in
+// flight, up to the upstream timeout, and then registers this one. The
+// returned function must be called when the request is done.
+func beginIdempotent(key string, wait time.Duration) func() {
+	idempotencyInFlight.Lock()
+	for {
+		inFlight, ok := idempotencyInFlight.keys[key]
+		if !ok {
+			break
+		}
+		idempotencyInFlight.Unlock()
+		timedOut := !waitIdempotent(inFlight, wait)
+		idempotencyInFlight.Lock()
+		if timedOut {
+			break
+		}
+	}
+
+	done := make(chan struct{})
+	idempotencyInFlight.keys[key] = done
+	idempotencyInFlight.Unlock()
+
+	return func() {
+		idempotencyInFlight.Lock()
+		if idempotencyInFlight.keys[key] == done {
+			delete(idempotencyInFlight.keys, key)
+		}
+		idempotencyInFlight.Unlock()
+		close(done)
+	}
+}
+
+func waitIdempotent(done chan struct{}, wait time.Duration) bool {
+	if wait <= 0 {
+		<-done
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// sequenceBackend answers every request with its number, so replayed
+// responses can be told from fresh ones.
+func sequenceBackend(t *testing.T, count *atomic.Int64) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("application/json")
+		fmt.Fprintf(ctx, `{"n":%d}`, count.Add(1))
+	})
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	type request struct {
+		method, url, key string
+	}
+	tests := []struct {
+		name     string
+		window   time.Duration
+		second   request
+		upstream int64
+	}{
+		{"same key replays", time.Minute, request{"POST", "api.example.com/orders", "k1"}, 1},
+		{"other key", time.Minute, request{"POST", "api.example.com/orders", "k2"}, 2},
+		{"no key", time.Minute, request{"POST", "api.example.com/orders", ""}, 2},
+		{"same key, other method", time.Minute, request{"PUT", "api.example.com/orders", "k1"}, 2},
+		{"same key, other target", time.Minute, request{"POST", "api.example.com/refunds", "k1"}, 2},
+		{"disabled", 0, request{"POST", "api.example.com/orders", "k1"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.ForwardBody = true
+			config.IdempotencyWindow = tt.window
+			var requests atomic.Int64
+			writeServers(t, sequenceBackend(t, &requests))
+
+			first := proxyDo(t, fasthttp.MethodPost, target("api.example.com/orders"), `{"amount":1}`, "Content-Type", "application/json", "Idempotency-Key", "k1")
+			firstBody := string(first.Body())
+			var headers []string
+			if tt.second.key != "" {
+				headers = []string{"Idempotency-Key", tt.second.key}
+			}
+			second := proxyDo(t, tt.second.method, target(tt.second.url), `{"amount":1}`, append(headers, "Content-Type", "application/json")...)
+
+			if requests.Load() != tt.upstream {
+				t.Errorf("upstream requests = %d, want %d", requests.Load(), tt.upstream)
+			}
+			if replayed := string(second.Body()) == firstBody; replayed != (tt.upstream == 1) {
+				t.Errorf("second response %s, first %s", second.Body(), firstBody)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeyConcurrent(t *testing.T) {
+	setup(t)
+	config.ForwardBody = true
+	config.IdempotencyWindow = time.Minute
+	var requests atomic.Int64
+	release := make(chan struct{})
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		n := requests.Add(1)
+		<-release
+		ctx.SetContentType("application/json")
+		fmt.Fprintf(ctx, `{"n":%d}`, n)
+	}))
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 3)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp := proxyDo(t, fasthttp.MethodPost, target("api.example.com/orders"), `{}`, "Content-Type", "application/json", "Idempotency-Key", "k1")
+			bodies[i] = string(resp.Body())
+		}(i)
+	}
+	waitFor(t, "the first request to reach the server", func() bool { return requests.Load() == 1 })
+	// The other two are waiting on the first rather than fetching.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if requests.Load() != 1 {
+		t.Errorf("upstream requests = %d, want 1 for three requests sharing a key", requests.Load())
+	}
+	for i, body := range bodies {
+		if body != `{"n":1}` {
+			t.Errorf("response %d = %s, want the first one's", i, body)
+		}
+	}
+}
+
+func TestIdempotencyWithoutCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		cacheTTL time.Duration
+		disabled bool // the cache kill switch is on
+		noCache  bool // the requests ask to bypass the cache
+	}{
+		{"cache-ttl 0", 0, false, false},
+		{"cache switched off", time.Minute, true, false},
+		{"no-cache requests", time.Minute, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.ForwardBody = true
+			config.CacheTTL = tt.cacheTTL
+			setCacheLifetime(tt.cacheTTL)
+			cacheDisabled.Store(tt.disabled)
+			config.IdempotencyWindow = 10 * time.Minute
+			var requests atomic.Int64
+			writeServers(t, sequenceBackend(t, &requests))
+
+			headers := []string{"Content-Type", "application/json", "Idempotency-Key", "k1"}
+			if tt.noCache {
+				headers = append(headers, "X-No-Cache", "true")
+			}
+			var bodies []string
+			for i := 0; i < 2; i++ {
+				resp := proxyDo(t, fasthttp.MethodPost, target("api.example.com/orders"), `{"amount":1}`, headers...)
+				bodies = append(bodies, string(resp.Body()))
+			}
+			if requests.Load() != 1 {
+				t.Errorf("upstream requests = %d, want 1", requests.Load())
+			}
+			if bodies[1] != bodies[0] {
+				t.Errorf("second response %s, want the first one's %s", bodies[1], bodies[0])
+			}
+		})
+	}
+}
+
+func TestSweepIdempotency(t *testing.T) {
+	setup(t)
+	config.IdempotencyWindow = time.Minute
+	idempotencySet("old", upstreamResponse{Body: `{}`})
+	sweepIdempotency(time.Now().Add(30 * time.Second))
+	if _, ok := idempotencyGet("old"); !ok {
+		t.Fatal("response dropped within the window")
+	}
+	sweepIdempotency(time.Now().Add(2 * time.Minute))
+	idempotencyResponses.Lock()
+	defer idempotencyResponses.Unlock()
+	if len(idempotencyResponses.entries) != 0 {
+		t.Errorf("entries after the window = %v, want none", idempotencyResponses.entries)
+	}
+}
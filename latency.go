@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// latencyWeight is how much each new sample moves a server's average.
+const latencyWeight = 0.2
+
+// recordLatency folds the duration of a successful attempt into the server's
+// moving average. A server whose average has stayed above -latency-sla for
+// -latency-sla-window is demoted; it is promoted again as soon as its average
+// drops back under the SLA.
+func recordLatency(server string, elapsed time.Duration) {
+	if config.LatencySLA <= 0 {
+		return
+	}
+
+	health.Lock()
+	defer health.Unlock()
+
+	h := healthFor(server)
+	now := time.Now()
+	if h.LatencySampledAt.IsZero() {
+		h.Latency = elapsed
+	} else {
+		h.Latency += time.Duration(latencyWeight * float64(elapsed-h.Latency))
+	}
+	h.LatencySampledAt = now
+
+	if h.Latency <= config.LatencySLA {
+		if h.Demoted {
+			fmt.Printf("Server %s is back within the latency SLA (%v)\n", server, h.Latency)
+		}
+		h.SlowSince = time.Time{}
+		h.Demoted = false
+		return
+	}
+
+	if h.SlowSince.IsZero() {
+		h.SlowSince = now
+	}
+	if !h.Demoted && now.Sub(h.SlowSince) >= config.LatencySLAWindow {
+		fmt.Printf("Server %s demoted: average latency %v over the %v SLA\n", server, h.Latency, config.LatencySLA)
+		h.Demoted = true
+	}
+}
+
+// isDemoted reports whether server is currently demoted. A demoted server only
+// gets traffic when the others fail, so its average would rarely change; once
+// it has gone a whole window without a sample it is given another chance.
+func (h *serverHealth) isDemoted(now time.Time) bool {
+	if !h.Demoted {
+		return false
+	}
+	if now.Sub(h.LatencySampledAt) >= config.LatencySLAWindow {
+		h.Demoted = false
+		h.SlowSince = time.Time{}
+		return false
+	}
+	return true
+}
+
+// demoteSlowServers moves demoted servers to the end of the list, keeping the
+// order within both groups.
+func demoteSlowServers(servers []Server) []Server {
+	if config.LatencySLA <= 0 {
+		return servers
+	}
+
+	health.Lock()
+	now := time.Now()
+	demoted := make(map[string]bool)
+	for _, server := range servers {
+		demoted[server.URL] = healthFor(server.URL).isDemoted(now)
+	}
+	health.Unlock()
+
+	sorted := append([]Server(nil), servers...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return !demoted[sorted[i].URL] && demoted[sorted[j].URL]
+	})
+	return sorted
+}
+
+// withinSLA returns how many of servers, as ordered by demoteSlowServers, are
+// not demoted. Rotation only moves among those, so a demoted server is not
+// picked first just because the rotation reached it. With every server
+// demoted they all rotate.
+func withinSLA(servers []Server) int {
+	if config.LatencySLA <= 0 {
+		return len(servers)
+	}
+
+	health.Lock()
+	defer health.Unlock()
+	now := time.Now()
+	for i, server := range servers {
+		if healthFor(server.URL).isDemoted(now) {
+			if i == 0 {
+				return len(servers)
+			}
+			return i
+		}
+	}
+	return len(servers)
+}
+
+// rotationIndex is the index of the nth server a request tries: the first
+// preferred servers starting at first, then the demoted rest in order.
+func rotationIndex(first int, n int, preferred int) int {
+	if n < preferred {
+		return (first + n) % preferred
+	}
+	return n
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestSlowServerDemoted(t *testing.T) {
+	setup(t)
+	config.LatencySLA = 10 * time.Millisecond
+	config.LatencySLAWindow = 50 * time.Millisecond
+	slow := newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(30 * time.Millisecond)
+		ctx.SetContentType("application/json")
+		fmt.Fprintf(ctx, `{"server":"http://%s"}`, ctx.Host())
+	})
+	fast := namedBackend(t)
+	writeServers(t, slow, fast)
+
+	for i := 0; !serverStatsSnapshot()[slow].Demoted; i++ {
+		if i == 20 {
+			t.Fatalf("slow server not demoted after %d requests: %+v", i, serverStatsSnapshot()[slow])
+		}
+		resp := proxyGet(t, target(fmt.Sprintf("api.example.com/warmup/%d", i)))
+		if resp.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("status = %d", resp.StatusCode())
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		if got := servedBy(t, proxyGet(t, target(fmt.Sprintf("api.example.com/demoted/%d", i)))); got != fast {
+			t.Errorf("request %d served by %s, want the fast server while the slow one is demoted", i, got)
+		}
+	}
+	if stats := serverStatsSnapshot()[fast]; stats.Demoted {
+		t.Errorf("fast server demoted: %+v", stats)
+	}
+}
+
+func TestRecordLatency(t *testing.T) {
+	const sla = 10 * time.Millisecond
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		wait    time.Duration // before the last sample
+		demoted bool
+	}{
+		{"within the SLA", []time.Duration{5 * time.Millisecond, 8 * time.Millisecond}, 0, false},
+		{"slow for less than the window", []time.Duration{50 * time.Millisecond, 50 * time.Millisecond}, 0, false},
+		{"slow for the whole window", []time.Duration{50 * time.Millisecond, 50 * time.Millisecond}, 30 * time.Millisecond, true},
+		{"one slow outlier", []time.Duration{time.Millisecond, time.Millisecond, 30 * time.Millisecond}, 30 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.LatencySLA = sla
+			config.LatencySLAWindow = 20 * time.Millisecond
+			for i, sample := range tt.samples {
+				if i == len(tt.samples)-1 {
+					time.Sleep(tt.wait)
+				}
+				recordLatency("http://server.test", sample)
+			}
+			health.Lock()
+			demoted := healthFor("http://server.test").Demoted
+			health.Unlock()
+			if demoted != tt.demoted {
+				t.Errorf("demoted = %v, want %v", demoted, tt.demoted)
+			}
+		})
+	}
+}
+
+func TestRotationIndex(t *testing.T) {
+	tests := []struct {
+		name             string
+		first, preferred int
+		total            int
+		want             []int
+	}{
+		{"nothing demoted", 2, 4, 4, []int{2, 3, 0, 1}},
+		{"last two demoted", 1, 2, 4, []int{1, 0, 2, 3}},
+		{"start at the first", 0, 3, 4, []int{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for n := 0; n < tt.total; n++ {
+				got = append(got, rotationIndex(tt.first, n, tt.preferred))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// priorityLimiter is a counting semaphore with two wait queues. When a slot
+// frees up it is handed to the oldest high-priority waiter first, so
+// latency-critical requests are not starved by queued batch traffic.
+type priorityLimiter struct {
+	sync.Mutex
+	slots  int
+	high   []chan struct{}
+	normal []chan struct{}
+}
+
+func newPriorityLimiter(size int) *priorityLimiter {
+	return &priorityLimiter{slots: size}
+}
+
+func (l *priorityLimiter) acquire(highPriority bool) {
+	l.Lock()
+	if l.slots > 0 {
+		l.slots--
+		l.Unlock()
+		return
+	}
+
+	wait := make(chan struct{})
+	if highPriority {
+		l.high = append(l.high, wait)
+	} else {
+		l.normal = append(l.normal, wait)
+	}
+	l.Unlock()
+
+	<-wait
+}
+
+func (l *priorityLimiter) release() {
+	l.Lock()
+	defer l.Unlock()
+
+	switch {
+	case len(l.high) > 0:
+		close(l.high[0])
+		l.high = l.high[1:]
+	case len(l.normal) > 0:
+		close(l.normal[0])
+		l.normal = l.normal[1:]
+	default:
+		l.slots++
+	}
+}
+
+func isHighPriority(ctx *fasthttp.RequestCtx) bool {
+	if config.PriorityHeader == "" {
+		return false
+	}
+	return strings.EqualFold(string(ctx.Request.Header.Peek(config.PriorityHeader)), "high")
+}
+
+// attemptSlots bounds the number of upstream attempts in flight across all
+// requests. It is nil when -max-inflight-attempts is not set.
+var attemptSlots chan struct{}
+
+func acquireAttempt() bool {
+	if attemptSlots != nil {
+		timer := time.NewTimer(config.InflightWait)
+		defer timer.Stop()
+
+		select {
+		case attemptSlots <- struct{}{}:
+		case <-timer.C:
+			return false
+		}
+	}
+
+	stats.UpstreamInFlight.Add(1)
+	return true
+}
+
+func releaseAttempt() {
+	stats.UpstreamInFlight.Add(-1)
+	if attemptSlots != nil {
+		<-attemptSlots
+	}
+}
+
+// targetSlots holds a semaphore per target host with -target-concurrency.
+// An entry lives while requests hold or wait for one of its slots.
+var targetSlots = struct {
+	sync.Mutex
+	hosts map[string]*targetSlot
+}{hosts: make(map[string]*targetSlot)}
+
+type targetSlot struct {
+	slots chan struct{}
+	users int
+}
+
+// acquireTarget takes one of the -target-concurrency slots of host, waiting
+// up to -target-concurrency-wait. The returned function gives it back; it
+// is nil when no slot freed up in time. Hosts differing only in case share
+// their slots.
+func acquireTarget(host string) func() {
+	if config.TargetConcurrency <= 0 {
+		return func() {}
+	}
+	host = strings.ToLower(host)
+
+	targetSlots.Lock()
+	slot, ok := targetSlots.hosts[host]
+	if !ok {
+		slot = &targetSlot{slots: make(chan struct{}, config.TargetConcurrency)}
+		targetSlots.hosts[host] = slot
+	}
+	slot.users++
+	targetSlots.Unlock()
+
+	leave := func() {
+		targetSlots.Lock()
+		if slot.users--; slot.users == 0 {
+			delete(targetSlots.hosts, host)
+		}
+		targetSlots.Unlock()
+	}
+
+	timer := time.NewTimer(config.TargetConcurrencyWait)
+	defer timer.Stop()
+	select {
+	case slot.slots <- struct{}{}:
+		return func() {
+			<-slot.slots
+			leave()
+		}
+	case <-timer.C:
+		leave()
+		return nil
+	}
+}
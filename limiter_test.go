@@ -0,0 +1,224 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestPriorityLimiterOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		queued string // priorities of the waiters in arrival order
+		want   string // order in which they get the slot
+	}{
+		{"normal only", "nnn", "nnn"},
+		{"high overtakes normal", "nnh", "hnn"},
+		{"high keeps arrival order", "hnh", "hhn"},
+		{"high only", "hh", "hh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newPriorityLimiter(1)
+			l.acquire(false)
+
+			var mu sync.Mutex
+			var order strings.Builder
+			var wg sync.WaitGroup
+			for i, priority := range tt.queued {
+				wg.Add(1)
+				go func(priority rune) {
+					defer wg.Done()
+					l.acquire(priority == 'h')
+					mu.Lock()
+					order.WriteRune(priority)
+					mu.Unlock()
+					l.release()
+				}(priority)
+				waitFor(t, "the waiter to queue", func() bool {
+					l.Lock()
+					defer l.Unlock()
+					return len(l.high)+len(l.normal) == i+1
+				})
+			}
+
+			l.release()
+			wg.Wait()
+			if got := order.String(); got != tt.want {
+				t.Errorf("dispatch order = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsHighPriority(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   bool
+	}{
+		{"no priority header configured", "", "high", false},
+		{"high", "X-Priority", "high", true},
+		{"case-insensitive", "X-Priority", "HIGH", true},
+		{"other value", "X-Priority", "low", false},
+		{"missing", "X-Priority", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.PriorityHeader = tt.header
+			var ctx fasthttp.RequestCtx
+			if tt.value != "" {
+				ctx.Request.Header.Set("X-Priority", tt.value)
+			}
+			if got := isHighPriority(&ctx); got != tt.want {
+				t.Errorf("isHighPriority = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxInflightAttempts(t *testing.T) {
+	setup(t)
+	config.MaxInflightAttempts = 1
+	config.InflightWait = 20 * time.Millisecond
+	attemptSlots = make(chan struct{}, config.MaxInflightAttempts)
+
+	release := make(chan struct{})
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		if strings.Contains(string(ctx.QueryArgs().Peek("url")), "slow") {
+			<-release
+		}
+		ctx.SetBodyString(`{}`)
+	}))
+
+	slow := make(chan int)
+	go func() {
+		slow <- proxyGet(t, target("api.example.com/slow")).StatusCode()
+	}()
+	waitFor(t, "the slow attempt to start", func() bool { return stats.UpstreamInFlight.Load() == 1 })
+
+	var snapshot statsSnapshot
+	if err := json.Unmarshal(proxyGet(t, "/stats").Body(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Upstream.InFlight != 1 {
+		t.Errorf("in_flight in /stats = %d, want 1", snapshot.Upstream.InFlight)
+	}
+
+	resp := proxyGet(t, target("api.example.com/blocked"))
+	if resp.StatusCode() != fasthttp.StatusServiceUnavailable || !strings.Contains(string(resp.Body()), "Too many upstream requests in flight") {
+		t.Errorf("request while saturated: %d %s, want 503", resp.StatusCode(), resp.Body())
+	}
+
+	close(release)
+	if status := <-slow; status != fasthttp.StatusOK {
+		t.Errorf("slow request status = %d, want 200", status)
+	}
+	if status := proxyGet(t, target("api.example.com/after")).StatusCode(); status != fasthttp.StatusOK {
+		t.Errorf("status once the slot is free = %d, want 200", status)
+	}
+	if got := stats.UpstreamInFlight.Load(); got != 0 {
+		t.Errorf("in-flight attempts after every request finished = %d", got)
+	}
+}
+
+func TestAcquireTarget(t *testing.T) {
+	setup(t)
+	config.TargetConcurrency = 2
+	config.TargetConcurrencyWait = 10 * time.Millisecond
+
+	first, second := acquireTarget("a.example"), acquireTarget("A.example")
+	if first == nil || second == nil {
+		t.Fatal("the first two requests got no slot")
+	}
+	if acquireTarget("a.example") != nil {
+		t.Error("a third request got a slot")
+	}
+	other := acquireTarget("b.example")
+	if other == nil {
+		t.Fatal("another host got no slot")
+	}
+	other()
+
+	// A slot given back while a request waits goes to that request.
+	config.TargetConcurrencyWait = 10 * time.Second
+	got := make(chan func())
+	go func() { got <- acquireTarget("a.example") }()
+	waitFor(t, "the request to wait", func() bool {
+		targetSlots.Lock()
+		defer targetSlots.Unlock()
+		return targetSlots.hosts["a.example"].users == 3
+	})
+	first()
+	third := <-got
+	if third == nil {
+		t.Fatal("the waiting request got no slot once one was given back")
+	}
+	second()
+	third()
+
+	targetSlots.Lock()
+	defer targetSlots.Unlock()
+	if len(targetSlots.hosts) != 0 {
+		t.Errorf("hosts left after every slot was given back: %v", targetSlots.hosts)
+	}
+}
+
+func TestTargetConcurrency(t *testing.T) {
+	setup(t)
+	config.TargetConcurrency = 2
+	config.TargetConcurrencyWait = 10 * time.Millisecond
+	release := make(chan struct{})
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		if strings.Contains(string(ctx.QueryArgs().Peek("url")), "slow") {
+			<-release
+		}
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{}`)
+	}))
+	cacheStore(cacheKey("https://busy.example/cached"), upstreamResponse{Body: `{"cached":true}`, ContentType: "application/json"}, time.Now(), time.Now().Add(time.Minute))
+
+	var wg sync.WaitGroup
+	statuses := make([]int, config.TargetConcurrency)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = proxyGet(t, target("https://busy.example/slow/"+strconv.Itoa(i))).StatusCode()
+		}(i)
+	}
+	waitFor(t, "the slow requests to hold every slot", func() bool { return stats.UpstreamInFlight.Load() == 2 })
+
+	for _, uri := range []string{"https://BUSY.example/other", "busy.example/other"} {
+		resp := proxyGet(t, target(uri))
+		if resp.StatusCode() != fasthttp.StatusTooManyRequests || !strings.Contains(string(resp.Body()), `"target_busy"`) {
+			t.Errorf("%s over the limit: %d %s, want 429 target_busy", uri, resp.StatusCode(), resp.Body())
+		}
+		if got := string(resp.Header.Peek("Retry-After")); got != "1" {
+			t.Errorf("%s Retry-After = %q, want 1", uri, got)
+		}
+	}
+	if resp := proxyGet(t, target("https://quiet.example/other")); resp.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("request to another host: %d %s, want 200", resp.StatusCode(), resp.Body())
+	}
+	if resp := proxyGet(t, target("https://busy.example/cached")); string(resp.Body()) != `{"cached":true}` {
+		t.Errorf("cache hit for the busy host: %d %s, want it served", resp.StatusCode(), resp.Body())
+	}
+
+	close(release)
+	wg.Wait()
+	for i, status := range statuses {
+		if status != fasthttp.StatusOK {
+			t.Errorf("slow request %d: status = %d, want 200", i, status)
+		}
+	}
+	if resp := proxyGet(t, target("https://busy.example/other")); resp.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("request once the slots are free: %d %s, want 200", resp.StatusCode(), resp.Body())
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	for _, mode := range []string{"0660", "0600"} {
+		t.Run(mode, func(t *testing.T) {
+			setup(t)
+			config.SocketMode = mode
+			writeServers(t, jsonBackend(t, `{"via":"socket"}`))
+			path := filepath.Join(t.TempDir(), "proxy.sock")
+
+			ln, err := listen("unix:" + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go (&fasthttp.Server{Handler: handleRoutes}).Serve(ln)
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Mode().Perm().String(); got != map[string]string{"0660": "-rw-rw----", "0600": "-rw-------"}[mode] {
+				t.Errorf("socket permissions = %s, want %s", got, mode)
+			}
+
+			client := &fasthttp.Client{Dial: func(string) (net.Conn, error) { return net.Dial("unix", path) }}
+			status, body, err := client.GetTimeout(nil, "http://proxy.test"+target("api.example.com/socket"), 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != fasthttp.StatusOK || string(body) != `{"via":"socket"}` {
+				t.Errorf("status = %d, body = %s", status, body)
+			}
+
+			ln.Close()
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Errorf("socket file left behind after closing: %v", err)
+			}
+			if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 0 {
+				t.Errorf("files left in the socket directory: %v", entries)
+			}
+		})
+	}
+}
+
+func TestListenExistingFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, path string)
+		want    string // in the error, "" for none
+	}{
+		{
+			name: "stale socket",
+			prepare: func(t *testing.T, path string) {
+				ln, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ln.(*net.UnixListener).SetUnlinkOnClose(false)
+				ln.Close()
+			},
+		},
+		{
+			name: "socket in use",
+			prepare: func(t *testing.T, path string) {
+				ln, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { ln.Close() })
+			},
+			want: "already in use by another process",
+		},
+		{
+			name:    "regular file",
+			prepare: func(t *testing.T, path string) { writeFile(t, path, "data") },
+			want:    "exists and is not a socket",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			path := filepath.Join(t.TempDir(), "proxy.sock")
+			tt.prepare(t, path)
+
+			var ln net.Listener
+			var err error
+			output := captureOutput(t, func() { ln, err = listen("unix:" + path) })
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				ln.Close()
+				if !strings.Contains(output, "Removing stale socket "+path) {
+					t.Errorf("output %q does not log the removal", output)
+				}
+				return
+			}
+			if err == nil {
+				ln.Close()
+				t.Fatalf("listen succeeded, want an error saying %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one saying %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenInvalidSocketMode(t *testing.T) {
+	setup(t)
+	config.SocketMode = "rw-rw----"
+	if ln, err := listen("unix:" + filepath.Join(t.TempDir(), "proxy.sock")); err == nil {
+		ln.Close()
+		t.Error("listen accepted an invalid -socket-mode")
+	}
+}
+
+func TestClientTimeouts(t *testing.T) {
+	tests := []struct {
+		name string
+		// send is what the client writes before going quiet.
+		send     string
+		answered bool
+	}{
+		{"request trickling in", "GET /?url=api.example.com/slow HTTP/1.1\r\nHost: proxy.test\r\n", false},
+		{"idle keep-alive connection", "GET /?url=api.example.com/slow HTTP/1.1\r\nHost: proxy.test\r\n\r\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.ReadTimeout = 200 * time.Millisecond
+			config.IdleTimeout = 200 * time.Millisecond
+			writeServers(t, jsonBackend(t, `{}`))
+			ln, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go newServer().Serve(ln)
+			t.Cleanup(func() { ln.Close() })
+
+			conn, err := net.Dial("tcp4", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			start := time.Now()
+			if _, err := conn.Write([]byte(tt.send)); err != nil {
+				t.Fatal(err)
+			}
+			// Whatever the server answers, the connection has to be closed
+			// soon after the timeout, not held open.
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var received []byte
+			buf := make([]byte, 4096)
+			for {
+				var n int
+				n, err = conn.Read(buf)
+				received = append(received, buf[:n]...)
+				if err != nil {
+					break
+				}
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatalf("connection still open after %s", time.Since(start))
+			}
+			if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+				t.Errorf("connection closed after %s, before the timeout", elapsed)
+			}
+			if answered := strings.HasPrefix(string(received), "HTTP/1.1 200"); answered != tt.answered {
+				t.Errorf("answered = %v, want %v: %q", answered, tt.answered, received)
+			}
+		})
+	}
+}
+
+func TestClientTimeoutDefaults(t *testing.T) {
+	setup(t)
+	server := newServer()
+	if server.ReadTimeout != 30*time.Second || server.IdleTimeout != time.Minute {
+		t.Errorf("ReadTimeout = %s, IdleTimeout = %s, want 30s and 1m", server.ReadTimeout, server.IdleTimeout)
+	}
+}
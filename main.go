@@ -1,13 +1,19 @@
 package main
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	jsoniter "github.com/json-iterator/go"
@@ -17,100 +23,988 @@ import (
 type ErrorResponse struct {
 	Message string `json:"message"`
 	Code    int    `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// UpstreamBody is the error body of the server's response with
+	// -upstream-errors wrap.
+	UpstreamBody string `json:"upstream_body,omitempty"`
 }
 
-type cachedData struct {
-	Value     string
-	ExpiresAt time.Time
+// upstreamResponse is a successful response from a server, as returned by
+// makeRequest and stored in the cache.
+type upstreamResponse struct {
+	Body        string
+	ContentType string
+
+	// StatusCode and Location are only set for redirects passed through
+	// with -follow-redirects=false; a zero StatusCode means 200.
+	StatusCode int
+	Location   string
+	// CacheControl is the redirect's own Cache-Control, see
+	// redirectCacheTTL.
+	CacheControl string
+
+	// Headers are the upstream response headers forwarded with
+	// -forward-headers.
+	Headers []headerField
+
+	// Timing is only set on responses fresh from a server.
+	Timing upstreamTiming
+
+	// CacheHits is how often a response served from the local cache has
+	// been served, this time included.
+	CacheHits int64
 }
 
 type HTTPError struct {
 	Code int
 	Body string
+	// Upstream is set when Body is the error response of the server itself
+	// rather than a message from the proxy, with its ContentType.
+	Upstream    bool
+	ContentType string
+	// Reason is sent as the "error" field of the JSON error, e.g.
+	// "redirect_loop".
+	Reason string
 }
 
+const maxUpstreamRedirects = 16
+
 var (
-	cache = struct {
-		sync.RWMutex
-		data          map[string]cachedData
-		cacheLifetime time.Duration
-	}{data: make(map[string]cachedData), cacheLifetime: time.Minute}
-
-	json        = jsoniter.ConfigCompatibleWithStandardLibrary
-	serverIndex int
+	json            = jsoniter.ConfigCompatibleWithStandardLibrary
+	jsonLine        = jsoniter.ConfigCompatibleWithStandardLibrary
+	serverIndex     atomic.Uint64
+	upstreamLimiter *priorityLimiter
+
+	softErrorPattern *regexp.Regexp
 )
 
 func main() {
-	server := &fasthttp.Server{
-		Handler:        handleRequests,
-		ReadBufferSize: 8192,
+	parseFlags()
+
+	if config.MaxConcurrency > 0 {
+		upstreamLimiter = newPriorityLimiter(config.MaxConcurrency)
+	}
+	if config.MaxInflightAttempts > 0 {
+		attemptSlots = make(chan struct{}, config.MaxInflightAttempts)
+	}
+	initRetryBudget()
+	upstreamClient.MaxResponseBodySize = config.MaxResponseSize
+
+	var err error
+	if json, jsonLine, err = jsonConfig(config.JSONMode); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if responseChain, err = buildResponseChain(config.ResponseMiddleware); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if config.SoftErrorPattern != "" {
+		if softErrorPattern, err = regexp.Compile(config.SoftErrorPattern); err != nil {
+			fmt.Printf("Error: invalid -soft-error-pattern: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.PendingPattern != "" {
+		if pendingPattern, err = regexp.Compile(config.PendingPattern); err != nil {
+			fmt.Printf("Error: invalid -pending-pattern: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if pendingFields, err = parsePendingFields(config.PendingFields); err != nil {
+		fmt.Printf("Error: invalid -pending-fields: %s\n", err)
+		os.Exit(1)
+	}
+
+	if config.AffinityCookie != "" && config.AffinitySecret == "" {
+		fmt.Printf("Error: -affinity-cookie needs -affinity-secret\n")
+		os.Exit(1)
+	}
+
+	if allowedPorts, err = parseAllowedPorts(config.AllowedPorts); err != nil {
+		fmt.Printf("Error: invalid -allowed-ports: %s\n", err)
+		os.Exit(1)
+	}
+
+	if config.CacheHitRatioAlarm > 0 && config.CacheHitRatioWindow <= 0 {
+		fmt.Printf("Error: -cache-hit-ratio-window must be positive\n")
+		os.Exit(1)
+	}
+
+	if config.GlobalBreakerThreshold > 0 && (config.GlobalBreakerWindow <= 0 || config.GlobalBreakerRamp <= 0) {
+		fmt.Printf("Error: -global-breaker-window and -global-breaker-ramp must be positive\n")
+		os.Exit(1)
+	}
+
+	if config.StatsFile != "" && config.StatsInterval <= 0 {
+		fmt.Printf("Error: -stats-interval must be positive\n")
+		os.Exit(1)
+	}
+
+	if config.UpstreamErrors != "message" && config.UpstreamErrors != "wrap" && config.UpstreamErrors != "raw" {
+		fmt.Printf("Error: -upstream-errors must be message, wrap or raw\n")
+		os.Exit(1)
+	}
+
+	if config.LogFormat != "text" && config.LogFormat != "json" {
+		fmt.Printf("Error: -log-format must be text or json\n")
+		os.Exit(1)
+	}
+
+	switch config.AccessLogFormat {
+	case "", "clf", "combined", "json":
+	default:
+		fmt.Printf("Error: -access-log-format must be clf, combined or json\n")
+		os.Exit(1)
+	}
+
+	if config.ExhaustionStatus < 400 || config.ExhaustionStatus > 599 {
+		fmt.Printf("Error: -exhaustion-status must be a 4xx or 5xx status code\n")
+		os.Exit(1)
+	}
+
+	if config.RemoteCacheFailMode != "open" && config.RemoteCacheFailMode != "closed" {
+		fmt.Printf("Error: -remote-cache-fail-mode must be open or closed\n")
+		os.Exit(1)
+	}
+
+	if config.CacheTTL < 0 {
+		fmt.Printf("Error: -cache-ttl must not be negative\n")
+		os.Exit(1)
+	}
+	if config.TimeoutDecay <= 0 || config.TimeoutDecay > 1 {
+		fmt.Printf("Error: -timeout-decay must be greater than 0 and at most 1\n")
+		os.Exit(1)
+	}
+	if config.NormalizeCharset != "" {
+		charset, ok := normalizeCharsets[strings.ToLower(config.NormalizeCharset)]
+		if !ok {
+			fmt.Printf("Error: -normalize-charset must be iso-8859-1 or windows-1252\n")
+			os.Exit(1)
+		}
+		config.NormalizeCharset = charset
+	}
+	if config.HealthPath != "" && !strings.HasPrefix(config.HealthPath, "/") {
+		fmt.Printf("Error: -health-path must start with /\n")
+		os.Exit(1)
+	}
+	if config.EscalateAfter > 0 && config.EscalateFanout < 2 {
+		fmt.Printf("Error: -escalate-fanout must be at least 2\n")
+		os.Exit(1)
+	}
+	if config.MaxStaleAge < 0 {
+		fmt.Printf("Error: -max-stale-age must not be negative\n")
+		os.Exit(1)
+	}
+	setCacheLifetime(config.CacheTTL)
+
+	if ttlSizeBuckets, err = parseTTLSizeBuckets(config.CacheTTLSizeBuckets); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if routeTTLRules, err = parseTTLRules(config.CacheTTLRoutes); err != nil {
+		fmt.Printf("Error: -cache-ttl-routes: %s\n", err)
+		os.Exit(1)
+	}
+	if hostTTLRules, err = parseTTLRules(config.CacheTTLHosts); err != nil {
+		fmt.Printf("Error: -cache-ttl-hosts: %s\n", err)
+		os.Exit(1)
+	}
+	if poolRoutes, err = parsePoolRoutes(config.PoolRoutes); err != nil {
+		fmt.Printf("Error: -pool-routes: %s\n", err)
+		os.Exit(1)
+	}
+
+	if quotaWindows, err = parseQuotaWindows(config.Quotas); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if config.QuotaClients != "" {
+		if quotaClientNames, err = loadQuotaClients(config.QuotaClients); err != nil {
+			fmt.Printf("Error: loading -quota-clients from %s failed: %s\n", config.QuotaClients, err)
+			os.Exit(1)
+		}
+	}
+	if config.QuotaFile != "" && len(quotaWindows) > 0 {
+		if err := loadQuotas(config.QuotaFile); err != nil {
+			fmt.Printf("Error: loading quotas from %s failed: %s\n", config.QuotaFile, err)
+			os.Exit(1)
+		}
+	}
+
+	loaded, err := loadFileConfig()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	files.Store(loaded)
+	applySettings(nil, loaded)
+
+	if config.SelfTest != "" {
+		os.Exit(runSelfTest(config.SelfTest, config.SelfTestInstance))
+	}
+
+	if config.CacheImport != "" {
+		imported, err := importCache(config.CacheImport)
+		if err != nil {
+			fmt.Printf("Error: cache import from %s failed: %s\n", config.CacheImport, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Imported %d cache entries from %s\n", imported, config.CacheImport)
+	}
+
+	startWebhook()
+	startPrewarm()
+	startHealthChecks()
+	startCacheSweeper()
+	startQuotaPersistence()
+	stopStatsFile := startStatsFile()
+	startReloadOnSignal()
+
+	tlsConfig, err := buildTLSConfig(config.TLSMinVersion, config.TLSCiphers)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		fmt.Println("Error: -tls-cert and -tls-key must be set together")
+		os.Exit(1)
 	}
 
-	fmt.Println("Server listening on :9001...")
-	if err := server.ListenAndServe(":9001"); err != nil {
+	server := newServer()
+	if config.TLSCert != "" {
+		server.TLSConfig = tlsConfig
+	}
+
+	printStartupBanner()
+	if err := serveUntilSignal(server, config.Addr); err != nil {
 		fmt.Printf("Error: %s\n", err)
 	}
+
+	if config.QuotaFile != "" && len(quotaWindows) > 0 {
+		if err := saveQuotas(config.QuotaFile); err != nil {
+			fmt.Printf("Saving quotas failed: %v\n", err)
+		}
+	}
+	// The final snapshot must not be overwritten by a periodic one still
+	// being written.
+	stopStatsFile()
+	if config.StatsFile != "" {
+		if err := writeStatsFile(config.StatsFile); err != nil {
+			fmt.Printf("Writing stats file failed: %v\n", err)
+		}
+	}
+}
+
+// newServer returns the proxy's server as configured by the flags.
+func newServer() *fasthttp.Server {
+	return &fasthttp.Server{
+		Handler:        withAccessLog(handleRoutes),
+		ReadBufferSize: 8192,
+		// fasthttp writes the response after the handler returns, so a
+		// client that goes away mid-write never reaches the rotation logic.
+		// Those errors are normally not logged; -debug shows them.
+		LogAllErrors: config.Debug,
+		// Without them a client that sends its request slowly, or never
+		// sends the next one, holds on to its connection forever.
+		ReadTimeout: config.ReadTimeout,
+		IdleTimeout: config.IdleTimeout,
+	}
+}
+
+// jsonConfig returns the serializer for responses and the one for output that
+// has to stay on a single line (NDJSON export, log lines), which is the same
+// except in indented mode.
+func jsonConfig(mode string) (jsoniter.API, jsoniter.API, error) {
+	switch mode {
+	case "compatible":
+		return jsoniter.ConfigCompatibleWithStandardLibrary, jsoniter.ConfigCompatibleWithStandardLibrary, nil
+	case "fastest":
+		return jsoniter.ConfigFastest, jsoniter.ConfigFastest, nil
+	case "indented":
+		indented := jsoniter.Config{
+			EscapeHTML:             true,
+			SortMapKeys:            true,
+			ValidateJsonRawMessage: true,
+			IndentionStep:          2,
+		}.Froze()
+		return indented, jsoniter.ConfigCompatibleWithStandardLibrary, nil
+	}
+	return nil, nil, fmt.Errorf("unknown -json-mode %q (available: compatible, fastest, indented)", mode)
 }
 
 func handleRequests(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	var attempts []attemptRecord
+
 	ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
 	ctx.Response.Header.Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+	reqID := requestID(ctx)
 
-	urlQueryParam := strings.ReplaceAll(string(ctx.QueryArgs().QueryString()), "url=", "")
-	urlQueryParam, _ = url.QueryUnescape(urlQueryParam)
-	decodedURL, err := url.QueryUnescape(urlQueryParam)
+	if proxyQuery(ctx).Get("debug") == "echo" {
+		handleEcho(ctx)
+		return
+	}
 
+	decodedURL, err := targetURL(ctx)
+	if errors.Is(err, errControlCharacters) {
+		sendJSONErrorCode(ctx, err.Error(), "invalid_url", fasthttp.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errDuplicateURLParam) {
+		sendJSONErrorCode(ctx, err.Error(), "duplicate_url", fasthttp.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errMalformedEncoding) {
+		sendJSONErrorCode(ctx, err.Error(), "malformed_encoding", fasthttp.StatusBadRequest)
+		return
+	}
 	if err != nil || decodedURL == "" {
 		sendJSONErrorResponse(ctx, "Invalid or missing URL parameter", fasthttp.StatusBadRequest)
 		return
 	}
+	if err := checkTargetPort(decodedURL); err != nil {
+		sendJSONErrorCode(ctx, errPortNotAllowed.Error(), "port_not_allowed", fasthttp.StatusForbidden)
+		return
+	}
+
+	ctx.SetUserValue("target", decodedURL)
+
+	if config.SlowThreshold > 0 {
+		defer func() {
+			if elapsed := time.Since(start); elapsed > config.SlowThreshold {
+				logSlowRequest(decodedURL, elapsed, attempts)
+			}
+		}()
+	}
 
-	servers, err := readServerAddresses("servers.txt")
+	opts, err := parseRequestOptions(ctx)
+	if err != nil {
+		sendJSONErrorResponse(ctx, err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	outbound, err := newUpstreamRequest(ctx, decodedURL, opts)
+	if err != nil {
+		sendJSONErrorResponse(ctx, err.Error(), fasthttp.StatusUnsupportedMediaType)
+		return
+	}
+
+	key, idempotent, err := proxyCacheKey(ctx, decodedURL, outbound)
+	if err != nil {
+		sendJSONErrorCode(ctx, err.Error(), "invalid_namespace", fasthttp.StatusBadRequest)
+		return
+	}
+	cacheable, cacheTTL := outbound.cacheable() && !idempotent, opts.CacheTTL
+	if idempotent {
+		// Requests repeating an Idempotency-Key get the stored response of
+		// the first one, whatever their method; a repeat arriving while the
+		// first is still running waits for it.
+		defer beginIdempotent(key, upstreamTimeout(opts))()
+		if replayed, ok := idempotencyGet(key); ok {
+			writeUpstreamResponse(ctx, replayed)
+			return
+		}
+	}
+	logCacheKey(ctx, decodedURL, requestNamespace(ctx), key)
+
+	var cacheLookupTime time.Duration
+	var cacheStatus string
+	if !opts.NoCache && cacheable {
+		lookupStart := time.Now()
+		if cachedData, ok := cacheGet(key); ok {
+			setServerTiming(ctx, timingMetric{Name: "cache", Desc: "hit", Duration: time.Since(lookupStart)})
+			setCDNCacheStatus(ctx, "HIT")
+			setCacheTier(ctx, cacheTierMemory)
+			recordCacheLookup(true)
+			writeUpstreamResponse(ctx, cachedData)
+			return
+		}
+		// An entry that is present but expired is replaced by this fetch.
+		cacheStatus = "MISS"
+		if cacheHasEntry(key) {
+			cacheStatus = "REVALIDATED"
+		}
+		cachedData, ok, err := remoteCacheGet(key)
+		if err != nil {
+			sendJSONErrorCode(ctx, err.Error(), "cache_unavailable", fasthttp.StatusServiceUnavailable)
+			return
+		}
+		if ok {
+			setServerTiming(ctx, timingMetric{Name: "cache", Desc: "remote hit", Duration: time.Since(lookupStart)})
+			setCDNCacheStatus(ctx, "HIT")
+			setCacheTier(ctx, cacheTierPeer)
+			recordCacheLookup(true)
+			writeUpstreamResponse(ctx, cachedData)
+			return
+		}
+		if config.PreferCache > 0 && serveCachePreferred(ctx, key) {
+			setServerTiming(ctx, timingMetric{Name: "cache", Desc: "stale hit", Duration: time.Since(lookupStart)})
+			recordCacheLookup(true)
+			return
+		}
+		recordCacheLookup(false)
+		cacheLookupTime = time.Since(lookupStart)
+	}
+
+	if config.NegativeDNSTTL > 0 {
+		if err := checkTargetResolves(targetHost(decodedURL)); err != nil {
+			sendJSONErrorResponse(ctx, "Target host could not be resolved", fasthttp.StatusBadGateway)
+			return
+		}
+	}
+
+	if admitted, retryAfter := admitGlobalCircuit(); !admitted {
+		setRetryAfter(ctx, retryAfter)
+		sendJSONErrorCode(ctx, "Shedding load: too many upstream requests are failing", "load_shedding", fasthttp.StatusServiceUnavailable)
+		return
+	}
+
+	servers, err := readServerAddresses(serversFile)
 	if err != nil {
 		sendJSONErrorResponse(ctx, err.Error(), fasthttp.StatusInternalServerError)
 		return
 	}
 
-	var finalResponse string
+	pool := targetPool(decodedURL)
+	pooled := poolServers(servers, pool)
+	if len(servers) > 0 && len(pooled) == 0 {
+		sendJSONErrorCode(ctx, "No eligible servers: "+poolName(pool)+" has no servers", "no_eligible_servers", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	servers = pooled
+
+	candidates := excludeServers(ctx, servers)
+	if len(servers) > 0 && len(candidates) == 0 {
+		sendJSONErrorCode(ctx, "No eligible servers: all servers are excluded by "+excludeServersHeader, "no_eligible_servers", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	servers, reason := eligibleServers(candidates, requestTags(ctx), opts.Server)
+	// With -single-server-retries a lone server is the only way to answer,
+	// so it is tried even while cooling down or with its breaker open.
+	sole := false
+	if config.SingleServerRetries > 0 {
+		if only, _ := candidateServers(candidates, requestTags(ctx), opts.Server); len(only) == 1 {
+			servers, reason, sole = only, "", true
+		}
+	}
+	if reason == reasonAllCoolingDown {
+		if serveFallback(ctx, decodedURL) {
+			return
+		}
+		candidates, _ = candidateServers(candidates, requestTags(ctx), opts.Server)
+		setRetryAfter(ctx, shortestCooldown(candidates))
+		sendJSONErrorCode(ctx, "No eligible servers: "+reason, "all_servers_cooling_down", config.ExhaustionStatus)
+		return
+	}
+	if len(servers) == 0 {
+		sendJSONErrorCode(ctx, "No eligible servers: "+reason, "no_eligible_servers", fasthttp.StatusServiceUnavailable)
+		return
+	}
+
+	if upstreamLimiter != nil {
+		upstreamLimiter.acquire(isHighPriority(ctx))
+		defer upstreamLimiter.release()
+	}
+
+	releaseTarget := acquireTarget(targetHostKey(decodedURL))
+	if releaseTarget == nil {
+		fmt.Printf("Too many requests in flight to %s\n", targetHostKey(decodedURL))
+		setRetryAfter(ctx, time.Second)
+		sendJSONErrorCode(ctx, "Too many requests in flight to the target host", "target_busy", fasthttp.StatusTooManyRequests)
+		return
+	}
+	defer releaseTarget()
+
+	if len(proxyQuery(ctx)["stream"]) > 0 {
+		streamFromServers(ctx, servers, decodedURL, outbound)
+		return
+	}
+
+	var finalResponse upstreamResponse
 	var lastError error
 
-	if time.Now().After(time.Now().Add(-3 * time.Minute)) {
-		serverIndex = 0
+	// A failover chain starts at its first server every time and does not
+	// move the rotation.
+	failover := failoverMode(requestTags(ctx))
+	first, preferred := 0, len(servers)
+	if failover {
+		servers = failoverOrder(servers, candidates)
+	} else {
+		preferred = withinSLA(servers)
+		first = rotationStart(preferred)
+		servers = preferAffinity(ctx, servers, first)
 	}
+	// A target that keeps failing with -escalate-after sends each attempt to
+	// several servers at once until it succeeds again.
+	fanOut := targetEscalated(targetHostKey(decodedURL))
+	attempted := false
+	pendingRetries := 0
+	soleRetries := 0
+	// With -rotation-budget, retries on other servers stop once that long
+	// has passed since the first attempt began.
+	var rotationDeadline time.Time
+rotation:
+	for pass := 0; pass < 2; pass++ {
+		var softFailed []Server
+		// The same error page from -identical-error-threshold servers in a
+		// row points at the target rather than the servers, so the rotation
+		// stops there, without a -no-cache-retry pass.
+		lastFingerprint, identical := "", 0
+		for n := 0; n < len(servers); n++ {
+			i := rotationIndex(first, n, preferred)
+			if attempted && !retryBudgetAvailable() {
+				fmt.Printf("Retry budget exhausted, not retrying %s\n", decodedURL)
+				break rotation
+			}
+			if attempted && !rotationDeadline.IsZero() && !time.Now().Before(rotationDeadline) {
+				fmt.Printf("Rotation budget of %s used up, not retrying %s\n", config.RotationBudget, decodedURL)
+				break rotation
+			}
+			if deadline, ok := requestDeadline(ctx); ok && !time.Now().Before(deadline) {
+				if !attempted {
+					sendJSONErrorCode(ctx, "Batch timed out", "batch_timeout", fasthttp.StatusGatewayTimeout)
+					return
+				}
+				fmt.Printf("Batch deadline passed, not retrying %s\n", decodedURL)
+				break rotation
+			}
+			if !sole && !serverAvailable(servers[i].URL) {
+				continue
+			}
+			if attempted {
+				spendRetryToken()
+			} else if config.RotationBudget > 0 {
+				rotationDeadline = time.Now().Add(config.RotationBudget)
+			}
+			retry := attempted
+			attempted = true
 
-	for i := serverIndex; i < len(servers); i++ {
-		encodedURL := url.QueryEscape(decodedURL)
-		fmt.Printf("Request %d: %s%s\n", i+1, servers[i], fmt.Sprintf("/?url=%s", encodedURL))
-		finalResponse, err = makeRequest(servers[i], fmt.Sprintf("/?url=%s", encodedURL))
+			if !acquireAttempt() {
+				releaseProbe(servers[i].URL)
+				sendJSONErrorResponse(ctx, "Too many upstream requests in flight", fasthttp.StatusServiceUnavailable)
+				return
+			}
 
-		if err == nil {
-			serverIndex = (i + 1) % len(servers)
-			break
+			endpoint := servers[i].endpoint(decodedURL)
+			fmt.Printf("Request %d: %s%s\n", i+1, servers[i].URL, endpoint)
+			attemptStart := time.Now()
+			attemptOutbound := outbound.forServer(servers[i])
+			attemptOutbound.RequestID = attemptID(reqID, len(attempts)+1)
+			attemptOutbound.Timeout = decayedTimeout(attemptOutbound.Timeout, len(attempts))
+			cutByBudget := false
+			if retry && !rotationDeadline.IsZero() {
+				// A retry may not run past the budget either.
+				if remaining := time.Until(rotationDeadline); attemptOutbound.Timeout <= 0 || remaining < attemptOutbound.Timeout {
+					attemptOutbound.Timeout = remaining
+					cutByBudget = true
+				}
+			}
+			cutByDeadline := false
+			if deadline, ok := requestDeadline(ctx); ok {
+				if remaining := time.Until(deadline); attemptOutbound.Timeout <= 0 || remaining < attemptOutbound.Timeout {
+					attemptOutbound.Timeout = max(remaining, time.Millisecond)
+					cutByDeadline = true
+				}
+			}
+			if fanOut {
+				var skipped int
+				i, skipped, finalResponse, err = fanOutAttempt(servers, i, len(servers)-n, decodedURL, outbound, attemptOutbound)
+				n += skipped
+			} else {
+				finalResponse, err = requestWithTransientRetry(servers[i], endpoint, attemptOutbound)
+				releaseAttempt()
+			}
+			attempts = append(attempts, newAttemptRecord(attemptOutbound.RequestID, servers[i].URL, attemptStart, err))
+			recordGlobalOutcome(err)
+
+			if err == nil {
+				lastError = nil
+				normalized := normalizeResponse(finalResponse)
+				if finalResponse.StatusCode == 0 && idempotent {
+					idempotencySet(key, normalized)
+				} else if finalResponse.StatusCode == 0 && cacheable {
+					cacheSetTTL(key, decodedURL, normalized, cacheTTL)
+				} else if cacheable && config.CacheRedirects {
+					if ttl, ok := redirectCacheTTL(finalResponse, cacheTTL); ok {
+						cacheSetTTL(key, decodedURL, finalResponse, ttl)
+					}
+				}
+				if !config.NormalizeCacheOnly {
+					finalResponse = normalized
+				}
+				recordSuccess(servers[i].URL)
+				creditRetryBudget()
+				recordLatency(servers[i].URL, time.Since(attemptStart))
+				ctx.SetUserValue("server", servers[i].URL)
+				setAffinityCookie(ctx, servers[i].URL)
+				if !failover {
+					serverIndex.Store(uint64(i+1) % uint64(preferred))
+				}
+				break rotation
+			}
+
+			// A retry that timed out only because the rotation budget ran
+			// out says nothing about the server or the target, so the
+			// earlier error is reported instead and a half-open probe is
+			// left for another request.
+			if statusCode, _ := parseHTTPError(err); cutByBudget && statusCode == fasthttp.StatusGatewayTimeout {
+				releaseProbe(servers[i].URL)
+				fmt.Printf("Rotation budget of %s used up during a retry of %s\n", config.RotationBudget, decodedURL)
+				break rotation
+			}
+			// The same goes for an attempt cut short by its batch's deadline.
+			if statusCode, _ := parseHTTPError(err); cutByDeadline && statusCode == fasthttp.StatusGatewayTimeout {
+				releaseProbe(servers[i].URL)
+				if lastError == nil {
+					lastError = err
+				}
+				fmt.Printf("Batch deadline passed during an attempt for %s\n", decodedURL)
+				break rotation
+			}
+			lastError = err
+			if opts.NoRotate {
+				if isRateLimitError(err) {
+					recordRateLimit(servers[i].URL)
+					recordTargetRateLimit(decodedURL)
+				} else {
+					recordFailure(servers[i].URL)
+				}
+				logFailedRotation(decodedURL, attempts)
+				statusCode, _ := parseHTTPError(lastError)
+				recordTargetOutcome(targetHostKey(decodedURL), statusCode < 500)
+				sendUpstreamError(ctx, lastError, statusCode)
+				return
+			}
+			if isRateLimitError(err) {
+				recordRateLimit(servers[i].URL)
+				recordTargetRateLimit(decodedURL)
+				if sole && soleRetries < config.SingleServerRetries {
+					soleRetries++
+					fmt.Printf("Only server %s is rate limited, retry %d of %d in %s\n", servers[i].URL, soleRetries, config.SingleServerRetries, config.SingleServerDelay)
+					time.Sleep(config.SingleServerDelay)
+					n--
+				}
+				continue
+			}
+			// A pending response is a healthy server asking to be asked
+			// again, so it counts as a success for its breaker.
+			if isPendingError(err) {
+				recordSuccess(servers[i].URL)
+				if pendingRetries >= config.PendingRetries {
+					fmt.Printf("Still pending after %d retries: %s\n", pendingRetries, decodedURL)
+					break rotation
+				}
+				pendingRetries++
+				if config.PendingRetryDelay > 0 {
+					time.Sleep(config.PendingRetryDelay)
+					n--
+				}
+				continue
+			}
+			recordFailure(servers[i].URL)
+			var retryable *retryableError
+			if errors.As(err, &retryable) {
+				// Only an error page may have come from a cache in
+				// front of the target.
+				if retryable.Fingerprint != "" {
+					softFailed = append(softFailed, servers[i])
+				}
+				if retryable.Fingerprint != "" && retryable.Fingerprint == lastFingerprint {
+					identical++
+				} else {
+					lastFingerprint, identical = retryable.Fingerprint, 1
+				}
+				if config.IdenticalErrors > 0 && lastFingerprint != "" && identical >= config.IdenticalErrors {
+					fmt.Printf("%d servers in a row returned the same error page for %s, not trying the others\n", identical, decodedURL)
+					lastError = &retryableError{Code: fasthttp.StatusBadGateway, Message: fmt.Sprintf("Upstream server returned an error page, the same one from %d servers in a row", identical)}
+					break rotation
+				}
+				continue
+			}
+
+			logFailedRotation(decodedURL, attempts)
+			// A 4xx from the target means the servers got through to it.
+			statusCode, _ := parseHTTPError(lastError)
+			recordTargetOutcome(targetHostKey(decodedURL), statusCode < 500)
+			if serveStaleOnError(ctx, key, lastError, opts, outbound) {
+				return
+			}
+			sendUpstreamError(ctx, lastError, statusCode)
+			return
 		}
 
-		lastError = err
-		if strings.Contains(err.Error(), "Ratelimit") || strings.Contains(err.Error(), "CAPTCHA") {
-			continue
+		// The pool ran out on error pages. With -no-cache-retry the servers
+		// that returned one get a single extra try, asked to bypass any cache
+		// in front of the target in case the error page itself was cached.
+		if pass > 0 || !config.NoCacheRetry || len(softFailed) == 0 || !isRetryableError(lastError) {
+			break
 		}
+		fmt.Printf("All servers failed for %s, retrying %d with cache bypass\n", decodedURL, len(softFailed))
+		servers = softFailed
+		first, preferred = 0, len(servers)
+		outbound = outbound.withCacheBypass()
+	}
 
-		statusCode, body := parseHTTPError(lastError)
-		sendJSONErrorResponse(ctx, body, statusCode)
+	if !attempted {
+		sendJSONErrorCode(ctx, "No eligible servers: all servers are cooling down or unhealthy", "no_eligible_servers", fasthttp.StatusServiceUnavailable)
 		return
 	}
+	recordTargetOutcome(targetHostKey(decodedURL), lastError == nil)
 
 	if lastError != nil {
-		statusCode, body := parseHTTPError(lastError)
-		sendJSONErrorResponse(ctx, body, statusCode)
+		logFailedRotation(decodedURL, attempts)
+		if serveStaleOnError(ctx, key, lastError, opts, outbound) {
+			return
+		}
+		statusCode, _ := parseHTTPError(lastError)
+		if allRateLimited(attempts) {
+			if serveFallback(ctx, decodedURL) {
+				return
+			}
+			statusCode = config.ExhaustionStatus
+			if retryAfter := shortestCooldown(servers); retryAfter > 0 {
+				setRetryAfter(ctx, retryAfter)
+			}
+		}
+		sendUpstreamError(ctx, lastError, statusCode)
 		return
 	}
 
-	ctx.Write([]byte(finalResponse))
+	setServerTiming(ctx,
+		timingMetric{Name: "cache", Desc: "miss", Duration: cacheLookupTime},
+		timingMetric{Name: "ttfb", Duration: finalResponse.Timing.TTFB},
+		timingMetric{Name: "upstream", Desc: fmt.Sprintf("%d attempts", len(attempts)), Duration: finalResponse.Timing.Total},
+		timingMetric{Name: "total", Duration: time.Since(start)},
+	)
+	if cacheStatus != "" {
+		setCDNCacheStatus(ctx, cacheStatus)
+	}
+	writeUpstreamResponse(ctx, finalResponse)
 }
 
-func sendJSONErrorResponse(ctx *fasthttp.RequestCtx, message string, statusCode int) {
+// decayedTimeout is the timeout of an attempt made after previous others for
+// the same request: timeout shortened by -timeout-decay for each of them, but
+// not below -min-upstream-timeout, or timeout itself when that is lower.
+func decayedTimeout(timeout time.Duration, previous int) time.Duration {
+	if timeout <= 0 || config.TimeoutDecay >= 1 || previous == 0 {
+		return timeout
+	}
+	decayed := time.Duration(float64(timeout) * math.Pow(config.TimeoutDecay, float64(previous)))
+	return max(decayed, min(config.MinUpstreamTimeout, timeout))
+}
+
+// rotationStart returns the index in a pool of n servers where rotation
+// begins. Rotation wraps around from there, so servers before it are tried
+// as well. The pool may also have shrunk since serverIndex was set, e.g. by
+// tag filtering.
+func rotationStart(n int) int {
+	return int(serverIndex.Load() % uint64(n))
+}
+
+// serveStaleOnError answers with an expired cache entry when the servers
+// failed and the entry expired less than -stale-if-error ago. Errors that
+// come from the target itself (4xx) are passed on as usual.
+func serveStaleOnError(ctx *fasthttp.RequestCtx, key string, err error, opts requestOptions, outbound upstreamRequest) bool {
+	if config.StaleIfError <= 0 || opts.NoCache || !outbound.cacheable() {
+		return false
+	}
+	if statusCode, _ := parseHTTPError(err); statusCode < 500 && !isRateLimitError(err) {
+		return false
+	}
+
+	stale, ok := cacheGetStale(key, config.StaleIfError)
+	if !ok {
+		return false
+	}
+
+	fmt.Printf("Serving stale cache entry after upstream error: %v\n", err)
+	ctx.Response.Header.Set("Warning", `111 - "Revalidation Failed"`)
+	setCDNCacheStatus(ctx, "STALE")
+	setCacheTier(ctx, cacheTierMemory)
+	writeUpstreamResponse(ctx, stale)
+	return true
+}
+
+func writeUpstreamResponse(ctx *fasthttp.RequestCtx, resp upstreamResponse) {
+	if err := decodeForClient(ctx, &resp); err != nil {
+		fmt.Printf("Failed to decompress response for the client: %v\n", err)
+		sendJSONErrorResponse(ctx, "Upstream response could not be decompressed", fasthttp.StatusBadGateway)
+		return
+	}
+	if err := applyResponseChain(ctx, &resp); err != nil {
+		fmt.Printf("Response middleware error: %v\n", err)
+		sendJSONErrorResponse(ctx, "Internal Server Error", fasthttp.StatusInternalServerError)
+		return
+	}
+
+	// Add rather than Set, so repeated headers such as Set-Cookie are all
+	// kept.
+	for _, header := range resp.Headers {
+		ctx.Response.Header.Add(header.Name, header.Value)
+	}
+	if resp.StatusCode != 0 {
+		ctx.SetStatusCode(resp.StatusCode)
+	}
+	if resp.Location != "" {
+		ctx.Response.Header.Set(fasthttp.HeaderLocation, resp.Location)
+	}
+	if resp.ContentType != "" {
+		ctx.SetContentType(resp.ContentType)
+	}
+	if config.CacheHitsHeader && resp.CacheHits > 0 {
+		ctx.Response.Header.Set("X-Cache-Hits", strconv.FormatInt(resp.CacheHits, 10))
+	}
+	if _, err := ctx.WriteString(resp.Body); err != nil {
+		debugf("Writing response to client failed: %v\n", err)
+	}
+}
+
+// debugf prints only with -debug.
+func debugf(format string, args ...interface{}) {
+	if config.Debug {
+		fmt.Printf("[DEBUG] "+format, args...)
+	}
+}
+
+// proxyParams are query parameters consumed by the proxy itself. They are
+// removed from the query string before the target URL is extracted, so a
+// target that uses one of these names itself has to be sent URL-encoded.
+var proxyParams = map[string]bool{
+	"tags":     true,
+	"envelope": true,
+	"stream":   true,
+	"debug":    true,
+	"ns":       true,
+}
+
+func splitProxyParams(rawQuery string) (string, url.Values) {
+	params := url.Values{}
+	var rest []string
+	for _, part := range strings.Split(rawQuery, "&") {
+		name, value, _ := strings.Cut(part, "=")
+		if proxyParams[name] {
+			value, _ = url.QueryUnescape(value)
+			params.Add(name, value)
+			continue
+		}
+		rest = append(rest, part)
+	}
+	return strings.Join(rest, "&"), params
+}
+
+func proxyQuery(ctx *fasthttp.RequestCtx) url.Values {
+	_, params := splitProxyParams(string(ctx.QueryArgs().QueryString()))
+	return params
+}
+
+func requestTags(ctx *fasthttp.RequestCtx) []string {
+	var tags []string
+	for _, value := range proxyQuery(ctx)["tags"] {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+func targetURL(ctx *fasthttp.RequestCtx) (string, error) {
+	rawQuery, _ := splitProxyParams(string(ctx.QueryArgs().QueryString()))
+	urlQueryParam, err := urlParam(rawQuery)
+	if err != nil {
+		return "", err
+	}
+	if urlQueryParam, err = unescapeTarget(urlQueryParam); err != nil {
+		return "", err
+	}
+	decodedURL, err := unescapeTarget(urlQueryParam)
+	if err != nil {
+		return "", err
+	}
+	if strings.IndexFunc(decodedURL, isControlCharacter) >= 0 {
+		return "", errControlCharacters
+	}
+	if config.LenientEncoding {
+		decodedURL = escapeStrayPercents(decodedURL)
+	}
+	return withRootPath(stripTrackingParams(decodedURL)), nil
+}
+
+// urlParam returns the raw value of the url parameter. An unencoded target
+// may carry its own query, so the value runs up to the next url parameter
+// rather than the next "&". Repeated url parameters are ignored, or rejected
+// with -strict-url-param. Without any url parameter the whole query is the
+// target.
+func urlParam(rawQuery string) (string, error) {
+	parts := strings.Split(rawQuery, "&")
+	start := -1
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "url=") {
+			continue
+		}
+		if start < 0 {
+			start = i
+			continue
+		}
+		if config.StrictURLParam {
+			return "", errDuplicateURLParam
+		}
+		return strings.TrimPrefix(strings.Join(parts[start:i], "&"), "url="), nil
+	}
+	if start < 0 {
+		return rawQuery, nil
+	}
+	return strings.TrimPrefix(strings.Join(parts[start:], "&"), "url="), nil
+}
+
+var errDuplicateURLParam = errors.New("The url parameter appears more than once; URL-encode a target whose own query contains url=")
+
+// errControlCharacters rejects targets with CR, LF or other control
+// characters, which a naive server could turn into request splitting.
+var errControlCharacters = errors.New("Target URL contains control characters")
+
+func isControlCharacter(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+func sendJSONResponse(ctx *fasthttp.RequestCtx, value interface{}, statusCode int) {
+	jsonResponse, err := json.Marshal(value)
+	if err != nil {
+		ctx.Error("Internal Server Error", fasthttp.StatusInternalServerError)
+		return
+	}
 	ctx.Response.Header.Set("Content-Type", "application/json")
 	ctx.Response.SetStatusCode(statusCode)
-	errorResponse := ErrorResponse{Message: message, Code: statusCode}
+	ctx.Write(jsonResponse)
+}
+
+func sendJSONErrorResponse(ctx *fasthttp.RequestCtx, message string, statusCode int) {
+	sendJSONErrorCode(ctx, message, "", statusCode)
+}
+
+func sendJSONErrorCode(ctx *fasthttp.RequestCtx, message string, errorCode string, statusCode int) {
+	sendError(ctx, ErrorResponse{Message: message, Code: statusCode, Error: errorCode})
+}
+
+// sendError sends errorResponse with its Code as the status: through the
+// -error-template, as plain text or HTML with -negotiate-errors, or as JSON.
+// Every error response goes through here.
+func sendError(ctx *fasthttp.RequestCtx, errorResponse ErrorResponse) {
+	if loadedFiles().errorTemplate != "" {
+		sendTemplatedError(ctx, errorResponse.Message, errorResponse.Error, errorResponse.Code)
+		return
+	}
+	if config.NegotiateErrors && sendNegotiatedError(ctx, errorResponse) {
+		return
+	}
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	ctx.Response.SetStatusCode(errorResponse.Code)
 	jsonResponse, err := json.Marshal(errorResponse)
 	if err != nil {
 		ctx.Error("Internal Server Error", fasthttp.StatusInternalServerError)
@@ -119,95 +1013,237 @@ func sendJSONErrorResponse(ctx *fasthttp.RequestCtx, message string, statusCode
 	ctx.Write(jsonResponse)
 }
 
-func makeRequest(serverURL string, endpoint string) (string, error) {
-	cacheKey := fmt.Sprintf("%s%s", serverURL, endpoint)
+// sendUpstreamError answers with the error a request ended on. An error
+// response of the server itself is sent the -upstream-errors way: as the
+// message of the usual error (message), in upstream_body of an error of its
+// own (wrap), or with its own body and content type (raw). A raw body the
+// client does not accept under -negotiate-errors is wrapped instead, so it
+// gets the format it asked for like every other error.
+func sendUpstreamError(ctx *fasthttp.RequestCtx, err error, statusCode int) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.Reason != "" {
+		sendJSONErrorCode(ctx, httpErr.Body, httpErr.Reason, statusCode)
+		return
+	}
+	if !errors.As(err, &httpErr) || !httpErr.Upstream || config.UpstreamErrors == "message" {
+		_, body := parseHTTPError(err)
+		sendJSONErrorResponse(ctx, body, statusCode)
+		return
+	}
+
+	if config.UpstreamErrors == "raw" && (!config.NegotiateErrors || acceptsContentType(ctx, httpErr.ContentType)) {
+		ctx.SetStatusCode(statusCode)
+		if httpErr.ContentType != "" {
+			ctx.SetContentType(httpErr.ContentType)
+		}
+		ctx.SetBodyString(httpErr.Body)
+		return
+	}
+
+	sendError(ctx, ErrorResponse{
+		Message:      fmt.Sprintf("Upstream server returned status %d", httpErr.Code),
+		Code:         statusCode,
+		Error:        "upstream_error",
+		UpstreamBody: httpErr.Body,
+	})
+}
 
-	if cachedData, ok := cacheGet(cacheKey); ok {
-		return cachedData, nil
+func upstreamTimeout(opts requestOptions) time.Duration {
+	if opts.Timeout > 0 {
+		return opts.Timeout
 	}
+	return config.UpstreamTimeout
+}
 
+// upstreamClient sends the buffered upstream requests. A body without
+// Content-Length that is not chunked is read until the server closes the
+// connection, and -max-response-size applies to it like to any other. Paths
+// are sent as built, so a server template putting the target in the path
+// keeps its escaped slashes. fasthttp's own retries are off: it would resend
+// even a POST after a closed connection, so requestWithTransientRetry alone
+// decides whether an attempt is repeated on the same server.
+var upstreamClient = &fasthttp.Client{DisablePathNormalizing: true, MaxIdemponentCallAttempts: 1}
+
+func makeRequest(serverURL string, endpoint string, outbound upstreamRequest) (upstreamResponse, error) {
 	requestURL := fmt.Sprintf("%s%s", serverURL, endpoint)
-	statusCode, body, err := fasthttp.Get(nil, requestURL)
+	defer trackInFlight(serverURL)()
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(requestURL)
+	// doRedirects reads the URI back before the client gets to this flag.
+	req.URI().DisablePathNormalizing = true
+	outbound.apply(req)
+	start := time.Now()
+	var err error
+	switch {
+	case outbound.HTTP2:
+		err = doHTTP2(req, resp, outbound.Timeout)
+	case config.ServerTiming && config.FollowRedirects:
+		err = doRedirects(timedClient, req, resp)
+	case config.ServerTiming:
+		err = timedClient.Do(req, resp)
+	case config.FollowRedirects:
+		err = doRedirects(upstreamClient, req, resp)
+	default:
+		err = upstreamClient.Do(req, resp)
+	}
+	timing := upstreamTiming{TTFB: time.Since(start)}
+	if err == nil {
+		err = readStreamedBody(resp)
+	}
+
+	statusCode, body := 0, resp.Body()
+	if err == nil {
+		statusCode = resp.StatusCode()
+		body, err = decodeUpstreamBody(resp)
+		if errors.Is(err, errDecompressedTooLarge) {
+			fmt.Printf("Upstream response too large after decompression: %s\n", requestURL)
+			return upstreamResponse{}, &HTTPError{Code: fasthttp.StatusBadGateway, Body: "Upstream response exceeds the decompressed size limit"}
+		}
+	}
 
 	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			fmt.Printf("DNS resolution timeout, moving to the next server.\n")
-			return "", fmt.Errorf("DNS resolution timeout: %v", err)
+		if errors.Is(err, fasthttp.ErrBodyTooLarge) {
+			fmt.Printf("Upstream response larger than -max-response-size: %s\n", requestURL)
+			return upstreamResponse{}, &HTTPError{Code: fasthttp.StatusBadGateway, Body: "Upstream response exceeds the size limit"}
+		}
+
+		if errors.Is(err, errRedirectLoop) {
+			fmt.Printf("Redirect loop: %s\n", requestURL)
+			return upstreamResponse{}, &HTTPError{Code: fasthttp.StatusBadGateway, Body: "Upstream redirects loop back to a URL already visited", Reason: "redirect_loop"}
+		}
+
+		var timeoutErr interface{ Timeout() bool }
+		if errors.As(err, &timeoutErr) && timeoutErr.Timeout() {
+			fmt.Printf("Upstream timeout: %v\n", err)
+			return upstreamResponse{}, &HTTPError{Code: fasthttp.StatusGatewayTimeout, Body: "Upstream server timed out"}
+		}
+
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			fmt.Printf("Connection refused: %v\n", err)
+			return upstreamResponse{}, &HTTPError{Code: fasthttp.StatusBadGateway, Body: "Upstream server refused the connection"}
+		}
+
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			fmt.Printf("DNS resolution failed: %v\n", err)
+			return upstreamResponse{}, &HTTPError{Code: fasthttp.StatusBadGateway, Body: "Upstream server address could not be resolved"}
 		}
 
 		if statusCode == fasthttp.StatusTooManyRequests || statusCode == 429 || statusCode == 420 || strings.Contains(err.Error(), "CAPTCHA") {
 			fmt.Printf("Ratelimit or CAPTCHA error: %v\n", err)
-			return "", fmt.Errorf("Ratelimit or CAPTCHA error: %v", err)
+			return upstreamResponse{}, fmt.Errorf("Ratelimit or CAPTCHA error: %v", err)
+		}
+		if closedWithoutResponse(err) {
+			// Retried on the same server like other transient errors
+			// first, then on the next one.
+			fmt.Printf("Upstream server closed the connection without a response: %v\n", err)
+			return upstreamResponse{}, fmt.Errorf("%w: %w", errTransient, &retryableError{Code: fasthttp.StatusBadGateway, Message: "Upstream server closed the connection without a response"})
+		}
+		if isTransientNetworkError(err) {
+			fmt.Printf("Transient network error: %v\n", err)
+			return upstreamResponse{}, fmt.Errorf("%w: %v", errTransient, err)
 		}
 		fmt.Printf("Unexpected error: %v\n", err)
-		return "", fmt.Errorf("Unexpected error: %v", err)
+		return upstreamResponse{}, fmt.Errorf("Unexpected error: %v", err)
+	}
+
+	// A body that was not decompressed keeps its encoding towards the
+	// client, see decodeUpstreamBody.
+	headers := upstreamResponseHeaders(resp, serverURL)
+	if encoding := resp.Header.ContentEncoding(); len(encoding) > 0 {
+		headers = append(headers, headerField{Name: fasthttp.HeaderContentEncoding, Value: string(encoding)})
+	}
+
+	if !config.FollowRedirects && fasthttp.StatusCodeIsRedirect(statusCode) {
+		return upstreamResponse{
+			Body:         string(body),
+			ContentType:  string(resp.Header.ContentType()),
+			StatusCode:   statusCode,
+			Location:     string(resp.Header.Peek(fasthttp.HeaderLocation)),
+			CacheControl: string(resp.Header.Peek(fasthttp.HeaderCacheControl)),
+			Headers:      headers,
+			Timing:       upstreamTiming{TTFB: timing.TTFB, Total: time.Since(start)},
+		}, nil
 	}
 
 	if statusCode != fasthttp.StatusOK {
 		fmt.Printf("Unexpected status code: %d\n", statusCode)
 		if statusCode == fasthttp.StatusTooManyRequests || statusCode == 429 || statusCode == 420 || strings.Contains(string(body), "CAPTCHA") {
 			fmt.Println("Ratelimit or CAPTCHA error, moving to the next server.")
-			return "", fmt.Errorf("Ratelimit or CAPTCHA error: Unexpected status code: %d", statusCode)
+			return upstreamResponse{}, fmt.Errorf("Ratelimit or CAPTCHA error: Unexpected status code: %d", statusCode)
 		}
-		return "", &HTTPError{Code: statusCode, Body: string(body)}
+		return upstreamResponse{}, &HTTPError{Code: statusCode, Body: string(body), Upstream: true, ContentType: string(resp.Header.ContentType())}
 	}
 
-	cacheSet(cacheKey, string(body))
+	if softErrorPattern != nil && softErrorPattern.Match(body) {
+		fmt.Printf("Response from %s matched the soft error pattern, moving to the next server.\n", serverURL)
+		sum := sha256.Sum256(body)
+		return upstreamResponse{}, &retryableError{Code: fasthttp.StatusBadGateway, Message: "Upstream server returned an error page", Fingerprint: hex.EncodeToString(sum[:])}
+	}
 
-	return string(body), nil
-}
+	if isPendingBody(body) {
+		fmt.Printf("Response from %s is still pending\n", serverURL)
+		return upstreamResponse{}, &retryableError{Code: fasthttp.StatusServiceUnavailable, Message: "Upstream response is still pending", Pending: true}
+	}
 
-func (e *HTTPError) Error() string {
-	return e.Body
+	return upstreamResponse{
+		Body:        string(body),
+		ContentType: string(resp.Header.ContentType()),
+		Headers:     headers,
+		Timing:      upstreamTiming{TTFB: timing.TTFB, Total: time.Since(start)},
+	}, nil
 }
 
-func parseHTTPError(err error) (int, string) {
-	if httpErr, ok := err.(*HTTPError); ok {
-		return httpErr.Code, httpErr.Body
+func upstreamResponseHeaders(resp *fasthttp.Response, serverURL string) []headerField {
+	if !config.ForwardHeaders {
+		return nil
 	}
-	return fasthttp.StatusInternalServerError, err.Error()
-}
-
-func cacheGet(key string) (string, bool) {
-	cache.RLock()
-	defer cache.RUnlock()
-
-	data, ok := cache.data[key]
-	if !ok || time.Now().After(data.ExpiresAt) {
-		return "", false
+	skip := responseSkipHeaders
+	if config.StripSetCookie {
+		skip = append([]string{"Set-Cookie"}, responseSkipHeaders...)
 	}
-
-	return data.Value, true
+	return capForwardedHeaders(forwardableHeaders(&resp.Header, skip), serverURL)
 }
 
-func cacheSet(key string, value string) {
-	cache.Lock()
-	defer cache.Unlock()
+func (e *HTTPError) Error() string {
+	return e.Body
+}
 
-	expiresAt := time.Now().Add(cache.cacheLifetime)
+// retryableError is an upstream failure that is the server's fault rather
+// than the target's, so the request moves on to the next server.
+type retryableError struct {
+	Code    int
+	Message string
+	// Pending marks a response that matched -pending-pattern or
+	// -pending-fields, see isPendingBody.
+	Pending bool
+	// Fingerprint is a hash of the error page, so the same page coming back
+	// from several servers can be told apart from one server's bad luck.
+	Fingerprint string
+}
 
-	cache.data[key] = cachedData{
-		Value:     value,
-		ExpiresAt: expiresAt,
-	}
+func (e *retryableError) Error() string {
+	return e.Message
 }
 
-func readServerAddresses(filePath string) ([]string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+func isRetryableError(err error) bool {
+	var retryable *retryableError
+	return errors.As(err, &retryable)
+}
 
-	var servers []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		servers = append(servers, scanner.Text())
+func parseHTTPError(err error) (int, string) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code, httpErr.Body
 	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	var retryable *retryableError
+	if errors.As(err, &retryable) {
+		return retryable.Code, retryable.Message
 	}
-
-	return servers, nil
+	return fasthttp.StatusInternalServerError, err.Error()
 }
@@ -0,0 +1,790 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// refusedServer returns the URL of a port nothing listens on any more.
+func refusedServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return "http://" + addr
+}
+
+func TestUpstreamConnectionErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		server func(t *testing.T) string
+		status int
+		body   string
+	}{
+		{"connection refused", refusedServer, fasthttp.StatusBadGateway, "refused the connection"},
+		{"timeout", func(t *testing.T) string {
+			return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				time.Sleep(200 * time.Millisecond)
+				ctx.SetBodyString(`{}`)
+			})
+		}, fasthttp.StatusGatewayTimeout, "timed out"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.UpstreamTimeout = 50 * time.Millisecond
+			writeServers(t, tt.server(t))
+
+			resp := proxyGet(t, target("api.example.com/x"))
+			if resp.StatusCode() != tt.status {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if !strings.Contains(string(resp.Body()), tt.body) {
+				t.Errorf("body %q does not contain %q", resp.Body(), tt.body)
+			}
+		})
+	}
+}
+
+func TestParseHTTPError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		code    int
+		message string
+	}{
+		{"HTTP error", &HTTPError{Code: fasthttp.StatusNotFound, Body: "gone"}, fasthttp.StatusNotFound, "gone"},
+		{"wrapped HTTP error", fmt.Errorf("fetching: %w", &HTTPError{Code: fasthttp.StatusNotFound, Body: "gone"}), fasthttp.StatusNotFound, "gone"},
+		{"wrapped retryable error", fmt.Errorf("%w: %w", errTransient, &retryableError{Code: fasthttp.StatusBadGateway, Message: "closed"}), fasthttp.StatusBadGateway, "closed"},
+		{"other error", fmt.Errorf("broken"), fasthttp.StatusInternalServerError, "broken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, message := parseHTTPError(tt.err)
+			if code != tt.code || message != tt.message {
+				t.Errorf("parseHTTPError = %d %q, want %d %q", code, message, tt.code, tt.message)
+			}
+		})
+	}
+}
+
+func TestDecayedTimeout(t *testing.T) {
+	tests := []struct {
+		decay    float64
+		min      time.Duration
+		timeout  time.Duration
+		previous int
+		want     time.Duration
+	}{
+		{1, time.Second, 8 * time.Second, 3, 8 * time.Second},
+		{0.5, time.Second, 8 * time.Second, 0, 8 * time.Second},
+		{0.5, time.Second, 8 * time.Second, 1, 4 * time.Second},
+		{0.5, time.Second, 8 * time.Second, 2, 2 * time.Second},
+		{0.5, time.Second, 8 * time.Second, 4, time.Second},
+		{0.5, time.Second, 8 * time.Second, 10, time.Second},
+		{0.75, time.Second, 8 * time.Second, 2, 4500 * time.Millisecond},
+		{0.5, time.Second, 500 * time.Millisecond, 2, 500 * time.Millisecond},
+		{0.5, time.Second, 0, 2, 0},
+	}
+	for _, tt := range tests {
+		setup(t)
+		config.TimeoutDecay = tt.decay
+		config.MinUpstreamTimeout = tt.min
+		if got := decayedTimeout(tt.timeout, tt.previous); got != tt.want {
+			t.Errorf("decay %v, minimum %s: decayedTimeout(%s, %d) = %s, want %s", tt.decay, tt.min, tt.timeout, tt.previous, got, tt.want)
+		}
+	}
+}
+
+func TestTimeoutDecay(t *testing.T) {
+	tests := []struct {
+		name    string
+		decay   float64
+		min     time.Duration
+		limited int // servers rate limiting the request before the slow one
+		want    time.Duration
+	}{
+		{"off", 1, 10 * time.Millisecond, 2, 200 * time.Millisecond},
+		{"first attempt", 0.5, 10 * time.Millisecond, 0, 200 * time.Millisecond},
+		{"second attempt", 0.5, 10 * time.Millisecond, 1, 100 * time.Millisecond},
+		{"third attempt", 0.5, 10 * time.Millisecond, 2, 50 * time.Millisecond},
+		{"minimum", 0.5, 80 * time.Millisecond, 2, 80 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.UpstreamTimeout = 200 * time.Millisecond
+			config.TimeoutDecay = tt.decay
+			config.MinUpstreamTimeout = tt.min
+			var servers []string
+			for i := 0; i < tt.limited; i++ {
+				servers = append(servers, statusBackend(t, fasthttp.StatusTooManyRequests, `{}`))
+			}
+			release := make(chan struct{})
+			t.Cleanup(func() { close(release) })
+			slow := newBackend(t, func(ctx *fasthttp.RequestCtx) { <-release })
+			writeServers(t, append(servers, slow)...)
+
+			output := captureOutput(t, func() { proxyGet(t, target("api.example.com/slow")) })
+			const prefix = "[ERROR] Request failed: target=api.example.com/slow attempts="
+			start := strings.Index(output, prefix)
+			if start < 0 {
+				t.Fatalf("no rotation path logged:\n%s", output)
+			}
+			line, _, _ := strings.Cut(output[start+len(prefix):], "\n")
+			var attempts []attemptRecord
+			if err := json.Unmarshal([]byte(line), &attempts); err != nil {
+				t.Fatalf("%v: %s", err, line)
+			}
+			if len(attempts) != tt.limited+1 {
+				t.Fatalf("logged attempts = %+v, want %d", attempts, tt.limited+1)
+			}
+			// The slow server's attempt runs until its timeout, give or take
+			// scheduling.
+			last := attempts[tt.limited]
+			took := time.Duration(last.DurationMS * float64(time.Millisecond))
+			if last.Server != slow || took < tt.want || took > tt.want+40*time.Millisecond {
+				t.Errorf("attempt on %s took %s, want %s timed out after %s", last.Server, took, slow, tt.want)
+			}
+		})
+	}
+}
+
+func TestSoftErrorPattern(t *testing.T) {
+	const errorPage = "<html>Error: service unavailable</html>"
+	tests := []struct {
+		name      string
+		pattern   string
+		servers   int // how many of broken, good are listed
+		status    int
+		body      string
+		cacheSize int
+	}{
+		{"matching page rotates", "Error: service", 2, fasthttp.StatusOK, `{"ok":true}`, 1},
+		{"no pattern", "", 2, fasthttp.StatusOK, errorPage, 1},
+		{"only soft errors", "Error: service", 1, fasthttp.StatusBadGateway, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.SoftErrorPattern = tt.pattern
+			if tt.pattern != "" {
+				softErrorPattern = regexp.MustCompile(tt.pattern)
+			}
+			var brokenRequests atomic.Int64
+			broken := newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				brokenRequests.Add(1)
+				ctx.SetBodyString(errorPage)
+			})
+			good := jsonBackend(t, `{"ok":true}`)
+			writeServers(t, []string{broken, good}[:tt.servers]...)
+
+			resp := proxyGet(t, target("api.example.com/soft"))
+			if resp.StatusCode() != tt.status {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if tt.body != "" && string(resp.Body()) != tt.body {
+				t.Errorf("body = %q, want %q", resp.Body(), tt.body)
+			}
+			if brokenRequests.Load() != 1 {
+				t.Errorf("the server with the error page got %d requests, want 1", brokenRequests.Load())
+			}
+			if got := cacheEntryCount(); got != tt.cacheSize {
+				t.Errorf("cache entries = %d, want %d", got, tt.cacheSize)
+			}
+			if _, ok := cacheGet(cacheKey("api.example.com/soft")); ok && tt.cacheSize == 0 {
+				t.Error("soft error page was cached")
+			}
+		})
+	}
+}
+
+func TestNoCacheRetry(t *testing.T) {
+	const errorPage = "<html>Error: service unavailable</html>"
+	tests := []struct {
+		name     string
+		retry    bool
+		status   int
+		requests int64 // per server
+	}{
+		{"bypass pass gets a fresh response", true, fasthttp.StatusOK, 2},
+		{"disabled", false, fasthttp.StatusBadGateway, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.NoCacheRetry = tt.retry
+			config.SoftErrorPattern = "Error: service"
+			softErrorPattern = regexp.MustCompile(config.SoftErrorPattern)
+
+			// Both servers sit behind a cache holding the error page, which
+			// only a no-cache request gets past.
+			var requests [2]atomic.Int64
+			var servers []string
+			for i := range requests {
+				count := &requests[i]
+				servers = append(servers, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+					count.Add(1)
+					if string(ctx.Request.Header.Peek("Cache-Control")) != "no-cache" {
+						ctx.SetBodyString(errorPage)
+						return
+					}
+					ctx.SetContentType("application/json")
+					ctx.SetBodyString(`{"fresh":true}`)
+				}))
+			}
+			writeServers(t, servers...)
+
+			resp := proxyGet(t, target("api.example.com/cached-error"))
+			if resp.StatusCode() != tt.status {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if tt.status == fasthttp.StatusOK && string(resp.Body()) != `{"fresh":true}` {
+				t.Errorf("body = %q", resp.Body())
+			}
+			// The extra pass starts again from the first server that failed.
+			if got := requests[0].Load(); got != tt.requests {
+				t.Errorf("first server got %d requests, want %d", got, tt.requests)
+			}
+			if got := requests[1].Load(); got != 1 {
+				t.Errorf("second server got %d requests, want 1", got)
+			}
+		})
+	}
+}
+
+func TestNoCacheRetryIsBounded(t *testing.T) {
+	setup(t)
+	config.NoCacheRetry = true
+	config.SoftErrorPattern = "Error: service"
+	softErrorPattern = regexp.MustCompile(config.SoftErrorPattern)
+	var requests atomic.Int64
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		requests.Add(1)
+		ctx.SetBodyString("<html>Error: service unavailable</html>")
+	}))
+
+	if status := proxyGet(t, target("api.example.com/always-broken")).StatusCode(); status != fasthttp.StatusBadGateway {
+		t.Errorf("status = %d, want 502", status)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("server got %d requests, want 2: one per pass", got)
+	}
+}
+
+func TestIdenticalErrorThreshold(t *testing.T) {
+	const down, other = "<html>Error: service down</html>", "<html>Error: service busy</html>"
+	tests := []struct {
+		name      string
+		threshold int
+		retry     bool     // -no-cache-retry
+		bodies    []string // per server, "" for a good response
+		status    int
+		identical bool // the 502 notes the page was the same from every server
+		requests  []int64
+	}{
+		{"off", 0, false, []string{down, down, down, down}, fasthttp.StatusBadGateway, false, []int64{1, 1, 1, 1}},
+		{"stops at the threshold", 2, false, []string{down, down, down, down}, fasthttp.StatusBadGateway, true, []int64{1, 1, 0, 0}},
+		{"different pages", 2, false, []string{down, other, down, other}, fasthttp.StatusBadGateway, false, []int64{1, 1, 1, 1}},
+		{"in a row only", 2, false, []string{other, down, down, ""}, fasthttp.StatusBadGateway, true, []int64{1, 1, 1, 0}},
+		{"answered before the threshold", 3, false, []string{down, down, "", down}, fasthttp.StatusOK, false, []int64{1, 1, 1, 0}},
+		{"no no-cache pass", 2, true, []string{down, down, down}, fasthttp.StatusBadGateway, true, []int64{1, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.IdenticalErrors = tt.threshold
+			config.NoCacheRetry = tt.retry
+			config.SoftErrorPattern = "Error: service"
+			softErrorPattern = regexp.MustCompile(config.SoftErrorPattern)
+			requests := make([]atomic.Int64, len(tt.bodies))
+			var servers []string
+			for i, body := range tt.bodies {
+				count, body := &requests[i], body
+				servers = append(servers, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+					count.Add(1)
+					if body == "" {
+						ctx.SetContentType("application/json")
+						ctx.SetBodyString(`{}`)
+						return
+					}
+					ctx.SetBodyString(body)
+				}))
+			}
+			writeServers(t, servers...)
+
+			resp := proxyGet(t, target("api.example.com/down"))
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if identical := strings.Contains(string(resp.Body()), "the same one from 2 servers in a row"); identical != tt.identical {
+				t.Errorf("body = %s, want the identical note %v", resp.Body(), tt.identical)
+			}
+			for i := range requests {
+				if got := requests[i].Load(); got != tt.requests[i] {
+					t.Errorf("server %d got %d requests, want %d", i+1, got, tt.requests[i])
+				}
+			}
+		})
+	}
+}
+
+func TestJSONMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		indented bool
+	}{
+		{"compatible", false},
+		{"fastest", false},
+		{"indented", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			setup(t)
+			var err error
+			if json, jsonLine, err = jsonConfig(tt.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			// An admin endpoint, an error response and a proxied error.
+			for _, uri := range []string{"/stats", "/?foo=bar", target("api.example.com/none")} {
+				body := string(proxyGet(t, uri).Body())
+				if got := strings.Contains(body, "\n  \""); got != tt.indented {
+					t.Errorf("%s indented = %v, want %v:\n%s", uri, got, tt.indented, body)
+				}
+			}
+			if line, _ := jsonLine.Marshal(map[string]int{"a": 1, "b": 2}); strings.Contains(string(line), "\n") {
+				t.Errorf("log lines are not single-line: %s", line)
+			}
+		})
+	}
+}
+
+func TestJSONModeUnknown(t *testing.T) {
+	if _, _, err := jsonConfig("pretty"); err == nil || !strings.Contains(err.Error(), "indented") {
+		t.Errorf("jsonConfig(pretty) error = %v, want the available modes listed", err)
+	}
+}
+
+func TestNoRotate(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    bool
+		header  string
+		rotates bool
+	}{
+		{"default rotates", false, "", true},
+		{"flag", true, "", false},
+		{"header", false, "1", false},
+		{"header turns the flag off", true, "false", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.NoRotate = tt.flag
+			var brokenRequests, goodRequests atomic.Int64
+			broken := newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				brokenRequests.Add(1)
+				ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+				ctx.SetBodyString("backend rate limited")
+			})
+			writeServers(t, broken, countingBackend(t, `{"ok":true}`, &goodRequests))
+
+			var headers []string
+			if tt.header != "" {
+				headers = []string{"X-No-Rotate", tt.header}
+			}
+			resp := proxyGet(t, target("api.example.com/rotate"), headers...)
+			if brokenRequests.Load() != 1 {
+				t.Errorf("first server got %d requests, want 1", brokenRequests.Load())
+			}
+			if tt.rotates {
+				if resp.StatusCode() != fasthttp.StatusOK || goodRequests.Load() != 1 {
+					t.Errorf("status = %d with %d requests to the second server, want the rotation to reach it", resp.StatusCode(), goodRequests.Load())
+				}
+				return
+			}
+			if goodRequests.Load() != 0 {
+				t.Errorf("second server got %d requests without rotation", goodRequests.Load())
+			}
+			if resp.StatusCode() == fasthttp.StatusOK || !strings.Contains(string(resp.Body()), "Unexpected status code: 429") {
+				t.Errorf("response = %d %s, want the first server's error", resp.StatusCode(), resp.Body())
+			}
+		})
+	}
+}
+
+func TestControlCharactersRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		reject bool
+	}{
+		{"CRLF injection", "api.example.com/a%0D%0AHost:%20evil.example", true},
+		{"double-encoded CRLF", "api.example.com%2Fa%250D%250AX-Injected%3A%201", true},
+		{"bare LF", "api.example.com/a%0A", true},
+		{"tab", "api.example.com/a%09b", true},
+		{"DEL", "api.example.com/a%7F", true},
+		{"NUL", "api.example.com/a%00", true},
+		{"space is fine", "api.example.com/a%20b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			var requests atomic.Int64
+			writeServers(t, countingBackend(t, `{}`, &requests))
+
+			resp := proxyGet(t, target(tt.target))
+			if !tt.reject {
+				if resp.StatusCode() != fasthttp.StatusOK || requests.Load() != 1 {
+					t.Errorf("status = %d with %d upstream requests, want it fetched", resp.StatusCode(), requests.Load())
+				}
+				return
+			}
+			var got ErrorResponse
+			if err := json.Unmarshal(resp.Body(), &got); err != nil {
+				t.Fatalf("%d %q: %v", resp.StatusCode(), resp.Body(), err)
+			}
+			if resp.StatusCode() != fasthttp.StatusBadRequest || got.Error != "invalid_url" {
+				t.Errorf("response = %d %+v, want 400 invalid_url", resp.StatusCode(), got)
+			}
+			if requests.Load() != 0 {
+				t.Errorf("server got %d requests for a rejected URL", requests.Load())
+			}
+		})
+	}
+}
+
+func TestRotationWrapsAround(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    uint64
+		good     int // index of the only server that answers
+		requests [3]int64
+	}{
+		{"healthy server before the start", 2, 0, [3]int64{1, 0, 1}},
+		{"healthy server right before the start", 2, 1, [3]int64{1, 1, 1}},
+		{"start past the end of a shrunk pool", 4, 0, [3]int64{1, 1, 1}},
+		{"healthy server at the start", 1, 1, [3]int64{0, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			var requests [3]atomic.Int64
+			var servers []string
+			for i := range requests {
+				count, good := &requests[i], i == tt.good
+				servers = append(servers, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+					count.Add(1)
+					if !good {
+						ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+						return
+					}
+					ctx.SetBodyString(`{}`)
+				}))
+			}
+			writeServers(t, servers...)
+			serverIndex.Store(tt.start)
+
+			if status := proxyGet(t, target("api.example.com/wrap")).StatusCode(); status != fasthttp.StatusOK {
+				t.Fatalf("status = %d, want the healthy server's answer", status)
+			}
+			for i := range requests {
+				if got := requests[i].Load(); got != tt.requests[i] {
+					t.Errorf("server %d got %d requests, want %d", i, got, tt.requests[i])
+				}
+			}
+			if got := serverIndex.Load(); got != uint64(tt.good+1)%3 {
+				t.Errorf("serverIndex = %d, want the server after the one that answered", got)
+			}
+		})
+	}
+}
+
+// TestConcurrentRotation is meant for go test -race: requests rotating through
+// the pool at once must not race on serverIndex, and rotation must still be
+// round-robin once they are done.
+func TestConcurrentRotation(t *testing.T) {
+	setup(t)
+	servers := []string{namedBackend(t), namedBackend(t), namedBackend(t), namedBackend(t)}
+	writeServers(t, servers...)
+
+	var mu sync.Mutex
+	used := make(map[string]int)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 25; n++ {
+				resp := proxyGet(t, target(fmt.Sprintf("api.example.com/concurrent/%d/%d", g, n)))
+				server := servedBy(t, resp)
+				mu.Lock()
+				used[server]++
+				mu.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, server := range servers {
+		if used[server] == 0 {
+			t.Errorf("%s got no requests: %v", server, used)
+		}
+		total += used[server]
+	}
+	if total != 200 {
+		t.Errorf("%d requests served, want 200: %v", total, used)
+	}
+	if index := serverIndex.Load(); index >= uint64(len(servers)) {
+		t.Errorf("serverIndex = %d outside the pool", index)
+	}
+
+	start := rotationStart(len(servers))
+	for n := 0; n < len(servers); n++ {
+		want := servers[(start+n)%len(servers)]
+		if got := servedBy(t, proxyGet(t, target(fmt.Sprintf("api.example.com/sequential/%d", n)))); got != want {
+			t.Errorf("sequential request %d went to %s, want %s", n, got, want)
+		}
+	}
+}
+
+func TestURLParam(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawQuery string
+		strict   bool
+		want     string
+		wantErr  bool
+	}{
+		{"single", "url=a.example/x", false, "a.example/x", false},
+		{"target query kept", "url=a.example/x?q=1&page=2", false, "a.example/x?q=1&page=2", false},
+		{"duplicate uses the first", "url=a.example/x&url=b.example/y", false, "a.example/x", false},
+		{"duplicate keeps the first one's query", "url=a.example/x?q=1&url=b.example/y", false, "a.example/x?q=1", false},
+		{"duplicate rejected in strict mode", "url=a.example/x&url=b.example/y", true, "", true},
+		{"single in strict mode", "url=a.example/x?q=1", true, "a.example/x?q=1", false},
+		{"encoded inner url is not a duplicate", "url=a.example%2Fx%3Furl%3Db", true, "a.example%2Fx%3Furl%3Db", false},
+		{"no url parameter", "a.example/x", false, "a.example/x", false},
+		{"url later in the query", "tags=fast&url=a.example/x", false, "a.example/x", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.StrictURLParam = tt.strict
+			got, err := urlParam(tt.rawQuery)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("urlParam(%q) = %q, %v, want %q, error %v", tt.rawQuery, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDuplicateURLParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		strict  bool
+		status  int
+		fetched string
+	}{
+		{"default uses the first", false, fasthttp.StatusOK, "api.example.com/first"},
+		{"strict", true, fasthttp.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.StrictURLParam = tt.strict
+			var fetched string
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				fetched = string(ctx.QueryArgs().Peek("url"))
+				ctx.SetBodyString(`{}`)
+			}))
+
+			resp := proxyGet(t, "/?url=api.example.com/first&url=api.example.com/second")
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if fetched != tt.fetched {
+				t.Errorf("server fetched %q, want %q", fetched, tt.fetched)
+			}
+			if tt.strict {
+				var got ErrorResponse
+				if err := json.Unmarshal(resp.Body(), &got); err != nil || got.Error != "duplicate_url" {
+					t.Errorf("error = %+v (%v), want duplicate_url", got, err)
+				}
+			}
+		})
+	}
+}
+
+// slowBackend answers with status after delay, counting its requests.
+func slowBackend(t *testing.T, delay time.Duration, status int, count *atomic.Int64) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		count.Add(1)
+		time.Sleep(delay)
+		ctx.SetStatusCode(status)
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{}`)
+	})
+}
+
+func TestRotationBudget(t *testing.T) {
+	tests := []struct {
+		name        string
+		budget      time.Duration
+		delays      []time.Duration // per server, each answering 429
+		maxAttempts int64
+		maxElapsed  time.Duration
+	}{
+		{"no budget tries every server", 0, []time.Duration{30, 30, 30, 30, 30, 30}, 6, time.Second},
+		{"budget stops the rotation", 100 * time.Millisecond, []time.Duration{30, 30, 30, 30, 30, 30, 30, 30, 30, 30}, 5, 175 * time.Millisecond},
+		{"retry cut off at the budget", 50 * time.Millisecond, []time.Duration{10, 1000}, 2, 150 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.RotationBudget = tt.budget
+			var attempts atomic.Int64
+			var servers []string
+			for _, delay := range tt.delays {
+				servers = append(servers, slowBackend(t, delay*time.Millisecond, fasthttp.StatusTooManyRequests, &attempts))
+			}
+			writeServers(t, servers...)
+
+			start := time.Now()
+			resp := proxyGet(t, target("api.example.com/budget"))
+			elapsed := time.Since(start)
+			if got := attempts.Load(); got < 2 || got > tt.maxAttempts {
+				t.Errorf("attempts = %d, want between 2 and %d", got, tt.maxAttempts)
+			}
+			if elapsed > tt.maxElapsed {
+				t.Errorf("request took %s, want at most %s", elapsed, tt.maxElapsed)
+			}
+			// The last server error is reported, not a timeout of the cut-off retry.
+			if resp.StatusCode() == fasthttp.StatusGatewayTimeout || !strings.Contains(string(resp.Body()), "429") {
+				t.Errorf("status = %d: %s, want the rate limit error", resp.StatusCode(), resp.Body())
+			}
+		})
+	}
+}
+
+func TestRotationBudgetKeepsFirstAttempt(t *testing.T) {
+	setup(t)
+	config.RotationBudget = 20 * time.Millisecond
+	var attempts atomic.Int64
+	writeServers(t, slowBackend(t, 100*time.Millisecond, fasthttp.StatusOK, &attempts))
+
+	if resp := proxyGet(t, target("api.example.com/budget")); resp.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("status = %d: %s, want the slow first attempt to finish", resp.StatusCode(), resp.Body())
+	}
+}
+
+func TestExhaustionStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		exhaustion int
+		statuses   []int // of the servers
+		cooldown   time.Duration
+		status     int
+		retryAfter bool
+	}{
+		{"default", 429, []int{429, 429}, 0, fasthttp.StatusTooManyRequests, false},
+		{"mapped to 503", 503, []int{429, 429}, 0, fasthttp.StatusServiceUnavailable, false},
+		{"mapped to 502 with cooldown", 502, []int{429, 429}, time.Minute, fasthttp.StatusBadGateway, true},
+		{"not every server rate limited", 503, []int{429, 404}, 0, fasthttp.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.ExhaustionStatus = tt.exhaustion
+			config.Cooldown = tt.cooldown
+			var servers []string
+			for _, status := range tt.statuses {
+				servers = append(servers, statusBackend(t, status, "limited"))
+			}
+			writeServers(t, servers...)
+
+			resp := proxyGet(t, target("api.example.com/exhausted"))
+			if resp.StatusCode() != tt.status {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if retryAfter := len(resp.Header.Peek("Retry-After")) > 0; retryAfter != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want one: %v", resp.Header.Peek("Retry-After"), tt.retryAfter)
+			}
+			if tt.cooldown == 0 {
+				return
+			}
+
+			// The servers are now cooling down, which the pre-check answers
+			// with the same status.
+			resp = proxyGet(t, target("api.example.com/exhausted/again"))
+			if resp.StatusCode() != tt.status || !strings.Contains(string(resp.Body()), "all_servers_cooling_down") {
+				t.Errorf("while cooling down: status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+		})
+	}
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		mode        string
+		contentType string
+		body        string // exact response body
+	}{
+		{"message", "application/json", `{"message":"backend broke","code":404}`},
+		{"wrap", "application/json", `{"message":"Upstream server returned status 404","code":404,"error":"upstream_error","upstream_body":"backend broke"}`},
+		{"raw", "text/plain; charset=utf-8", "backend broke"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			setup(t)
+			config.UpstreamErrors = tt.mode
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				ctx.SetStatusCode(fasthttp.StatusNotFound)
+				ctx.SetContentType("text/plain; charset=utf-8")
+				ctx.SetBodyString("backend broke")
+			}))
+
+			resp := proxyGet(t, target("api.example.com/broken"))
+			if resp.StatusCode() != fasthttp.StatusNotFound {
+				t.Errorf("status = %d, want 404", resp.StatusCode())
+			}
+			if ct := string(resp.Header.ContentType()); ct != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+			}
+			if string(resp.Body()) != tt.body {
+				t.Errorf("body = %s\nwant %s", resp.Body(), tt.body)
+			}
+		})
+	}
+}
+
+func TestProxyErrorsStayJSON(t *testing.T) {
+	for _, mode := range []string{"wrap", "raw"} {
+		t.Run(mode, func(t *testing.T) {
+			setup(t)
+			config.UpstreamErrors = mode
+			writeServers(t, refusedServer(t))
+
+			resp := proxyGet(t, target("api.example.com/refused"))
+			var body ErrorResponse
+			if err := json.Unmarshal(resp.Body(), &body); err != nil || body.UpstreamBody != "" {
+				t.Errorf("body = %s, want a JSON error of the proxy (%v)", resp.Body(), err)
+			}
+			if resp.StatusCode() != fasthttp.StatusBadGateway {
+				t.Errorf("status = %d, want 502", resp.StatusCode())
+			}
+		})
+	}
+}
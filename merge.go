@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/valyala/fasthttp"
+)
+
+type mergeSource struct {
+	Server string `json:"server"`
+	Status string `json:"status"`
+	Items  int    `json:"items,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type mergeResponse struct {
+	Items   []jsoniter.RawMessage `json:"items"`
+	Sources []mergeSource         `json:"sources"`
+}
+
+// handleMerge serves /merge with -merge. The target is fetched from up to
+// -merge-servers servers at once, each of which must answer with a JSON
+// array, and the arrays are concatenated in server order with duplicates
+// dropped, see mergeItems. Servers that fail are listed in sources; the
+// response is only an error when none of them succeeded. Nothing is cached.
+func handleMerge(ctx *fasthttp.RequestCtx) {
+	if !config.Merge {
+		sendJSONErrorResponse(ctx, "Merging is disabled", fasthttp.StatusNotFound)
+		return
+	}
+
+	decodedURL, err := targetURL(ctx)
+	if err != nil || decodedURL == "" {
+		sendJSONErrorResponse(ctx, "Invalid or missing URL parameter", fasthttp.StatusBadRequest)
+		return
+	}
+	if err := checkTargetPort(decodedURL); err != nil {
+		sendJSONErrorCode(ctx, errPortNotAllowed.Error(), "port_not_allowed", fasthttp.StatusForbidden)
+		return
+	}
+
+	opts, err := parseRequestOptions(ctx)
+	if err != nil {
+		sendJSONErrorResponse(ctx, err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	outbound, err := newUpstreamRequest(ctx, decodedURL, opts)
+	if err != nil {
+		sendJSONErrorResponse(ctx, err.Error(), fasthttp.StatusUnsupportedMediaType)
+		return
+	}
+
+	servers, err := readServerAddresses(serversFile)
+	if err != nil {
+		sendJSONErrorResponse(ctx, err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	pool := targetPool(decodedURL)
+	pooled := poolServers(servers, pool)
+	if len(servers) > 0 && len(pooled) == 0 {
+		sendJSONErrorCode(ctx, "No eligible servers: "+poolName(pool)+" has no servers", "no_eligible_servers", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	candidates := excludeServers(ctx, pooled)
+	if len(pooled) > 0 && len(candidates) == 0 {
+		sendJSONErrorCode(ctx, "No eligible servers: all servers are excluded by "+excludeServersHeader, "no_eligible_servers", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	eligible, reason := eligibleServers(candidates, requestTags(ctx), opts.Server)
+	if len(eligible) == 0 {
+		sendJSONErrorCode(ctx, "No eligible servers: "+reason, "no_eligible_servers", fasthttp.StatusServiceUnavailable)
+		return
+	}
+
+	if upstreamLimiter != nil {
+		upstreamLimiter.acquire(isHighPriority(ctx))
+		defer upstreamLimiter.release()
+	}
+
+	// Each server used claims its half-open probe and an attempt slot, as
+	// an attempt of handleRequests would.
+	servers = nil
+	saturated := false
+	for _, server := range eligible {
+		if config.MergeServers > 0 && len(servers) == config.MergeServers {
+			break
+		}
+		if !serverAvailable(server.URL) {
+			continue
+		}
+		if !acquireAttempt() {
+			releaseProbe(server.URL)
+			saturated = true
+			break
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		if saturated {
+			sendJSONErrorResponse(ctx, "Too many upstream requests in flight", fasthttp.StatusServiceUnavailable)
+		} else {
+			sendJSONErrorCode(ctx, "No eligible servers: all servers are cooling down or unhealthy", "no_eligible_servers", fasthttp.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	reqID := requestID(ctx)
+	arrays := make([][]jsoniter.RawMessage, len(servers))
+	sources := make([]mergeSource, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server Server) {
+			defer wg.Done()
+			defer releaseAttempt()
+			sources[i] = mergeSource{Server: server.URL, Status: "ok"}
+
+			attemptOutbound := outbound.forServer(server)
+			attemptOutbound.RequestID = attemptID(reqID, i+1)
+			attemptStart := time.Now()
+			response, err := makeRequest(server.URL, server.endpoint(decodedURL), attemptOutbound)
+			if err != nil {
+				if isRateLimitError(err) {
+					recordRateLimit(server.URL)
+				} else {
+					recordFailure(server.URL)
+				}
+				_, body := parseHTTPError(err)
+				sources[i].Status, sources[i].Error = "error", body
+				return
+			}
+			recordSuccess(server.URL)
+			recordLatency(server.URL, time.Since(attemptStart))
+
+			if err := json.Unmarshal([]byte(response.Body), &arrays[i]); err != nil {
+				sources[i].Status, sources[i].Error = "error", "response is not a JSON array"
+				return
+			}
+			sources[i].Items = len(arrays[i])
+		}(i, server)
+	}
+	wg.Wait()
+
+	merged := mergeResponse{Items: mergeItems(arrays, config.MergeKey), Sources: sources}
+	for _, source := range sources {
+		if source.Status == "ok" {
+			sendJSONResponse(ctx, merged, fasthttp.StatusOK)
+			return
+		}
+	}
+	fmt.Printf("Merge of %s failed on all %d servers\n", decodedURL, len(servers))
+	sendJSONResponse(ctx, merged, fasthttp.StatusBadGateway)
+}
+
+// mergeItems concatenates arrays, keeping the first item for each value of
+// the key field. Items that are not objects or lack the field are compared
+// by their whole JSON text instead, which is also what an empty key does.
+func mergeItems(arrays [][]jsoniter.RawMessage, key string) []jsoniter.RawMessage {
+	items := []jsoniter.RawMessage{}
+	seen := make(map[string]bool)
+	for _, array := range arrays {
+		for _, item := range array {
+			identity := "item:" + string(item)
+			if key != "" {
+				var fields map[string]jsoniter.RawMessage
+				if json.Unmarshal(item, &fields) == nil {
+					if value, ok := fields[key]; ok {
+						identity = "key:" + string(value)
+					}
+				}
+			}
+			if seen[identity] {
+				continue
+			}
+			seen[identity] = true
+			items = append(items, item)
+		}
+	}
+	return items
+}
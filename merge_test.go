@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/valyala/fasthttp"
+)
+
+func TestMergeItems(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		arrays []string
+		want   string
+	}{
+		{"by key", "id", []string{`[{"id":1,"v":"a"},{"id":2,"v":"a"}]`, `[{"id":2,"v":"b"},{"id":3,"v":"b"}]`}, `[{"id":1,"v":"a"},{"id":2,"v":"a"},{"id":3,"v":"b"}]`},
+		{"whole items without a key", "", []string{`[{"id":1},{"id":2}]`, `[{"id":2},{"id":2,"x":1}]`}, `[{"id":1},{"id":2},{"id":2,"x":1}]`},
+		{"items without the key field", "id", []string{`[{"name":"a"},1,"s"]`, `[{"name":"a"},1,{"id":1}]`}, `[{"name":"a"},1,"s",{"id":1}]`},
+		{"key values compared as JSON", "id", []string{`[{"id":1}]`, `[{"id":"1"}]`}, `[{"id":1},{"id":"1"}]`},
+		{"no arrays", "id", nil, `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var arrays [][]jsoniter.RawMessage
+			for _, array := range tt.arrays {
+				var items []jsoniter.RawMessage
+				if err := json.Unmarshal([]byte(array), &items); err != nil {
+					t.Fatal(err)
+				}
+				arrays = append(arrays, items)
+			}
+			got, err := json.Marshal(mergeItems(arrays, tt.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("merged = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		bodies   []string // per server, "" for one answering 500
+		servers  int      // -merge-servers
+		status   int
+		items    string
+		statuses []string
+	}{
+		{
+			name:     "overlap deduped",
+			bodies:   []string{`[{"id":1},{"id":2}]`, `[{"id":2},{"id":3}]`},
+			status:   fasthttp.StatusOK,
+			items:    `[{"id":1},{"id":2},{"id":3}]`,
+			statuses: []string{"ok", "ok"},
+		},
+		{
+			name:     "partial failure",
+			bodies:   []string{`[{"id":1}]`, "", `{"not":"an array"}`},
+			status:   fasthttp.StatusOK,
+			items:    `[{"id":1}]`,
+			statuses: []string{"ok", "error", "error"},
+		},
+		{
+			name:     "all failed",
+			bodies:   []string{"", `{}`},
+			status:   fasthttp.StatusBadGateway,
+			items:    `[]`,
+			statuses: []string{"error", "error"},
+		},
+		{
+			name:     "limited number of servers",
+			bodies:   []string{`[{"id":1}]`, `[{"id":2}]`, `[{"id":3}]`},
+			servers:  2,
+			status:   fasthttp.StatusOK,
+			items:    `[{"id":1},{"id":2}]`,
+			statuses: []string{"ok", "ok"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.Merge = true
+			config.MergeKey = "id"
+			config.MergeServers = tt.servers
+			var servers []string
+			for _, body := range tt.bodies {
+				if body == "" {
+					servers = append(servers, statusBackend(t, fasthttp.StatusInternalServerError, "down"))
+				} else {
+					servers = append(servers, jsonBackend(t, body))
+				}
+			}
+			writeServers(t, servers...)
+
+			resp := proxyGet(t, "/merge?url=api.example.com/items")
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			var merged mergeResponse
+			if err := json.Unmarshal(resp.Body(), &merged); err != nil {
+				t.Fatal(err)
+			}
+			if items, _ := json.Marshal(merged.Items); string(items) != tt.items {
+				t.Errorf("items = %s, want %s", items, tt.items)
+			}
+			if len(merged.Sources) != len(tt.statuses) {
+				t.Fatalf("sources = %+v, want %v", merged.Sources, tt.statuses)
+			}
+			for i, source := range merged.Sources {
+				if source.Server != servers[i] || source.Status != tt.statuses[i] {
+					t.Errorf("source %d = %+v, want %s %s", i, source, servers[i], tt.statuses[i])
+				}
+				if source.Status == "error" && source.Error == "" {
+					t.Errorf("source %d has no error", i)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeDisabled(t *testing.T) {
+	setup(t)
+	var requests atomic.Int64
+	writeServers(t, countingBackend(t, `[]`, &requests))
+
+	resp := proxyGet(t, "/merge?url=api.example.com/items")
+	if resp.StatusCode() != fasthttp.StatusNotFound || !strings.Contains(string(resp.Body()), "disabled") || requests.Load() != 0 {
+		t.Errorf("status = %d: %s, want /merge disabled without -merge", resp.StatusCode(), resp.Body())
+	}
+}
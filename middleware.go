@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ResponseMiddleware transforms a successful response after it has been
+// fetched (or read from the cache) and before it is written to the client.
+// The cached copy is never affected.
+type ResponseMiddleware interface {
+	ProcessResponse(ctx *fasthttp.RequestCtx, resp *upstreamResponse) error
+}
+
+type ResponseMiddlewareFunc func(ctx *fasthttp.RequestCtx, resp *upstreamResponse) error
+
+func (f ResponseMiddlewareFunc) ProcessResponse(ctx *fasthttp.RequestCtx, resp *upstreamResponse) error {
+	return f(ctx, resp)
+}
+
+var responseMiddlewares = map[string]ResponseMiddleware{
+	"envelope": ResponseMiddlewareFunc(envelopeMiddleware),
+	"location": ResponseMiddlewareFunc(locationRewriteMiddleware),
+}
+
+// locationRewriteMiddleware points the Location of a passed-through redirect
+// back at the proxy, so clients following it stay on the proxy path. Relative
+// locations are resolved against the target first; targets without a scheme
+// are resolved by the Lambda, so their relative redirects are left alone.
+func locationRewriteMiddleware(ctx *fasthttp.RequestCtx, resp *upstreamResponse) error {
+	if resp.Location == "" {
+		return nil
+	}
+
+	location, err := url.Parse(resp.Location)
+	if err != nil {
+		return nil
+	}
+
+	if !location.IsAbs() {
+		target, _ := ctx.UserValue("target").(string)
+		base, err := url.Parse(target)
+		if err != nil || !base.IsAbs() {
+			return nil
+		}
+		location = base.ResolveReference(location)
+	}
+
+	resp.Location = fmt.Sprintf("/?url=%s", url.QueryEscape(location.String()))
+	return nil
+}
+
+var responseChain []ResponseMiddleware
+
+// buildResponseChain resolves a comma-separated list of middleware names into
+// the chain applied by applyResponseChain, in the given order.
+func buildResponseChain(names string) ([]ResponseMiddleware, error) {
+	var chain []ResponseMiddleware
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		middleware, ok := responseMiddlewares[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown response middleware %q", name)
+		}
+		chain = append(chain, middleware)
+	}
+	return chain, nil
+}
+
+func applyResponseChain(ctx *fasthttp.RequestCtx, resp *upstreamResponse) error {
+	for _, middleware := range responseChain {
+		if err := middleware.ProcessResponse(ctx, resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func appendMiddleware(suffix string) ResponseMiddleware {
+	return ResponseMiddlewareFunc(func(ctx *fasthttp.RequestCtx, resp *upstreamResponse) error {
+		resp.Body += suffix
+		return nil
+	})
+}
+
+func TestResponseChainOrder(t *testing.T) {
+	responseMiddlewares["first"] = appendMiddleware("+first")
+	responseMiddlewares["second"] = appendMiddleware("+second")
+	responseMiddlewares["failing"] = ResponseMiddlewareFunc(func(*fasthttp.RequestCtx, *upstreamResponse) error {
+		return errors.New("failed")
+	})
+	t.Cleanup(func() {
+		delete(responseMiddlewares, "first")
+		delete(responseMiddlewares, "second")
+		delete(responseMiddlewares, "failing")
+	})
+
+	tests := []struct {
+		names   string
+		want    string
+		wantErr bool
+	}{
+		{"first,second", "body+first+second", false},
+		{"second, first", "body+second+first", false},
+		{"", "body", false},
+		{"first,failing,second", "body+first", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.names, func(t *testing.T) {
+			setup(t)
+			chain, err := buildResponseChain(tt.names)
+			if err != nil {
+				t.Fatal(err)
+			}
+			responseChain = chain
+
+			var ctx fasthttp.RequestCtx
+			resp := upstreamResponse{Body: "body"}
+			if err := applyResponseChain(&ctx, &resp); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if resp.Body != tt.want {
+				t.Errorf("body = %q, want %q", resp.Body, tt.want)
+			}
+		})
+	}
+
+	if _, err := buildResponseChain("first,unknown"); err == nil {
+		t.Error("unknown middleware accepted")
+	}
+}
+
+func TestResponseChainLeavesCacheAlone(t *testing.T) {
+	responseMiddlewares["first"] = appendMiddleware("+first")
+	t.Cleanup(func() { delete(responseMiddlewares, "first") })
+	setup(t)
+	responseChain, _ = buildResponseChain("first")
+	writeServers(t, jsonBackend(t, `{}`))
+
+	for i := 0; i < 2; i++ {
+		if body := string(proxyGet(t, target("api.example.com/x")).Body()); body != "{}+first" {
+			t.Errorf("response %d = %q, want the middleware applied once", i+1, body)
+		}
+	}
+	if cached, _ := cacheGet(cacheKey("api.example.com/x")); cached.Body != "{}" {
+		t.Errorf("cached body = %q, want the upstream body", cached.Body)
+	}
+}
+
+func TestLocationRewrite(t *testing.T) {
+	tests := []struct {
+		name       string
+		middleware string
+		target     string
+		location   string
+		want       string
+	}{
+		{"absolute", "location", "https://api.example.com/old", "https://api.example.com/new?a=1", "/?url=https%3A%2F%2Fapi.example.com%2Fnew%3Fa%3D1"},
+		{"relative", "location", "https://api.example.com/dir/old", "../moved", "/?url=https%3A%2F%2Fapi.example.com%2Fmoved"},
+		{"relative without a scheme", "location", "api.example.com/old", "/moved", "/moved"},
+		{"opt-in", "", "https://api.example.com/old", "https://api.example.com/new", "https://api.example.com/new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.FollowRedirects = false
+			responseChain, _ = buildResponseChain(tt.middleware)
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				ctx.Response.Header.Set("Location", tt.location)
+				ctx.SetStatusCode(fasthttp.StatusFound)
+			}))
+
+			resp := proxyGet(t, target(url.QueryEscape(tt.target)))
+			if resp.StatusCode() != fasthttp.StatusFound {
+				t.Fatalf("status = %d, want 302: %s", resp.StatusCode(), resp.Body())
+			}
+			if got := string(resp.Header.Peek("Location")); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
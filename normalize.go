@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/valyala/fasthttp"
+)
+
+// normalizeResponse returns resp with the -normalize-bom, -normalize-charset,
+// -normalize-trim and -normalize-blank-fields rules applied, so responses
+// that only differ in volatile parts compare and dedupe as equal and clients
+// get plain UTF-8. Redirects are left alone.
+func normalizeResponse(resp upstreamResponse) upstreamResponse {
+	if resp.StatusCode != 0 {
+		return resp
+	}
+	if textContentType(resp.ContentType) && !bodyEncoded(resp) {
+		if config.NormalizeBOM {
+			resp.Body = strings.TrimPrefix(resp.Body, utf8BOM)
+		}
+		if config.NormalizeCharset != "" {
+			resp = transcodeToUTF8(resp, config.NormalizeCharset)
+		}
+		if config.NormalizeTrim {
+			resp.Body = strings.TrimSpace(resp.Body)
+		}
+	}
+	if config.NormalizeBlankFields != "" && strings.Contains(strings.ToLower(resp.ContentType), "json") {
+		resp.Body = blankJSONFields(resp.Body, config.NormalizeBlankFields)
+	}
+	return resp
+}
+
+// blankJSONFields sets every listed field of a JSON body to null. Fields are
+// dot-separated paths such as "meta.generated_at", and apply to each element
+// of the arrays along the way. A body that is not valid JSON is returned as
+// it is.
+func blankJSONFields(body string, fields string) string {
+	var doc interface{}
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return body
+	}
+
+	for _, field := range strings.Split(fields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			blankField(doc, strings.Split(field, "."))
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return body
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func blankField(value interface{}, path []string) {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, element := range v {
+			blankField(element, path)
+		}
+	case map[string]interface{}:
+		child, ok := v[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			v[path[0]] = nil
+			return
+		}
+		blankField(child, path[1:])
+	}
+}
+
+const utf8BOM = "\uFEFF"
+
+// windows1252High maps the bytes 0x80 to 0x9F of windows-1252 to Unicode;
+// the five bytes it leaves undefined map to the code point of the same value,
+// as browsers do. The other bytes are the same as in ISO-8859-1.
+var windows1252High = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+// normalizeCharsets are the -normalize-charset values, by every name they
+// go by in a Content-Type.
+var normalizeCharsets = map[string]string{
+	"iso-8859-1":   "iso-8859-1",
+	"latin1":       "iso-8859-1",
+	"latin-1":      "iso-8859-1",
+	"windows-1252": "windows-1252",
+	"cp1252":       "windows-1252",
+}
+
+// textContentType reports whether contentType is text a charset applies to:
+// text/*, JSON, XML or JavaScript.
+func textContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	return strings.HasPrefix(mediaType, "text/") || strings.Contains(mediaType, "json") ||
+		strings.Contains(mediaType, "xml") || strings.Contains(mediaType, "javascript")
+}
+
+// bodyEncoded reports whether resp still has the Content-Encoding it came
+// with, in which case its bytes are not text.
+func bodyEncoded(resp upstreamResponse) bool {
+	for _, header := range resp.Headers {
+		if strings.EqualFold(header.Name, fasthttp.HeaderContentEncoding) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentTypeCharset splits contentType into its lower-case charset
+// parameter, "" without one, and the rest of its parts.
+func contentTypeCharset(contentType string) (charset string, rest []string) {
+	parts := strings.Split(contentType, ";")
+	for _, part := range parts {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "charset") {
+			charset = strings.ToLower(strings.Trim(strings.TrimSpace(value), `"`))
+			continue
+		}
+		rest = append(rest, strings.TrimSpace(part))
+	}
+	return charset, rest
+}
+
+// transcodeToUTF8 converts the body of resp from charset to UTF-8 when its
+// Content-Type declares that charset, or declares none and the body is not
+// valid UTF-8, and then labels it charset=utf-8.
+func transcodeToUTF8(resp upstreamResponse, charset string) upstreamResponse {
+	declared, rest := contentTypeCharset(resp.ContentType)
+	if declared == "" && utf8.ValidString(resp.Body) || declared != "" && normalizeCharsets[declared] != charset {
+		return resp
+	}
+
+	var b strings.Builder
+	b.Grow(len(resp.Body) + len(resp.Body)/8)
+	for i := 0; i < len(resp.Body); i++ {
+		c := resp.Body[i]
+		switch {
+		case c < 0x80:
+			b.WriteByte(c)
+		case c < 0xA0 && charset == "windows-1252":
+			b.WriteRune(windows1252High[c-0x80])
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	resp.Body = b.String()
+	resp.ContentType = strings.Join(append(rest, "charset=utf-8"), "; ")
+	return resp
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestBlankJSONFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		fields string
+		want   string
+	}{
+		{"top level", `{"id":1,"ts":"2024-01-01T00:00:00Z"}`, "ts", `{"id":1,"ts":null}`},
+		{"nested", `{"meta":{"generated_at":123,"v":2}}`, "meta.generated_at", `{"meta":{"generated_at":null,"v":2}}`},
+		{"through arrays", `{"items":[{"ts":1,"n":"a"},{"ts":2,"n":"b"}]}`, "items.ts", `{"items":[{"n":"a","ts":null},{"n":"b","ts":null}]}`},
+		{"several fields", `{"a":1,"b":2,"c":3}`, " a , c ,", `{"a":null,"b":2,"c":null}`},
+		{"missing field", `{"a":1}`, "b,a.x", `{"a":1}`},
+		{"large numbers kept", `{"id":12345678901234567890,"ts":1}`, "ts", `{"id":12345678901234567890,"ts":null}`},
+		{"html kept unescaped", `{"html":"<b>&</b>","ts":1}`, "ts", `{"html":"<b>&</b>","ts":null}`},
+		{"not JSON", `not json {`, "ts", `not json {`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := blankJSONFields(tt.body, tt.fields); got != tt.want {
+				t.Errorf("blankJSONFields = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		trim   bool
+		fields string
+		resp   upstreamResponse
+		want   string
+	}{
+		{"off", false, "", upstreamResponse{Body: " {} \n", ContentType: "application/json"}, " {} \n"},
+		{"trim", true, "", upstreamResponse{Body: " {} \n", ContentType: "application/json"}, "{}"},
+		{"blank fields of JSON", false, "ts", upstreamResponse{Body: `{"ts":1}`, ContentType: "application/json; charset=utf-8"}, `{"ts":null}`},
+		{"fields left alone outside JSON", false, "ts", upstreamResponse{Body: `{"ts":1}`, ContentType: "text/plain"}, `{"ts":1}`},
+		{"binary not trimmed", true, "", upstreamResponse{Body: " \x00\x01 ", ContentType: "application/octet-stream"}, " \x00\x01 "},
+		{"redirect left alone", true, "", upstreamResponse{Body: " moved ", ContentType: "text/plain", StatusCode: fasthttp.StatusFound}, " moved "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.NormalizeTrim = tt.trim
+			config.NormalizeBlankFields = tt.fields
+			if got := normalizeResponse(tt.resp).Body; got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeBeforeCaching(t *testing.T) {
+	tests := []struct {
+		name      string
+		cacheOnly bool
+	}{
+		{"returned and cached", false},
+		{"cached only", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.NormalizeBlankFields = "meta.generated_at"
+			config.NormalizeCacheOnly = tt.cacheOnly
+			var requests atomic.Int64
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				ctx.SetContentType("application/json")
+				fmt.Fprintf(ctx, `{"data":"x","meta":{"generated_at":%d}}`, requests.Add(1))
+			}))
+			const normalized = `{"data":"x","meta":{"generated_at":null}}`
+
+			fresh := string(proxyGet(t, target("api.example.com/normalize")).Body())
+			cached := string(proxyGet(t, target("api.example.com/normalize")).Body())
+			if want := map[bool]string{false: normalized, true: `{"data":"x","meta":{"generated_at":1}}`}[tt.cacheOnly]; fresh != want {
+				t.Errorf("fresh response = %s, want %s", fresh, want)
+			}
+			if cached != normalized {
+				t.Errorf("cached response = %s, want %s", cached, normalized)
+			}
+			if requests.Load() != 1 {
+				t.Errorf("server requests = %d, want the second one cached", requests.Load())
+			}
+		})
+	}
+}
+
+func TestNormalizedBodiesDedupe(t *testing.T) {
+	setup(t)
+	config.CacheDedupe = true
+	config.NormalizeTrim = true
+	config.NormalizeBlankFields = "ts"
+	var requests atomic.Int64
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("application/json")
+		fmt.Fprintf(ctx, "  {\"ts\":%d,\"v\":1}\n", requests.Add(1))
+	}))
+
+	for i := 0; i < 3; i++ {
+		proxyGet(t, target(fmt.Sprintf("api.example.com/normalize/%d", i)))
+	}
+	if got := blobCount(); got != 1 {
+		t.Errorf("%d stored bodies for three responses equal after normalization, want 1", got)
+	}
+}
+
+func TestTextContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/plain", true},
+		{"Text/HTML; charset=windows-1252", true},
+		{"application/json", true},
+		{"application/problem+json; charset=utf-8", true},
+		{"application/xml", true},
+		{"application/javascript", true},
+		{"application/octet-stream", false},
+		{"image/png", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := textContentType(tt.contentType); got != tt.want {
+			t.Errorf("textContentType(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestContentTypeCharset(t *testing.T) {
+	tests := []struct {
+		contentType string
+		charset     string
+		rest        string
+	}{
+		{"text/plain", "", "text/plain"},
+		{"text/plain; charset=ISO-8859-1", "iso-8859-1", "text/plain"},
+		{`text/html;charset="windows-1252"; level=1`, "windows-1252", "text/html; level=1"},
+		{"application/json ; Charset = latin1 ", "latin1", "application/json"},
+	}
+	for _, tt := range tests {
+		charset, rest := contentTypeCharset(tt.contentType)
+		if charset != tt.charset || strings.Join(rest, "; ") != tt.rest {
+			t.Errorf("contentTypeCharset(%q) = %q, %q, want %q, %q", tt.contentType, charset, rest, tt.charset, tt.rest)
+		}
+	}
+}
+
+func TestTranscodeToUTF8(t *testing.T) {
+	tests := []struct {
+		name        string
+		charset     string
+		resp        upstreamResponse
+		body        string
+		contentType string
+	}{
+		{"latin-1 declared", "iso-8859-1", upstreamResponse{Body: "caf\xe9", ContentType: "text/plain; charset=iso-8859-1"}, "café", "text/plain; charset=utf-8"},
+		{"declared by another name", "iso-8859-1", upstreamResponse{Body: "caf\xe9", ContentType: "text/plain; charset=latin1"}, "café", "text/plain; charset=utf-8"},
+		{"windows-1252 punctuation", "windows-1252", upstreamResponse{Body: "\x93hi\x94 \x80", ContentType: "text/plain; charset=cp1252"}, "“hi” €", "text/plain; charset=utf-8"},
+		{"windows-1252 undefined byte", "windows-1252", upstreamResponse{Body: "\x81", ContentType: "text/plain; charset=windows-1252"}, "\u0081", "text/plain; charset=utf-8"},
+		{"latin-1 has no punctuation", "iso-8859-1", upstreamResponse{Body: "\x80", ContentType: "text/plain; charset=iso-8859-1"}, "\u0080", "text/plain; charset=utf-8"},
+		{"undeclared and not UTF-8", "windows-1252", upstreamResponse{Body: `{"name":"caf` + "\xe9" + `"}`, ContentType: "application/json"}, `{"name":"café"}`, "application/json; charset=utf-8"},
+		{"undeclared and UTF-8", "windows-1252", upstreamResponse{Body: `{"name":"café"}`, ContentType: "application/json"}, `{"name":"café"}`, "application/json"},
+		{"another charset declared", "windows-1252", upstreamResponse{Body: "caf\xe9", ContentType: "text/plain; charset=utf-8"}, "caf\xe9", "text/plain; charset=utf-8"},
+		{"the other configured charset", "iso-8859-1", upstreamResponse{Body: "\x80", ContentType: "text/plain; charset=windows-1252"}, "\x80", "text/plain; charset=windows-1252"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := transcodeToUTF8(tt.resp, tt.charset)
+			if got.Body != tt.body || got.ContentType != tt.contentType {
+				t.Errorf("transcodeToUTF8 = %q, %q, want %q, %q", got.Body, got.ContentType, tt.body, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestNormalizeBOM(t *testing.T) {
+	gzipped := []headerField{{Name: "Content-Encoding", Value: "gzip"}}
+	tests := []struct {
+		name string
+		bom  bool
+		trim bool
+		resp upstreamResponse
+		want string
+	}{
+		{"off", false, false, upstreamResponse{Body: utf8BOM + `{}`, ContentType: "application/json"}, utf8BOM + `{}`},
+		{"JSON", true, false, upstreamResponse{Body: utf8BOM + `{}`, ContentType: "application/json"}, `{}`},
+		{"text", true, false, upstreamResponse{Body: utf8BOM + "a,b\n", ContentType: "text/csv"}, "a,b\n"},
+		{"only a leading one", true, false, upstreamResponse{Body: utf8BOM + utf8BOM + "x", ContentType: "text/plain"}, utf8BOM + "x"},
+		{"not leading", true, false, upstreamResponse{Body: "x" + utf8BOM, ContentType: "text/plain"}, "x" + utf8BOM},
+		{"with trim", true, true, upstreamResponse{Body: utf8BOM + " {} ", ContentType: "application/json"}, `{}`},
+		{"binary left alone", true, false, upstreamResponse{Body: utf8BOM + "\x00", ContentType: "application/octet-stream"}, utf8BOM + "\x00"},
+		{"still encoded", true, false, upstreamResponse{Body: utf8BOM + `{}`, ContentType: "application/json", Headers: gzipped}, utf8BOM + `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.NormalizeBOM = tt.bom
+			config.NormalizeTrim = tt.trim
+			if got := normalizeResponse(tt.resp).Body; got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeEncodingBeforeCaching(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+		wantType    string
+	}{
+		{"BOM", "application/json", utf8BOM + `{"name":"café"}`, `{"name":"café"}`, "application/json"},
+		{"charset", "application/json; charset=windows-1252", `{"name":"caf` + "\xe9" + `"}`, `{"name":"café"}`, "application/json; charset=utf-8"},
+		{"BOM and charset", "text/plain; charset=windows-1252", utf8BOM + "\x93quoted\x94", "“quoted”", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.NormalizeBOM = true
+			config.NormalizeCharset = "windows-1252"
+			var requests atomic.Int64
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				requests.Add(1)
+				ctx.SetContentType(tt.contentType)
+				ctx.SetBodyString(tt.body)
+			}))
+
+			for _, step := range []string{"fresh", "cached"} {
+				resp := proxyGet(t, target("api.example.com/encoding"))
+				if string(resp.Body()) != tt.want || string(resp.Header.ContentType()) != tt.wantType {
+					t.Errorf("%s response = %q, %q, want %q, %q", step, resp.Body(), resp.Header.ContentType(), tt.want, tt.wantType)
+				}
+			}
+			if requests.Load() != 1 {
+				t.Errorf("server requests = %d, want the second one cached", requests.Load())
+			}
+			if cached, ok := cacheGet(cacheKey("api.example.com/encoding")); !ok || cached.Body != tt.want {
+				t.Errorf("cached %q, %v, want %q", cached.Body, ok, tt.want)
+			}
+		})
+	}
+}
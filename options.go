@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// requestOptions are the per-request overrides a client may send, either as
+// individual headers or bundled in X-Proxy-Options.
+type requestOptions struct {
+	Timeout  time.Duration
+	CacheTTL time.Duration
+	NoCache  bool
+	Server   string
+	NoRotate bool
+}
+
+const optionsHeader = "X-Proxy-Options"
+
+var optionHeaders = map[string]string{
+	"timeout":   "X-Proxy-Timeout",
+	"ttl":       "X-Cache-TTL",
+	"no-cache":  "X-No-Cache",
+	"server":    "X-Pin-Server",
+	"no-rotate": "X-No-Rotate",
+}
+
+// parseRequestOptions reads X-Proxy-Options, either a JSON object or a
+// "key=value" list separated by ";" or ",", and then the individual option
+// headers, which take precedence. Durations are clamped to the configured
+// maximums; unparsable values are rejected.
+func parseRequestOptions(ctx *fasthttp.RequestCtx) (requestOptions, error) {
+	values := make(map[string]string)
+
+	if bundle := strings.TrimSpace(string(ctx.Request.Header.Peek(optionsHeader))); bundle != "" {
+		if err := parseOptionsBundle(bundle, values); err != nil {
+			return requestOptions{}, err
+		}
+	}
+
+	for name, header := range optionHeaders {
+		if value := ctx.Request.Header.Peek(header); len(value) > 0 {
+			values[name] = string(value)
+		}
+	}
+
+	opts := requestOptions{NoRotate: config.NoRotate}
+	for name, value := range values {
+		var err error
+		switch name {
+		case "timeout":
+			opts.Timeout, err = parseOptionDuration(value, config.MaxUpstreamTimeout)
+		case "ttl":
+			opts.CacheTTL, err = parseOptionDuration(value, config.MaxCacheTTL)
+		case "no-cache":
+			if value == "" {
+				opts.NoCache = true
+			} else {
+				opts.NoCache, err = strconv.ParseBool(value)
+			}
+		case "server":
+			opts.Server = value
+		case "no-rotate":
+			if value == "" {
+				opts.NoRotate = true
+			} else {
+				opts.NoRotate, err = strconv.ParseBool(value)
+			}
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return requestOptions{}, fmt.Errorf("invalid %s option %q: %v", name, value, err)
+		}
+	}
+
+	return opts, nil
+}
+
+func parseOptionsBundle(bundle string, values map[string]string) error {
+	if strings.HasPrefix(bundle, "{") {
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(bundle), &decoded); err != nil {
+			return fmt.Errorf("invalid %s header: %v", optionsHeader, err)
+		}
+		for name, value := range decoded {
+			values[strings.ToLower(name)] = fmt.Sprint(value)
+		}
+		return nil
+	}
+
+	for _, part := range strings.FieldsFunc(bundle, func(r rune) bool { return r == ';' || r == ',' }) {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		values[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	return nil
+}
+
+// parseOptionDuration accepts a Go duration or a plain number of seconds and
+// clamps the result to [0, max].
+func parseOptionDuration(value string, max time.Duration) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, numErr := strconv.ParseFloat(value, 64)
+		if numErr != nil {
+			return 0, err
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+
+	if d < 0 {
+		d = 0
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseRequestOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    requestOptions
+		wantErr bool
+	}{
+		{"none", nil, requestOptions{}, false},
+		{"key=value list", []string{optionsHeader, "timeout=5s; ttl=30, no-cache; server=http://a.test; no-rotate=true"},
+			requestOptions{Timeout: 5 * time.Second, CacheTTL: 30 * time.Second, NoCache: true, Server: "http://a.test", NoRotate: true}, false},
+		{"JSON object", []string{optionsHeader, `{"timeout": 2.5, "TTL": "1m", "no-cache": true, "server": "http://b.test"}`},
+			requestOptions{Timeout: 2500 * time.Millisecond, CacheTTL: time.Minute, NoCache: true, Server: "http://b.test"}, false},
+		{"clamped to the maximums", []string{optionsHeader, "timeout=10m;ttl=48h"},
+			requestOptions{Timeout: time.Minute, CacheTTL: time.Hour}, false},
+		{"negative clamped to zero", []string{optionsHeader, "timeout=-5s"}, requestOptions{}, false},
+		{"individual headers take precedence", []string{optionsHeader, "timeout=5s;server=http://a.test", "X-Proxy-Timeout", "7s", "X-Pin-Server", "http://c.test"},
+			requestOptions{Timeout: 7 * time.Second, Server: "http://c.test"}, false},
+		{"invalid duration", []string{optionsHeader, "timeout=soon"}, requestOptions{}, true},
+		{"invalid bool", []string{optionsHeader, "no-cache=maybe"}, requestOptions{}, true},
+		{"unknown option", []string{optionsHeader, "colour=blue"}, requestOptions{}, true},
+		{"invalid JSON", []string{optionsHeader, "{timeout"}, requestOptions{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			var ctx fasthttp.RequestCtx
+			for i := 0; i+1 < len(tt.headers); i += 2 {
+				ctx.Request.Header.Set(tt.headers[i], tt.headers[i+1])
+			}
+			got, err := parseRequestOptions(&ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("options = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyOptionsHeaderApplied(t *testing.T) {
+	setup(t)
+	server, other := namedBackend(t), namedBackend(t)
+	writeServers(t, server, other)
+
+	// The pin picks the server and no-cache makes the second request go
+	// upstream again, this time pinned to the other server.
+	first := proxyGet(t, target("api.example.com/opts"), optionsHeader, "server="+other)
+	if got := servedBy(t, first); got != other {
+		t.Errorf("pinned request served by %s, want %s", got, other)
+	}
+	second := proxyGet(t, target("api.example.com/opts"), optionsHeader, `{"server": "`+server+`", "no-cache": true}`)
+	if got := servedBy(t, second); got != server {
+		t.Errorf("no-cache request served by %s, want %s", got, server)
+	}
+
+	resp := proxyGet(t, target("api.example.com/opts"), optionsHeader, "timeout=soon")
+	if resp.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("invalid option status = %d, want 400", resp.StatusCode())
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// pendingField is one -pending-fields entry: the JSON value at path must
+// equal value for a body to count as pending.
+type pendingField struct {
+	path  []interface{}
+	value string
+}
+
+var (
+	pendingPattern *regexp.Regexp
+	pendingFields  []pendingField
+)
+
+// parsePendingFields reads -pending-fields, e.g. "status=pending,job.state=queued".
+// Path segments that are numbers index into arrays.
+func parsePendingFields(spec string) ([]pendingField, error) {
+	var fields []pendingField
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		path, value, ok := strings.Cut(entry, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("pending field %q is not path=value", entry)
+		}
+		field := pendingField{value: value}
+		for _, segment := range strings.Split(path, ".") {
+			if index, err := strconv.Atoi(segment); err == nil {
+				field.path = append(field.path, index)
+			} else {
+				field.path = append(field.path, segment)
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// isPendingBody reports whether a successful response body is only a "try
+// again" answer, going by -pending-pattern and -pending-fields. Fields match
+// strings by their text and other values by their JSON form, e.g. true.
+func isPendingBody(body []byte) bool {
+	if pendingPattern != nil && pendingPattern.Match(body) {
+		return true
+	}
+	for _, field := range pendingFields {
+		value := json.Get(body, field.path...)
+		if value.LastError() == nil && value.ValueType() != jsoniter.InvalidValue && value.ToString() == field.value {
+			return true
+		}
+	}
+	return false
+}
+
+func isPendingError(err error) bool {
+	var retryable *retryableError
+	return errors.As(err, &retryable) && retryable.Pending
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestParsePendingFields(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []pendingField
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"status=pending", []pendingField{{path: []interface{}{"status"}, value: "pending"}}, false},
+		{" job.state=queued , items.0.done=false ", []pendingField{
+			{path: []interface{}{"job", "state"}, value: "queued"},
+			{path: []interface{}{"items", 0, "done"}, value: "false"},
+		}, false},
+		{"status=", []pendingField{{path: []interface{}{"status"}, value: ""}}, false},
+		{"status", nil, true},
+		{"=pending", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePendingFields(tt.spec)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePendingFields(%q) = %v, %v, want %v (error %v)", tt.spec, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestIsPendingBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		fields  string
+		body    string
+		pending bool
+	}{
+		{"nothing configured", "", "", `{"status":"pending"}`, false},
+		{"pattern", `"status":\s*"pending"`, "", `{"status": "pending"}`, true},
+		{"pattern not matched", `"status":\s*"pending"`, "", `{"status":"done"}`, false},
+		{"field", "", "status=pending", `{"status":"pending"}`, true},
+		{"field with another value", "", "status=pending", `{"status":"done"}`, false},
+		{"nested field", "", "job.state=queued", `{"job":{"state":"queued"}}`, true},
+		{"array index", "", "items.1.done=false", `{"items":[{"done":true},{"done":false}]}`, true},
+		{"boolean by its JSON form", "", "ready=false", `{"ready":false}`, true},
+		{"missing field", "", "status=", `{"other":1}`, false},
+		{"not JSON", "", "status=pending", `status=pending`, false},
+		{"any field", "", "status=pending,job.state=queued", `{"job":{"state":"queued"}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			if tt.pattern != "" {
+				pendingPattern = regexp.MustCompile(tt.pattern)
+			}
+			pendingFields, _ = parsePendingFields(tt.fields)
+			if got := isPendingBody([]byte(tt.body)); got != tt.pending {
+				t.Errorf("isPendingBody(%s) = %v, want %v", tt.body, got, tt.pending)
+			}
+		})
+	}
+}
+
+// pendingBackend answers pending the first pending times it is asked and
+// with body after that.
+func pendingBackend(t *testing.T, pending int64, body string, requests *atomic.Int64) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("application/json")
+		if requests.Add(1) <= pending {
+			ctx.SetBodyString(`{"status":"pending"}`)
+			return
+		}
+		ctx.SetBodyString(body)
+	})
+}
+
+func TestPendingRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		delay    time.Duration
+		pending  []int64 // pending answers per server before a final one
+		status   int
+		body     string
+		requests []int64
+	}{
+		{"next server answers", 3, 0, []int64{1, 0}, fasthttp.StatusOK, `{"server":2}`, []int64{1, 1}},
+		{"several pending servers", 3, 0, []int64{1, 1, 0}, fasthttp.StatusOK, `{"server":3}`, []int64{1, 1, 1}},
+		{"retries used up", 1, 0, []int64{1, 1, 0}, fasthttp.StatusServiceUnavailable, "", []int64{1, 1, 0}},
+		{"servers run out", 3, 0, []int64{1, 1}, fasthttp.StatusServiceUnavailable, "", []int64{1, 1}},
+		{"same server after the delay", 3, 10 * time.Millisecond, []int64{2, 0}, fasthttp.StatusOK, `{"server":1}`, []int64{3, 0}},
+		{"delay with retries used up", 2, 10 * time.Millisecond, []int64{5, 0}, fasthttp.StatusServiceUnavailable, "", []int64{3, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.PendingRetries = tt.retries
+			config.PendingRetryDelay = tt.delay
+			pendingFields, _ = parsePendingFields("status=pending")
+			requests := make([]atomic.Int64, len(tt.pending))
+			var servers []string
+			for i, pending := range tt.pending {
+				servers = append(servers, pendingBackend(t, pending, fmt.Sprintf(`{"server":%d}`, i+1), &requests[i]))
+			}
+			writeServers(t, servers...)
+
+			resp := proxyGet(t, target("api.example.com/job"))
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if tt.body != "" && string(resp.Body()) != tt.body {
+				t.Errorf("body = %s, want %s", resp.Body(), tt.body)
+			}
+			for i := range requests {
+				if got := requests[i].Load(); got != tt.requests[i] {
+					t.Errorf("server %d got %d requests, want %d", i+1, got, tt.requests[i])
+				}
+			}
+			cached, ok := cacheGet(cacheKey("api.example.com/job"))
+			if tt.body == "" && ok || tt.body != "" && (!ok || cached.Body != tt.body) {
+				t.Errorf("cached %q, %v, want only the final response cached", cached.Body, ok)
+			}
+		})
+	}
+}
+
+func TestPendingKeepsServerHealthy(t *testing.T) {
+	setup(t)
+	config.BreakerThreshold = 1
+	pendingFields, _ = parsePendingFields("status=pending")
+	var requests atomic.Int64
+	server := pendingBackend(t, 1, `{"done":true}`, &requests)
+	writeServers(t, server)
+
+	if resp := proxyGet(t, target("api.example.com/job")); resp.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503 for the pending answer: %s", resp.StatusCode(), resp.Body())
+	}
+	if resp := proxyGet(t, target("api.example.com/job")); string(resp.Body()) != `{"done":true}` {
+		t.Errorf("second request = %d %s, want the server asked again", resp.StatusCode(), resp.Body())
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/valyala/fasthttp"
+)
+
+type planServer struct {
+	Server string `json:"server"`
+	Reason string `json:"reason"`
+}
+
+type planResponse struct {
+	Target       string       `json:"target"`
+	CacheKey     string       `json:"cache_key"`
+	Cached       bool         `json:"cached"`
+	Chosen       string       `json:"chosen,omitempty"`
+	Candidates   []string     `json:"candidates"`
+	Excluded     []planServer `json:"excluded,omitempty"`
+	NoCandidates string       `json:"no_candidates_reason,omitempty"`
+}
+
+// handlePlan serves /plan?url=...: the servers a request for the target would
+// try right now, in order, after pinning, tags, health, cooldowns, latency
+// demotion and affinity, plus every server left out and why. No server is
+// contacted. Chosen is the first candidate; a fresh cache entry would be
+// served instead, which Cached reports.
+func handlePlan(ctx *fasthttp.RequestCtx) {
+	if !authorizeAdmin(ctx) {
+		return
+	}
+	decodedURL, err := targetURL(ctx)
+	if err != nil || decodedURL == "" {
+		sendJSONErrorResponse(ctx, "Invalid or missing URL parameter", fasthttp.StatusBadRequest)
+		return
+	}
+	opts, err := parseRequestOptions(ctx)
+	if err != nil {
+		sendJSONErrorResponse(ctx, err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+	outbound, err := newUpstreamRequest(ctx, decodedURL, opts)
+	if err != nil {
+		sendJSONErrorResponse(ctx, err.Error(), fasthttp.StatusUnsupportedMediaType)
+		return
+	}
+	key, idempotent, err := proxyCacheKey(ctx, decodedURL, outbound)
+	if err != nil {
+		sendJSONErrorCode(ctx, err.Error(), "invalid_namespace", fasthttp.StatusBadRequest)
+		return
+	}
+
+	plan := planResponse{Target: decodedURL, CacheKey: key, Candidates: []string{}}
+	if !opts.NoCache && (idempotent || outbound.cacheable()) {
+		_, plan.Cached = cacheEntry(key)
+	}
+
+	servers, err := readServerAddresses(serversFile)
+	if err != nil {
+		sendJSONErrorResponse(ctx, err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	// The same selection as in handleRequests, without claiming probes.
+	tags := requestTags(ctx)
+	pool := targetPool(decodedURL)
+	candidates := excludeServers(ctx, poolServers(servers, pool))
+	kept := make(map[string]bool, len(candidates))
+	for _, server := range candidates {
+		kept[server.URL] = true
+	}
+	eligible, reason := eligibleServers(candidates, tags, opts.Server)
+	sole := false
+	if config.SingleServerRetries > 0 {
+		if only, _ := candidateServers(candidates, tags, opts.Server); len(only) == 1 {
+			eligible, reason, sole = only, "", true
+		}
+	}
+	plan.NoCandidates = reason
+	if len(eligible) > 0 {
+		first, preferred := 0, len(eligible)
+		if failoverMode(tags) {
+			eligible = failoverOrder(eligible, candidates)
+		} else {
+			preferred = withinSLA(eligible)
+			first = rotationStart(preferred)
+			eligible = preferAffinity(ctx, eligible, first)
+		}
+		for n := range eligible {
+			plan.Candidates = append(plan.Candidates, eligible[rotationIndex(first, n, preferred)].URL)
+		}
+		plan.Chosen = plan.Candidates[0]
+	}
+
+	for _, server := range servers {
+		switch {
+		case server.Pool != pool:
+			plan.Excluded = append(plan.Excluded, planServer{Server: server.URL, Reason: "not in " + poolName(pool)})
+		case !kept[server.URL]:
+			plan.Excluded = append(plan.Excluded, planServer{Server: server.URL, Reason: "excluded by " + excludeServersHeader})
+		case opts.Server != "" && server.URL != opts.Server:
+			plan.Excluded = append(plan.Excluded, planServer{Server: server.URL, Reason: "not pinned"})
+		case len(tags) > 0 && !server.hasTags(tags):
+			plan.Excluded = append(plan.Excluded, planServer{Server: server.URL, Reason: "tags do not match"})
+		default:
+			// A lone server under -single-server-retries is tried anyway.
+			if reason := serverUnavailableReason(server.URL); reason != "" && !sole {
+				plan.Excluded = append(plan.Excluded, planServer{Server: server.URL, Reason: reason})
+			}
+		}
+	}
+
+	sendJSONResponse(ctx, plan, fasthttp.StatusOK)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestPlan(t *testing.T) {
+	tests := []struct {
+		name       string
+		prepare    func(servers []string)
+		query      string
+		candidates []int          // indexes into the servers, in order
+		excluded   map[int]string // server index to reason
+		noneReason bool
+	}{
+		{name: "all healthy", candidates: []int{0, 1, 2}},
+		{
+			name:       "rotation continues after the last server used",
+			prepare:    func([]string) { serverIndex.Store(1) },
+			candidates: []int{1, 2, 0},
+		},
+		{
+			name: "cooling down",
+			prepare: func(servers []string) {
+				config.Cooldown = time.Minute
+				recordRateLimit(servers[0])
+			},
+			candidates: []int{1, 2},
+			excluded:   map[int]string{0: unavailableCooldown},
+		},
+		{
+			name: "breaker open",
+			prepare: func(servers []string) {
+				config.BreakerThreshold = 1
+				recordFailure(servers[1])
+			},
+			candidates: []int{0, 2},
+			excluded:   map[int]string{1: unavailableUnhealthy},
+		},
+		{
+			name:       "tags",
+			query:      "&tags=fast",
+			candidates: []int{2},
+			excluded:   map[int]string{0: "tags do not match", 1: "tags do not match"},
+		},
+		{
+			name: "none left",
+			prepare: func(servers []string) {
+				config.Cooldown = time.Minute
+				for _, server := range servers {
+					recordRateLimit(server)
+				}
+			},
+			candidates: []int{},
+			excluded:   map[int]string{0: unavailableCooldown, 1: unavailableCooldown, 2: unavailableCooldown},
+			noneReason: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.setAdminKey("secret")
+			var requests atomic.Int64
+			servers := []string{countingBackend(t, `{}`, &requests), countingBackend(t, `{}`, &requests), countingBackend(t, `{}`, &requests)}
+			writeFile(t, serversFile, fmt.Sprintf(`[{"url":%q},{"url":%q},{"url":%q,"tags":["fast"]}]`, servers[0], servers[1], servers[2]))
+			if tt.prepare != nil {
+				tt.prepare(servers)
+			}
+
+			resp := proxyGet(t, "/plan?url=api.example.com/plan"+tt.query, "X-API-Key", "secret")
+			if resp.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+			}
+			var plan planResponse
+			if err := json.Unmarshal(resp.Body(), &plan); err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, i := range tt.candidates {
+				want = append(want, servers[i])
+			}
+			if fmt.Sprint(plan.Candidates) != fmt.Sprint(want) {
+				t.Errorf("candidates = %v, want %v", plan.Candidates, want)
+			}
+			if len(want) > 0 && plan.Chosen != want[0] || len(want) == 0 && plan.Chosen != "" {
+				t.Errorf("chosen = %q, want the first candidate", plan.Chosen)
+			}
+			if (plan.NoCandidates != "") != tt.noneReason {
+				t.Errorf("no_candidates_reason = %q", plan.NoCandidates)
+			}
+			excluded := map[string]string{}
+			for _, server := range plan.Excluded {
+				excluded[server.Server] = server.Reason
+			}
+			if len(excluded) != len(tt.excluded) {
+				t.Errorf("excluded = %v, want %v", plan.Excluded, tt.excluded)
+			}
+			for i, reason := range tt.excluded {
+				if excluded[servers[i]] != reason {
+					t.Errorf("%s excluded for %q, want %q", servers[i], excluded[servers[i]], reason)
+				}
+			}
+			if requests.Load() != 0 {
+				t.Errorf("plan contacted the servers %d times", requests.Load())
+			}
+		})
+	}
+}
+
+func TestPlanFollowsTraffic(t *testing.T) {
+	setup(t)
+	config.setAdminKey("secret")
+	config.Cooldown = time.Minute
+	limited := statusBackend(t, fasthttp.StatusTooManyRequests, "slow down")
+	healthy := jsonBackend(t, `{}`)
+	writeServers(t, limited, healthy)
+
+	proxyGet(t, target("api.example.com/plan"))
+	resp := proxyGet(t, "/plan?url=api.example.com/other", "X-API-Key", "secret")
+	var plan planResponse
+	if err := json.Unmarshal(resp.Body(), &plan); err != nil {
+		t.Fatalf("%v: %s", err, resp.Body())
+	}
+	if plan.Chosen != healthy || len(plan.Candidates) != 1 {
+		t.Errorf("candidates = %v, want only %s", plan.Candidates, healthy)
+	}
+	if len(plan.Excluded) != 1 || plan.Excluded[0] != (planServer{Server: limited, Reason: unavailableCooldown}) {
+		t.Errorf("excluded = %v, want %s cooling down", plan.Excluded, limited)
+	}
+}
+
+func TestPlanExcludeServers(t *testing.T) {
+	setup(t)
+	config.setAdminKey("secret")
+	first, second := jsonBackend(t, `{}`), jsonBackend(t, `{}`)
+	writeServers(t, first, second)
+
+	resp := proxyGet(t, "/plan?url=api.example.com/plan", "X-API-Key", "secret", excludeServersHeader, first)
+	var plan planResponse
+	if err := json.Unmarshal(resp.Body(), &plan); err != nil {
+		t.Fatalf("%v: %s", err, resp.Body())
+	}
+	if plan.Chosen != second || len(plan.Candidates) != 1 {
+		t.Errorf("candidates = %v, want only %s", plan.Candidates, second)
+	}
+	if len(plan.Excluded) != 1 || plan.Excluded[0] != (planServer{Server: first, Reason: "excluded by " + excludeServersHeader}) {
+		t.Errorf("excluded = %v, want %s excluded by the header", plan.Excluded, first)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// poolRoute sends targets whose host matches Host, and path matches Path
+// when it is set, to the servers of Pool.
+type poolRoute struct {
+	Host string
+	Path string
+	Pool string
+}
+
+var poolRoutes []poolRoute
+
+// parsePoolRoutes parses -pool-routes, a comma-separated list of
+// pattern=pool pairs such as "api.a.com=a,*.b.com/v2/*=b". A pattern is a
+// host glob optionally followed by a path glob. The order is kept since the
+// first matching route wins.
+func parsePoolRoutes(spec string) ([]poolRoute, error) {
+	var routes []poolRoute
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, pool, ok := strings.Cut(part, "=")
+		if !ok || pattern == "" || pool == "" {
+			return nil, fmt.Errorf("invalid pool route %q, expected pattern=pool", part)
+		}
+		host, routePath, hasPath := strings.Cut(pattern, "/")
+		route := poolRoute{Host: strings.ToLower(host), Pool: pool}
+		if hasPath {
+			route.Path = "/" + routePath
+		}
+		if _, err := path.Match(route.Host, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern in pool route %q", part)
+		}
+		if _, err := path.Match(route.Path, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern in pool route %q", part)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// targetPool returns the pool of the first -pool-routes entry matching
+// target, or "" for the default pool.
+func targetPool(target string) string {
+	if len(poolRoutes) == 0 {
+		return ""
+	}
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	for _, route := range poolRoutes {
+		if matched, _ := path.Match(route.Host, host); !matched {
+			continue
+		}
+		if route.Path == "" || matchesRoute(route.Path, parsed.EscapedPath()) {
+			return route.Pool
+		}
+	}
+	return ""
+}
+
+// poolServers returns the servers of pool. Servers without a "Pool" in the
+// servers file make up the default pool "".
+func poolServers(servers []Server, pool string) []Server {
+	var members []Server
+	for _, server := range servers {
+		if server.Pool == pool {
+			members = append(members, server)
+		}
+	}
+	return members
+}
+
+func poolName(pool string) string {
+	if pool == "" {
+		return "the default pool"
+	}
+	return "pool " + pool
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestParsePoolRoutes(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []poolRoute
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "api.a.com=a, *.B.com/v2/*=b", want: []poolRoute{{Host: "api.a.com", Pool: "a"}, {Host: "*.b.com", Path: "/v2/*", Pool: "b"}}},
+		{spec: "api.a.com", wantErr: true},
+		{spec: "=a", wantErr: true},
+		{spec: "api.a.com=", wantErr: true},
+		{spec: "[a=a", wantErr: true},
+		{spec: "api.a.com/[v2=a", wantErr: true},
+	}
+	for _, tt := range tests {
+		routes, err := parsePoolRoutes(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePoolRoutes(%q) error = %v, want one: %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if fmt.Sprint(routes) != fmt.Sprint(tt.want) {
+			t.Errorf("parsePoolRoutes(%q) = %v, want %v", tt.spec, routes, tt.want)
+		}
+	}
+}
+
+func TestTargetPool(t *testing.T) {
+	setup(t)
+	poolRoutes, _ = parsePoolRoutes("api.a.com=a,*.b.com/v2/*=b,*.b.com=b-other")
+	tests := []struct {
+		target string
+		pool   string
+	}{
+		{"api.a.com/anything", "a"},
+		{"https://API.A.com:8443/x", "a"},
+		{"eu.b.com/v2/items", "b"},
+		{"eu.b.com/v1/items", "b-other"},
+		{"b.com/v2/items", ""},
+		{"api.c.com/x", ""},
+	}
+	for _, tt := range tests {
+		if pool := targetPool(tt.target); pool != tt.pool {
+			t.Errorf("targetPool(%q) = %q, want %q", tt.target, pool, tt.pool)
+		}
+	}
+}
+
+func TestPoolRouting(t *testing.T) {
+	setup(t)
+	poolRoutes, _ = parsePoolRoutes("api.a.com=a,api.b.com=b,api.empty.com=empty")
+	a1, a2, b, def := namedBackend(t), namedBackend(t), namedBackend(t), namedBackend(t)
+	writeFile(t, serversFile, fmt.Sprintf(`[{"url":%q,"pool":"a"},{"url":%q,"pool":"a"},{"url":%q,"pool":"b"},{"url":%q}]`, a1, a2, b, def))
+
+	tests := []struct {
+		target string
+		pool   map[string]bool
+	}{
+		{"api.a.com/1", map[string]bool{a1: true, a2: true}},
+		{"api.a.com/2", map[string]bool{a1: true, a2: true}},
+		{"api.b.com/1", map[string]bool{b: true}},
+		{"api.b.com/2", map[string]bool{b: true}},
+		{"api.other.com/1", map[string]bool{def: true}},
+	}
+	for _, tt := range tests {
+		resp := proxyGet(t, target(tt.target))
+		if server := servedBy(t, resp); !tt.pool[server] {
+			t.Errorf("%s served by %s, want one of %v", tt.target, server, tt.pool)
+		}
+	}
+
+	resp := proxyGet(t, target("api.empty.com/1"))
+	if resp.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("empty pool: status = %d, want 503: %s", resp.StatusCode(), resp.Body())
+	}
+}
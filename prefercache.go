@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// preferCacheRefreshing holds the cache keys with a background refresh
+// running, so a popular expired entry is fetched once and not per hit.
+var preferCacheRefreshing sync.Map
+
+// preferCacheRefreshes tracks the refreshes running in the background.
+var preferCacheRefreshes sync.WaitGroup
+
+// serveCachePreferred answers from an entry that expired less than
+// -prefer-cache ago, without waiting for the servers, and refreshes it in the
+// background. -prefer-cache is thus the grace period of stale-while-revalidate,
+// with at most one refresh per key however many stale hits arrive. It reports
+// whether such an entry was found.
+func serveCachePreferred(ctx *fasthttp.RequestCtx, key string) bool {
+	cachedData, ok := cacheGetStale(key, config.PreferCache)
+	if !ok {
+		return false
+	}
+
+	refreshInBackground(ctx, key)
+	ctx.Response.Header.Set("Warning", `110 - "Response is Stale"`)
+	setCDNCacheStatus(ctx, "STALE")
+	setCacheTier(ctx, cacheTierMemory)
+	writeUpstreamResponse(ctx, cachedData)
+	return true
+}
+
+// refreshInBackground replays the request with X-No-Cache, which skips the
+// lookup but stores the fresh response as usual.
+func refreshInBackground(ctx *fasthttp.RequestCtx, key string) {
+	if _, running := preferCacheRefreshing.LoadOrStore(key, true); running {
+		stats.CacheRefreshesJoined.Add(1)
+		return
+	}
+	stats.CacheRefreshes.Add(1)
+
+	var sub fasthttp.RequestCtx
+	ctx.Request.CopyTo(&sub.Request)
+	sub.Request.Header.Set(optionHeaders["no-cache"], "true")
+
+	preferCacheRefreshes.Add(1)
+	go func() {
+		defer preferCacheRefreshes.Done()
+		defer preferCacheRefreshing.Delete(key)
+		handleRequests(&sub)
+		if code := sub.Response.StatusCode(); code != fasthttp.StatusOK {
+			fmt.Printf("Background refresh of %s failed with status %d, keeping the cached entry\n", key, code)
+		}
+	}()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestPreferCache(t *testing.T) {
+	tests := []struct {
+		name       string
+		cached     bool
+		expiredAgo time.Duration // negative for an entry that is still fresh
+		stale      bool          // answered from the cache
+		refresh    bool          // and refreshed in the background
+	}{
+		{"expired within the window", true, 30 * time.Second, true, true},
+		{"fresh entry", true, -time.Minute, true, false},
+		{"expired too long ago", true, 2 * time.Minute, false, false},
+		{"nothing cached", false, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			t.Cleanup(preferCacheRefreshes.Wait)
+			config.PreferCache = time.Minute
+			release := make(chan struct{})
+			var requests atomic.Int64
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				requests.Add(1)
+				<-release
+				ctx.SetContentType("application/json")
+				ctx.SetBodyString(`{"fresh":true}`)
+			}))
+			key := cacheKey("api.example.com/prefer")
+			if tt.cached {
+				now := time.Now()
+				cacheStore(key, upstreamResponse{Body: `{"fresh":false}`, ContentType: "application/json"}, now.Add(-time.Hour), now.Add(-tt.expiredAgo))
+			}
+
+			if !tt.stale {
+				// The fetch blocks the request, so let the server answer.
+				close(release)
+			}
+			resp := proxyGet(t, target("api.example.com/prefer"))
+			if served := string(resp.Body()) == `{"fresh":false}`; served != tt.stale {
+				t.Fatalf("served the cached entry = %v, want %v: %s", served, tt.stale, resp.Body())
+			}
+			if warning := len(resp.Header.Peek("Warning")) > 0; warning != tt.refresh {
+				t.Errorf("Warning present = %v, want %v", warning, tt.refresh)
+			}
+			if !tt.stale {
+				return
+			}
+
+			if tt.refresh {
+				waitFor(t, "the background refresh to reach the server", func() bool { return requests.Load() == 1 })
+			}
+			close(release)
+			preferCacheRefreshes.Wait()
+			if !tt.refresh {
+				if got := requests.Load(); got != 0 {
+					t.Errorf("upstream requests = %d for a fresh entry", got)
+				}
+				return
+			}
+			if got := requests.Load(); got != 1 {
+				t.Errorf("upstream requests = %d, want one refresh", got)
+			}
+			if fresh, ok := cacheGet(key); !ok || fresh.Body != `{"fresh":true}` {
+				t.Errorf("entry after the refresh = %q, %v, want the fresh response", fresh.Body, ok)
+			}
+		})
+	}
+}
+
+func TestPreferCacheSingleRefresh(t *testing.T) {
+	setup(t)
+	t.Cleanup(preferCacheRefreshes.Wait)
+	config.PreferCache = time.Minute
+	release := make(chan struct{})
+	var requests atomic.Int64
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		requests.Add(1)
+		<-release
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"fresh":true}`)
+	}))
+	key := cacheKey("api.example.com/popular")
+	now := time.Now()
+	cacheStore(key, upstreamResponse{Body: `{"fresh":false}`, ContentType: "application/json"}, now.Add(-time.Hour), now.Add(-time.Second))
+
+	// Every stale hit arrives while the first one's refresh is still waiting
+	// on the server.
+	const hits = 50
+	var wg sync.WaitGroup
+	bodies := make([]string, hits)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i] = string(proxyGet(t, target("api.example.com/popular")).Body())
+		}(i)
+	}
+	wg.Wait()
+	waitFor(t, "the refresh to reach the server", func() bool { return requests.Load() == 1 })
+	close(release)
+	preferCacheRefreshes.Wait()
+
+	for i, body := range bodies {
+		if body != `{"fresh":false}` {
+			t.Errorf("hit %d = %s, want the stale entry", i, body)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("upstream requests = %d, want exactly one refresh", got)
+	}
+	if refreshes, joined := stats.CacheRefreshes.Load(), stats.CacheRefreshesJoined.Load(); refreshes != 1 || joined != hits-1 {
+		t.Errorf("refreshes = %d, joined = %d, want 1 and %d", refreshes, joined, hits-1)
+	}
+	if body := string(proxyGet(t, target("api.example.com/popular")).Body()); body != `{"fresh":true}` {
+		t.Errorf("after the refresh = %s, want the fresh response", body)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("upstream requests = %d after the refresh, want the fresh entry served", got)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// startPrewarm sends one warm-up request to every server, -prewarm-interval
+// apart, so cold-starting backends are not all hit at once by live traffic.
+// A server is skipped by requests until its warm-up has been sent; it becomes
+// ready once the warm-up returns, whatever the outcome, and failures are left
+// to the breaker and health checks.
+func startPrewarm() {
+	if config.PrewarmInterval <= 0 {
+		return
+	}
+
+	servers, err := readServerAddresses(serversFile)
+	if err != nil {
+		fmt.Printf("Pre-warm: cannot read servers: %v\n", err)
+		return
+	}
+	servers = prewarmOrder(servers, config.PrewarmOrder)
+
+	health.Lock()
+	for _, server := range servers {
+		healthFor(server.URL).Warming = true
+	}
+	health.Unlock()
+
+	go warmServers(servers)
+}
+
+// warmServers warms servers one after the other, -prewarm-interval apart.
+func warmServers(servers []Server) {
+	for i, server := range servers {
+		if i > 0 {
+			time.Sleep(config.PrewarmInterval)
+		}
+		warmServer(server)
+	}
+	fmt.Printf("Pre-warm: %d servers ready\n", len(servers))
+}
+
+// prewarmOrder puts the servers listed in order (comma-separated URLs) first,
+// in that order, followed by the rest in file order.
+func prewarmOrder(servers []Server, order string) []Server {
+	var ordered []Server
+	used := make(map[string]bool)
+	for _, name := range strings.Split(order, ",") {
+		name = strings.TrimRight(strings.TrimSpace(name), "/")
+		for _, server := range servers {
+			if !used[server.URL] && strings.TrimRight(server.URL, "/") == name {
+				ordered = append(ordered, server)
+				used[server.URL] = true
+			}
+		}
+	}
+	for _, server := range servers {
+		if !used[server.URL] {
+			ordered = append(ordered, server)
+		}
+	}
+	return ordered
+}
+
+func warmServer(server Server) {
+	endpoint := "/"
+	if config.PrewarmURL != "" {
+		endpoint = server.endpoint(config.PrewarmURL)
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(server.URL + endpoint)
+	start := time.Now()
+	err := upstreamClient.DoTimeout(req, resp, config.HealthTimeout)
+	if err != nil {
+		fmt.Printf("Pre-warm: %s failed after %v: %v\n", server.URL, time.Since(start), err)
+	} else {
+		fmt.Printf("Pre-warm: %s answered %d in %v\n", server.URL, resp.StatusCode(), time.Since(start))
+	}
+
+	health.Lock()
+	healthFor(server.URL).Warming = false
+	health.Unlock()
+}
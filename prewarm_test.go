@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestPrewarmOrder(t *testing.T) {
+	servers := []Server{{URL: "http://a.test"}, {URL: "http://b.test"}, {URL: "http://c.test"}}
+	tests := []struct {
+		order string
+		want  string
+	}{
+		{"", "abc"},
+		{"http://c.test", "cab"},
+		{"http://b.test/, http://a.test", "bac"},
+		{"http://unknown.test,http://c.test", "cab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			var got string
+			for _, server := range prewarmOrder(servers, tt.order) {
+				got += server.URL[len("http://") : len("http://")+1]
+			}
+			if got != tt.want {
+				t.Errorf("order = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarmServers(t *testing.T) {
+	setup(t)
+	config.PrewarmInterval = 50 * time.Millisecond
+
+	var mu sync.Mutex
+	var warmed []string
+	var warmedAt []time.Time
+	var urls []string
+	for i := 0; i < 3; i++ {
+		urls = append(urls, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+			mu.Lock()
+			warmed = append(warmed, "http://"+string(ctx.Host()))
+			warmedAt = append(warmedAt, time.Now())
+			mu.Unlock()
+			ctx.SetBodyString(`{}`)
+		}))
+	}
+	writeServers(t, urls...)
+	servers := prewarmOrder([]Server{{URL: urls[0]}, {URL: urls[1]}, {URL: urls[2]}}, urls[2])
+
+	health.Lock()
+	for _, server := range servers {
+		healthFor(server.URL).Warming = true
+	}
+	health.Unlock()
+	if resp := proxyGet(t, target("api.example.com/cold")); resp.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("status while every server is warming = %d, want 503", resp.StatusCode())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		warmServers(servers)
+		close(done)
+	}()
+	waitFor(t, "the first server to warm", func() bool { return serverUnavailableReason(urls[2]) == "" })
+	if reason := serverUnavailableReason(urls[0]); reason != unavailableWarming {
+		t.Errorf("server warmed second is %q right after the first, want %q", reason, unavailableWarming)
+	}
+	<-done
+
+	for _, url := range urls {
+		if reason := serverUnavailableReason(url); reason != "" {
+			t.Errorf("%s unavailable after warming: %s", url, reason)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(warmed) != 3 || warmed[0] != urls[2] || warmed[1] != urls[0] || warmed[2] != urls[1] {
+		t.Fatalf("warm-up order = %v, want %v", warmed, []string{urls[2], urls[0], urls[1]})
+	}
+	for i := 1; i < len(warmedAt); i++ {
+		if gap := warmedAt[i].Sub(warmedAt[i-1]); gap < config.PrewarmInterval {
+			t.Errorf("warm-up %d came %s after the previous one, want at least %s", i+1, gap, config.PrewarmInterval)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// quotaWindow is one "period:limit" entry of -quotas. Windows are aligned with
+// time.Truncate, so a 1h window resets on the hour and a 24h window at
+// midnight UTC.
+type quotaWindow struct {
+	Period time.Duration
+	Limit  int64
+}
+
+type quotaUsage struct {
+	Period      string    `json:"period"`
+	WindowStart time.Time `json:"window_start"`
+	Count       int64     `json:"count"`
+}
+
+type quotaStatus struct {
+	Period    string    `json:"period"`
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+const quotaSaveInterval = 30 * time.Second
+
+var quotaWindows []quotaWindow
+
+var quotas = struct {
+	sync.Mutex
+	usage map[string][]quotaUsage
+}{usage: make(map[string][]quotaUsage)}
+
+func parseQuotaWindows(spec string) ([]quotaWindow, error) {
+	var windows []quotaWindow
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		period, limit, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid -quotas entry %q, expected period:limit", part)
+		}
+		d, err := time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid -quotas period %q", period)
+		}
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid -quotas limit %q", limit)
+		}
+		windows = append(windows, quotaWindow{Period: d, Limit: n})
+	}
+	return windows, nil
+}
+
+// quotaClientNames maps the keys of -quota-clients to the client names they
+// were issued to.
+var quotaClientNames map[string]string
+
+// loadQuotaClients reads -quota-clients, a JSON object of client names and
+// their keys. Keys may be ${ENV:NAME} references.
+func loadQuotaClients(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var clients map[string]string
+	if err := json.Unmarshal(data, &clients); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	names := make(map[string]string, len(clients))
+	for name, key := range clients {
+		if err := checkSecrets(key); err != nil {
+			return nil, fmt.Errorf("client %s: %w", name, err)
+		}
+		key = expandSecrets(key)
+		if key == "" {
+			return nil, fmt.Errorf("client %s has an empty key", name)
+		}
+		if other, ok := names[key]; ok {
+			return nil, fmt.Errorf("clients %s and %s have the same key", other, name)
+		}
+		names[key] = name
+	}
+	return names, nil
+}
+
+// quotaClient identifies the client a request is charged to: the client
+// whose -quota-clients key it sends in -quota-key-header, or its remote IP.
+// Unknown keys count by IP, so a client cannot pick a fresh quota by
+// sending a new value.
+func quotaClient(ctx *fasthttp.RequestCtx) string {
+	if key := ctx.Request.Header.Peek(config.QuotaKeyHeader); len(key) > 0 {
+		if name, ok := quotaClientNames[string(key)]; ok {
+			return "client:" + name
+		}
+	}
+	return "ip:" + ctx.RemoteIP().String()
+}
+
+// currentUsage returns the client's usage for every window, resetting the
+// counters of windows that have rolled over. The caller holds quotas.
+func currentUsage(client string, now time.Time) []quotaUsage {
+	usage := quotas.usage[client]
+	current := make([]quotaUsage, len(quotaWindows))
+	for i, window := range quotaWindows {
+		current[i] = quotaUsage{Period: window.Period.String(), WindowStart: now.Truncate(window.Period)}
+		for _, u := range usage {
+			if u.Period == current[i].Period && u.WindowStart.Equal(current[i].WindowStart) {
+				current[i].Count = u.Count
+			}
+		}
+	}
+	return current
+}
+
+// chargeQuota counts one request for client. When any window is exhausted
+// nothing is counted and the time until the last exhausted window resets is
+// returned.
+func chargeQuota(client string) (time.Duration, bool) {
+	if len(quotaWindows) == 0 {
+		return 0, true
+	}
+
+	quotas.Lock()
+	defer quotas.Unlock()
+
+	now := time.Now()
+	usage := currentUsage(client, now)
+
+	var retryAfter time.Duration
+	for i, window := range quotaWindows {
+		if usage[i].Count >= window.Limit {
+			if wait := usage[i].WindowStart.Add(window.Period).Sub(now); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	if retryAfter > 0 {
+		quotas.usage[client] = usage
+		return retryAfter, false
+	}
+
+	for i := range usage {
+		usage[i].Count++
+	}
+	quotas.usage[client] = usage
+	return 0, true
+}
+
+// pruneQuotas forgets the clients whose every window has ended, so clients
+// that went away do not stay in memory or in -quota-file forever.
+func pruneQuotas(now time.Time) {
+	quotas.Lock()
+	defer quotas.Unlock()
+
+	for client, usage := range quotas.usage {
+		active := false
+		for _, u := range usage {
+			period, err := time.ParseDuration(u.Period)
+			if err != nil || now.Before(u.WindowStart.Add(period)) {
+				active = true
+				break
+			}
+		}
+		if !active {
+			delete(quotas.usage, client)
+		}
+	}
+}
+
+// enforceQuota charges the request to its client and answers 429 with
+// Retry-After once a quota is used up.
+func enforceQuota(ctx *fasthttp.RequestCtx) bool {
+	return enforceClientQuota(ctx, quotaClient(ctx))
+}
+
+// enforceClientQuota is enforceQuota for a request charged to client, such as
+// a /batch URL, whose own ctx does not tell the client.
+func enforceClientQuota(ctx *fasthttp.RequestCtx, client string) bool {
+	retryAfter, ok := chargeQuota(client)
+	if ok {
+		return true
+	}
+
+	setRetryAfter(ctx, retryAfter)
+	sendJSONErrorCode(ctx, "Quota exceeded", "quota_exceeded", fasthttp.StatusTooManyRequests)
+	return false
+}
+
+// setRetryAfter sets Retry-After to d rounded up to whole seconds.
+func setRetryAfter(ctx *fasthttp.RequestCtx, d time.Duration) {
+	ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+func quotaStatuses(client string, now time.Time) []quotaStatus {
+	usage := currentUsage(client, now)
+	statuses := make([]quotaStatus, len(quotaWindows))
+	for i, window := range quotaWindows {
+		statuses[i] = quotaStatus{
+			Period:    usage[i].Period,
+			Limit:     window.Limit,
+			Used:      usage[i].Count,
+			Remaining: window.Limit - usage[i].Count,
+			ResetsAt:  usage[i].WindowStart.Add(window.Period),
+		}
+		if statuses[i].Remaining < 0 {
+			statuses[i].Remaining = 0
+		}
+	}
+	return statuses
+}
+
+// handleQuota serves GET /quota, the usage of ?client= (as "client:<name>"
+// or "ip:<address>") or of every known client.
+func handleQuota(ctx *fasthttp.RequestCtx) {
+	if !authorizeAdmin(ctx) {
+		return
+	}
+
+	quotas.Lock()
+	defer quotas.Unlock()
+
+	now := time.Now()
+	result := make(map[string][]quotaStatus)
+	if client := string(ctx.QueryArgs().Peek("client")); client != "" {
+		result[client] = quotaStatuses(client, now)
+	} else {
+		for client := range quotas.usage {
+			result[client] = quotaStatuses(client, now)
+		}
+	}
+	sendJSONResponse(ctx, result, fasthttp.StatusOK)
+}
+
+func loadQuotas(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	usage := make(map[string][]quotaUsage)
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return err
+	}
+
+	quotas.Lock()
+	quotas.usage = usage
+	quotas.Unlock()
+	return nil
+}
+
+// saveQuotas writes the counters to path through a temporary file, so a
+// crash while saving never leaves a truncated file behind.
+func saveQuotas(path string) error {
+	quotas.Lock()
+	data, err := jsonLine.Marshal(quotas.usage)
+	quotas.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces path with data by renaming a temporary file in the
+// same directory over it, so readers never see a partly written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// startQuotaPersistence prunes idle clients and, with -quota-file, saves
+// the counters every quotaSaveInterval.
+func startQuotaPersistence() {
+	if len(quotaWindows) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(quotaSaveInterval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			pruneQuotas(now)
+			if config.QuotaFile == "" {
+				continue
+			}
+			if err := saveQuotas(config.QuotaFile); err != nil {
+				fmt.Printf("Saving quotas failed: %v\n", err)
+			}
+		}
+	}()
+}
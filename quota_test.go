@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseQuotaWindows(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []quotaWindow
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"1h:1000, 24h:10000", []quotaWindow{{time.Hour, 1000}, {24 * time.Hour, 10000}}, false},
+		{"1h", nil, true},
+		{"soon:10", nil, true},
+		{"1h:0", nil, true},
+		{"-1h:10", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseQuotaWindows(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("windows = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("window %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaExhausted(t *testing.T) {
+	setup(t)
+	config.setAdminKey("secret")
+	quotaWindows = []quotaWindow{{time.Hour, 2}, {24 * time.Hour, 100}}
+	quotaClientNames = map[string]string{"k1": "acme"}
+	writeServers(t, jsonBackend(t, `{}`))
+
+	tests := []struct {
+		name   string
+		key    string
+		status int
+	}{
+		{"first request", "k1", fasthttp.StatusOK},
+		{"last within the quota", "k1", fasthttp.StatusOK},
+		{"quota used up", "k1", fasthttp.StatusTooManyRequests},
+		{"still rejected", "k1", fasthttp.StatusTooManyRequests},
+		{"other client counted by IP", "", fasthttp.StatusOK},
+		{"unknown key counted by IP", "unknown", fasthttp.StatusOK},
+	}
+	for i, tt := range tests {
+		resp := proxyGet(t, target("api.example.com/quota/"+strconv.Itoa(i)), "X-Client-Key", tt.key)
+		if resp.StatusCode() != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, resp.StatusCode(), tt.status, resp.Body())
+		}
+		retryAfter, _ := strconv.Atoi(string(resp.Header.Peek("Retry-After")))
+		if tt.status == fasthttp.StatusTooManyRequests && (retryAfter <= 0 || retryAfter > 3600) {
+			t.Errorf("%s: Retry-After = %q, want the time until the hour is up", tt.name, resp.Header.Peek("Retry-After"))
+		}
+	}
+
+	var usage map[string][]quotaStatus
+	if err := json.Unmarshal(proxyGet(t, "/quota?client=client:acme", "X-API-Key", "secret").Body(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	hourly := usage["client:acme"]
+	if len(hourly) != 2 || hourly[0].Used != 2 || hourly[0].Remaining != 0 || hourly[1].Used != 2 {
+		t.Errorf("/quota = %+v, want 2 used in both windows and nothing left of the hourly one", usage)
+	}
+	if resp := proxyGet(t, "/quota"); resp.StatusCode() == fasthttp.StatusOK {
+		t.Errorf("/quota without the admin key answered %s", resp.Body())
+	}
+}
+
+func TestQuotaPersistence(t *testing.T) {
+	setup(t)
+	quotaWindows = []quotaWindow{{time.Hour, 3}}
+	for i := 0; i < 3; i++ {
+		if _, ok := chargeQuota("client:acme"); !ok {
+			t.Fatalf("request %d rejected", i)
+		}
+	}
+	if err := saveQuotas("quotas.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart starts from the saved counters.
+	quotas.Lock()
+	quotas.usage = make(map[string][]quotaUsage)
+	quotas.Unlock()
+	if err := loadQuotas("quotas.json"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := chargeQuota("client:acme"); ok {
+		t.Error("quota reset by the restart")
+	}
+	if err := loadQuotas("missing.json"); err != nil {
+		t.Errorf("loading a missing file: %v", err)
+	}
+}
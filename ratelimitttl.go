@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// rateLimitedTargets holds, by target host, until when cache entries for
+// that host get the -rate-limit-ttl-factor extension.
+var rateLimitedTargets = struct {
+	sync.Mutex
+	until map[string]time.Time
+}{until: make(map[string]time.Time)}
+
+// recordTargetRateLimit notes that a server was rate limited fetching
+// target, for the per-host counts in /stats and /metrics and for the TTL
+// extension, which lasts -rate-limit-ttl-window past the last one.
+func recordTargetRateLimit(target string) {
+	host := targetHostKey(target)
+	if host == "" {
+		return
+	}
+	countTargetRateLimit(host)
+	if config.RateLimitTTLFactor <= 1 {
+		return
+	}
+
+	now := time.Now()
+	rateLimitedTargets.Lock()
+	defer rateLimitedTargets.Unlock()
+	if until, ok := rateLimitedTargets.until[host]; !ok || now.After(until) {
+		fmt.Printf("Target %s is rate limited, caching it %vx longer\n", host, config.RateLimitTTLFactor)
+	}
+	rateLimitedTargets.until[host] = now.Add(config.RateLimitTTLWindow)
+}
+
+// rateLimitedTTL returns ttl multiplied by -rate-limit-ttl-factor, up to
+// -rate-limit-ttl-max, while target is rate limited, and ttl otherwise.
+func rateLimitedTTL(target string, ttl time.Duration) time.Duration {
+	if config.RateLimitTTLFactor <= 1 {
+		return ttl
+	}
+
+	host := targetHostKey(target)
+	rateLimitedTargets.Lock()
+	until, ok := rateLimitedTargets.until[host]
+	if ok && time.Now().After(until) {
+		delete(rateLimitedTargets.until, host)
+		fmt.Printf("Target %s is no longer rate limited, back to its normal cache TTL\n", host)
+		ok = false
+	}
+	rateLimitedTargets.Unlock()
+	if !ok {
+		return ttl
+	}
+
+	extended := time.Duration(float64(ttl) * config.RateLimitTTLFactor)
+	if config.RateLimitTTLMax > 0 && extended > config.RateLimitTTLMax {
+		extended = max(config.RateLimitTTLMax, ttl)
+	}
+	return extended
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRateLimitTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		factor  float64
+		max     time.Duration
+		limited bool // whether the first server rate limits the fetch
+		scale   float64
+	}{
+		{"off", 0, time.Hour, true, 1},
+		{"not rate limited", 4, time.Hour, false, 1},
+		{"extended", 4, time.Hour, true, 4},
+		{"capped", 100, 10 * time.Minute, true, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			setCacheLifetime(time.Minute)
+			config.RateLimitTTLFactor = tt.factor
+			config.RateLimitTTLMax = tt.max
+			first := jsonBackend(t, `{}`)
+			if tt.limited {
+				first = statusBackend(t, fasthttp.StatusTooManyRequests, "slow down")
+			}
+			writeServers(t, first, jsonBackend(t, `{}`))
+
+			const target = "https://api.example.com/limited"
+			proxyGet(t, "/?url="+target)
+			entry, ok := cacheEntry(cacheKey(target))
+			if !ok {
+				t.Fatal("response not cached")
+			}
+			want := time.Duration(float64(time.Minute) * tt.scale)
+			if ttl := entry.ExpiresAt.Sub(entry.StoredAt); ttl != want {
+				t.Errorf("TTL = %s, want %s", ttl, want)
+			}
+		})
+	}
+}
+
+func TestRateLimitedTTLWindow(t *testing.T) {
+	setup(t)
+	config.RateLimitTTLFactor = 2
+	config.RateLimitTTLWindow = time.Minute
+	recordTargetRateLimit("https://api.example.com/a")
+
+	tests := []struct {
+		step   string
+		target string
+		want   time.Duration
+	}{
+		{"same target", "https://api.example.com/a", 2 * time.Minute},
+		{"other path on the host", "https://API.example.com/b?q=1", 2 * time.Minute},
+		{"other host", "https://other.example.com/a", time.Minute},
+		{"host without a scheme", "api.example.com/c", 2 * time.Minute},
+		{"plain path", "/items/1", time.Minute},
+	}
+	for _, tt := range tests {
+		if got := rateLimitedTTL(tt.target, time.Minute); got != tt.want {
+			t.Errorf("%s: rateLimitedTTL = %s, want %s", tt.step, got, tt.want)
+		}
+	}
+
+	// Once the window has passed without another rate limit, the TTL goes
+	// back to normal.
+	rateLimitedTargets.Lock()
+	rateLimitedTargets.until["api.example.com"] = time.Now().Add(-time.Second)
+	rateLimitedTargets.Unlock()
+	output := captureOutput(t, func() {
+		if got := rateLimitedTTL("https://api.example.com/a", time.Minute); got != time.Minute {
+			t.Errorf("after the window: rateLimitedTTL = %s, want 1m", got)
+		}
+	})
+	if output != "Target api.example.com is no longer rate limited, back to its normal cache TTL\n" {
+		t.Errorf("output = %q", output)
+	}
+}
+
+func TestRateLimitTTLOverrideNotExtended(t *testing.T) {
+	setup(t)
+	config.RateLimitTTLFactor = 4
+	recordTargetRateLimit("https://api.example.com/a")
+	cacheSetTTL("https://api.example.com/a", "https://api.example.com/a", upstreamResponse{Body: `{}`}, 30*time.Second)
+	entry, _ := cacheEntry("https://api.example.com/a")
+	if ttl := entry.ExpiresAt.Sub(entry.StoredAt); ttl != 30*time.Second {
+		t.Errorf("TTL = %s, want the override of 30s", ttl)
+	}
+}
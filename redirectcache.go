@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// redirectCacheTTL returns how long a redirect passed through with
+// -follow-redirects=false may be cached with -cache-redirects, going by its
+// own Cache-Control: no-store, no-cache and private keep it out of the cache
+// and s-maxage or max-age set the TTL. Without either, only the permanent
+// 301 and 308 are cached, for ttl (zero being the usual computed TTL).
+func redirectCacheTTL(resp upstreamResponse, ttl time.Duration) (time.Duration, bool) {
+	maxAge, sharedMaxAge := -1, -1
+	for _, directive := range strings.Split(resp.CacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache", "private":
+			return 0, false
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+				maxAge = seconds
+			}
+		case "s-maxage":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+				sharedMaxAge = seconds
+			}
+		}
+	}
+
+	if sharedMaxAge >= 0 {
+		maxAge = sharedMaxAge
+	}
+	if maxAge >= 0 {
+		return time.Duration(maxAge) * time.Second, maxAge > 0
+	}
+	switch resp.StatusCode {
+	case fasthttp.StatusMovedPermanently, fasthttp.StatusPermanentRedirect:
+		return ttl, true
+	}
+	return 0, false
+}
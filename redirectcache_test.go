@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRedirectCacheTTL(t *testing.T) {
+	tests := []struct {
+		status       int
+		cacheControl string
+		ttl          time.Duration
+		ok           bool
+	}{
+		{fasthttp.StatusMovedPermanently, "", 0, true},
+		{fasthttp.StatusPermanentRedirect, "", 0, true},
+		{fasthttp.StatusFound, "", 0, false},
+		{fasthttp.StatusTemporaryRedirect, "", 0, false},
+		{fasthttp.StatusFound, "max-age=60", time.Minute, true},
+		{fasthttp.StatusFound, `public, max-age="30"`, 30 * time.Second, true},
+		{fasthttp.StatusFound, "max-age=60, s-maxage=600", 10 * time.Minute, true},
+		{fasthttp.StatusMovedPermanently, "max-age=0", 0, false},
+		{fasthttp.StatusMovedPermanently, "no-store", 0, false},
+		{fasthttp.StatusMovedPermanently, "max-age=60, No-Cache", 0, false},
+		{fasthttp.StatusMovedPermanently, "private", 0, false},
+		{fasthttp.StatusMovedPermanently, "max-age=soon", 0, true},
+	}
+	for _, tt := range tests {
+		ttl, ok := redirectCacheTTL(upstreamResponse{StatusCode: tt.status, CacheControl: tt.cacheControl}, 0)
+		if ttl != tt.ttl || ok != tt.ok {
+			t.Errorf("%d with Cache-Control %q: ttl = %s, %v, want %s, %v", tt.status, tt.cacheControl, ttl, ok, tt.ttl, tt.ok)
+		}
+	}
+}
+
+func TestCacheRedirects(t *testing.T) {
+	tests := []struct {
+		name         string
+		enabled      bool
+		status       int
+		cacheControl string
+		cached       bool
+		ttl          time.Duration // zero for the default TTL
+	}{
+		{"permanent redirect", true, fasthttp.StatusMovedPermanently, "", true, 0},
+		{"temporary redirect", true, fasthttp.StatusFound, "", false, 0},
+		{"temporary redirect with max-age", true, fasthttp.StatusFound, "max-age=90", true, 90 * time.Second},
+		{"no-store", true, fasthttp.StatusMovedPermanently, "no-store", false, 0},
+		{"off", false, fasthttp.StatusMovedPermanently, "", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.FollowRedirects = false
+			config.CacheRedirects = tt.enabled
+			var requests atomic.Int64
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				requests.Add(1)
+				if tt.cacheControl != "" {
+					ctx.Response.Header.Set(fasthttp.HeaderCacheControl, tt.cacheControl)
+				}
+				ctx.Redirect("https://api.example.com/new", tt.status)
+			}))
+
+			for i := 0; i < 2; i++ {
+				resp := proxyGet(t, target("api.example.com/old"))
+				if resp.StatusCode() != tt.status {
+					t.Fatalf("request %d: status = %d, want %d: %s", i, resp.StatusCode(), tt.status, resp.Body())
+				}
+				if got := string(resp.Header.Peek(fasthttp.HeaderLocation)); got != "https://api.example.com/new" {
+					t.Errorf("request %d: Location = %q", i, got)
+				}
+			}
+			want := int64(2)
+			if tt.cached {
+				want = 1
+			}
+			if got := requests.Load(); got != want {
+				t.Errorf("server requests = %d, want %d", got, want)
+			}
+
+			entry, ok := cacheEntry(cacheKey("api.example.com/old"))
+			if ok != tt.cached {
+				t.Fatalf("cached = %v, want %v", ok, tt.cached)
+			}
+			if !ok {
+				return
+			}
+			if entry.StatusCode != tt.status || entry.Location != "https://api.example.com/new" {
+				t.Errorf("entry = %d %q", entry.StatusCode, entry.Location)
+			}
+			if tt.ttl > 0 {
+				if got := entry.ExpiresAt.Sub(entry.StoredAt); got != tt.ttl {
+					t.Errorf("TTL = %s, want %s", got, tt.ttl)
+				}
+			}
+		})
+	}
+}
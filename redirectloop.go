@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/valyala/fasthttp"
+)
+
+var errRedirectLoop = errors.New("upstream redirects loop back to a URL already visited")
+
+// doRedirects is client.DoRedirects, except that a Location leading back to
+// a URL already requested in this sequence ends it with errRedirectLoop
+// right away instead of going round until maxUpstreamRedirects.
+func doRedirects(client *fasthttp.Client, req *fasthttp.Request, resp *fasthttp.Response) error {
+	location := req.URI().String()
+	visited := map[string]bool{location: true}
+	for redirects := 0; ; redirects++ {
+		req.SetRequestURI(location)
+		req.URI().DisablePathNormalizing = true
+		if err := client.Do(req, resp); err != nil {
+			return err
+		}
+		if !fasthttp.StatusCodeIsRedirect(resp.StatusCode()) {
+			return nil
+		}
+		if redirects == maxUpstreamRedirects {
+			return fasthttp.ErrTooManyRedirects
+		}
+
+		next := resp.Header.Peek(fasthttp.HeaderLocation)
+		if len(next) == 0 {
+			return fasthttp.ErrMissingLocation
+		}
+		uri := fasthttp.AcquireURI()
+		uri.Update(location)
+		uri.UpdateBytes(next)
+		uri.DisablePathNormalizing = true
+		location = uri.String()
+		fasthttp.ReleaseURI(uri)
+
+		if visited[location] {
+			return errRedirectLoop
+		}
+		visited[location] = true
+	}
+}
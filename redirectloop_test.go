@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// redirectingBackend redirects /n/<i> to whatever next returns for i, with
+// "" ending the sequence with a 200.
+func redirectingBackend(t *testing.T, requests *atomic.Int64, next func(i int) string) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		requests.Add(1)
+		i, _ := strconv.Atoi(strings.TrimPrefix(string(ctx.Path()), "/n/"))
+		if location := next(i); location != "" {
+			ctx.Redirect(location, fasthttp.StatusFound)
+			return
+		}
+		ctx.SetContentType("application/json")
+		fmt.Fprintf(ctx, `{"hop":%d}`, i)
+	})
+}
+
+func TestDoRedirects(t *testing.T) {
+	tests := []struct {
+		name     string
+		next     func(i int) string
+		err      error
+		requests int64
+	}{
+		{"no redirect", func(int) string { return "" }, nil, 1},
+		{"chain", func(i int) string {
+			if i < 3 {
+				return fmt.Sprintf("/n/%d", i+1)
+			}
+			return ""
+		}, nil, 4},
+		{"to itself", func(i int) string { return fmt.Sprintf("/n/%d", i) }, errRedirectLoop, 1},
+		{"back and forth", func(i int) string { return fmt.Sprintf("/n/%d", 1-i) }, errRedirectLoop, 2},
+		{"back to the start", func(i int) string { return fmt.Sprintf("/n/%d", (i+1)%5) }, errRedirectLoop, 5},
+		{"too many hops", func(i int) string { return fmt.Sprintf("/n/%d", i+1) }, fasthttp.ErrTooManyRedirects, maxUpstreamRedirects + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			server := redirectingBackend(t, &requests, tt.next)
+			req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(resp)
+			req.SetRequestURI(server + "/n/0")
+
+			if err := doRedirects(upstreamClient, req, resp); !errors.Is(err, tt.err) {
+				t.Errorf("error = %v, want %v", err, tt.err)
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("server requests = %d, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestDoRedirectsMissingLocation(t *testing.T) {
+	server := newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusFound)
+	})
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(server + "/")
+
+	if err := doRedirects(upstreamClient, req, resp); !errors.Is(err, fasthttp.ErrMissingLocation) {
+		t.Errorf("error = %v, want %v", err, fasthttp.ErrMissingLocation)
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	tests := []struct {
+		name  string
+		http2 bool
+		timed bool
+	}{
+		{"HTTP/1.1", false, false},
+		{"with -server-timing", false, true},
+		{"HTTP/2", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.ServerTiming = tt.timed
+			var requests atomic.Int64
+			if tt.http2 {
+				server := http2Backend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requests.Add(1)
+					http.Redirect(w, r, r.URL.String(), http.StatusFound)
+				}))
+				writeFile(t, serversFile, `[{"url":"`+server+`","HTTPVersion":"2"}]`)
+			} else {
+				writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+					requests.Add(1)
+					ctx.Redirect(string(ctx.RequestURI()), fasthttp.StatusFound)
+				}))
+			}
+
+			resp := proxyGet(t, target("api.example.com/loop"))
+			if resp.StatusCode() != fasthttp.StatusBadGateway || !strings.Contains(string(resp.Body()), `"error":"redirect_loop"`) {
+				t.Errorf("status = %d: %s, want 502 redirect_loop", resp.StatusCode(), resp.Body())
+			}
+			if got := requests.Load(); got != 1 {
+				t.Errorf("server requests = %d, want the loop caught at the first repeat", got)
+			}
+		})
+	}
+}
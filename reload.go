@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/valyala/fasthttp"
+)
+
+// fileConfig is the configuration read from the files named on the command
+// line. A reload builds a new one and swaps it in whole, so a request that
+// has already read a setting keeps going with the old value.
+type fileConfig struct {
+	// targetHeaders are the static headers from -target-headers, by
+	// lower-case target host.
+	targetHeaders map[string]map[string]string
+	// errorTemplate is the body from -error-template that replaces the JSON
+	// ErrorResponse, or "" to keep the JSON.
+	errorTemplate string
+	// fallbacks are the -fallbacks responses, in the order they are tried.
+	fallbacks []fallbackResponse
+	// servers are the server URLs in the servers file when it was loaded,
+	// so a reload can tell which ones were removed.
+	servers []string
+	// settings are those of -settings-file, see settings.go.
+	settings settings
+}
+
+var files atomic.Pointer[fileConfig]
+
+func loadedFiles() *fileConfig {
+	if f := files.Load(); f != nil {
+		return f
+	}
+	return &fileConfig{}
+}
+
+// loadFileConfig reads every configured file and checks the servers file.
+// Nothing is applied unless all of them load.
+func loadFileConfig() (*fileConfig, error) {
+	loaded := &fileConfig{}
+	var err error
+	if config.TargetHeaders != "" {
+		if loaded.targetHeaders, err = loadTargetHeaders(config.TargetHeaders); err != nil {
+			return nil, fmt.Errorf("loading -target-headers failed: %s", err)
+		}
+	}
+	if config.ErrorTemplate != "" {
+		if loaded.errorTemplate, err = loadErrorTemplate(config.ErrorTemplate); err != nil {
+			return nil, fmt.Errorf("loading -error-template failed: %s", err)
+		}
+	}
+	if config.Fallbacks != "" {
+		if loaded.fallbacks, err = loadFallbacks(config.Fallbacks); err != nil {
+			return nil, fmt.Errorf("loading -fallbacks failed: %s", err)
+		}
+	}
+	if config.SettingsFile != "" {
+		if loaded.settings, err = loadSettings(config.SettingsFile); err != nil {
+			return nil, fmt.Errorf("loading -settings-file failed: %s", err)
+		}
+	}
+	if err := checkServersFile(serversFile); err != nil {
+		return nil, err
+	}
+	// A servers file that does not parse right now says nothing about
+	// which servers were removed.
+	servers, err := readServerAddresses(serversFile)
+	if err != nil {
+		loaded.servers = loadedFiles().servers
+	}
+	for _, server := range servers {
+		loaded.servers = append(loaded.servers, server.URL)
+	}
+	return loaded, nil
+}
+
+// reloadRun is one reload and the triggers waiting for its result.
+type reloadRun struct {
+	done chan struct{}
+	err  error
+}
+
+// reloads serializes reloads. queued is the reload waiting for the running
+// one to finish; every trigger that comes in meanwhile joins it, as it has not
+// read any file yet and will see whatever changes the triggers were for.
+var reloads struct {
+	sync.Mutex
+	queued  *reloadRun
+	running sync.Mutex
+}
+
+// reloadFileConfig re-reads the configuration files. On an error the running
+// configuration is kept. Reloads run one at a time, and triggers that arrive
+// while one runs are coalesced into a single reload after it.
+func reloadFileConfig() error {
+	reloads.Lock()
+	if run := reloads.queued; run != nil {
+		reloads.Unlock()
+		<-run.done
+		return run.err
+	}
+	run := &reloadRun{done: make(chan struct{})}
+	reloads.queued = run
+	reloads.Unlock()
+
+	reloads.running.Lock()
+	reloads.Lock()
+	reloads.queued = nil
+	reloads.Unlock()
+	run.err = applyFileConfig()
+	reloads.running.Unlock()
+	close(run.done)
+	return run.err
+}
+
+// applyFileConfig loads the configuration files and swaps them in. The cache
+// is left alone: none of the reloaded settings change how entries are keyed,
+// and a new cache TTL only applies to entries stored from then on.
+func applyFileConfig() error {
+	loaded, err := loadFileConfig()
+	if err != nil {
+		fmt.Printf("Reload failed, keeping the current configuration: %s\n", err)
+		return err
+	}
+	previous := files.Swap(loaded)
+	fmt.Println("Configuration reloaded")
+	applySettings(previous, loaded)
+	if previous != nil {
+		drainRemovedServers(previous.servers, loaded.servers)
+	}
+	return nil
+}
+
+// startReloadOnSignal reloads the configuration files on SIGHUP.
+func startReloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			reloadFileConfig()
+		}
+	}()
+}
+
+// handleReload serves POST /admin/reload, the same as sending SIGHUP.
+func handleReload(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		sendJSONErrorResponse(ctx, "Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeAdmin(ctx) {
+		return
+	}
+
+	if err := reloadFileConfig(); err != nil {
+		sendJSONErrorCode(ctx, "Reload failed: "+err.Error(), "reload_failed", fasthttp.StatusUnprocessableEntity)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
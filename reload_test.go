@@ -0,0 +1,239 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// reloadBackend is a backend answering with the X-Env header it got, which
+// comes from -target-headers. Requests for a target containing /slow wait
+// for release first.
+func reloadBackend(t *testing.T, release chan struct{}, requests *atomic.Int64) string {
+	return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		requests.Add(1)
+		if strings.Contains(string(ctx.QueryArgs().Peek("url")), "/slow") {
+			<-release
+		}
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"env":"` + string(ctx.Request.Header.Peek("X-Env")) + `"}`)
+	})
+}
+
+func reload(t *testing.T) *fasthttp.Response {
+	t.Helper()
+	return proxyDo(t, fasthttp.MethodPost, "/admin/reload", "", "X-API-Key", "secret")
+}
+
+func TestReloadMidRequest(t *testing.T) {
+	setup(t)
+	config.setAdminKey("secret")
+	config.TargetHeaders = "target-headers.json"
+	writeFile(t, config.TargetHeaders, `{"api.example.com": {"X-Env": "old"}}`)
+	if err := reloadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	var requests atomic.Int64
+	writeServers(t, reloadBackend(t, release, &requests))
+
+	if body := string(proxyGet(t, target("https://api.example.com/cached")).Body()); body != `{"env":"old"}` {
+		t.Fatalf("before the reload: %s", body)
+	}
+	slow := make(chan string)
+	go func() { slow <- string(proxyGet(t, target("https://api.example.com/slow")).Body()) }()
+	waitFor(t, "the slow request to reach the server", func() bool { return requests.Load() == 2 })
+
+	writeFile(t, config.TargetHeaders, `{"api.example.com": {"X-Env": "new"}}`)
+	if resp := reload(t); resp.StatusCode() != fasthttp.StatusNoContent {
+		t.Fatalf("reload: status = %d: %s", resp.StatusCode(), resp.Body())
+	}
+	close(release)
+
+	if body := <-slow; body != `{"env":"old"}` {
+		t.Errorf("request in flight during the reload = %s, want it finished with the old headers", body)
+	}
+	if body := string(proxyGet(t, target("https://api.example.com/cached")).Body()); body != `{"env":"old"}` || requests.Load() != 2 {
+		t.Errorf("cached entry after the reload = %s with %d requests, want it still served from the cache", body, requests.Load())
+	}
+	if body := string(proxyGet(t, target("https://api.example.com/fresh")).Body()); body != `{"env":"new"}` {
+		t.Errorf("request after the reload = %s, want the new headers", body)
+	}
+}
+
+func TestReloadFailureKeepsConfig(t *testing.T) {
+	setup(t)
+	config.setAdminKey("secret")
+	config.TargetHeaders = "target-headers.json"
+	writeFile(t, config.TargetHeaders, `{"api.example.com": {"X-Env": "old"}}`)
+	if err := reloadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int64
+	writeServers(t, reloadBackend(t, nil, &requests))
+
+	writeFile(t, config.TargetHeaders, `{"api.example.com": `)
+	var resp *fasthttp.Response
+	output := captureOutput(t, func() { resp = reload(t) })
+	if resp.StatusCode() != fasthttp.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want 422: %s", resp.StatusCode(), resp.Body())
+	}
+	if !strings.Contains(output, "Reload failed, keeping the current configuration") {
+		t.Errorf("output = %q", output)
+	}
+	if body := string(proxyGet(t, target("https://api.example.com/a")).Body()); body != `{"env":"old"}` {
+		t.Errorf("after the failed reload = %s, want the old headers", body)
+	}
+}
+
+func TestReloadSettings(t *testing.T) {
+	setup(t)
+	config.setAdminKey("flag-key")
+	config.SettingsFile = "settings.json"
+	writeFile(t, config.SettingsFile, `{"cache_ttl": "1h"}`)
+	if err := reloadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int64
+	writeServers(t, countingBackend(t, `{}`, &requests))
+	proxyGet(t, target("https://api.example.com/settings"))
+	before, _ := cacheEntry(cacheKey("https://api.example.com/settings"))
+
+	writeFile(t, config.SettingsFile, `{"api_key": "file-key", "cache_ttl": "2h"}`)
+	if resp := proxyDo(t, fasthttp.MethodPost, "/admin/reload", "", "X-API-Key", "flag-key"); resp.StatusCode() != fasthttp.StatusNoContent {
+		t.Fatalf("reload: status = %d: %s", resp.StatusCode(), resp.Body())
+	}
+	if resp := proxyDo(t, fasthttp.MethodPost, "/admin/reload", "", "X-API-Key", "flag-key"); resp.StatusCode() == fasthttp.StatusNoContent {
+		t.Error("the old key still works after the reload")
+	}
+	if after, ok := cacheEntry(cacheKey("https://api.example.com/settings")); !ok || !after.ExpiresAt.Equal(before.ExpiresAt) {
+		t.Errorf("cached entry after the reload: %v, expiry %s, want it kept with %s", ok, after.ExpiresAt, before.ExpiresAt)
+	}
+	proxyGet(t, target("https://api.example.com/settings/new"))
+	if entry, _ := cacheEntry(cacheKey("https://api.example.com/settings/new")); entry.ExpiresAt.Sub(entry.StoredAt) != 2*time.Hour {
+		t.Errorf("new entry TTL = %s, want the reloaded 2h", entry.ExpiresAt.Sub(entry.StoredAt))
+	}
+}
+
+func TestReloadsCoalesce(t *testing.T) {
+	setup(t)
+	config.TargetHeaders = "target-headers.json"
+	writeFile(t, config.TargetHeaders, `{}`)
+
+	// Hold the running reload so every trigger queues up behind it.
+	reloads.running.Lock()
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	output := captureOutput(t, func() {
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = reloadFileConfig()
+			}(i)
+		}
+		waitFor(t, "a reload to be queued", func() bool {
+			reloads.Lock()
+			defer reloads.Unlock()
+			return reloads.queued != nil
+		})
+		time.Sleep(50 * time.Millisecond)
+		reloads.running.Unlock()
+		wg.Wait()
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("reload %d: %v", i, err)
+		}
+	}
+	if n := strings.Count(output, "Configuration reloaded"); n != 1 {
+		t.Errorf("%d reloads for %d triggers, want them merged into one", n, len(errs))
+	}
+}
+
+func TestConcurrentReloads(t *testing.T) {
+	setup(t)
+	config.setAdminKey("secret")
+	config.TargetHeaders = "target-headers.json"
+	config.ErrorTemplate = "error.html"
+	writeServers(t, jsonBackend(t, `{}`))
+	version := func(f *fileConfig) (string, string) {
+		return f.targetHeaders["api.example.com"]["X-Env"], f.errorTemplate
+	}
+
+	// Every configuration a request can see has both files of one version.
+	done := make(chan struct{})
+	var mixed atomic.Value
+	var reader sync.WaitGroup
+	reader.Add(1)
+	go func() {
+		defer reader.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if headers, template := version(loadedFiles()); headers != template {
+				mixed.Store(headers + " with " + template)
+			}
+		}
+	}()
+
+	rounds := []struct {
+		version string
+		broken  bool // the error template is missing
+	}{
+		{"1", false}, {"2", false}, {"3", true}, {"4", false}, {"5", true},
+	}
+	want := ""
+	output := captureOutput(t, func() {
+		for _, round := range rounds {
+			writeFile(t, config.TargetHeaders, `{"api.example.com": {"X-Env": "`+round.version+`"}}`)
+			if round.broken {
+				os.Remove(config.ErrorTemplate)
+			} else {
+				writeFile(t, config.ErrorTemplate, round.version)
+				want = round.version
+			}
+
+			// Triggers through the endpoint and directly, as SIGHUP does.
+			var wg sync.WaitGroup
+			statuses := make([]int, 4)
+			for i := range statuses {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if i%2 == 0 {
+						statuses[i] = reload(t).StatusCode()
+					} else if reloadFileConfig() == nil {
+						statuses[i] = fasthttp.StatusNoContent
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			for i, status := range statuses {
+				if (status == fasthttp.StatusNoContent) == round.broken {
+					t.Errorf("version %s: reload %d got %d", round.version, i, status)
+				}
+			}
+			if headers, template := version(loadedFiles()); headers != want || template != want {
+				t.Errorf("version %s: loaded headers %q and template %q, want %q", round.version, headers, template, want)
+			}
+		}
+	})
+	close(done)
+	reader.Wait()
+	if got := mixed.Load(); got != nil {
+		t.Errorf("a request saw headers %s", got)
+	}
+	if n := strings.Count(output, "Configuration reloaded"); n < 3 || n > 3*4 {
+		t.Errorf("%d reloads applied for 3 good rounds of 4 triggers", n)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// The remote cache is another instance of the proxy, shared by several
+// front instances through its /cache/entry endpoint. It sits behind the
+// in-memory cache: lookups go to it on a local miss and stores are written
+// to both.
+
+var errRemoteCacheUnavailable = errors.New("Remote cache is unavailable")
+
+var remoteCacheClient = &fasthttp.Client{}
+
+// remoteCacheBreaker short-circuits remote cache calls after
+// -remote-cache-breaker-threshold consecutive failures, so a hanging cache
+// costs one timeout per open period instead of one per request.
+var remoteCacheBreaker = struct {
+	sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}{}
+
+// remoteCacheStores tracks the stores remoteCacheSet runs in the background.
+var remoteCacheStores sync.WaitGroup
+
+var remoteCacheStats struct {
+	Hits          atomic.Int64
+	Misses        atomic.Int64
+	Errors        atomic.Int64
+	ShortCircuits atomic.Int64
+}
+
+func remoteCacheAllow() bool {
+	remoteCacheBreaker.Lock()
+	defer remoteCacheBreaker.Unlock()
+
+	switch remoteCacheBreaker.state {
+	case breakerOpen:
+		if time.Since(remoteCacheBreaker.openedAt) < config.RemoteCacheBreakerOpen {
+			return false
+		}
+		remoteCacheBreaker.state = breakerHalfOpen
+		remoteCacheBreaker.probing = true
+	case breakerHalfOpen:
+		if remoteCacheBreaker.probing {
+			return false
+		}
+		remoteCacheBreaker.probing = true
+	}
+	return true
+}
+
+func remoteCacheDone(err error) {
+	remoteCacheBreaker.Lock()
+	defer remoteCacheBreaker.Unlock()
+
+	remoteCacheBreaker.probing = false
+	if err == nil {
+		if remoteCacheBreaker.state != breakerClosed {
+			fmt.Println("Remote cache recovered, closing breaker")
+		}
+		remoteCacheBreaker.state = breakerClosed
+		remoteCacheBreaker.failures = 0
+		return
+	}
+
+	remoteCacheStats.Errors.Add(1)
+	remoteCacheBreaker.failures++
+	if remoteCacheBreaker.state == breakerHalfOpen || remoteCacheBreaker.failures >= config.RemoteCacheBreakerThreshold {
+		if remoteCacheBreaker.state != breakerOpen {
+			fmt.Printf("Remote cache failing (%v), opening breaker\n", err)
+		}
+		remoteCacheBreaker.state = breakerOpen
+		remoteCacheBreaker.openedAt = time.Now()
+	}
+}
+
+func remoteCacheBreakerState() string {
+	remoteCacheBreaker.Lock()
+	defer remoteCacheBreaker.Unlock()
+	return remoteCacheBreaker.state.String()
+}
+
+func remoteCacheURL(key string) string {
+	return fmt.Sprintf("%s/cache/entry?key=%s", config.RemoteCache, url.QueryEscape(key))
+}
+
+// remoteCacheGet looks key up in the remote cache. A failing or
+// short-circuited lookup is a miss with -remote-cache-fail-mode=open and
+// errRemoteCacheUnavailable with closed.
+func remoteCacheGet(key string) (upstreamResponse, bool, error) {
+	if config.RemoteCache == "" || cacheOff() {
+		return upstreamResponse{}, false, nil
+	}
+
+	if !remoteCacheAllow() {
+		remoteCacheStats.ShortCircuits.Add(1)
+		return upstreamResponse{}, false, remoteCacheFailure()
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(remoteCacheURL(key))
+	req.Header.Set("X-API-Key", config.RemoteCacheAPIKey)
+
+	err := remoteCacheClient.DoTimeout(req, resp, config.RemoteCacheTimeout)
+	if err == nil && resp.StatusCode() != fasthttp.StatusOK && resp.StatusCode() != fasthttp.StatusNotFound {
+		err = fmt.Errorf("unexpected status code %d", resp.StatusCode())
+	}
+	remoteCacheDone(err)
+	if err != nil {
+		fmt.Printf("Remote cache lookup failed: %v\n", err)
+		return upstreamResponse{}, false, remoteCacheFailure()
+	}
+
+	if resp.StatusCode() == fasthttp.StatusNotFound {
+		remoteCacheStats.Misses.Add(1)
+		return upstreamResponse{}, false, nil
+	}
+
+	var entry cacheExportEntry
+	if err := json.Unmarshal(resp.Body(), &entry); err != nil || !entry.ExpiresAt.After(time.Now()) {
+		remoteCacheStats.Misses.Add(1)
+		return upstreamResponse{}, false, nil
+	}
+
+	remoteCacheStats.Hits.Add(1)
+	cached := upstreamResponse{Body: string(entry.Body), ContentType: entry.ContentType, StatusCode: entry.StatusCode, Location: entry.Location, Headers: entry.Headers}
+	cacheStore(key, cached, entry.StoredAt, entry.ExpiresAt)
+	return cached, true, nil
+}
+
+func remoteCacheFailure() error {
+	if config.RemoteCacheFailMode == "closed" {
+		return errRemoteCacheUnavailable
+	}
+	return nil
+}
+
+// remoteCacheSet writes an entry to the remote cache in the background.
+// Failures only count towards the breaker.
+func remoteCacheSet(key string, resp upstreamResponse, storedAt time.Time, expiresAt time.Time) {
+	if config.RemoteCache == "" {
+		return
+	}
+
+	body, err := jsonLine.Marshal(cacheExportEntry{
+		Key:         key,
+		ContentType: resp.ContentType,
+		Headers:     resp.Headers,
+		StatusCode:  resp.StatusCode,
+		Location:    resp.Location,
+		Body:        []byte(resp.Body),
+		StoredAt:    storedAt,
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		return
+	}
+
+	remoteCacheStores.Add(1)
+	go func() {
+		defer remoteCacheStores.Done()
+		if !remoteCacheAllow() {
+			remoteCacheStats.ShortCircuits.Add(1)
+			return
+		}
+
+		req := fasthttp.AcquireRequest()
+		resp := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseRequest(req)
+		defer fasthttp.ReleaseResponse(resp)
+
+		req.SetRequestURI(remoteCacheURL(key))
+		req.Header.SetMethod(fasthttp.MethodPut)
+		req.Header.Set("X-API-Key", config.RemoteCacheAPIKey)
+		req.Header.SetContentType("application/json")
+		req.SetBody(body)
+
+		err := remoteCacheClient.DoTimeout(req, resp, config.RemoteCacheTimeout)
+		if err == nil && resp.StatusCode() != fasthttp.StatusNoContent {
+			err = fmt.Errorf("unexpected status code %d", resp.StatusCode())
+		}
+		remoteCacheDone(err)
+		if err != nil {
+			fmt.Printf("Remote cache store failed: %v\n", err)
+		}
+	}()
+}
+
+// handleCacheEntry serves /cache/entry for instances using this one as their
+// -remote-cache: GET returns the entry for ?key= as JSON (404 when absent),
+// PUT stores one in the /cache/export format.
+func handleCacheEntry(ctx *fasthttp.RequestCtx) {
+	if !authorizeAdmin(ctx) {
+		return
+	}
+
+	switch {
+	case ctx.IsGet():
+		key := string(ctx.QueryArgs().Peek("key"))
+		meta, ok := cacheEntry(key)
+		if !ok {
+			sendJSONErrorResponse(ctx, "Not cached", fasthttp.StatusNotFound)
+			return
+		}
+		resp, ok := cacheGet(key)
+		if !ok {
+			sendJSONErrorResponse(ctx, "Not cached", fasthttp.StatusNotFound)
+			return
+		}
+		sendJSONResponse(ctx, cacheExportEntry{
+			Key:         key,
+			ContentType: resp.ContentType,
+			Headers:     resp.Headers,
+			StatusCode:  resp.StatusCode,
+			Location:    resp.Location,
+			Body:        []byte(resp.Body),
+			StoredAt:    meta.StoredAt,
+			ExpiresAt:   meta.ExpiresAt,
+		}, fasthttp.StatusOK)
+	case ctx.IsPut():
+		var entry cacheExportEntry
+		if err := json.Unmarshal(ctx.PostBody(), &entry); err != nil || entry.Key == "" {
+			sendJSONErrorResponse(ctx, "Invalid cache entry", fasthttp.StatusBadRequest)
+			return
+		}
+		if entry.ExpiresAt.After(time.Now()) && !cacheOff() {
+			cacheStore(entry.Key, upstreamResponse{Body: string(entry.Body), ContentType: entry.ContentType, StatusCode: entry.StatusCode, Location: entry.Location, Headers: entry.Headers}, entry.StoredAt, entry.ExpiresAt)
+		}
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	default:
+		sendJSONErrorResponse(ctx, "Method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
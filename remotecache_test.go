@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRemoteCacheBreaker(t *testing.T) {
+	tests := []struct {
+		failMode string
+		status   int
+	}{
+		{"open", fasthttp.StatusOK},
+		{"closed", fasthttp.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.failMode, func(t *testing.T) {
+			setup(t)
+			t.Cleanup(remoteCacheStores.Wait)
+			hang := make(chan struct{})
+			config.RemoteCache = newBackend(t, func(ctx *fasthttp.RequestCtx) { <-hang })
+			t.Cleanup(func() { close(hang) })
+			config.RemoteCacheTimeout = 100 * time.Millisecond
+			config.RemoteCacheFailMode = tt.failMode
+			config.RemoteCacheBreakerThreshold = 2
+			config.RemoteCacheBreakerOpen = time.Hour
+			writeServers(t, jsonBackend(t, `{"ok":true}`))
+
+			for i := 0; i < 5; i++ {
+				start := time.Now()
+				resp := proxyGet(t, target(fmt.Sprintf("api.example.com/item/%d", i)))
+				elapsed := time.Since(start)
+				if resp.StatusCode() != tt.status {
+					t.Errorf("request %d: status = %d, want %d: %s", i, resp.StatusCode(), tt.status, resp.Body())
+				}
+				// The first two lookups wait out the timeout and open the
+				// breaker; the rest must not wait at all.
+				if i < 2 && elapsed < config.RemoteCacheTimeout {
+					t.Errorf("request %d took %v, less than the cache timeout", i, elapsed)
+				}
+				if i >= 2 && elapsed >= config.RemoteCacheTimeout/2 {
+					t.Errorf("request %d took %v with the breaker open", i, elapsed)
+				}
+			}
+
+			var snapshot statsSnapshot
+			if err := json.Unmarshal(proxyGet(t, "/stats").Body(), &snapshot); err != nil {
+				t.Fatal(err)
+			}
+			if snapshot.Cache.Remote == nil || snapshot.Cache.Remote.Breaker != "open" {
+				t.Fatalf("remote cache stats = %+v, want the breaker open", snapshot.Cache.Remote)
+			}
+			if snapshot.Cache.Remote.ShortCircuits < 3 || snapshot.Cache.Remote.Errors < 2 {
+				t.Errorf("short_circuits = %d, errors = %d, want at least 3 and 2", snapshot.Cache.Remote.ShortCircuits, snapshot.Cache.Remote.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	"github.com/valyala/fasthttp"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID returns the client's X-Request-ID when it is a sane token, or a
+// new random one, and echoes it on the response. Each upstream attempt gets
+// its own ID derived from it, see attemptID.
+func requestID(ctx *fasthttp.RequestCtx) string {
+	id := string(ctx.Request.Header.Peek(requestIDHeader))
+	if !requestIDPattern.MatchString(id) {
+		var b [8]byte
+		rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+	ctx.Response.Header.Set(requestIDHeader, id)
+	return id
+}
+
+// currentRequestID returns the ID requestID already gave ctx, or assigns
+// one now.
+func currentRequestID(ctx *fasthttp.RequestCtx) string {
+	if id := ctx.Response.Header.Peek(requestIDHeader); len(id) > 0 {
+		return string(id)
+	}
+	return requestID(ctx)
+}
+
+// attemptID is the X-Request-ID sent with the n-th upstream attempt of a
+// request, counting from 1, e.g. "3f2a9c.2".
+func attemptID(requestID string, n int) string {
+	return fmt.Sprintf("%s.%d", requestID, n)
+}
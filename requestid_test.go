@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestAttemptIDs(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		kept     bool // whether the client's ID is the base of the attempt IDs
+	}{
+		{"client ID", "trace-42:a.b", true},
+		{"no client ID", "", false},
+		{"invalid client ID", "bad id\x7f", false},
+		{"too long client ID", strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			var mu sync.Mutex
+			var seen []string
+			backend := func(status int) string {
+				return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+					mu.Lock()
+					seen = append(seen, string(ctx.Request.Header.Peek(requestIDHeader)))
+					mu.Unlock()
+					ctx.SetStatusCode(status)
+					ctx.SetContentType("application/json")
+					ctx.SetBodyString(`{}`)
+				})
+			}
+			writeServers(t, backend(fasthttp.StatusTooManyRequests), backend(fasthttp.StatusTooManyRequests), backend(fasthttp.StatusOK))
+
+			var headers []string
+			if tt.clientID != "" {
+				headers = []string{requestIDHeader, tt.clientID}
+			}
+			resp := proxyGet(t, target("api.example.com/ids"), headers...)
+			if resp.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+			}
+			id := string(resp.Header.Peek(requestIDHeader))
+			if kept := id == tt.clientID; kept != tt.kept || !requestIDPattern.MatchString(id) {
+				t.Errorf("response %s = %q for client ID %q", requestIDHeader, id, tt.clientID)
+			}
+			want := []string{id + ".1", id + ".2", id + ".3"}
+			if fmt.Sprint(seen) != fmt.Sprint(want) {
+				t.Errorf("servers saw %q, want %q", seen, want)
+			}
+		})
+	}
+}
+
+func TestAttemptIDsLogged(t *testing.T) {
+	setup(t)
+	writeServers(t, statusBackend(t, fasthttp.StatusTooManyRequests, `{}`), statusBackend(t, fasthttp.StatusTooManyRequests, `{}`))
+
+	output := captureOutput(t, func() {
+		proxyGet(t, target("api.example.com/ids"), requestIDHeader, "trace-7")
+	})
+	const prefix = "[ERROR] Request failed: target=api.example.com/ids attempts="
+	start := strings.Index(output, prefix)
+	if start < 0 {
+		t.Fatalf("no rotation path logged:\n%s", output)
+	}
+	line, _, _ := strings.Cut(output[start+len(prefix):], "\n")
+	var attempts []attemptRecord
+	if err := json.Unmarshal([]byte(line), &attempts); err != nil {
+		t.Fatalf("%v: %s", err, line)
+	}
+	if len(attempts) != 2 || attempts[0].ID != "trace-7.1" || attempts[1].ID != "trace-7.2" {
+		t.Errorf("logged attempts = %+v, want IDs trace-7.1 and trace-7.2", attempts)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "sync"
+
+// retryBudget is a token bucket shared by all requests. Every attempt after
+// the first one of a request spends a token, and every successful request
+// earns -retry-budget-ratio of one back, so during a widespread outage
+// retries die down instead of multiplying the load on the servers.
+var retryBudget = struct {
+	sync.Mutex
+	tokens float64
+}{}
+
+func initRetryBudget() {
+	retryBudget.Lock()
+	retryBudget.tokens = float64(config.RetryBudget)
+	retryBudget.Unlock()
+}
+
+func retryBudgetAvailable() bool {
+	if config.RetryBudget <= 0 {
+		return true
+	}
+
+	retryBudget.Lock()
+	defer retryBudget.Unlock()
+	return retryBudget.tokens >= 1
+}
+
+func spendRetryToken() {
+	if config.RetryBudget <= 0 {
+		return
+	}
+
+	retryBudget.Lock()
+	defer retryBudget.Unlock()
+	if retryBudget.tokens >= 1 {
+		retryBudget.tokens--
+	}
+}
+
+func creditRetryBudget() {
+	if config.RetryBudget <= 0 {
+		return
+	}
+
+	retryBudget.Lock()
+	defer retryBudget.Unlock()
+	retryBudget.tokens += config.RetryBudgetRatio
+	if max := float64(config.RetryBudget); retryBudget.tokens > max {
+		retryBudget.tokens = max
+	}
+}
+
+func retryBudgetTokens() float64 {
+	retryBudget.Lock()
+	defer retryBudget.Unlock()
+	return retryBudget.tokens
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRetryBudget(t *testing.T) {
+	setup(t)
+	config.RetryBudget = 2
+	config.RetryBudgetRatio = 0.5
+	initRetryBudget()
+	config.SoftErrorPattern = "Error: service"
+	softErrorPattern = regexp.MustCompile(config.SoftErrorPattern)
+
+	var failing atomic.Bool
+	var attempts atomic.Int64
+	var servers []string
+	for i := 0; i < 3; i++ {
+		page := fmt.Sprintf("<html>Error: service %d unavailable</html>", i)
+		servers = append(servers, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+			attempts.Add(1)
+			if failing.Load() {
+				ctx.SetBodyString(page)
+				return
+			}
+			ctx.SetBodyString(`{}`)
+		}))
+	}
+	writeServers(t, servers...)
+
+	steps := []struct {
+		name     string
+		failing  bool
+		attempts int64 // made by the request
+		tokens   float64
+	}{
+		{"outage spends the budget on retries", true, 3, 0},
+		{"drained budget allows no retry", true, 1, 0},
+		{"still none", true, 1, 0},
+		{"success earns part of a token", false, 1, 0.5},
+		{"another success earns a full token", false, 1, 1},
+		{"one retry is allowed again", true, 2, 0},
+		{"recovery earns tokens back", false, 1, 0.5},
+	}
+	for i, step := range steps {
+		failing.Store(step.failing)
+		before := attempts.Load()
+		resp := proxyGet(t, target(fmt.Sprintf("api.example.com/budget/%d", i)))
+		if got := attempts.Load() - before; got != step.attempts {
+			t.Errorf("%s: %d attempts, want %d", step.name, got, step.attempts)
+		}
+		if wantOK := !step.failing; (resp.StatusCode() == fasthttp.StatusOK) != wantOK {
+			t.Errorf("%s: status = %d", step.name, resp.StatusCode())
+		}
+		if got := retryBudgetTokens(); got != step.tokens {
+			t.Errorf("%s: tokens = %v, want %v", step.name, got, step.tokens)
+		}
+	}
+}
+
+func TestRetryBudgetCap(t *testing.T) {
+	setup(t)
+	config.RetryBudget = 2
+	config.RetryBudgetRatio = 0.75
+	initRetryBudget()
+	for i := 0; i < 5; i++ {
+		creditRetryBudget()
+	}
+	if got := retryBudgetTokens(); got != 2 {
+		t.Errorf("tokens after crediting a full bucket = %v, want 2", got)
+	}
+
+	config.RetryBudget = 0
+	for i := 0; i < 5; i++ {
+		spendRetryToken()
+	}
+	if !retryBudgetAvailable() {
+		t.Error("retries throttled with -retry-budget 0")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import "time"
+
+// rollingBuckets is how many slices a rolling window is cut into; the oldest
+// slice is dropped as the window moves on.
+const rollingBuckets = 10
+
+type rollingBucket struct {
+	start  time.Time
+	ok     int
+	failed int
+}
+
+// rollingCounts counts outcomes over a rolling window, for the cache hit
+// ratio alarm and the global circuit. It is not safe for concurrent use;
+// callers hold their own lock.
+type rollingCounts struct {
+	buckets [rollingBuckets]rollingBucket
+}
+
+// add counts one outcome at now and returns the ok and total counts over the
+// window ending at now.
+func (r *rollingCounts) add(now time.Time, window time.Duration, ok bool) (int, int) {
+	// Buckets are at least a nanosecond long, so a window under
+	// rollingBuckets nanoseconds does not divide by zero.
+	span := max(window/rollingBuckets, 1)
+	start := now.Truncate(span)
+	bucket := &r.buckets[(start.UnixNano()/int64(span))%rollingBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = rollingBucket{start: start}
+	}
+	if ok {
+		bucket.ok++
+	} else {
+		bucket.failed++
+	}
+
+	oks, total := 0, 0
+	for _, b := range r.buckets {
+		if now.Sub(b.start) < window {
+			oks += b.ok
+			total += b.ok + b.failed
+		}
+	}
+	return oks, total
+}
+
+// reset forgets every outcome counted so far.
+func (r *rollingCounts) reset() {
+	r.buckets = [rollingBuckets]rollingBucket{}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+type cacheExistsResponse struct {
+	Cached     bool    `json:"cached"`
+	AgeSeconds float64 `json:"age_seconds,omitempty"`
+	ExpiresIn  float64 `json:"expires_in,omitempty"`
+}
+
+// transparentPrefix is where the proxy's own endpoints live in -transparent
+// mode, where every other path belongs to the servers.
+const transparentPrefix = "/_proxy"
+
+func handleRoutes(ctx *fasthttp.RequestCtx) {
+	route := string(ctx.Path())
+	if config.Transparent {
+		if rest, ok := strings.CutPrefix(route, transparentPrefix); ok && strings.HasPrefix(rest, "/") {
+			route = rest
+		} else {
+			route = ""
+		}
+	}
+	switch route {
+	case "/batch":
+		handleBatch(ctx)
+	case "/echo":
+		handleEcho(ctx)
+	case "/quota":
+		handleQuota(ctx)
+	case "/stats":
+		handleStats(ctx)
+	case "/metrics":
+		handleMetrics(ctx)
+	case "/plan":
+		handlePlan(ctx)
+	case "/merge":
+		if enforceQuota(ctx) {
+			handleMerge(ctx)
+		}
+	case "/cache":
+		handleCacheHead(ctx)
+	case "/admin/apikey":
+		handleAPIKeyRotation(ctx)
+	case "/admin/reload":
+		handleReload(ctx)
+	case "/admin/stats/reset":
+		handleStatsReset(ctx)
+	case "/cache/exists":
+		handleCacheExists(ctx)
+	case "/cache/entry":
+		handleCacheEntry(ctx)
+	case "/cache/export":
+		handleCacheExport(ctx)
+	case "/cache/dump":
+		handleCacheDump(ctx)
+	case "/cache/disable":
+		handleCacheToggle(ctx, true)
+	case "/cache/enable":
+		handleCacheToggle(ctx, false)
+	default:
+		if !enforceQuota(ctx) {
+			return
+		}
+		if config.Transparent {
+			handleTransparent(ctx)
+		} else {
+			handleRequests(ctx)
+		}
+	}
+}
+
+func handleCacheExists(ctx *fasthttp.RequestCtx) {
+	decodedURL, err := targetURL(ctx)
+	if err != nil || decodedURL == "" {
+		sendJSONErrorResponse(ctx, "Invalid or missing URL parameter", fasthttp.StatusBadRequest)
+		return
+	}
+
+	key, err := requestCacheKey(ctx, decodedURL)
+	if err != nil {
+		sendJSONErrorCode(ctx, err.Error(), "invalid_namespace", fasthttp.StatusBadRequest)
+		return
+	}
+
+	data, ok := cacheEntry(key)
+	if !ok {
+		sendJSONResponse(ctx, cacheExistsResponse{Cached: false}, fasthttp.StatusOK)
+		return
+	}
+
+	now := time.Now()
+	sendJSONResponse(ctx, cacheExistsResponse{
+		Cached:     true,
+		AgeSeconds: now.Sub(data.StoredAt).Seconds(),
+		ExpiresIn:  data.ExpiresAt.Sub(now).Seconds(),
+	}, fasthttp.StatusOK)
+}
+
+// handleCacheHead serves HEAD /cache?url=..., the metadata of a cache entry
+// as headers: X-Cache-Exists, Age, Cache-Control with the remaining lifetime
+// and the Content-Length of the cached body.
+func handleCacheHead(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsHead() {
+		ctx.Response.Header.Set("Allow", fasthttp.MethodHead)
+		sendJSONErrorResponse(ctx, "Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	decodedURL, err := targetURL(ctx)
+	if err != nil || decodedURL == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	key, err := requestCacheKey(ctx, decodedURL)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	data, ok := cacheEntry(key)
+	if !ok {
+		ctx.Response.Header.Set("X-Cache-Exists", "false")
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	ctx.Response.Header.Set("X-Cache-Exists", "true")
+	ctx.Response.Header.Set("Age", strconv.Itoa(int(now.Sub(data.StoredAt).Seconds())))
+	ctx.Response.Header.Set("Cache-Control", fmt.Sprintf("max-age=%d", int(data.ExpiresAt.Sub(now).Seconds())))
+	if data.ContentType != "" {
+		ctx.SetContentType(data.ContentType)
+	}
+	ctx.Response.Header.SetContentLength(data.Size)
+}
+
+// authorizeAdmin checks the X-API-Key header against -api-key and writes an
+// error response when the request may not use admin endpoints.
+func authorizeAdmin(ctx *fasthttp.RequestCtx) bool {
+	adminKey := config.adminKey()
+	if adminKey == "" {
+		sendJSONErrorResponse(ctx, "Admin endpoints are disabled", fasthttp.StatusForbidden)
+		return false
+	}
+
+	key := ctx.Request.Header.Peek("X-API-Key")
+	if subtle.ConstantTimeCompare(key, []byte(adminKey)) != 1 {
+		sendJSONErrorResponse(ctx, "Invalid or missing API key", fasthttp.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+type apiKeyRotation struct {
+	APIKey string `json:"api_key"`
+}
+
+// handleAPIKeyRotation serves POST /admin/apikey, authenticated with the
+// current key. The new key applies to every request checked after it.
+func handleAPIKeyRotation(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		sendJSONErrorResponse(ctx, "Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeAdmin(ctx) {
+		return
+	}
+
+	var rotation apiKeyRotation
+	if err := json.Unmarshal(ctx.PostBody(), &rotation); err != nil || strings.TrimSpace(rotation.APIKey) == "" {
+		sendJSONErrorResponse(ctx, "Request body must be a JSON object with a non-empty api_key", fasthttp.StatusBadRequest)
+		return
+	}
+
+	config.setAdminKey(strings.TrimSpace(rotation.APIKey))
+	fmt.Println("Admin API key rotated")
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+func handleCacheToggle(ctx *fasthttp.RequestCtx, disable bool) {
+	if !ctx.IsPost() {
+		sendJSONErrorResponse(ctx, "Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeAdmin(ctx) {
+		return
+	}
+
+	cacheDisabled.Store(disable)
+	fmt.Printf("Cache disabled: %t\n", disable)
+
+	sendJSONResponse(ctx, map[string]bool{"disabled": disable}, fasthttp.StatusOK)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCacheExists(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		status int
+		cached bool
+	}{
+		{"cached", "api.example.com/cached", fasthttp.StatusOK, true},
+		{"uncached", "api.example.com/other", fasthttp.StatusOK, false},
+		{"missing url", "", fasthttp.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			writeServers(t, jsonBackend(t, `{}`))
+			proxyGet(t, target("api.example.com/cached"))
+
+			resp := proxyGet(t, "/cache/exists?url="+tt.url)
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if tt.status != fasthttp.StatusOK {
+				return
+			}
+			var got cacheExistsResponse
+			if err := json.Unmarshal(resp.Body(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Cached != tt.cached {
+				t.Errorf("cached = %v, want %v", got.Cached, tt.cached)
+			}
+			if tt.cached && (got.ExpiresIn <= 0 || got.ExpiresIn > cacheLifetime().Seconds() || got.AgeSeconds < 0) {
+				t.Errorf("age_seconds = %v, expires_in = %v for a fresh entry with a TTL of %s", got.AgeSeconds, got.ExpiresIn, cacheLifetime())
+			}
+			if !tt.cached && (got.AgeSeconds != 0 || got.ExpiresIn != 0) {
+				t.Errorf("uncached URL has age_seconds = %v, expires_in = %v", got.AgeSeconds, got.ExpiresIn)
+			}
+		})
+	}
+}
+
+func TestCacheExistsExpiry(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		cached    bool
+	}{
+		{"fresh", time.Minute, true},
+		{"expired", -time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			now := time.Now()
+			cacheStore(cacheKey("api.example.com/entry"), upstreamResponse{Body: "{}"}, now.Add(-time.Minute), now.Add(tt.expiresIn))
+
+			var got cacheExistsResponse
+			if err := json.Unmarshal(proxyGet(t, "/cache/exists?url=api.example.com/entry").Body(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Cached != tt.cached {
+				t.Errorf("cached = %v, want %v", got.Cached, tt.cached)
+			}
+			if tt.cached && got.AgeSeconds < 59 {
+				t.Errorf("age_seconds = %v for an entry stored a minute ago", got.AgeSeconds)
+			}
+		})
+	}
+}
+
+func TestCacheToggle(t *testing.T) {
+	setup(t)
+	config.setAdminKey("secret")
+	var requests atomic.Int64
+	writeServers(t, countingBackend(t, `{}`, &requests))
+	url := target("api.example.com/toggle")
+
+	steps := []struct {
+		name     string
+		toggle   string // endpoint posted to before the request, if any
+		key      string
+		status   int
+		upstream int64 // upstream requests made so far after the request
+	}{
+		{"first request is stored", "", "", 0, 1},
+		{"served from cache", "", "", 0, 1},
+		{"toggle needs the key", "/cache/disable", "wrong", fasthttp.StatusUnauthorized, 1},
+		{"disabled cache misses", "/cache/disable", "secret", fasthttp.StatusOK, 2},
+		{"disabled cache stores nothing", "", "", 0, 3},
+		{"re-enabled cache serves the old entry", "/cache/enable", "secret", fasthttp.StatusOK, 3},
+	}
+	for _, step := range steps {
+		if step.toggle != "" {
+			resp := proxyDo(t, fasthttp.MethodPost, step.toggle, "", "X-API-Key", step.key)
+			if resp.StatusCode() != step.status {
+				t.Fatalf("%s: POST %s status = %d, want %d", step.name, step.toggle, resp.StatusCode(), step.status)
+			}
+		}
+		proxyGet(t, url)
+		if got := requests.Load(); got != step.upstream {
+			t.Fatalf("%s: upstream requests = %d, want %d", step.name, got, step.upstream)
+		}
+	}
+	if got := cacheEntryCount(); got != 1 {
+		t.Errorf("cache entries = %d, want the one stored before disabling", got)
+	}
+}
+
+func TestCacheHead(t *testing.T) {
+	const body = `{"items":[1,2,3]}`
+	tests := []struct {
+		name   string
+		method string
+		uri    string
+		status int
+		exists string
+	}{
+		{"cached", fasthttp.MethodHead, "/cache?url=api.example.com/entry", fasthttp.StatusOK, "true"},
+		{"uncached", fasthttp.MethodHead, "/cache?url=api.example.com/other", fasthttp.StatusNotFound, "false"},
+		{"expired", fasthttp.MethodHead, "/cache?url=api.example.com/expired", fasthttp.StatusNotFound, "false"},
+		{"missing url", fasthttp.MethodHead, "/cache", fasthttp.StatusBadRequest, ""},
+		{"GET", fasthttp.MethodGet, "/cache?url=api.example.com/entry", fasthttp.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			now := time.Now()
+			cacheStore(cacheKey("api.example.com/entry"), upstreamResponse{Body: body, ContentType: "application/json"}, now.Add(-30*time.Second), now.Add(90*time.Second))
+			cacheStore(cacheKey("api.example.com/expired"), upstreamResponse{Body: body}, now.Add(-time.Hour), now.Add(-time.Second))
+
+			resp := proxyDo(t, tt.method, tt.uri, "")
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if got := string(resp.Header.Peek("X-Cache-Exists")); got != tt.exists {
+				t.Errorf("X-Cache-Exists = %q, want %q", got, tt.exists)
+			}
+			if tt.method == fasthttp.MethodGet {
+				if allow := string(resp.Header.Peek("Allow")); allow != fasthttp.MethodHead {
+					t.Errorf("Allow = %q", allow)
+				}
+				return
+			}
+			if len(resp.Body()) != 0 {
+				t.Errorf("HEAD response has a body: %q", resp.Body())
+			}
+			if tt.exists != "true" {
+				return
+			}
+			if age := string(resp.Header.Peek("Age")); age != "30" {
+				t.Errorf("Age = %q, want 30", age)
+			}
+			if cc := string(resp.Header.Peek("Cache-Control")); cc != "max-age=89" && cc != "max-age=90" {
+				t.Errorf("Cache-Control = %q, want the remaining 90s", cc)
+			}
+			if resp.Header.ContentLength() != len(body) || string(resp.Header.ContentType()) != "application/json" {
+				t.Errorf("Content-Length = %d, Content-Type = %q, want %d, application/json", resp.Header.ContentLength(), resp.Header.ContentType(), len(body))
+			}
+		})
+	}
+}
+
+func TestAPIKeyRotation(t *testing.T) {
+	setup(t)
+	config.setAdminKey("old")
+
+	steps := []struct {
+		name   string
+		method string
+		uri    string
+		key    string
+		body   string
+		status int
+	}{
+		{"old key works", fasthttp.MethodGet, "/quota", "old", "", fasthttp.StatusOK},
+		{"rotation needs the current key", fasthttp.MethodPost, "/admin/apikey", "wrong", `{"api_key":"new"}`, fasthttp.StatusUnauthorized},
+		{"rotation needs a key", fasthttp.MethodPost, "/admin/apikey", "old", `{"api_key":"  "}`, fasthttp.StatusBadRequest},
+		{"rotation needs POST", fasthttp.MethodGet, "/admin/apikey", "old", "", fasthttp.StatusMethodNotAllowed},
+		{"rotate", fasthttp.MethodPost, "/admin/apikey", "old", `{"api_key":" new "}`, fasthttp.StatusNoContent},
+		{"old key fails", fasthttp.MethodGet, "/quota", "old", "", fasthttp.StatusUnauthorized},
+		{"new key works", fasthttp.MethodGet, "/quota", "new", "", fasthttp.StatusOK},
+	}
+	for _, step := range steps {
+		resp := proxyDo(t, step.method, step.uri, step.body, "X-API-Key", step.key)
+		if resp.StatusCode() != step.status {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, resp.StatusCode(), step.status, resp.Body())
+		}
+	}
+}
+
+func TestAPIKeyFromSettingsReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		startup bool
+		before  string // key in the settings file before the reload
+		after   string
+		want    string
+	}{
+		{"startup", true, "", "file", "file"},
+		{"changed in the file", false, "file", "newer", "newer"},
+		{"unchanged file keeps the rotated key", false, "file", "file", "rotated"},
+		{"no key in the file", false, "", "", "rotated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.setAdminKey("rotated")
+			previous := &fileConfig{settings: settings{APIKey: tt.before}}
+			if tt.startup {
+				previous = nil
+			}
+			applySettings(previous, &fileConfig{settings: settings{APIKey: tt.after}})
+			if got := config.adminKey(); got != tt.want {
+				t.Errorf("admin key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+type runtimeStats struct {
+	Goroutines  int     `json:"goroutines"`
+	HeapAlloc   uint64  `json:"heap_alloc_bytes"`
+	HeapInuse   uint64  `json:"heap_inuse_bytes"`
+	Sys         uint64  `json:"sys_bytes"`
+	GCCycles    uint32  `json:"gc_cycles"`
+	GCPauseLast float64 `json:"gc_pause_last_seconds"`
+	OpenFDs     int     `json:"open_fds,omitempty"`
+}
+
+func runtimeStatsSnapshot() runtimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return runtimeStats{
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   mem.HeapAlloc,
+		HeapInuse:   mem.HeapInuse,
+		Sys:         mem.Sys,
+		GCCycles:    mem.NumGC,
+		GCPauseLast: time.Duration(mem.PauseNs[(mem.NumGC+255)%256]).Seconds(),
+		OpenFDs:     openFDs(),
+	}
+}
+
+// openFDs counts the proxy's open file descriptors, or returns 0 where
+// /proc is not available.
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+// metricsRegistry holds what /metrics serves: the Prometheus Go and process
+// collectors, followed by the per-target rate limit counters.
+var metricsRegistry = newMetricsRegistry()
+
+func newMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		newTargetRateLimitCollector(),
+	)
+	return registry
+}
+
+// A host that cannot be a label value is left out of a scrape rather than
+// failing all of it.
+var metricsHandler = fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}))
+
+// handleMetrics serves /metrics in the Prometheus text format through
+// promhttp. Like /stats it needs no API key, so scrapers can reach it
+// without credentials.
+func handleMetrics(ctx *fasthttp.RequestCtx) {
+	metricsHandler(ctx)
+}
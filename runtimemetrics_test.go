@@ -0,0 +1,106 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// parseMetrics returns the samples of a Prometheus text exposition by name,
+// and the TYPE of each metric.
+func parseMetrics(t *testing.T, body string) (map[string]float64, map[string]string) {
+	t.Helper()
+	samples, types := make(map[string]float64), make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if fields := strings.Fields(line); strings.HasPrefix(line, "# TYPE ") && len(fields) == 4 {
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " ")
+		if !ok {
+			t.Fatalf("malformed sample %q", line)
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("sample %q: %v", line, err)
+		}
+		samples[name] = parsed
+	}
+	return samples, types
+}
+
+func TestMetrics(t *testing.T) {
+	setup(t)
+	config.setAdminKey("secret")
+	runtime.GC()
+
+	resp := proxyGet(t, "/metrics")
+	if resp.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("status = %d without an API key: %s", resp.StatusCode(), resp.Body())
+	}
+	if got := string(resp.Header.ContentType()); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", got)
+	}
+	samples, types := parseMetrics(t, string(resp.Body()))
+
+	tests := []struct {
+		name     string
+		kind     string
+		positive bool
+	}{
+		{"go_goroutines", "gauge", true},
+		{"go_threads", "gauge", true},
+		{"go_memstats_alloc_bytes", "gauge", true},
+		{"go_memstats_alloc_bytes_total", "counter", true},
+		{"go_memstats_sys_bytes", "gauge", true},
+		{"go_memstats_heap_alloc_bytes", "gauge", true},
+		{"go_memstats_heap_inuse_bytes", "gauge", true},
+		{"go_memstats_heap_idle_bytes", "gauge", false},
+		{"go_memstats_heap_objects", "gauge", true},
+		{"go_memstats_next_gc_bytes", "gauge", true},
+		{"go_memstats_last_gc_time_seconds", "gauge", true},
+		{"go_gc_duration_seconds", "summary", false},
+		{"process_open_fds", "gauge", true},
+	}
+	for _, tt := range tests {
+		if types[tt.name] != tt.kind {
+			t.Errorf("%s has TYPE %q, want %s", tt.name, types[tt.name], tt.kind)
+		}
+		if tt.kind == "summary" {
+			if samples[tt.name+"_count"] < 1 {
+				t.Errorf("%s_count = %v after a GC", tt.name, samples[tt.name+"_count"])
+			}
+			continue
+		}
+		value, ok := samples[tt.name]
+		if !ok || tt.positive && value <= 0 {
+			t.Errorf("%s = %v, %v, want a positive value", tt.name, value, ok)
+		}
+	}
+}
+
+func TestRuntimeStats(t *testing.T) {
+	setup(t)
+	runtime.GC()
+
+	var snapshot statsSnapshot
+	if err := json.Unmarshal(proxyGet(t, "/stats").Body(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	got := snapshot.Runtime
+	if got.Goroutines <= 0 || got.HeapAlloc == 0 || got.HeapInuse == 0 || got.Sys < got.HeapInuse {
+		t.Errorf("runtime = %+v, want goroutines and memory reported", got)
+	}
+	if got.GCCycles == 0 {
+		t.Errorf("gc_cycles = 0 after a GC")
+	}
+	if got.OpenFDs <= 0 {
+		t.Errorf("open_fds = %d, want the descriptors in /proc/self/fd", got.OpenFDs)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// secretReference matches ${ENV:NAME} in a configured header value.
+var secretReference = regexp.MustCompile(`\$\{ENV:([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandSecrets replaces every ${ENV:NAME} in value with that environment
+// variable, so keys can stay out of the servers and -target-headers files.
+// The result is only ever sent upstream, never logged.
+func expandSecrets(value string) string {
+	return secretReference.ReplaceAllStringFunc(value, func(reference string) string {
+		return os.Getenv(secretReference.FindStringSubmatch(reference)[1])
+	})
+}
+
+// checkSecrets fails when value refers to an environment variable that is
+// not set. The error names the variable, never a value.
+func checkSecrets(value string) error {
+	for _, match := range secretReference.FindAllStringSubmatch(value, -1) {
+		if _, ok := os.LookupEnv(match[1]); !ok {
+			return fmt.Errorf("environment variable %s is not set", match[1])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestExpandSecrets(t *testing.T) {
+	t.Setenv("BACKEND_KEY", "k3y")
+	t.Setenv("EMPTY_KEY", "")
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{"${ENV:BACKEND_KEY}", "k3y"},
+		{"Bearer ${ENV:BACKEND_KEY}.${ENV:BACKEND_KEY}", "Bearer k3y.k3y"},
+		{"[${ENV:EMPTY_KEY}]", "[]"},
+		{"$BACKEND_KEY ${BACKEND_KEY} ${env:BACKEND_KEY}", "$BACKEND_KEY ${BACKEND_KEY} ${env:BACKEND_KEY}"},
+		{"${ENV:1KEY}", "${ENV:1KEY}"},
+	}
+	for _, tt := range tests {
+		if got := expandSecrets(tt.value); got != tt.want {
+			t.Errorf("expandSecrets(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSecrets(t *testing.T) {
+	t.Setenv("BACKEND_KEY", "k3y")
+	t.Setenv("EMPTY_KEY", "")
+	tests := []struct {
+		value   string
+		wantErr string
+	}{
+		{"plain", ""},
+		{"${ENV:BACKEND_KEY} ${ENV:EMPTY_KEY}", ""},
+		{"${ENV:BACKEND_KEY} ${ENV:UNSET_BACKEND_KEY}", "environment variable UNSET_BACKEND_KEY is not set"},
+	}
+	for _, tt := range tests {
+		err := checkSecrets(tt.value)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("checkSecrets(%q) = %v, want %q", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServerHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		forward bool
+		client  string // X-Api-Key sent by the client
+	}{
+		{"added", false, ""},
+		{"replacing the client's", true, "client-key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			t.Setenv("BACKEND_KEY", "k3y-from-env")
+			config.ForwardHeaders = tt.forward
+			config.AccessLogFormat = "json"
+			var received fasthttp.RequestHeader
+			server := newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				ctx.Request.Header.CopyTo(&received)
+				ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+			})
+			writeFile(t, serversFile, `[{"url":"`+server+`","Headers":{"x-api-key":"Key ${ENV:BACKEND_KEY}"}}]`)
+
+			var headers []string
+			if tt.client != "" {
+				headers = []string{"X-Api-Key", tt.client}
+			}
+			output := captureOutput(t, func() {
+				withAccessLog(handleRoutes)(proxyCtx(target("api.example.com/secret"), headers...))
+			})
+			if got := received.PeekAll("X-Api-Key"); len(got) != 1 || string(got[0]) != "Key k3y-from-env" {
+				t.Errorf("X-Api-Key = %q, want only the server's", got)
+			}
+			if !strings.Contains(output, server) {
+				t.Fatalf("log does not mention the request: %s", output)
+			}
+			if strings.Contains(output, "k3y-from-env") {
+				t.Errorf("the secret was logged: %s", output)
+			}
+		})
+	}
+}
+
+// proxyCtx is a request for the proxy's handlers to be called directly,
+// with headers given as name, value pairs.
+func proxyCtx(uri string, headers ...string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.SetRequestURI(uri)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&req, nil, nil)
+	return ctx
+}
+
+func TestServerHeadersUnsetSecret(t *testing.T) {
+	setup(t)
+	writeFile(t, serversFile, `[{"url":"http://a.example","Headers":{"X-Api-Key":"${ENV:UNSET_BACKEND_KEY}"}}]`)
+	_, err := parseServerAddresses(serversFile)
+	if err == nil || !strings.Contains(err.Error(), "UNSET_BACKEND_KEY is not set") || !strings.Contains(err.Error(), "X-Api-Key") {
+		t.Errorf("error = %v, want the unset variable named", err)
+	}
+}
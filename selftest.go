@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+func runSelfTest(target string, instance string) int {
+	requestURI := fmt.Sprintf("/?url=%s", url.QueryEscape(target))
+
+	var statusCode int
+	var body []byte
+	server := "unknown"
+
+	if instance != "" {
+		var err error
+		statusCode, body, err = fasthttp.Get(nil, strings.TrimRight(instance, "/")+requestURI)
+		if err != nil {
+			fmt.Printf("Self-test failed: %v\n", err)
+			return 2
+		}
+		server = instance
+	} else {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI(requestURI)
+		handleRequests(&ctx)
+
+		statusCode = ctx.Response.StatusCode()
+		body = ctx.Response.Body()
+		if s, ok := ctx.UserValue("server").(string); ok {
+			server = s
+		}
+	}
+
+	fmt.Printf("Status: %d\n", statusCode)
+	fmt.Printf("Server: %s\n", server)
+	fmt.Printf("Body: %s\n", body)
+
+	if statusCode != fasthttp.StatusOK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		instance string
+		want     int
+		output   string
+	}{
+		{"success against a stub", fasthttp.StatusOK, "", 0, "Status: 200"},
+		{"upstream failure", fasthttp.StatusInternalServerError, "", 1, "Status: 500"},
+		{"instance unreachable", fasthttp.StatusOK, "http://127.0.0.1:1", 2, "Self-test failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			server := statusBackend(t, tt.status, `{"ok":true}`)
+			writeServers(t, server)
+
+			var code int
+			output := captureOutput(t, func() { code = runSelfTest("api.example.com/ping", tt.instance) })
+			if code != tt.want {
+				t.Errorf("exit code = %d, want %d\n%s", code, tt.want, output)
+			}
+			if !strings.Contains(output, tt.output) {
+				t.Errorf("output does not contain %q:\n%s", tt.output, output)
+			}
+			if tt.want == 0 && !strings.Contains(output, "Server: "+server) {
+				t.Errorf("output does not name the server %s:\n%s", server, output)
+			}
+		})
+	}
+}
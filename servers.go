@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+const serversFile = "servers.txt"
+
+// Server is one backend from the server file. The file is either one URL per
+// line or a JSON array of Server objects.
+type Server struct {
+	URL  string
+	Tags []string
+	// Method, when set, is used for every request to this server, see
+	// -force-method.
+	Method string
+	// Template is the request URI sent to this server, with {url} replaced
+	// by the escaped target. It defaults to defaultTemplate.
+	Template string
+	// Pool is the named pool the server belongs to, see -pool-routes.
+	Pool string
+	// TransientRetries overrides -transient-retries for this server; a
+	// negative value turns the retries off.
+	TransientRetries int
+	// HTTPVersion is "1.1", the default, or "2" for https servers that
+	// should be reached over HTTP/2.
+	HTTPVersion string
+	// Headers are added to every request sent to this server, replacing
+	// any of the same name. Values may refer to ${ENV:NAME}.
+	Headers map[string]string
+	// HealthPath overrides -health-path for this server.
+	HealthPath string
+}
+
+const (
+	urlPlaceholder  = "{url}"
+	defaultTemplate = "/?url=" + urlPlaceholder
+)
+
+// healthPath is the path the health checker requests on this server, or ""
+// to only check that it accepts connections.
+func (s Server) healthPath() string {
+	if s.HealthPath != "" {
+		return s.HealthPath
+	}
+	return config.HealthPath
+}
+
+// endpoint returns the request URI asking this server for target.
+func (s Server) endpoint(target string) string {
+	template := s.Template
+	if template == "" {
+		template = defaultTemplate
+	}
+	return strings.ReplaceAll(template, urlPlaceholder, url.QueryEscape(target))
+}
+
+// checkServersFile runs at startup so a servers file that can never be read
+// stops the proxy right away instead of failing every request. A missing
+// file is only reported, since it may be created later.
+func checkServersFile(filePath string) error {
+	info, err := os.Stat(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("Warning: %s does not exist yet, requests fail until it is created\n", filePath)
+		return nil
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("%s cannot be accessed: permission denied on the file or one of its directories", filePath)
+	}
+	if err != nil {
+		return fmt.Errorf("%s cannot be accessed: %v", filePath, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory; it must be a file listing one server URL per line or a JSON array", filePath)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file (mode %s)", filePath, info.Mode().Type())
+	}
+
+	f, err := os.Open(filePath)
+	if errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("%s cannot be read: permission denied, make it readable by the user running the proxy", filePath)
+	}
+	if err != nil {
+		return fmt.Errorf("%s cannot be read: %v", filePath, err)
+	}
+	return f.Close()
+}
+
+func readServerAddresses(filePath string) ([]Server, error) {
+	servers, err := parseServerAddresses(filePath)
+	if err != nil {
+		return nil, err
+	}
+	stopDraining(servers)
+	return servers, nil
+}
+
+func parseServerAddresses(filePath string) ([]Server, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '[' {
+		var servers []Server
+		if err := json.Unmarshal(trimmed, &servers); err != nil {
+			return nil, err
+		}
+		for _, server := range servers {
+			if server.Template != "" && !strings.Contains(server.Template, urlPlaceholder) {
+				return nil, fmt.Errorf("template %q of server %s has no %s placeholder", server.Template, server.URL, urlPlaceholder)
+			}
+			if err := server.checkHTTPVersion(); err != nil {
+				return nil, err
+			}
+			if server.HealthPath != "" && !strings.HasPrefix(server.HealthPath, "/") {
+				return nil, fmt.Errorf("health path %q of server %s must start with /", server.HealthPath, server.URL)
+			}
+			for name, value := range server.Headers {
+				if err := checkSecrets(value); err != nil {
+					return nil, fmt.Errorf("header %s of server %s: %v", name, server.URL, err)
+				}
+			}
+		}
+		return dedupeServers(servers), nil
+	}
+
+	var servers []Server
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		// Scanning drops the \r of CRLF line endings; whitespace around
+		// the URL and blank lines, e.g. a trailing one, are dropped here.
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		servers = append(servers, Server{URL: line})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return dedupeServers(servers), nil
+}
+
+// reportedDuplicates is the last list of duplicate servers warned about. The
+// file is read for every request, so each list is only reported once.
+var reportedDuplicates struct {
+	sync.Mutex
+	list string
+}
+
+// dedupeServers drops every server whose URL, ignoring a trailing slash, is
+// already listed, keeping the first entry, unless -dedupe-servers=false asks
+// for duplicates to stay as extra weight in the rotation.
+func dedupeServers(servers []Server) []Server {
+	if !config.DedupeServers {
+		return servers
+	}
+
+	seen := make(map[string]bool, len(servers))
+	var duplicates []string
+	unique := servers[:0:0]
+	for _, server := range servers {
+		address := strings.TrimRight(server.URL, "/")
+		if seen[address] {
+			duplicates = append(duplicates, server.URL)
+			continue
+		}
+		seen[address] = true
+		unique = append(unique, server)
+	}
+
+	list := strings.Join(duplicates, ", ")
+	reportedDuplicates.Lock()
+	defer reportedDuplicates.Unlock()
+	if list != reportedDuplicates.list {
+		reportedDuplicates.list = list
+		if list != "" {
+			fmt.Printf("Warning: %s lists servers more than once, ignoring the duplicates: %s\n", serversFile, list)
+		}
+	}
+	return unique
+}
+
+func (s Server) hasTags(tags []string) bool {
+	for _, want := range tags {
+		found := false
+		for _, tag := range s.Tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func filterServersByTags(servers []Server, tags []string) []Server {
+	var matched []Server
+	for _, server := range servers {
+		if server.hasTags(tags) {
+			matched = append(matched, server)
+		}
+	}
+	return matched
+}
+
+const excludeServersHeader = "X-Exclude-Servers"
+
+// excludeServers drops the servers a request lists in X-Exclude-Servers, e.g.
+// one known to return bad data for its target. Entries that are not in the
+// pool are ignored.
+func excludeServers(ctx *fasthttp.RequestCtx, servers []Server) []Server {
+	header := string(ctx.Request.Header.Peek(excludeServersHeader))
+	if header == "" {
+		return servers
+	}
+
+	excluded := make(map[string]bool)
+	for _, entry := range strings.Split(header, ",") {
+		if entry = strings.TrimRight(strings.TrimSpace(entry), "/"); entry != "" {
+			excluded[entry] = true
+		}
+	}
+
+	var kept []Server
+	for _, server := range servers {
+		address := strings.TrimRight(server.URL, "/")
+		if excluded[address] {
+			delete(excluded, address)
+			continue
+		}
+		kept = append(kept, server)
+	}
+	for entry := range excluded {
+		debugf("Ignoring %s entry %s, it is not in the pool\n", excludeServersHeader, entry)
+	}
+	return kept
+}
+
+// reasonAllCoolingDown is the eligibleServers reason when every candidate
+// was rate limited recently, which handleRequests answers with a 429.
+const reasonAllCoolingDown = "all servers are cooling down"
+
+// eligibleServers applies every per-request filter to servers. When nothing
+// is left it also returns a human-readable reason for the caller's error.
+func eligibleServers(servers []Server, tags []string, pin string) ([]Server, string) {
+	servers, reason := candidateServers(servers, tags, pin)
+	if len(servers) == 0 {
+		return nil, reason
+	}
+
+	var eligible []Server
+	coolingDown, unhealthy, warming := 0, 0, 0
+	for _, server := range servers {
+		switch serverUnavailableReason(server.URL) {
+		case "":
+			eligible = append(eligible, server)
+		case unavailableCooldown:
+			coolingDown++
+		case unavailableWarming:
+			warming++
+			unhealthy++
+		default:
+			unhealthy++
+		}
+	}
+
+	if len(eligible) > 0 {
+		return demoteSlowServers(eligible), ""
+	}
+
+	switch {
+	case warming == len(servers):
+		return nil, "all servers are still warming up"
+	case unhealthy == 0:
+		return nil, reasonAllCoolingDown
+	case coolingDown == 0:
+		return nil, "all servers are unhealthy"
+	default:
+		return nil, "all servers are cooling down or unhealthy"
+	}
+}
+
+// candidateServers applies the pin and tags of a request to servers.
+func candidateServers(servers []Server, tags []string, pin string) ([]Server, string) {
+	if len(servers) == 0 {
+		return nil, "no servers are configured"
+	}
+
+	if pin != "" {
+		var pinned []Server
+		for _, server := range servers {
+			if server.URL == pin {
+				pinned = append(pinned, server)
+			}
+		}
+		if len(pinned) == 0 {
+			return nil, fmt.Sprintf("pinned server %s is not configured", pin)
+		}
+		servers = pinned
+	}
+
+	if len(tags) > 0 {
+		servers = filterServersByTags(servers, tags)
+		if len(servers) == 0 {
+			return nil, fmt.Sprintf("no servers match tags %s", strings.Join(tags, ","))
+		}
+	}
+	return servers, ""
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRequestTags(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"url=a.example", nil},
+		{"url=a.example&tags=fast", []string{"fast"}},
+		{"url=a.example&tags=fast,us", []string{"fast", "us"}},
+		{"url=a.example&tags=%20fast%20,,us,", []string{"fast", "us"}},
+		{"url=a.example&tags=fast&tags=us", []string{"fast", "us"}},
+		{"url=a.example&tags=", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			var ctx fasthttp.RequestCtx
+			ctx.Request.SetRequestURI("/?" + tt.query)
+			if got := requestTags(&ctx); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("requestTags = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagFiltering(t *testing.T) {
+	setup(t)
+	fastUS, fast, cheap := namedBackend(t), namedBackend(t), namedBackend(t)
+	writeFile(t, serversFile, fmt.Sprintf(`[
+		{"url": %q, "tags": ["fast", "us"]},
+		{"url": %q, "tags": ["fast"]},
+		{"url": %q, "tags": ["cheap"]}
+	]`, fastUS, fast, cheap))
+
+	tests := []struct {
+		tags string
+		want []string
+	}{
+		{"fast", []string{fastUS, fast}},
+		{"fast,us", []string{fastUS}},
+		{" cheap ,", []string{cheap}},
+		{"", []string{fastUS, fast, cheap}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tags, func(t *testing.T) {
+			used := map[string]bool{}
+			for i := 0; i < 6; i++ {
+				resp := proxyGet(t, target(fmt.Sprintf("api.example.com/%s/%d", url.QueryEscape(tt.tags), i))+"&tags="+url.QueryEscape(tt.tags))
+				used[servedBy(t, resp)] = true
+			}
+			var got []string
+			for server := range used {
+				got = append(got, server)
+			}
+			sort.Strings(got)
+			sort.Strings(tt.want)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("servers used = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	resp := proxyGet(t, target("api.example.com/gpu")+"&tags=gpu")
+	if resp.StatusCode() != fasthttp.StatusServiceUnavailable || !strings.Contains(string(resp.Body()), "no servers match tags gpu") {
+		t.Errorf("unmatched tag: %d %s, want 503 naming the tag", resp.StatusCode(), resp.Body())
+	}
+}
+
+func TestNoEligibleServers(t *testing.T) {
+	setHealth := func(update func(h *serverHealth)) func(server string) {
+		return func(server string) {
+			health.Lock()
+			defer health.Unlock()
+			update(healthFor(server))
+		}
+	}
+	tests := []struct {
+		name    string
+		servers bool
+		prepare func(server string)
+		headers []string
+		exclude bool
+		query   string
+		status  int
+		code    string
+		message string
+	}{
+		{name: "no servers configured", status: fasthttp.StatusServiceUnavailable, code: "no_eligible_servers", message: "no servers are configured"},
+		{name: "no server matches the tags", servers: true, query: "&tags=gpu", status: fasthttp.StatusServiceUnavailable, code: "no_eligible_servers", message: "no servers match tags gpu"},
+		{name: "pinned server not configured", servers: true, headers: []string{"X-Pin-Server", "http://other.test"}, status: fasthttp.StatusServiceUnavailable, code: "no_eligible_servers", message: "pinned server http://other.test is not configured"},
+		{name: "all servers excluded", servers: true, exclude: true, status: fasthttp.StatusServiceUnavailable, code: "no_eligible_servers", message: "all servers are excluded"},
+		{name: "all servers unhealthy", servers: true, prepare: setHealth(func(h *serverHealth) {
+			h.Breaker, h.OpenedAt = breakerOpen, time.Now()
+		}), status: fasthttp.StatusServiceUnavailable, code: "no_eligible_servers", message: "all servers are unhealthy"},
+		{name: "all servers warming up", servers: true, prepare: setHealth(func(h *serverHealth) {
+			h.Warming = true
+		}), status: fasthttp.StatusServiceUnavailable, code: "no_eligible_servers", message: "all servers are still warming up"},
+		{name: "all servers cooling down", servers: true, prepare: setHealth(func(h *serverHealth) {
+			h.CooldownUntil = time.Now().Add(time.Minute)
+		}), status: fasthttp.StatusTooManyRequests, code: "all_servers_cooling_down", message: reasonAllCoolingDown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			server := jsonBackend(t, `{}`)
+			if tt.servers {
+				writeServers(t, server)
+			} else {
+				writeFile(t, serversFile, "")
+			}
+			if tt.prepare != nil {
+				tt.prepare(server)
+			}
+			headers := tt.headers
+			if tt.exclude {
+				headers = append(headers, excludeServersHeader, server)
+			}
+
+			resp := proxyGet(t, target("api.example.com/x")+tt.query, headers...)
+			var got ErrorResponse
+			if err := json.Unmarshal(resp.Body(), &got); err != nil {
+				t.Fatalf("%d %q: %v", resp.StatusCode(), resp.Body(), err)
+			}
+			if resp.StatusCode() != tt.status || got.Error != tt.code || !strings.Contains(got.Message, tt.message) {
+				t.Errorf("got %d %s %q, want %d %s with %q", resp.StatusCode(), got.Error, got.Message, tt.status, tt.code, tt.message)
+			}
+		})
+	}
+}
+
+func TestCheckServersFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		prepare  func(t *testing.T, dir string) string // returns the path to check
+		unixOnly bool                                  // needs file permissions to be enforced
+		want     string                                // in the error, "" for none
+	}{
+		{
+			name: "regular file",
+			prepare: func(t *testing.T, dir string) string {
+				writeFile(t, dir+"/servers.txt", "http://a.example\n")
+				return dir + "/servers.txt"
+			},
+		},
+		{
+			name:    "missing file",
+			prepare: func(t *testing.T, dir string) string { return dir + "/servers.txt" },
+		},
+		{
+			name:    "directory",
+			prepare: func(t *testing.T, dir string) string { return dir },
+			want:    "is a directory",
+		},
+		{
+			name: "device",
+			prepare: func(t *testing.T, dir string) string {
+				if info, err := os.Stat(os.DevNull); err != nil || info.Mode().IsRegular() {
+					t.Skip("no device file to check")
+				}
+				return os.DevNull
+			},
+			want: "is not a regular file",
+		},
+		{
+			name: "unreadable file",
+			prepare: func(t *testing.T, dir string) string {
+				writeFile(t, dir+"/servers.txt", "http://a.example\n")
+				os.Chmod(dir+"/servers.txt", 0)
+				return dir + "/servers.txt"
+			},
+			unixOnly: true,
+			want:     "cannot be read: permission denied",
+		},
+		{
+			name: "unsearchable directory",
+			prepare: func(t *testing.T, dir string) string {
+				writeFile(t, dir+"/servers.txt", "http://a.example\n")
+				os.Chmod(dir, 0)
+				t.Cleanup(func() { os.Chmod(dir, 0o755) })
+				return dir + "/servers.txt"
+			},
+			unixOnly: true,
+			want:     "cannot be accessed: permission denied",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.unixOnly && (runtime.GOOS == "windows" || os.Geteuid() == 0) {
+				t.Skip("file permissions are not enforced for this user")
+			}
+			dir := t.TempDir()
+			path := tt.prepare(t, dir)
+
+			var err error
+			captureOutput(t, func() { err = checkServersFile(path) })
+			if tt.want == "" && err != nil {
+				t.Errorf("error = %v, want none", err)
+			}
+			if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("error = %v, want one saying %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckServersFileMissingWarns(t *testing.T) {
+	path := t.TempDir() + "/servers.txt"
+	output := captureOutput(t, func() {
+		if err := checkServersFile(path); err != nil {
+			t.Errorf("error = %v for a missing file", err)
+		}
+	})
+	if !strings.Contains(output, "Warning: "+path+" does not exist yet") {
+		t.Errorf("output = %q, want a warning", output)
+	}
+}
+
+func TestTextServersFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"LF", "http://a.example\nhttp://b.example\n", []string{"http://a.example", "http://b.example"}},
+		{"CRLF", "http://a.example\r\nhttp://b.example\r\n", []string{"http://a.example", "http://b.example"}},
+		{"no final newline", "http://a.example\r\nhttp://b.example", []string{"http://a.example", "http://b.example"}},
+		{"blank lines", "\r\nhttp://a.example\r\n\r\n  \r\nhttp://b.example\r\n\r\n", []string{"http://a.example", "http://b.example"}},
+		{"surrounding whitespace", " \thttp://a.example  \r\n", []string{"http://a.example"}},
+		{"only blank lines", "\r\n\r\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			writeFile(t, serversFile, tt.content)
+			servers, err := parseServerAddresses(serversFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, server := range servers {
+				got = append(got, server.URL)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("servers = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCRLFServersFile(t *testing.T) {
+	setup(t)
+	writeFile(t, serversFile, jsonBackend(t, `{"server":1}`)+"\r\n"+jsonBackend(t, `{"server":2}`)+"\r\n")
+
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		resp := proxyGet(t, target(fmt.Sprintf("api.example.com/crlf/%d", i)))
+		if resp.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("request %d: status = %d: %s", i, resp.StatusCode(), resp.Body())
+		}
+		seen[string(resp.Body())] = true
+	}
+	if !seen[`{"server":1}`] || !seen[`{"server":2}`] {
+		t.Errorf("answered by %v, want both servers", seen)
+	}
+}
+
+func TestDedupeServers(t *testing.T) {
+	tests := []struct {
+		name    string
+		dedupe  bool
+		content string
+		want    string
+		warning string
+	}{
+		{"no duplicates", true, "http://a.example\nhttp://b.example\n", "http://a.example http://b.example", ""},
+		{"duplicate dropped", true, "http://a.example\nhttp://b.example\nhttp://a.example\n", "http://a.example http://b.example", "http://a.example"},
+		{"trailing slash", true, "http://a.example/\nhttp://a.example\n", "http://a.example/", "http://a.example"},
+		{"several", true, "http://a.example\nhttp://a.example\nhttp://b.example\nhttp://b.example/\n", "http://a.example http://b.example", "http://a.example, http://b.example/"},
+		{"JSON keeps the first entry", true, `[{"url":"http://a.example","Tags":["first"]},{"url":"http://a.example","Tags":["second"]}]`, "http://a.example[first]", "http://a.example"},
+		{"kept as weight", false, "http://a.example\nhttp://b.example\nhttp://a.example\n", "http://a.example http://b.example http://a.example", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.DedupeServers = tt.dedupe
+			writeFile(t, serversFile, tt.content)
+			var servers []Server
+			output := captureOutput(t, func() {
+				var err error
+				if servers, err = parseServerAddresses(serversFile); err != nil {
+					t.Error(err)
+				}
+			})
+			var got []string
+			for _, server := range servers {
+				if len(server.Tags) > 0 {
+					got = append(got, server.URL+"["+strings.Join(server.Tags, ",")+"]")
+				} else {
+					got = append(got, server.URL)
+				}
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("servers = %q, want %s", got, tt.want)
+			}
+			wantOutput := ""
+			if tt.warning != "" {
+				wantOutput = "Warning: " + serversFile + " lists servers more than once, ignoring the duplicates: " + tt.warning + "\n"
+			}
+			if output != wantOutput {
+				t.Errorf("output = %q, want %q", output, wantOutput)
+			}
+		})
+	}
+}
+
+func TestDuplicateServersWarnedOnce(t *testing.T) {
+	setup(t)
+	read := func(content string) string {
+		writeFile(t, serversFile, content)
+		return captureOutput(t, func() { parseServerAddresses(serversFile) })
+	}
+	if output := read("http://a.example\nhttp://a.example\n"); output == "" {
+		t.Error("duplicate not warned about")
+	}
+	if output := read("http://a.example\nhttp://a.example\n"); output != "" {
+		t.Errorf("same duplicates warned about again: %q", output)
+	}
+	if output := read("http://a.example\nhttp://a.example\nhttp://b.example\nhttp://b.example\n"); !strings.Contains(output, "http://a.example, http://b.example") {
+		t.Errorf("changed duplicates: output = %q", output)
+	}
+	read("http://a.example\n")
+	if output := read("http://a.example\nhttp://a.example\n"); output == "" {
+		t.Error("duplicate added back not warned about")
+	}
+}
+
+func TestDuplicateServersRotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		dedupe   bool
+		requests int
+		repeated int64
+		other    int64
+	}{
+		{"deduped", true, 4, 2, 2},
+		{"weighted", false, 6, 4, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.DedupeServers = tt.dedupe
+			var repeated, other atomic.Int64
+			a := countingBackend(t, `{}`, &repeated)
+			writeServers(t, a, countingBackend(t, `{}`, &other), a+"/")
+
+			for i := 0; i < tt.requests; i++ {
+				if resp := proxyGet(t, target(fmt.Sprintf("api.example.com/weight/%d", i))); resp.StatusCode() != fasthttp.StatusOK {
+					t.Fatalf("request %d: status = %d: %s", i, resp.StatusCode(), resp.Body())
+				}
+			}
+			if repeated.Load() != tt.repeated || other.Load() != tt.other {
+				t.Errorf("requests = %d to the repeated server and %d to the other, want %d and %d", repeated.Load(), other.Load(), tt.repeated, tt.other)
+			}
+		})
+	}
+}
+
+func TestServerEndpoint(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"", "/?url=api.example.com%2Fa%3Fb%3D1"},
+		{"/fetch?target={url}", "/fetch?target=api.example.com%2Fa%3Fb%3D1"},
+		{"/get/{url}", "/get/api.example.com%2Fa%3Fb%3D1"},
+		{"/both?a={url}&b={url}", "/both?a=api.example.com%2Fa%3Fb%3D1&b=api.example.com%2Fa%3Fb%3D1"},
+	}
+	for _, tt := range tests {
+		if got := (Server{Template: tt.template}).endpoint("api.example.com/a?b=1"); got != tt.want {
+			t.Errorf("template %q: endpoint = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestServerTemplates(t *testing.T) {
+	setup(t)
+	var mu sync.Mutex
+	received := map[string]string{}
+	backend := func() string {
+		return newBackend(t, func(ctx *fasthttp.RequestCtx) {
+			mu.Lock()
+			received[string(ctx.Host())] = string(ctx.RequestURI())
+			mu.Unlock()
+			ctx.SetContentType("application/json")
+			ctx.SetBodyString(`{}`)
+		})
+	}
+	query, path, plain := backend(), backend(), backend()
+	writeFile(t, serversFile, fmt.Sprintf(`[{"url":%q,"template":"/fetch?target={url}"},{"url":%q,"template":"/get/{url}"},{"url":%q}]`, query, path, plain))
+
+	// Round robin sends one request to each server.
+	for i := 0; i < 3; i++ {
+		if resp := proxyGet(t, target("api.example.com/items/1")); resp.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+		}
+		resetCache()
+	}
+	want := map[string]string{
+		query: "/fetch?target=api.example.com%2Fitems%2F1",
+		path:  "/get/api.example.com%2Fitems%2F1",
+		plain: "/?url=api.example.com%2Fitems%2F1",
+	}
+	for server, uri := range want {
+		if got := received[strings.TrimPrefix(server, "http://")]; got != uri {
+			t.Errorf("%s got %q, want %q", server, got, uri)
+		}
+	}
+}
+
+func TestServerTemplateWithoutPlaceholder(t *testing.T) {
+	setup(t)
+	var requests atomic.Int64
+	server := countingBackend(t, `{}`, &requests)
+	writeFile(t, serversFile, `[{"url":"`+server+`","template":"/fetch?target=url"}]`)
+
+	if _, err := parseServerAddresses(serversFile); err == nil || !strings.Contains(err.Error(), "has no {url} placeholder") {
+		t.Errorf("error = %v, want the missing placeholder", err)
+	}
+	if resp := proxyGet(t, target("api.example.com/items/1")); resp.StatusCode() == fasthttp.StatusOK || requests.Load() != 0 {
+		t.Errorf("status = %d with %d server requests, want the servers file rejected", resp.StatusCode(), requests.Load())
+	}
+}
+
+func TestExcludeServers(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude func(servers []string) string
+		tried   []bool
+		status  int
+	}{
+		{"no header", func([]string) string { return "" }, []bool{true, true, true}, fasthttp.StatusTooManyRequests},
+		{"one server", func(s []string) string { return s[1] }, []bool{true, false, true}, fasthttp.StatusTooManyRequests},
+		{"spaces and trailing slashes", func(s []string) string { return " " + s[0] + "/ , " + s[2] + " " }, []bool{false, true, false}, fasthttp.StatusTooManyRequests},
+		{"unknown entries ignored", func(s []string) string { return "http://unknown.test," + s[2] }, []bool{true, true, false}, fasthttp.StatusTooManyRequests},
+		{"every server", func(s []string) string { return strings.Join(s, ",") }, []bool{false, false, false}, fasthttp.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			counts := make([]atomic.Int64, 3)
+			var servers []string
+			for i := range counts {
+				count := &counts[i]
+				servers = append(servers, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+					count.Add(1)
+					ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+				}))
+			}
+			writeServers(t, servers...)
+
+			var headers []string
+			if header := tt.exclude(servers); header != "" {
+				headers = []string{excludeServersHeader, header}
+			}
+			resp := proxyGet(t, target("api.example.com/exclude"), headers...)
+			if resp.StatusCode() != tt.status {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			for i, tried := range tt.tried {
+				if got := counts[i].Load() > 0; got != tried {
+					t.Errorf("%s tried = %v, want %v", servers[i], got, tried)
+				}
+			}
+		})
+	}
+}
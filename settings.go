@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// settings are the values of -settings-file, which override the matching
+// flags and, unlike them, are picked up again by every reload.
+type settings struct {
+	// APIKey replaces -api-key. It may refer to ${ENV:NAME} secrets.
+	APIKey string `json:"api_key"`
+	// CacheTTL replaces -cache-ttl, e.g. "5m"; "0" turns caching off.
+	CacheTTL string `json:"cache_ttl"`
+
+	cacheTTL time.Duration
+}
+
+func loadSettings(filePath string) (settings, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return settings{}, err
+	}
+
+	var loaded settings
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return settings{}, err
+	}
+	if err := checkSecrets(loaded.APIKey); err != nil {
+		return settings{}, fmt.Errorf("api_key: %v", err)
+	}
+	loaded.APIKey = expandSecrets(loaded.APIKey)
+	if loaded.CacheTTL != "" {
+		if loaded.cacheTTL, err = time.ParseDuration(loaded.CacheTTL); err != nil || loaded.cacheTTL < 0 {
+			return settings{}, fmt.Errorf("invalid cache_ttl %q", loaded.CacheTTL)
+		}
+	}
+	return loaded, nil
+}
+
+// applySettings puts the settings of loaded into effect where they differ
+// from those of previous, nil at startup. A key replaced through
+// /admin/apikey therefore stays in place until the file's key is changed.
+// Cached entries keep the expiry they were stored with.
+func applySettings(previous *fileConfig, loaded *fileConfig) {
+	var before settings
+	if previous != nil {
+		before = previous.settings
+	}
+	after := loaded.settings
+
+	if after.APIKey != "" && after.APIKey != before.APIKey {
+		config.setAdminKey(after.APIKey)
+		fmt.Println("API key set from -settings-file")
+	}
+	if after.CacheTTL != "" && after.cacheTTL != before.cacheTTL {
+		setCacheLifetime(after.cacheTTL)
+		fmt.Printf("Cache TTL set to %s from -settings-file\n", after.cacheTTL)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/valyala/fasthttp"
+)
+
+// serveUntilSignal runs server on addr until SIGINT or SIGTERM, then drains
+// open connections for up to -shutdown-grace. A second signal while draining
+// exits immediately.
+func serveUntilSignal(server *fasthttp.Server, addr string) error {
+	// Signals are caught from before the socket is open, so one arriving
+	// while the proxy starts up shuts it down cleanly too.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	ln, err := listen(addr)
+	if err != nil {
+		return err
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if config.TLSCert != "" {
+			serveErr <- server.ServeTLS(ln, config.TLSCert, config.TLSKey)
+			return
+		}
+		serveErr <- server.Serve(ln)
+	}()
+
+	var sig os.Signal
+	select {
+	case err := <-serveErr:
+		return err
+	case sig = <-signals:
+	}
+
+	fmt.Printf("Received %s, draining connections for up to %s...\n", sig, config.ShutdownGrace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownGrace)
+	defer cancel()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- server.ShutdownWithContext(ctx)
+	}()
+
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			fmt.Printf("Grace period expired, closing remaining connections: %v\n", err)
+			return nil
+		}
+		fmt.Println("Shutdown complete.")
+		return nil
+	case sig = <-signals:
+		fmt.Printf("Received second %s, exiting immediately.\n", sig)
+		os.Exit(1)
+	}
+
+	return nil
+}
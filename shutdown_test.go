@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// TestServeUntilSignalProcess is the proxy process signalled by
+// TestServeUntilSignal. It only runs when started by that test.
+func TestServeUntilSignalProcess(t *testing.T) {
+	addr := os.Getenv("SHUTDOWN_TEST_ADDR")
+	if addr == "" {
+		t.Skip("only run by TestServeUntilSignal")
+	}
+	config.ShutdownGrace, _ = time.ParseDuration(os.Getenv("SHUTDOWN_TEST_GRACE"))
+	server := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(time.Minute)
+	}}
+	fmt.Println("Listening")
+	if err := serveUntilSignal(server, addr); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func TestServeUntilSignal(t *testing.T) {
+	tests := []struct {
+		name         string
+		grace        time.Duration
+		inFlight     bool
+		secondSignal bool
+		exitCode     int
+		output       string
+	}{
+		{"nothing to drain", time.Minute, false, false, 0, "Shutdown complete."},
+		{"grace period expires", 100 * time.Millisecond, true, false, 0, "Grace period expired"},
+		{"second signal", time.Minute, true, true, 1, "Received second terminated, exiting immediately."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socket := filepath.Join(t.TempDir(), "proxy.sock")
+			cmd := exec.Command(os.Args[0], "-test.run=^TestServeUntilSignalProcess$")
+			cmd.Env = append(os.Environ(), "SHUTDOWN_TEST_ADDR=unix:"+socket, "SHUTDOWN_TEST_GRACE="+tt.grace.String())
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { cmd.Process.Kill() })
+
+			lines := make(chan string, 100)
+			go func() {
+				scanner := bufio.NewScanner(stdout)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+				close(lines)
+			}()
+			waitFor(t, "the socket", func() bool {
+				conn, err := net.Dial("unix", socket)
+				if err == nil {
+					conn.Close()
+				}
+				return err == nil
+			})
+
+			if tt.inFlight {
+				conn, err := net.Dial("unix", socket)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: proxy\r\n\r\n")
+				// Give the server time to read the request before the signal.
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			cmd.Process.Signal(syscall.SIGTERM)
+			var output []string
+			for line := range lines {
+				output = append(output, line)
+				if strings.Contains(line, "draining connections") && tt.secondSignal {
+					cmd.Process.Signal(syscall.SIGTERM)
+				}
+			}
+
+			err = cmd.Wait()
+			code := 0
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				code = exitErr.ExitCode()
+			}
+			joined := strings.Join(output, "\n")
+			if code != tt.exitCode {
+				t.Errorf("exit code = %d, want %d\n%s", code, tt.exitCode, joined)
+			}
+			if !strings.Contains(joined, "Received terminated, draining connections for up to "+tt.grace.String()) || !strings.Contains(joined, tt.output) {
+				t.Errorf("output does not log the drain and %q:\n%s", tt.output, joined)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+var stats struct {
+	UpstreamInFlight atomic.Int64
+
+	CacheCompressedEntries  atomic.Int64
+	CacheCompressedRawBytes atomic.Int64
+	CacheCompressedBytes    atomic.Int64
+	CacheCollisions         atomic.Int64
+	CacheRefreshes          atomic.Int64
+	CacheRefreshesJoined    atomic.Int64
+	CacheHostEvictions      atomic.Int64
+	CacheMemoryHits         atomic.Int64
+	CachePeerHits           atomic.Int64
+}
+
+type cacheStats struct {
+	Entries           int   `json:"entries"`
+	Disabled          bool  `json:"disabled"`
+	CompressedEntries int64 `json:"compressed_entries"`
+	CompressedRaw     int64 `json:"compressed_raw_bytes"`
+	CompressedStored  int64 `json:"compressed_stored_bytes"`
+	Collisions        int64 `json:"cache_collisions"`
+	Refreshes         int64 `json:"background_refreshes"`
+	RefreshesJoined   int64 `json:"background_refreshes_joined"`
+	HostEvictions     int64 `json:"host_evictions"`
+
+	TierHits cacheTierStats `json:"tier_hits"`
+
+	HitRatio *hitRatioSnapshot    `json:"hit_ratio,omitempty"`
+	Remote   *remoteCacheSnapshot `json:"remote,omitempty"`
+}
+
+// cacheTierStats counts cache hits, stale ones included, by the tier that
+// served them.
+type cacheTierStats struct {
+	Memory int64 `json:"memory"`
+	Peer   int64 `json:"peer"`
+}
+
+type remoteCacheSnapshot struct {
+	Breaker       string `json:"breaker"`
+	Hits          int64  `json:"hits"`
+	Misses        int64  `json:"misses"`
+	Errors        int64  `json:"errors"`
+	ShortCircuits int64  `json:"short_circuits"`
+}
+
+type upstreamStats struct {
+	InFlight      int64                  `json:"in_flight"`
+	RetryBudget   *float64               `json:"retry_budget,omitempty"`
+	GlobalCircuit *globalCircuitSnapshot `json:"global_circuit,omitempty"`
+}
+
+type statsSnapshot struct {
+	Cache    cacheStats             `json:"cache"`
+	Upstream upstreamStats          `json:"upstream"`
+	Servers  map[string]serverStats `json:"servers"`
+	Targets  map[string]targetStats `json:"targets"`
+	Runtime  runtimeStats           `json:"runtime"`
+}
+
+func snapshotStats() statsSnapshot {
+	return collectStats(false)
+}
+
+// resetStats returns the counters and sets them back to zero. Each counter is
+// swapped rather than read and cleared, so an increment racing the reset is
+// in either the returned snapshot or the next one, never both or neither.
+// Gauges such as cache entries and in-flight requests are reported as they
+// are.
+func resetStats() statsSnapshot {
+	return collectStats(true)
+}
+
+func counterValue(counter *atomic.Int64, reset bool) int64 {
+	if reset {
+		return counter.Swap(0)
+	}
+	return counter.Load()
+}
+
+func collectStats(reset bool) statsSnapshot {
+	entries := cacheEntryCount()
+
+	var remote *remoteCacheSnapshot
+	if config.RemoteCache != "" {
+		remote = &remoteCacheSnapshot{
+			Breaker:       remoteCacheBreakerState(),
+			Hits:          counterValue(&remoteCacheStats.Hits, reset),
+			Misses:        counterValue(&remoteCacheStats.Misses, reset),
+			Errors:        counterValue(&remoteCacheStats.Errors, reset),
+			ShortCircuits: counterValue(&remoteCacheStats.ShortCircuits, reset),
+		}
+	}
+
+	return statsSnapshot{
+		Cache: cacheStats{
+			Entries:           entries,
+			Disabled:          cacheOff(),
+			CompressedEntries: counterValue(&stats.CacheCompressedEntries, reset),
+			CompressedRaw:     counterValue(&stats.CacheCompressedRawBytes, reset),
+			CompressedStored:  counterValue(&stats.CacheCompressedBytes, reset),
+			Collisions:        counterValue(&stats.CacheCollisions, reset),
+			Refreshes:         counterValue(&stats.CacheRefreshes, reset),
+			RefreshesJoined:   counterValue(&stats.CacheRefreshesJoined, reset),
+			HostEvictions:     counterValue(&stats.CacheHostEvictions, reset),
+			HitRatio:          hitRatioStats(),
+			Remote:            remote,
+			TierHits: cacheTierStats{
+				Memory: counterValue(&stats.CacheMemoryHits, reset),
+				Peer:   counterValue(&stats.CachePeerHits, reset),
+			},
+		},
+		Upstream: upstreamStats{
+			InFlight:      stats.UpstreamInFlight.Load(),
+			RetryBudget:   retryBudgetSnapshot(),
+			GlobalCircuit: globalCircuitStats(),
+		},
+		Servers: serverStatsSnapshot(),
+		Targets: targetStatsSnapshot(reset),
+		Runtime: runtimeStatsSnapshot(),
+	}
+}
+
+func retryBudgetSnapshot() *float64 {
+	if config.RetryBudget <= 0 {
+		return nil
+	}
+	tokens := retryBudgetTokens()
+	return &tokens
+}
+
+func handleStats(ctx *fasthttp.RequestCtx) {
+	sendJSONResponse(ctx, snapshotStats(), fasthttp.StatusOK)
+}
+
+// handleStatsReset serves POST /admin/stats/reset: the /stats snapshot at
+// the moment of the reset, with the counters starting over from zero.
+func handleStatsReset(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		sendJSONErrorResponse(ctx, "Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeAdmin(ctx) {
+		return
+	}
+	sendJSONResponse(ctx, resetStats(), fasthttp.StatusOK)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestStatsResetRoute(t *testing.T) {
+	tests := []struct {
+		name     string
+		adminKey string
+		method   string
+		key      string
+		status   int
+		reset    bool
+	}{
+		{"reset", "secret", fasthttp.MethodPost, "secret", fasthttp.StatusOK, true},
+		{"GET", "secret", fasthttp.MethodGet, "secret", fasthttp.StatusMethodNotAllowed, false},
+		{"wrong key", "secret", fasthttp.MethodPost, "guess", fasthttp.StatusUnauthorized, false},
+		{"admin disabled", "", fasthttp.MethodPost, "", fasthttp.StatusForbidden, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.setAdminKey(tt.adminKey)
+			stats.CacheCollisions.Add(3)
+			countTargetRateLimit("api.example.com")
+
+			resp := proxyDo(t, tt.method, "/admin/stats/reset", "", "X-API-Key", tt.key)
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if tt.reset {
+				var snapshot statsSnapshot
+				if err := json.Unmarshal(resp.Body(), &snapshot); err != nil {
+					t.Fatal(err)
+				}
+				if snapshot.Cache.Collisions != 3 || snapshot.Targets["api.example.com"].RateLimits != 1 {
+					t.Errorf("reset returned collisions %d and targets %v, want the counts before the reset", snapshot.Cache.Collisions, snapshot.Targets)
+				}
+			}
+			got := snapshotStats()
+			if reset := got.Cache.Collisions == 0 && len(got.Targets) == 0; reset != tt.reset {
+				t.Errorf("after the request: collisions %d, targets %v, want reset %v", got.Cache.Collisions, got.Targets, tt.reset)
+			}
+		})
+	}
+}
+
+func TestResetStatsConcurrently(t *testing.T) {
+	setup(t)
+	const (
+		writers    = 8
+		increments = 2000
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				stats.CacheCollisions.Add(1)
+				countTargetRateLimit("api.example.com")
+			}
+		}()
+	}
+
+	// Every increment lands in exactly one of the reset snapshots or the
+	// final one.
+	stop, done := make(chan struct{}), make(chan struct{})
+	var collisions, rateLimits, resets int64
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			snapshot := resetStats()
+			collisions += snapshot.Cache.Collisions
+			rateLimits += snapshot.Targets["api.example.com"].RateLimits
+			resets++
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-done
+
+	final := snapshotStats()
+	collisions += final.Cache.Collisions
+	rateLimits += final.Targets["api.example.com"].RateLimits
+	if collisions != writers*increments || rateLimits != writers*increments {
+		t.Errorf("counted %d collisions and %d rate limits over %d resets, want %d of each", collisions, rateLimits, resets, writers*increments)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type statsFileSnapshot struct {
+	WrittenAt time.Time `json:"written_at"`
+	statsSnapshot
+}
+
+// writeStatsFile writes the /stats snapshot to path, see -stats-file.
+func writeStatsFile(path string) error {
+	data, err := json.Marshal(statsFileSnapshot{WrittenAt: time.Now().UTC(), statsSnapshot: snapshotStats()})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// startStatsFile writes -stats-file every -stats-interval, for setups that
+// poll a file instead of scraping /stats. The returned stop ends the writes
+// and waits for one in progress.
+func startStatsFile() (stop func()) {
+	if config.StatsFile == "" {
+		return func() {}
+	}
+
+	path := config.StatsFile
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(config.StatsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := writeStatsFile(path); err != nil {
+				fmt.Printf("Writing stats file failed: %v\n", err)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		wg.Wait()
+	}
+}
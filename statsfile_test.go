@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readStatsFile returns the snapshot in path, or ok false while there is
+// none yet.
+func readStatsFile(t *testing.T, path string) (snapshot statsFileSnapshot, ok bool) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return snapshot, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatalf("stats file is not a snapshot: %v\n%s", err, data)
+	}
+	return snapshot, true
+}
+
+func TestStatsFile(t *testing.T) {
+	setup(t)
+	dir := t.TempDir()
+	config.StatsFile = filepath.Join(dir, "stats.json")
+	config.StatsInterval = 20 * time.Millisecond
+	server := jsonBackend(t, `{}`)
+	writeServers(t, server)
+	stop := startStatsFile()
+	t.Cleanup(stop)
+
+	steps := []struct {
+		target  string
+		entries int
+	}{
+		{"api.example.com/first", 1},
+		{"api.example.com/second", 2},
+	}
+	var last time.Time
+	for _, step := range steps {
+		proxyGet(t, target(step.target))
+		var snapshot statsFileSnapshot
+		waitFor(t, "the stats file to show the request", func() bool {
+			var ok bool
+			snapshot, ok = readStatsFile(t, config.StatsFile)
+			return ok && snapshot.Cache.Entries == step.entries
+		})
+		if !snapshot.WrittenAt.After(last) {
+			t.Errorf("written_at = %s, not after the previous %s", snapshot.WrittenAt, last)
+		}
+		last = snapshot.WrittenAt
+		if _, ok := snapshot.Servers[server]; !ok {
+			t.Errorf("servers = %v, want %s", snapshot.Servers, server)
+		}
+	}
+
+	stop()
+	written, _ := readStatsFile(t, config.StatsFile)
+	time.Sleep(3 * config.StatsInterval)
+	if after, _ := readStatsFile(t, config.StatsFile); !after.WrittenAt.Equal(written.WrittenAt) {
+		t.Errorf("stats file rewritten at %s after stop", after.WrittenAt)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory has %d files, want only the stats file without temporary ones", len(entries))
+	}
+}
+
+func TestStatsFileOff(t *testing.T) {
+	setup(t)
+	stop := startStatsFile()
+	stop()
+	if _, err := os.Stat("stats.json"); !os.IsNotExist(err) {
+		t.Errorf("stats file written without -stats-file: %v", err)
+	}
+}
+
+func TestWriteStatsFile(t *testing.T) {
+	setup(t)
+	path := filepath.Join(t.TempDir(), "stats.json")
+	writeFile(t, path, "old")
+	stats.CacheCollisions.Add(3)
+
+	if err := writeStatsFile(path); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, _ := readStatsFile(t, path)
+	if snapshot.Cache.Collisions != 3 || time.Since(snapshot.WrittenAt) > time.Minute {
+		t.Errorf("cache_collisions = %d, written_at = %s, want the current stats", snapshot.Cache.Collisions, snapshot.WrittenAt)
+	}
+	if err := writeStatsFile(filepath.Join(path, "not-a-directory", "stats.json")); err == nil {
+		t.Error("writing below a file succeeded")
+	}
+}
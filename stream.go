@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var streamingClient = &fasthttp.Client{StreamResponseBody: true, DisablePathNormalizing: true}
+
+// streamedBody hands an upstream body stream to the server and returns the
+// pooled request/response once fasthttp has finished copying it to the client.
+// The request counts as in flight to its server until then, see drain.go.
+type streamedBody struct {
+	req      *fasthttp.Request
+	resp     *fasthttp.Response
+	finished func()
+	done     bool
+}
+
+func (b *streamedBody) Read(p []byte) (int, error) {
+	n, err := b.resp.BodyStream().Read(p)
+	if err == io.EOF {
+		b.done = true
+	}
+	return n, err
+}
+
+// Close is also called when the client went away before the whole body was
+// written. That is not the server's fault, so it is only logged.
+func (b *streamedBody) Close() error {
+	if !b.done {
+		debugf("Client disconnected before the stream from %s finished\n", b.req.URI().Host())
+	}
+	err := b.resp.CloseBodyStream()
+	fasthttp.ReleaseRequest(b.req)
+	fasthttp.ReleaseResponse(b.resp)
+	b.finished()
+	return err
+}
+
+// streamFromServers serves a stream=1 request. The upstream body is written to
+// the client as it arrives instead of being buffered, so it is neither cached
+// nor passed through the response middlewares. Chunked upstream bodies are
+// dechunked by the client and re-chunked towards our client when no length is
+// known. Rotation only happens before any of the body has been sent. Like
+// any other request it starts where the last one left off, and each attempt
+// takes an attempt slot until its body has been passed on.
+func streamFromServers(ctx *fasthttp.RequestCtx, servers []Server, decodedURL string, outbound upstreamRequest) {
+	reqID := string(ctx.Response.Header.Peek(requestIDHeader))
+	// A stream is passed on as it arrives, so it may only be compressed
+	// when the client takes gzip itself.
+	outbound.AcceptGzip = outbound.AcceptGzip && ctx.Request.Header.HasAcceptEncoding("gzip")
+
+	var attempts []attemptRecord
+	var rotationDeadline time.Time
+	preferred := withinSLA(servers)
+	first := rotationStart(preferred)
+	for n := 0; n < len(servers); n++ {
+		i := rotationIndex(first, n, preferred)
+		server := servers[i]
+		attempted := len(attempts) > 0
+		if attempted && !retryBudgetAvailable() {
+			fmt.Printf("Retry budget exhausted, not retrying %s\n", decodedURL)
+			break
+		}
+		if attempted && !rotationDeadline.IsZero() && !time.Now().Before(rotationDeadline) {
+			fmt.Printf("Rotation budget of %s used up, not retrying %s\n", config.RotationBudget, decodedURL)
+			break
+		}
+		if !serverAvailable(server.URL) {
+			continue
+		}
+		if attempted {
+			spendRetryToken()
+		} else if config.RotationBudget > 0 {
+			rotationDeadline = time.Now().Add(config.RotationBudget)
+		}
+		if !acquireAttempt() {
+			releaseProbe(server.URL)
+			sendJSONErrorResponse(ctx, "Too many upstream requests in flight", fasthttp.StatusServiceUnavailable)
+			return
+		}
+
+		endpoint := server.endpoint(decodedURL)
+		attemptOutbound := outbound.forServer(server)
+		attemptOutbound.RequestID = attemptID(reqID, len(attempts)+1)
+
+		req := fasthttp.AcquireRequest()
+		resp := fasthttp.AcquireResponse()
+		req.SetRequestURI(server.URL + endpoint)
+		attemptOutbound.apply(req)
+
+		fmt.Printf("Streaming request %d: %s%s\n", i+1, server.URL, endpoint)
+		attemptStart := time.Now()
+		inFlight := trackInFlight(server.URL)
+		finished := func() {
+			inFlight()
+			releaseAttempt()
+		}
+		// failed gives up on this server before anything was sent to the
+		// client, so the rotation can go on.
+		failed := func(err error) {
+			fasthttp.ReleaseRequest(req)
+			fasthttp.ReleaseResponse(resp)
+			finished()
+			attempts = append(attempts, newAttemptRecord(attemptOutbound.RequestID, server.URL, attemptStart, err))
+			recordGlobalOutcome(err)
+			if isRateLimitError(err) {
+				recordRateLimit(server.URL)
+				recordTargetRateLimit(decodedURL)
+				return
+			}
+			fmt.Printf("Streaming error from %s: %v\n", server.URL, err)
+			recordFailure(server.URL)
+		}
+
+		var err error
+		if attemptOutbound.HTTP2 {
+			err = doHTTP2Stream(req, resp)
+		} else {
+			err = streamingClient.Do(req, resp)
+		}
+		if err != nil {
+			failed(&HTTPError{Code: fasthttp.StatusBadGateway, Body: err.Error()})
+			continue
+		}
+
+		statusCode := resp.StatusCode()
+		if statusCode == fasthttp.StatusTooManyRequests || statusCode == 420 {
+			resp.CloseBodyStream()
+			failed(fmt.Errorf("Ratelimit or CAPTCHA error: Unexpected status code: %d", statusCode))
+			continue
+		}
+
+		// HTTP/1.0 has no chunked encoding, and fasthttp chunks a body
+		// stream of unknown length, so such clients get the body buffered.
+		buffered := !ctx.Request.Header.IsHTTP11() && resp.Header.ContentLength() < 0
+		if buffered {
+			if err := bufferStream(resp); err != nil {
+				failed(&HTTPError{Code: fasthttp.StatusBadGateway, Body: err.Error()})
+				continue
+			}
+		}
+
+		// Any other response is passed on as it is; only a 200 counts as a
+		// success, as for buffered requests.
+		if statusCode == fasthttp.StatusOK {
+			recordGlobalOutcome(nil)
+			recordSuccess(server.URL)
+			creditRetryBudget()
+			serverIndex.Store(uint64(i+1) % uint64(preferred))
+		} else {
+			recordGlobalOutcome(&HTTPError{Code: statusCode})
+		}
+		ctx.SetUserValue("server", server.URL)
+
+		for _, header := range upstreamResponseHeaders(resp, server.URL) {
+			ctx.Response.Header.Add(header.Name, header.Value)
+		}
+		ctx.SetStatusCode(statusCode)
+		if contentType := resp.Header.ContentType(); len(contentType) > 0 {
+			ctx.SetContentTypeBytes(contentType)
+		}
+		if encoding := resp.Header.ContentEncoding(); len(encoding) > 0 {
+			ctx.Response.Header.SetContentEncodingBytes(encoding)
+		}
+		if buffered {
+			ctx.SetBody(resp.Body())
+			fasthttp.ReleaseRequest(req)
+			fasthttp.ReleaseResponse(resp)
+			finished()
+			return
+		}
+		ctx.SetBodyStream(&streamedBody{req: req, resp: resp, finished: finished}, resp.Header.ContentLength())
+		return
+	}
+
+	if len(attempts) == 0 {
+		sendJSONErrorCode(ctx, "No eligible servers: all servers are cooling down or unhealthy", "no_eligible_servers", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	logFailedRotation(decodedURL, attempts)
+	if allRateLimited(attempts) {
+		if retryAfter := shortestCooldown(servers); retryAfter > 0 {
+			setRetryAfter(ctx, retryAfter)
+		}
+		sendJSONErrorResponse(ctx, "No server could serve the stream", config.ExhaustionStatus)
+		return
+	}
+	sendJSONErrorResponse(ctx, "No server could serve the stream", fasthttp.StatusBadGateway)
+}
+
+// bufferStream reads the whole upstream body into resp, within
+// -max-response-size, for a client that cannot take a chunked response.
+func bufferStream(resp *fasthttp.Response) error {
+	if config.MaxResponseSize > 0 {
+		return readStreamedBody(resp)
+	}
+
+	buf := acquireBodyBuffer()
+	defer releaseBodyBuffer(buf)
+	if _, err := buf.ReadFrom(resp.BodyStream()); err != nil {
+		return err
+	}
+	resp.SetBody(buf.Bytes())
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func chunkedBackend(t testing.TB, parts int) (string, string) {
+	var want strings.Builder
+	for i := 0; i < parts; i++ {
+		fmt.Fprintf(&want, "part%d;", i)
+	}
+	url := newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("text/plain")
+		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+			for i := 0; i < parts; i++ {
+				fmt.Fprintf(w, "part%d;", i)
+				w.Flush()
+			}
+		})
+	})
+	return url, want.String()
+}
+
+func TestChunkedUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		chunked bool // whether the proxy passes the body on chunked
+	}{
+		{"buffered", "", false},
+		{"streamed", "&stream=1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			server, want := chunkedBackend(t, 50)
+			writeServers(t, server)
+
+			resp := proxyGet(t, target("api.example.com/chunked")+tt.query)
+			if resp.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+			}
+			if string(resp.Body()) != want {
+				t.Errorf("body = %q, want %q", resp.Body(), want)
+			}
+			if chunked := resp.Header.ContentLength() < 0; chunked != tt.chunked {
+				t.Errorf("chunked = %v (Content-Length %d), want %v", chunked, resp.Header.ContentLength(), tt.chunked)
+			}
+			waitFor(t, "the request to finish", func() bool { return serverStatsSnapshot()[server].InFlight == 0 })
+		})
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		logged bool // whether the proxy sees the client go away
+	}{
+		{"buffered", "", false},
+		{"streamed", "&stream=1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.Debug = true
+			release := make(chan struct{})
+			var requests atomic.Int64
+			server := newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				requests.Add(1)
+				ctx.SetContentType("text/plain")
+				ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+					w.WriteString("first;")
+					w.Flush()
+					<-release
+					for i := 0; i < 100; i++ {
+						fmt.Fprintf(w, "part%d;", i)
+						w.Flush()
+					}
+				})
+			})
+			writeServers(t, server)
+
+			output := captureOutput(t, func() {
+				conn, err := proxyListener.Dial()
+				if err != nil {
+					t.Fatal(err)
+				}
+				fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: proxy.test\r\n\r\n", target("api.example.com/disconnect")+tt.query)
+				if tt.logged {
+					// Hang up once the stream has started.
+					buf := make([]byte, 1)
+					if _, err := conn.Read(buf); err != nil {
+						t.Fatal(err)
+					}
+				}
+				conn.Close()
+				close(release)
+				waitFor(t, "the request to finish", func() bool {
+					return requests.Load() == 1 && serverStatsSnapshot()[server].InFlight == 0
+				})
+				if tt.logged {
+					// The stream is closed after the handler has returned.
+					time.Sleep(50 * time.Millisecond)
+				}
+			})
+			logged := "[DEBUG] Client disconnected before the stream from " + strings.TrimPrefix(server, "http://") + " finished"
+			if tt.logged && !strings.Contains(output, logged) {
+				t.Errorf("output %q does not log the disconnect", output)
+			}
+
+			health.Lock()
+			failures := 0
+			if h := health.servers[server]; h != nil {
+				failures = h.ConsecutiveFailures
+			}
+			health.Unlock()
+			if failures != 0 {
+				t.Errorf("server has %d failures after the client went away", failures)
+			}
+			if resp := proxyGet(t, target("api.example.com/disconnect")+tt.query); resp.StatusCode() != fasthttp.StatusOK {
+				t.Errorf("next request: status = %d: %s", resp.StatusCode(), resp.Body())
+			}
+		})
+	}
+}
+
+func TestDebugf(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		t.Run(fmt.Sprint(debug), func(t *testing.T) {
+			setup(t)
+			config.Debug = debug
+			output := captureOutput(t, func() { debugf("write failed: %v\n", "broken pipe") })
+			want := ""
+			if debug {
+				want = "[DEBUG] write failed: broken pipe\n"
+			}
+			if output != want {
+				t.Errorf("output = %q, want %q", output, want)
+			}
+		})
+	}
+}
+
+func TestHTTP10Client(t *testing.T) {
+	tests := []struct {
+		name      string
+		proto     string
+		keepAlive bool
+		query     string
+		chunked   bool // whether the response is sent chunked
+		closed    bool // whether the proxy closes the connection after it
+	}{
+		{"HTTP/1.0 streamed", "HTTP/1.0", false, "&stream=1", false, true},
+		{"HTTP/1.0 streamed with keep-alive", "HTTP/1.0", true, "&stream=1", false, false},
+		{"HTTP/1.0 buffered", "HTTP/1.0", false, "", false, true},
+		{"HTTP/1.1 streamed", "HTTP/1.1", false, "&stream=1", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			server, want := chunkedBackend(t, 50)
+			writeServers(t, server)
+
+			conn, err := proxyListener.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			request := fmt.Sprintf("GET %s %s\r\nHost: proxy.test\r\n", target("api.example.com/legacy")+tt.query, tt.proto)
+			if tt.keepAlive {
+				request += "Connection: keep-alive\r\n"
+			}
+			fmt.Fprint(conn, request+"\r\n")
+
+			r := bufio.NewReader(conn)
+			var resp fasthttp.Response
+			if err := resp.Read(r); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode() != fasthttp.StatusOK || string(resp.Body()) != want {
+				t.Fatalf("status = %d, body = %q, want %q", resp.StatusCode(), resp.Body(), want)
+			}
+			if chunked := resp.Header.ContentLength() < 0; chunked != tt.chunked {
+				t.Errorf("chunked = %v (Content-Length %d), want %v", chunked, resp.Header.ContentLength(), tt.chunked)
+			}
+			if closed := resp.ConnectionClose(); closed != tt.closed {
+				t.Errorf("Connection: close = %v, want %v", closed, tt.closed)
+			}
+			if tt.closed {
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := r.ReadByte(); err == nil {
+					t.Errorf("connection still open after the response")
+				}
+			}
+		})
+	}
+}
+
+func TestHTTP10ClientResponseTooLarge(t *testing.T) {
+	setup(t)
+	config.MaxResponseSize = 100
+	server, _ := chunkedBackend(t, 50)
+	writeServers(t, server)
+
+	conn, err := proxyListener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s HTTP/1.0\r\nHost: proxy.test\r\n\r\n", target("api.example.com/legacy")+"&stream=1")
+	var resp fasthttp.Response
+	if err := resp.Read(bufio.NewReader(conn)); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != fasthttp.StatusBadGateway {
+		t.Errorf("status = %d: %s, want 502 for a body over -max-response-size", resp.StatusCode(), resp.Body())
+	}
+}
+
+func TestStreamRotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int // status each server answers with
+		retryBudget int
+		status      int
+		server      int // index of the server that answered, -1 for none
+		rateLimits  int64
+		outcomes    int // attempts counted by the global circuit
+	}{
+		{"first server", []int{200, 200}, 0, fasthttp.StatusOK, 0, 0, 1},
+		{"rate limited", []int{429, 200}, 0, fasthttp.StatusOK, 1, 1, 1},
+		{"error status passed on", []int{500, 200}, 0, fasthttp.StatusInternalServerError, 0, 0, 1},
+		{"all rate limited", []int{429, 420}, 0, fasthttp.StatusTooManyRequests, -1, 2, 0},
+		{"retry budget", []int{429, 429, 200}, 1, fasthttp.StatusTooManyRequests, -1, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.GlobalBreakerThreshold = 0.99
+			config.RetryBudget = tt.retryBudget
+			initRetryBudget()
+			var urls []string
+			for _, status := range tt.statuses {
+				status := status
+				urls = append(urls, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+					ctx.SetStatusCode(status)
+					ctx.SetContentType("application/json")
+					fmt.Fprintf(ctx, `{"server":"http://%s"}`, ctx.Host())
+				}))
+			}
+			writeServers(t, urls...)
+
+			resp := proxyGet(t, target("api.example.com/stream")+"&stream=1")
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d: %s, want %d", resp.StatusCode(), resp.Body(), tt.status)
+			}
+			if tt.server >= 0 {
+				if got := servedBy(t, resp); got != urls[tt.server] {
+					t.Errorf("served by %s, want server %d", got, tt.server)
+				}
+			}
+			if got := targetStatsSnapshot(false)["api.example.com"].RateLimits; got != tt.rateLimits {
+				t.Errorf("target rate limits = %d, want %d", got, tt.rateLimits)
+			}
+			globalCircuit.Lock()
+			outcomes := globalCircuit.attempts
+			globalCircuit.Unlock()
+			if outcomes != tt.outcomes {
+				t.Errorf("global circuit attempts = %d, want %d", outcomes, tt.outcomes)
+			}
+			if tt.retryBudget > 0 && retryBudgetTokens() != 0 {
+				t.Errorf("retry tokens = %v, want the budget spent", retryBudgetTokens())
+			}
+			waitFor(t, "the attempt slots to be given back", func() bool { return stats.UpstreamInFlight.Load() == 0 })
+		})
+	}
+}
+
+func TestStreamRotationStart(t *testing.T) {
+	setup(t)
+	servers := []string{namedBackend(t), namedBackend(t)}
+	writeServers(t, servers...)
+
+	for i, want := range []string{servers[0], servers[1], servers[0]} {
+		resp := proxyGet(t, target("api.example.com/stream")+"&stream=1")
+		if got := servedBy(t, resp); got != want {
+			t.Errorf("stream %d served by %s, want %s", i, got, want)
+		}
+	}
+	if got := servedBy(t, proxyGet(t, target("api.example.com/buffered"))); got != servers[1] {
+		t.Errorf("buffered request after the streams served by %s, want %s", got, servers[1])
+	}
+}
+
+func TestStreamMaxInflightAttempts(t *testing.T) {
+	setup(t)
+	config.MaxInflightAttempts = 1
+	config.InflightWait = 20 * time.Millisecond
+	attemptSlots = make(chan struct{}, config.MaxInflightAttempts)
+	release := make(chan struct{})
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("text/plain")
+		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+			w.WriteString("first;")
+			w.Flush()
+			<-release
+			w.WriteString("last;")
+		})
+	}))
+
+	streamed := make(chan int)
+	go func() {
+		streamed <- proxyGet(t, target("api.example.com/slow")+"&stream=1").StatusCode()
+	}()
+	// The stream keeps its slot while the body is still being passed on.
+	waitFor(t, "the stream to start", func() bool { return stats.UpstreamInFlight.Load() == 1 })
+	resp := proxyGet(t, target("api.example.com/blocked")+"&stream=1")
+	if resp.StatusCode() != fasthttp.StatusServiceUnavailable || !strings.Contains(string(resp.Body()), "Too many upstream requests in flight") {
+		t.Errorf("stream while saturated: %d %s, want 503", resp.StatusCode(), resp.Body())
+	}
+
+	close(release)
+	if status := <-streamed; status != fasthttp.StatusOK {
+		t.Errorf("slow stream status = %d, want 200", status)
+	}
+	waitFor(t, "the slot to be given back", func() bool { return stats.UpstreamInFlight.Load() == 0 })
+	if resp := proxyGet(t, target("api.example.com/after")+"&stream=1"); resp.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("stream once the slot is free: %d %s, want 200", resp.StatusCode(), resp.Body())
+	}
+}
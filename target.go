@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// targetHost returns the host name of a decoded target URL. Targets without a
+// scheme are resolved by the Lambda against its own base URL, so their host is
+// not known here and "" is returned.
+func targetHost(target string) string {
+	if !strings.Contains(target, "://") {
+		return ""
+	}
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return parsed.Hostname()
+}
+
+// withScheme returns target with http:// in front when it has no scheme of
+// its own, such as example.com:22/ or //example.com:6379, since that is how a
+// server may well resolve it. A "://" after the first /, ? or # is part of
+// the path or query, not a scheme.
+func withScheme(target string) string {
+	if i := strings.Index(target, "://"); i > 0 && !strings.ContainsAny(target[:i], "/?#") {
+		return target
+	}
+	return "http://" + strings.TrimPrefix(target, "//")
+}
+
+// targetHostKey is the host of target in lower case, a target without a
+// scheme taken as http, which is what per-host state such as rate limit
+// counts and cache limits is kept under. It is "" for a target without a
+// host, such as a plain path.
+func targetHostKey(target string) string {
+	return strings.ToLower(targetHost(withScheme(target)))
+}
+
+var errMalformedEncoding = errors.New("Target URL contains malformed percent-encoding, such as a % not followed by two hex digits; encode a literal % as %25")
+
+// unescapeTarget is url.QueryUnescape, failing with errMalformedEncoding on
+// a bad escape. With -lenient-encoding a "%" that does not start an escape
+// is taken literally instead.
+func unescapeTarget(s string) (string, error) {
+	unescaped, err := url.QueryUnescape(s)
+	if err == nil {
+		return unescaped, nil
+	}
+	if !config.LenientEncoding {
+		return "", errMalformedEncoding
+	}
+	return url.QueryUnescape(escapeStrayPercents(s))
+}
+
+// escapeStrayPercents escapes every "%" in s that is not followed by two hex
+// digits as "%25".
+func escapeStrayPercents(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && (i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2])) {
+			b.WriteString("%25")
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// withRootPath gives a target without a path, such as https://example.com or
+// https://example.com?q=1, the root path "/" with -root-path. Backends that
+// 404 on an empty path then get the same request a browser would send, and
+// both spellings share a cache entry.
+func withRootPath(target string) string {
+	if !config.RootPath {
+		return target
+	}
+
+	authority := 0
+	if i := strings.Index(target, "://"); i >= 0 {
+		authority = i + len("://")
+	}
+	end := strings.IndexAny(target[authority:], "/?#")
+	if end < 0 {
+		return target + "/"
+	}
+	if end += authority; target[end] != '/' {
+		return target[:end] + "/" + target[end:]
+	}
+	return target
+}
+
+// stripTrackingParams removes the query parameters matching -strip-params
+// (glob patterns such as "utm_*") from a decoded target URL, so links that
+// only differ in tracking parameters are fetched and cached once. The other
+// parameters keep their order and encoding.
+func stripTrackingParams(target string) string {
+	if config.StripParams == "" {
+		return target
+	}
+
+	rest, fragment, hasFragment := strings.Cut(target, "#")
+	base, query, hasQuery := strings.Cut(rest, "?")
+	if !hasQuery {
+		return target
+	}
+
+	var kept []string
+	for _, param := range strings.Split(query, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if param != "" && !matchesStripParam(name) {
+			kept = append(kept, param)
+		}
+	}
+
+	canonical := base
+	if len(kept) > 0 {
+		canonical += "?" + strings.Join(kept, "&")
+	}
+	if hasFragment {
+		canonical += "#" + fragment
+	}
+	return canonical
+}
+
+func matchesStripParam(name string) bool {
+	for _, pattern := range strings.Split(config.StripParams, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+var errTargetUnresolvable = errors.New("target host could not be resolved")
+
+var dnsCache = struct {
+	sync.Mutex
+	entries map[string]dnsCacheEntry
+}{entries: make(map[string]dnsCacheEntry)}
+
+type dnsCacheEntry struct {
+	err       error
+	expiresAt time.Time
+}
+
+// checkTargetResolves looks up host and remembers the outcome for
+// -negative-dns-ttl, so repeated requests for a host that does not resolve
+// fail immediately instead of waiting on DNS again.
+func checkTargetResolves(host string) error {
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+
+	dnsCache.Lock()
+	entry, ok := dnsCache.entries[host]
+	dnsCache.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := net.DefaultResolver.LookupHost(ctx, host)
+	var dnsErr *net.DNSError
+	if err != nil && !errors.As(err, &dnsErr) {
+		return nil
+	}
+	if err != nil {
+		err = errTargetUnresolvable
+	}
+
+	dnsCache.Lock()
+	dnsCache.entries[host] = dnsCacheEntry{err: err, expiresAt: time.Now().Add(config.NegativeDNSTTL)}
+	dnsCache.Unlock()
+
+	return err
+}
+
+var errPortNotAllowed = errors.New("Target port is not allowed")
+
+// allowedPorts is -allowed-ports; nil allows every port.
+var allowedPorts map[int]bool
+
+func parseAllowedPorts(spec string) (map[int]bool, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	ports := make(map[int]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(entry))
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%q is not a port", entry)
+		}
+		ports[port] = true
+	}
+	return ports, nil
+}
+
+// checkTargetPort rejects targets whose port is not in -allowed-ports, so
+// the proxy cannot be used to probe arbitrary ports. Without a port, http
+// means 80 and https 443. Other schemes are rejected, and a target without a
+// scheme, such as example.com:22/ or //example.com:6379, is checked as http
+// since that is how a server may well resolve it.
+func checkTargetPort(target string) error {
+	if allowedPorts == nil {
+		return nil
+	}
+	parsed, err := url.Parse(withScheme(target))
+	if err != nil {
+		return errPortNotAllowed
+	}
+	scheme := strings.ToLower(parsed.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return errPortNotAllowed
+	}
+
+	port, err := strconv.Atoi(parsed.Port())
+	if parsed.Port() == "" {
+		port, err = 80, nil
+		if scheme == "https" {
+			port = 443
+		}
+	}
+	if err != nil || !allowedPorts[port] {
+		return errPortNotAllowed
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestNegativeDNSCache(t *testing.T) {
+	setup(t)
+	config.NegativeDNSTTL = time.Minute
+	var requests atomic.Int64
+	writeServers(t, countingBackend(t, `{}`, &requests))
+
+	resp := proxyGet(t, target("http://unresolvable.invalid/x"))
+	if resp.StatusCode() != fasthttp.StatusBadGateway {
+		t.Fatalf("status = %d, want 502: %s", resp.StatusCode(), resp.Body())
+	}
+	dnsCache.Lock()
+	entry, ok := dnsCache.entries["unresolvable.invalid"]
+	dnsCache.Unlock()
+	if !ok || entry.err == nil || time.Until(entry.expiresAt) <= 0 || time.Until(entry.expiresAt) > config.NegativeDNSTTL {
+		t.Fatalf("negative cache entry = %+v, %v", entry, ok)
+	}
+
+	start := time.Now()
+	resp = proxyGet(t, target("http://unresolvable.invalid/y"))
+	if resp.StatusCode() != fasthttp.StatusBadGateway {
+		t.Errorf("second status = %d, want 502", resp.StatusCode())
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("second request took %s", elapsed)
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("upstream requests = %d, want none for an unresolvable host", got)
+	}
+}
+
+func TestNegativeDNSCacheEntries(t *testing.T) {
+	// localhost always resolves, so a failure can only come from the cache.
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		status    int
+	}{
+		{"cached failure", time.Minute, fasthttp.StatusBadGateway},
+		{"expired failure", -time.Second, fasthttp.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.NegativeDNSTTL = time.Minute
+			writeServers(t, jsonBackend(t, `{}`))
+			dnsCache.Lock()
+			dnsCache.entries["localhost"] = dnsCacheEntry{err: errTargetUnresolvable, expiresAt: time.Now().Add(tt.expiresIn)}
+			dnsCache.Unlock()
+
+			if resp := proxyGet(t, target("http://localhost/x")); resp.StatusCode() != tt.status {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+		})
+	}
+}
+
+func TestStripTrackingParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns string
+		target   string
+		want     string
+	}{
+		{"disabled", "", "https://a.example/p?utm_source=x&id=1", "https://a.example/p?utm_source=x&id=1"},
+		{"glob", "utm_*", "https://a.example/p?utm_source=x&id=1&utm_medium=y", "https://a.example/p?id=1"},
+		{"several patterns", "utm_*, fbclid", "https://a.example/p?fbclid=abc&q=a%20b&utm_campaign=z", "https://a.example/p?q=a%20b"},
+		{"whole query stripped", "utm_*", "https://a.example/p?utm_source=x", "https://a.example/p"},
+		{"fragment kept", "gclid", "https://a.example/p?gclid=1&x=2#top", "https://a.example/p?x=2#top"},
+		{"encoded name", "utm_*", "https://a.example/p?utm%5Fsource=x&x=2", "https://a.example/p?x=2"},
+		{"no query", "utm_*", "https://a.example/p", "https://a.example/p"},
+		{"prefix only matches with a glob", "utm", "https://a.example/p?utm_source=x", "https://a.example/p?utm_source=x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.StripParams = tt.patterns
+			if got := stripTrackingParams(tt.target); got != tt.want {
+				t.Errorf("stripTrackingParams(%q) = %q, want %q", tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripParamsCanonicalFetch(t *testing.T) {
+	setup(t)
+	config.StripParams = "utm_*,fbclid"
+	var requests atomic.Int64
+	var fetched string
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		requests.Add(1)
+		fetched = string(ctx.QueryArgs().Peek("url"))
+		ctx.SetBodyString(`{}`)
+	}))
+
+	for _, uri := range []string{"api.example.com/item?id=7&utm_source=mail", "api.example.com/item?fbclid=abc&id=7&utm_medium=social"} {
+		if status := proxyGet(t, target(uri)).StatusCode(); status != fasthttp.StatusOK {
+			t.Fatalf("%s: status = %d", uri, status)
+		}
+	}
+	if fetched != "api.example.com/item?id=7" {
+		t.Errorf("server fetched %q, want the canonical URL", fetched)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("server got %d requests, want 1 with the second served from cache", requests.Load())
+	}
+	if _, ok := cacheGet(cacheKey("api.example.com/item?id=7")); !ok {
+		t.Error("response not cached under the canonical URL")
+	}
+}
+
+func TestWithRootPath(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"https://example.com", "https://example.com/"},
+		{"https://example.com?q=1", "https://example.com/?q=1"},
+		{"https://example.com#top", "https://example.com/#top"},
+		{"https://example.com:8443", "https://example.com:8443/"},
+		{"example.com", "example.com/"},
+		{"example.com?q=1", "example.com/?q=1"},
+		{"https://example.com/", "https://example.com/"},
+		{"https://example.com/a?q=1", "https://example.com/a?q=1"},
+	}
+	setup(t)
+	for _, tt := range tests {
+		config.RootPath = false
+		if got := withRootPath(tt.target); got != tt.target {
+			t.Errorf("without -root-path: withRootPath(%q) = %q", tt.target, got)
+		}
+		config.RootPath = true
+		if got := withRootPath(tt.target); got != tt.want {
+			t.Errorf("withRootPath(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestRootPathFetch(t *testing.T) {
+	tests := []struct {
+		rootPath bool
+		fetched  []string // targets the server is asked for
+	}{
+		{false, []string{"https://example.com?q=1", "https://example.com/?q=1"}},
+		{true, []string{"https://example.com/?q=1"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.rootPath), func(t *testing.T) {
+			setup(t)
+			config.RootPath = tt.rootPath
+			var mu sync.Mutex
+			var fetched []string
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				mu.Lock()
+				fetched = append(fetched, string(ctx.QueryArgs().Peek("url")))
+				mu.Unlock()
+				ctx.SetContentType("application/json")
+				ctx.SetBodyString(`{}`)
+			}))
+
+			for _, spelling := range []string{"https://example.com?q=1", "https://example.com/?q=1"} {
+				if resp := proxyGet(t, target(url.QueryEscape(spelling))); resp.StatusCode() != fasthttp.StatusOK {
+					t.Fatalf("%s: status = %d: %s", spelling, resp.StatusCode(), resp.Body())
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if fmt.Sprint(fetched) != fmt.Sprint(tt.fetched) {
+				t.Errorf("fetched %q, want %q", fetched, tt.fetched)
+			}
+		})
+	}
+}
+
+func TestEscapeStrayPercents(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"https://a.example/p?q=100%", "https://a.example/p?q=100%25"},
+		{"https://a.example/%GG", "https://a.example/%25GG"},
+		{"https://a.example/%4", "https://a.example/%254"},
+		{"https://a.example/%41%2f", "https://a.example/%41%2f"},
+		{"%%41", "%25%41"},
+		{"no escapes", "no escapes"},
+	}
+	for _, tt := range tests {
+		if got := escapeStrayPercents(tt.in); got != tt.want {
+			t.Errorf("escapeStrayPercents(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMalformedEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		lenient bool
+		uri     string
+		status  int
+		fetched string // target the server is asked for
+	}{
+		{"bad escape rejected", false, "/?url=https://api.example.com/a%GG", fasthttp.StatusBadRequest, ""},
+		{"trailing percent rejected", false, "/?url=https://api.example.com/a?q=100%", fasthttp.StatusBadRequest, ""},
+		{"escaped bad escape rejected", false, "/?url=https%3A%2F%2Fapi.example.com%2Fa%25GG", fasthttp.StatusBadRequest, ""},
+		{"valid escapes", false, "/?url=https://api.example.com/a%2520b", fasthttp.StatusOK, "https://api.example.com/a b"},
+		{"bad escape repaired", true, "/?url=https://api.example.com/a%GG", fasthttp.StatusOK, "https://api.example.com/a%25GG"},
+		{"trailing percent repaired", true, "/?url=https://api.example.com/a?q=100%", fasthttp.StatusOK, "https://api.example.com/a?q=100%25"},
+		{"valid escapes kept", true, "/?url=https://api.example.com/a%2520b%GG", fasthttp.StatusOK, "https://api.example.com/a b%25GG"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.LenientEncoding = tt.lenient
+			var fetched atomic.Value
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				fetched.Store(string(ctx.QueryArgs().Peek("url")))
+				ctx.SetContentType("application/json")
+				ctx.SetBodyString(`{}`)
+			}))
+
+			resp := proxyGet(t, tt.uri)
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if tt.status == fasthttp.StatusBadRequest {
+				if !strings.Contains(string(resp.Body()), `"error":"malformed_encoding"`) {
+					t.Errorf("body = %s, want malformed_encoding", resp.Body())
+				}
+				if fetched.Load() != nil {
+					t.Errorf("fetched %v for a rejected target", fetched.Load())
+				}
+				return
+			}
+			if got, _ := fetched.Load().(string); got != tt.fetched {
+				t.Errorf("fetched %q, want %q", got, tt.fetched)
+			}
+		})
+	}
+}
+
+func TestParseAllowedPorts(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    map[int]bool
+		wantErr bool
+	}{
+		{"", nil, false},
+		{" ", nil, false},
+		{"80,443", map[int]bool{80: true, 443: true}, false},
+		{" 8080 , 443", map[int]bool{8080: true, 443: true}, false},
+		{"80,http", nil, true},
+		{"0", nil, true},
+		{"65536", nil, true},
+		{"80,", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAllowedPorts(tt.spec)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAllowedPorts(%q) = %v, %v, want %v (error %v)", tt.spec, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestTargetHostKey(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"https://api.example.com/a", "api.example.com"},
+		{"https://API.Example.com:8443/a?b=1", "api.example.com"},
+		{"api.example.com/a", "api.example.com"},
+		{"API.example.com:8080/a", "api.example.com"},
+		{"//api.example.com/a", "api.example.com"},
+		{"api.example.com/r?next=https://other.example/", "api.example.com"},
+		{"/items/1", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := targetHostKey(tt.target); got != tt.want {
+			t.Errorf("targetHostKey(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTargetPort(t *testing.T) {
+	tests := []struct {
+		allowed string
+		target  string
+		ok      bool
+	}{
+		{"80,443", "https://api.example.com/a", true},
+		{"80,443", "http://api.example.com/a", true},
+		{"80,443", "HTTPS://api.example.com/a", true},
+		{"80,443", "https://api.example.com:443/a", true},
+		{"80,443", "http://api.example.com:443/a", true},
+		{"80,443", "https://api.example.com:8443/a", false},
+		{"80,443", "http://api.example.com:22/a", false},
+		{"80,443", "ftp://api.example.com/a", false},
+		{"80,443", "ftp://api.example.com:80/a", false},
+		{"80,443", "https://[::1]:6379/a", false},
+		{"80,443", "api.example.com/a", true},
+		{"80,443", "/items/1", true},
+		{"80,443", "api.example.com:22/a", false},
+		{"80,443", "//api.example.com:6379", false},
+		{"80,443", "api.example.com:443/a", true},
+		{"80,443", "api.example.com/r?next=https://other.example:22/", true},
+		{"443", "http://api.example.com/a", false},
+		{"8443", "https://api.example.com:8443/a", true},
+		{"", "https://api.example.com:6379/a", true},
+	}
+	for _, tt := range tests {
+		allowedPorts, _ = parseAllowedPorts(tt.allowed)
+		if err := checkTargetPort(tt.target); (err == nil) != tt.ok {
+			t.Errorf("checkTargetPort(%q) with -allowed-ports %q = %v, want allowed %v", tt.target, tt.allowed, err, tt.ok)
+		}
+	}
+	allowedPorts = nil
+}
+
+func TestAllowedPortsRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		transparent bool
+		uri         string
+		allowed     bool
+	}{
+		{"default port", false, target("https://api.example.com/items"), true},
+		{"explicit standard port", false, target("http://api.example.com:80/items"), true},
+		{"other port", false, target("https://api.example.com:8443/items"), false},
+		{"other port escaped", false, target(url.QueryEscape("https://api.example.com:6379/items")), false},
+		{"other port without a scheme", false, target("api.example.com:22/items"), false},
+		{"merge with another port", false, "/merge?url=https://api.example.com:8443/items", false},
+		{"transparent without a url", true, "/v1/items", true},
+		{"transparent url parameter", true, "/v1/items?url=https://api.example.com/items", true},
+		{"transparent url parameter with another port", true, "/v1/items?url=http://10.0.0.1:6379/", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.Merge = true
+			config.Transparent = tt.transparent
+			var requests atomic.Int64
+			writeServers(t, countingBackend(t, `[]`, &requests))
+
+			resp := proxyGet(t, tt.uri)
+			if !tt.allowed {
+				if resp.StatusCode() != fasthttp.StatusForbidden || !strings.Contains(string(resp.Body()), `"port_not_allowed"`) {
+					t.Errorf("status = %d: %s, want 403 port_not_allowed", resp.StatusCode(), resp.Body())
+				}
+				if requests.Load() != 0 {
+					t.Errorf("server requests = %d for a refused port", requests.Load())
+				}
+				return
+			}
+			if resp.StatusCode() != fasthttp.StatusOK || requests.Load() != 1 {
+				t.Errorf("status = %d with %d server requests: %s", resp.StatusCode(), requests.Load(), resp.Body())
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxTrackedTargets bounds how many target hosts get their own rate limit
+// counter; the rest are counted together under otherTargets, so a crawl over
+// many hosts cannot grow /stats and /metrics without end.
+const (
+	maxTrackedTargets = 1000
+	otherTargets      = "other"
+)
+
+// targetRateLimits counts, by target host, the rate limit and CAPTCHA
+// responses servers got fetching it.
+var targetRateLimits = struct {
+	sync.Mutex
+	counts map[string]int64
+}{counts: make(map[string]int64)}
+
+type targetStats struct {
+	RateLimits int64 `json:"rate_limits"`
+}
+
+func countTargetRateLimit(host string) {
+	targetRateLimits.Lock()
+	defer targetRateLimits.Unlock()
+	if _, ok := targetRateLimits.counts[host]; !ok && len(targetRateLimits.counts) >= maxTrackedTargets {
+		host = otherTargets
+	}
+	targetRateLimits.counts[host]++
+}
+
+// targetStatsSnapshot returns the counts by host, and with reset starts
+// them over.
+func targetStatsSnapshot(reset bool) map[string]targetStats {
+	targetRateLimits.Lock()
+	defer targetRateLimits.Unlock()
+	snapshot := make(map[string]targetStats, len(targetRateLimits.counts))
+	for host, count := range targetRateLimits.counts {
+		snapshot[host] = targetStats{RateLimits: count}
+	}
+	if reset {
+		targetRateLimits.counts = make(map[string]int64)
+	}
+	return snapshot
+}
+
+// targetRateLimitCollector adds the per-host rate limit counters to
+// /metrics.
+type targetRateLimitCollector struct {
+	desc *prometheus.Desc
+}
+
+func newTargetRateLimitCollector() targetRateLimitCollector {
+	return targetRateLimitCollector{desc: prometheus.NewDesc("proxy_target_rate_limits_total", "Rate limit and CAPTCHA responses servers got, by target host.", []string{"host"}, nil)}
+}
+
+func (c targetRateLimitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c targetRateLimitCollector) Collect(ch chan<- prometheus.Metric) {
+	for host, stats := range targetStatsSnapshot(false) {
+		metric, err := prometheus.NewConstMetric(c.desc, prometheus.CounterValue, float64(stats.RateLimits), host)
+		if err != nil {
+			metric = prometheus.NewInvalidMetric(c.desc, err)
+		}
+		ch <- metric
+	}
+}
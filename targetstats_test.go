@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestCountTargetRateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		tracked int // hosts already counted
+		host    string
+		counted string
+	}{
+		{"new host", 0, "a.example", "a.example"},
+		{"below the cap", maxTrackedTargets - 1, "a.example", "a.example"},
+		{"at the cap", maxTrackedTargets, "a.example", otherTargets},
+		{"tracked host at the cap", maxTrackedTargets, "host0.example", "host0.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			for i := 0; i < tt.tracked; i++ {
+				countTargetRateLimit(fmt.Sprintf("host%d.example", i))
+			}
+			countTargetRateLimit(tt.host)
+
+			snapshot := targetStatsSnapshot(false)
+			want := int64(1)
+			if tt.counted == "host0.example" {
+				want = 2
+			}
+			if got := snapshot[tt.counted].RateLimits; got != want {
+				t.Errorf("%s counted %d times, want %d", tt.counted, got, want)
+			}
+			if tt.counted != tt.host {
+				if _, ok := snapshot[tt.host]; ok {
+					t.Errorf("%s got its own counter past the cap", tt.host)
+				}
+			}
+			if len(snapshot) > maxTrackedTargets+1 {
+				t.Errorf("%d counters, want at most %d", len(snapshot), maxTrackedTargets+1)
+			}
+		})
+	}
+}
+
+func TestTargetStatsSnapshotReset(t *testing.T) {
+	setup(t)
+	countTargetRateLimit("a.example")
+	if got := targetStatsSnapshot(true)["a.example"].RateLimits; got != 1 {
+		t.Errorf("snapshot before the reset = %d, want 1", got)
+	}
+	if got := targetStatsSnapshot(false); len(got) != 0 {
+		t.Errorf("snapshot after the reset = %v, want no counts", got)
+	}
+}
+
+func TestTargetRateLimitMetrics(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts []string
+		want  string
+	}{
+		{"no counts", nil, ""},
+		{"sorted by host", []string{"b.example", "a.example", "b.example"},
+			"proxy_target_rate_limits_total{host=\"a.example\"} 1\nproxy_target_rate_limits_total{host=\"b.example\"} 2\n"},
+		{"escaped labels", []string{"a\"b\\c\nd"},
+			"proxy_target_rate_limits_total{host=\"a\\\"b\\\\c\\nd\"} 1\n"},
+		{"invalid label left out", []string{"a.example", "\xff.example"},
+			"proxy_target_rate_limits_total{host=\"a.example\"} 1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			for _, host := range tt.hosts {
+				countTargetRateLimit(host)
+			}
+			resp := proxyGet(t, "/metrics")
+			if resp.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+			}
+			got := string(resp.Body())
+			if tt.want == "" {
+				if strings.Contains(got, "proxy_target_rate_limits_total") {
+					t.Errorf("metrics = %q, want no target counters", got)
+				}
+				return
+			}
+			header := "# HELP proxy_target_rate_limits_total Rate limit and CAPTCHA responses servers got, by target host.\n# TYPE proxy_target_rate_limits_total counter\n"
+			if !strings.Contains(got, header+tt.want) {
+				t.Errorf("metrics = %q, want samples %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetRateLimits(t *testing.T) {
+	setup(t)
+	config.setAdminKey("secret")
+	writeServers(t,
+		statusBackend(t, fasthttp.StatusTooManyRequests, `{"error":"slow down"}`),
+		statusBackend(t, fasthttp.StatusForbidden, `{"error":"CAPTCHA required"}`),
+	)
+
+	// Each request is rate limited by both servers.
+	for i, uri := range []string{
+		"https://a.example/1",
+		"https://A.Example/2",
+		"https://b.example/1",
+		"b.example/2",
+		"B.example:443/3",
+		"/no/host",
+	} {
+		if resp := proxyGet(t, target(uri)); resp.StatusCode() != fasthttp.StatusTooManyRequests {
+			t.Fatalf("request %d: status = %d: %s", i, resp.StatusCode(), resp.Body())
+		}
+	}
+
+	var snapshot statsSnapshot
+	if err := json.Unmarshal(proxyGet(t, "/stats").Body(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	// Targets without a scheme count towards their host; a plain path has
+	// none.
+	want := map[string]int64{"a.example": 4, "b.example": 6}
+	if len(snapshot.Targets) != len(want) {
+		t.Errorf("targets = %v, want %v", snapshot.Targets, want)
+	}
+	for host, count := range want {
+		if got := snapshot.Targets[host].RateLimits; got != count {
+			t.Errorf("/stats rate limits for %s = %d, want %d", host, got, count)
+		}
+	}
+
+	samples, types := parseMetrics(t, string(proxyGet(t, "/metrics").Body()))
+	if types["proxy_target_rate_limits_total"] != "counter" {
+		t.Errorf("proxy_target_rate_limits_total type = %q, want counter", types["proxy_target_rate_limits_total"])
+	}
+	for host, count := range want {
+		if got := samples[`proxy_target_rate_limits_total{host="`+host+`"}`]; got != float64(count) {
+			t.Errorf("/metrics rate limits for %s = %v, want %d", host, got, count)
+		}
+	}
+
+	if resp := proxyDo(t, fasthttp.MethodPost, "/admin/stats/reset", "", "X-API-Key", "secret"); resp.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("reset status = %d: %s", resp.StatusCode(), resp.Body())
+	}
+	if got := targetStatsSnapshot(false); len(got) != 0 {
+		t.Errorf("counts after the stats reset = %v, want none", got)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// timedClient is used by makeRequest with -server-timing. Streaming the body
+// makes Do return as soon as the response headers are in, which gives the
+// time to first byte; makeRequest then reads the body as usual. DNS and
+// connect times are not reported since connections are pooled and the client
+// does not expose them per request. Like upstreamClient it leaves retries to
+// requestWithTransientRetry.
+var timedClient = &fasthttp.Client{StreamResponseBody: true, DisablePathNormalizing: true, MaxIdemponentCallAttempts: 1}
+
+// upstreamTiming is measured by makeRequest for the Server-Timing header.
+type upstreamTiming struct {
+	TTFB  time.Duration
+	Total time.Duration
+}
+
+type timingMetric struct {
+	Name     string
+	Desc     string
+	Duration time.Duration
+}
+
+// setServerTiming writes the metrics as a Server-Timing header, durations in
+// milliseconds.
+func setServerTiming(ctx *fasthttp.RequestCtx, metrics ...timingMetric) {
+	if !config.ServerTiming {
+		return
+	}
+
+	parts := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		part := metric.Name
+		if metric.Desc != "" {
+			part += fmt.Sprintf(";desc=%q", metric.Desc)
+		}
+		part += fmt.Sprintf(";dur=%.3f", float64(metric.Duration.Microseconds())/1000)
+		parts = append(parts, part)
+	}
+	ctx.Response.Header.Set("Server-Timing", strings.Join(parts, ", "))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// serverTimingMetrics parses a Server-Timing header into the desc and
+// duration of each metric, by name.
+func serverTimingMetrics(t *testing.T, header string) map[string]timingMetric {
+	t.Helper()
+	metrics := make(map[string]timingMetric)
+	for _, part := range strings.Split(header, ", ") {
+		fields := strings.Split(part, ";")
+		metric := timingMetric{Name: fields[0]}
+		for _, field := range fields[1:] {
+			name, value, _ := strings.Cut(field, "=")
+			switch name {
+			case "desc":
+				metric.Desc, _ = strconv.Unquote(value)
+			case "dur":
+				ms, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					t.Fatalf("bad duration in %q: %v", header, err)
+				}
+				metric.Duration = time.Duration(ms * float64(time.Millisecond))
+			}
+		}
+		metrics[metric.Name] = metric
+	}
+	return metrics
+}
+
+func TestServerTiming(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	setup(t)
+	config.ServerTiming = true
+	writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(delay)
+		ctx.SetBodyString(`{}`)
+	}))
+
+	resp := proxyGet(t, target("api.example.com/timed"))
+	metrics := serverTimingMetrics(t, string(resp.Header.Peek("Server-Timing")))
+	for _, name := range []string{"cache", "ttfb", "upstream", "total"} {
+		if _, ok := metrics[name]; !ok {
+			t.Errorf("fresh fetch has no %s metric: %q", name, resp.Header.Peek("Server-Timing"))
+		}
+	}
+	if metrics["cache"].Desc != "miss" || metrics["upstream"].Desc != "1 attempts" {
+		t.Errorf("cache desc = %q, upstream desc = %q", metrics["cache"].Desc, metrics["upstream"].Desc)
+	}
+	if ttfb := metrics["ttfb"].Duration; ttfb < delay {
+		t.Errorf("ttfb = %s for a server answering after %s", ttfb, delay)
+	}
+	if metrics["upstream"].Duration < metrics["ttfb"].Duration || metrics["total"].Duration < metrics["upstream"].Duration {
+		t.Errorf("metrics out of order: %+v", metrics)
+	}
+
+	resp = proxyGet(t, target("api.example.com/timed"))
+	metrics = serverTimingMetrics(t, string(resp.Header.Peek("Server-Timing")))
+	if len(metrics) != 1 || metrics["cache"].Desc != "hit" {
+		t.Errorf("cache hit Server-Timing = %q, want only the cache lookup", resp.Header.Peek("Server-Timing"))
+	}
+}
+
+func TestServerTimingDisabled(t *testing.T) {
+	setup(t)
+	writeServers(t, jsonBackend(t, `{}`))
+	if header := proxyGet(t, target("api.example.com/timed")).Header.Peek("Server-Timing"); len(header) > 0 {
+		t.Errorf("Server-Timing = %q without -server-timing", header)
+	}
+}
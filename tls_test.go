@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestBuildTLSConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		minVersion string
+		ciphers    string
+		version    uint16
+		suites     []uint16
+		wantErr    bool
+	}{
+		{"default", flag.Lookup("tls-min-version").DefValue, "", tls.VersionTLS12, nil, false},
+		{"TLS 1.3", "1.3", "", tls.VersionTLS13, nil, false},
+		{"cipher list", "1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", tls.VersionTLS12,
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, false},
+		{"unknown version", "1.4", "", 0, nil, true},
+		{"version without the dot", "12", "", 0, nil, true},
+		{"unknown cipher", "1.2", "TLS_MADE_UP", 0, nil, true},
+		{"insecure cipher", "1.2", "TLS_RSA_WITH_RC4_128_SHA", 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildTLSConfig(tt.minVersion, tt.ciphers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.MinVersion != tt.version {
+				t.Errorf("MinVersion = %x, want %x", got.MinVersion, tt.version)
+			}
+			if !reflect.DeepEqual(got.CipherSuites, tt.suites) {
+				t.Errorf("CipherSuites = %v, want %v", got.CipherSuites, tt.suites)
+			}
+		})
+	}
+}
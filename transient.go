@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// errTransient marks makeRequest errors that isTransientNetworkError let
+// through, see requestWithTransientRetry.
+var errTransient = errors.New("Transient network error")
+
+// isTransientNetworkError reports whether err is a network blip worth
+// retrying on the same server: the connection was reset or closed under the
+// request, or the error says it is temporary. A refused connection or a
+// failed DNS lookup is a hard error and rotates right away.
+func isTransientNetworkError(err error) bool {
+	if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, fasthttp.ErrConnectionClosed) {
+		return true
+	}
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// closedWithoutResponse reports whether the server accepted the connection
+// and closed it again before sending any response.
+func closedWithoutResponse(err error) bool {
+	return errors.Is(err, fasthttp.ErrConnectionClosed) || errors.Is(err, io.EOF)
+}
+
+// transientRetries is how often server is retried after a transient error:
+// its TransientRetries from the servers file, else -transient-retries.
+func (s Server) transientRetries() int {
+	if s.TransientRetries != 0 {
+		return max(s.TransientRetries, 0)
+	}
+	return config.TransientRetries
+}
+
+// requestWithTransientRetry is makeRequest for one server, retried on that
+// same server after transient network errors with a doubling
+// -transient-retry-backoff. Rotating away after a blip would lose whatever
+// the server has warmed up for the target. Requests that are not retrySafe,
+// such as a POST without an Idempotency-Key, are never retried.
+func requestWithTransientRetry(server Server, endpoint string, outbound upstreamRequest) (upstreamResponse, error) {
+	response, err := makeRequest(server.URL, endpoint, outbound)
+	retries := server.transientRetries()
+	if !outbound.retrySafe() {
+		retries = 0
+	}
+	backoff := config.TransientRetryBackoff
+	for retry := 1; retry <= retries && errors.Is(err, errTransient); retry++ {
+		fmt.Printf("Transient error from %s, retrying it in %v (%d/%d)\n", server.URL, backoff, retry, retries)
+		time.Sleep(backoff)
+		backoff *= 2
+		response, err = makeRequest(server.URL, endpoint, outbound)
+	}
+	// Once the retries are used up, a transient error that is also
+	// retryable rotates to the next server.
+	var retryable *retryableError
+	if errors.As(err, &retryable) {
+		return response, retryable
+	}
+	return response, err
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// resettingBackend is a TCP backend that resets the first resets connections
+// after reading their request and answers the later ones with a JSON body.
+// It counts the connections it accepts in conns.
+func resettingBackend(t *testing.T, resets int64, conns *atomic.Int64) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			n := conns.Add(1)
+			go func() {
+				defer conn.Close()
+				var req fasthttp.Request
+				if err := req.Read(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				if n <= resets {
+					conn.(*net.TCPConn).SetLinger(0)
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 2\r\nConnection: close\r\n\r\n{}")
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return "http://" + ln.Addr().String()
+}
+
+func TestTransientRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		retries     int
+		perServer   string // TransientRetries in the servers file
+		method      string
+		idempotency bool
+		conns       int64 // connections to the resetting server
+		rotated     bool
+	}{
+		{name: "off", retries: 0, method: fasthttp.MethodGet, conns: 1, rotated: true},
+		{name: "retried once", retries: 1, method: fasthttp.MethodGet, conns: 2},
+		{name: "server override", retries: 0, perServer: `,"TransientRetries":2`, method: fasthttp.MethodGet, conns: 2},
+		{name: "server turns them off", retries: 2, perServer: `,"TransientRetries":-1`, method: fasthttp.MethodGet, conns: 1, rotated: true},
+		{name: "POST not retried", retries: 1, method: fasthttp.MethodPost, conns: 1, rotated: true},
+		{name: "POST with an Idempotency-Key", retries: 1, method: fasthttp.MethodPost, idempotency: true, conns: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.TransientRetries = tt.retries
+			config.TransientRetryBackoff = time.Millisecond
+			config.ForwardBody = true
+			var conns, fallbackRequests atomic.Int64
+			flaky := resettingBackend(t, 1, &conns)
+			fallback := countingBackend(t, `{"from":"fallback"}`, &fallbackRequests)
+			writeFile(t, serversFile, fmt.Sprintf(`[{"url":%q%s},{"url":%q}]`, flaky, tt.perServer, fallback))
+
+			var headers []string
+			if tt.idempotency {
+				headers = []string{idempotencyHeader, "order-1"}
+			}
+			resp := proxyDo(t, tt.method, target("api.example.com/blip"), "", headers...)
+			if resp.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+			}
+			if got := conns.Load(); got != tt.conns {
+				t.Errorf("connections to the flaky server = %d, want %d", got, tt.conns)
+			}
+			if rotated := fallbackRequests.Load() > 0; rotated != tt.rotated {
+				t.Errorf("rotated = %v, want %v: %s", rotated, tt.rotated, resp.Body())
+			}
+		})
+	}
+}
+
+func TestTransientRetriesUsedUp(t *testing.T) {
+	setup(t)
+	config.TransientRetries = 2
+	config.TransientRetryBackoff = time.Millisecond
+	var conns atomic.Int64
+	writeServers(t, resettingBackend(t, 10, &conns))
+
+	resp := proxyGet(t, target("api.example.com/down"))
+	if resp.StatusCode() < 500 {
+		t.Errorf("status = %d, want a server error: %s", resp.StatusCode(), resp.Body())
+	}
+	if got := conns.Load(); got != 3 {
+		t.Errorf("connections = %d, want the attempt and two retries", got)
+	}
+}
+
+func TestIsTransientNetworkError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{syscall.ECONNRESET, true},
+		{&net.OpError{Op: "read", Err: &net.OpError{Err: syscall.ECONNRESET}}, true},
+		{fmt.Errorf("write: %w", syscall.EPIPE), true},
+		{io.ErrUnexpectedEOF, true},
+		{fasthttp.ErrConnectionClosed, true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, false},
+		{&net.DNSError{Err: "no such host", Name: "backend.test", IsTemporary: true}, false},
+		{errors.New("something else"), false},
+	}
+	for _, tt := range tests {
+		if got := isTransientNetworkError(tt.err); got != tt.want {
+			t.Errorf("isTransientNetworkError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestClosedWithoutResponse(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{fasthttp.ErrConnectionClosed, true},
+		{io.EOF, true},
+		{fmt.Errorf("read: %w", io.EOF), true},
+		{io.ErrUnexpectedEOF, false},
+		{syscall.ECONNRESET, false},
+		{errors.New("something else"), false},
+	}
+	for _, tt := range tests {
+		if got := closedWithoutResponse(tt.err); got != tt.want {
+			t.Errorf("closedWithoutResponse(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestClosedConnection(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		closing  int // servers closing the connection, ahead of the others
+		working  int
+		status   int
+		fallback int64
+	}{
+		{"next server answers", 0, 1, 1, fasthttp.StatusOK, 1},
+		{"retried before rotating", 1, 1, 1, fasthttp.StatusOK, 1},
+		{"several closing servers", 0, 2, 1, fasthttp.StatusOK, 1},
+		{"no server left", 0, 1, 0, fasthttp.StatusBadGateway, 0},
+		{"retries used up", 1, 2, 0, fasthttp.StatusBadGateway, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.TransientRetries = tt.retries
+			config.TransientRetryBackoff = time.Millisecond
+			var servers []string
+			for i := 0; i < tt.closing; i++ {
+				servers = append(servers, rawBackend(t, ""))
+			}
+			var fallbackRequests atomic.Int64
+			for i := 0; i < tt.working; i++ {
+				servers = append(servers, countingBackend(t, `{"from":"fallback"}`, &fallbackRequests))
+			}
+			writeServers(t, servers...)
+
+			resp := proxyGet(t, target("api.example.com/closed"))
+			if resp.StatusCode() != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode(), tt.status, resp.Body())
+			}
+			if tt.status == fasthttp.StatusBadGateway && !strings.Contains(string(resp.Body()), "closed the connection without a response") {
+				t.Errorf("body = %s, want the closed connection reported", resp.Body())
+			}
+			if got := fallbackRequests.Load(); got != tt.fallback {
+				t.Errorf("working server requests = %d, want %d", got, tt.fallback)
+			}
+		})
+	}
+}
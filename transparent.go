@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// handleTransparent serves every request in -transparent mode. Instead of
+// extracting a target from url=, the incoming path and query are sent to the
+// server unchanged, which makes the proxy a plain load balancer in front of
+// the pool. Responses are not cached since there is no target URL to key on.
+func handleTransparent(ctx *fasthttp.RequestCtx) {
+	// A url parameter is still the target for servers that read one, and
+	// otherwise the request's own host and path pick the -pool-routes pool.
+	// Only an actual url parameter counts: targetURL would take a query
+	// without one as the target.
+	var target string
+	var err error
+	if ctx.QueryArgs().Has("url") {
+		target, err = targetURL(ctx)
+	}
+	if err == nil && target != "" && checkTargetPort(target) != nil {
+		sendJSONErrorCode(ctx, errPortNotAllowed.Error(), "port_not_allowed", fasthttp.StatusForbidden)
+		return
+	}
+	if err != nil || target == "" {
+		target = string(ctx.Host()) + string(ctx.Path())
+	}
+
+	opts, err := parseRequestOptions(ctx)
+	if err != nil {
+		sendJSONErrorResponse(ctx, err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	outbound, err := newUpstreamRequest(ctx, "", opts)
+	if err != nil {
+		sendJSONErrorResponse(ctx, err.Error(), fasthttp.StatusUnsupportedMediaType)
+		return
+	}
+
+	servers, err := readServerAddresses(serversFile)
+	if err != nil {
+		sendJSONErrorResponse(ctx, err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	pool := targetPool(target)
+	pooled := poolServers(servers, pool)
+	if len(servers) > 0 && len(pooled) == 0 {
+		sendJSONErrorCode(ctx, "No eligible servers: "+poolName(pool)+" has no servers", "no_eligible_servers", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	candidates := excludeServers(ctx, pooled)
+	if len(pooled) > 0 && len(candidates) == 0 {
+		sendJSONErrorCode(ctx, "No eligible servers: all servers are excluded by "+excludeServersHeader, "no_eligible_servers", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	servers, reason := eligibleServers(candidates, nil, opts.Server)
+	if len(servers) == 0 {
+		sendJSONErrorCode(ctx, "No eligible servers: "+reason, "no_eligible_servers", fasthttp.StatusServiceUnavailable)
+		return
+	}
+
+	if upstreamLimiter != nil {
+		upstreamLimiter.acquire(isHighPriority(ctx))
+		defer upstreamLimiter.release()
+	}
+
+	endpoint := string(ctx.RequestURI())
+	reqID := requestID(ctx)
+	var lastError error
+	attempt := 0
+	first := rotationStart(len(servers))
+	for n := 0; n < len(servers); n++ {
+		i := (first + n) % len(servers)
+		server := servers[i]
+		if !serverAvailable(server.URL) {
+			continue
+		}
+		if !acquireAttempt() {
+			releaseProbe(server.URL)
+			sendJSONErrorResponse(ctx, "Too many upstream requests in flight", fasthttp.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Printf("Transparent request: %s%s\n", server.URL, endpoint)
+		attempt++
+		attemptStart := time.Now()
+		attemptOutbound := outbound.forServer(server)
+		attemptOutbound.RequestID = attemptID(reqID, attempt)
+		response, err := requestWithTransientRetry(server, endpoint, attemptOutbound)
+		releaseAttempt()
+		if err == nil {
+			recordSuccess(server.URL)
+			recordLatency(server.URL, time.Since(attemptStart))
+			serverIndex.Store(uint64(i+1) % uint64(len(servers)))
+			ctx.SetUserValue("server", server.URL)
+			writeUpstreamResponse(ctx, response)
+			return
+		}
+
+		lastError = err
+		if isRateLimitError(err) {
+			recordRateLimit(server.URL)
+		} else {
+			recordFailure(server.URL)
+		}
+		if opts.NoRotate || !isRateLimitError(err) && !isRetryableError(err) {
+			break
+		}
+	}
+
+	if lastError == nil {
+		sendJSONErrorCode(ctx, "No eligible servers: all servers are cooling down or unhealthy", "no_eligible_servers", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	statusCode, _ := parseHTTPError(lastError)
+	sendUpstreamError(ctx, lastError, statusCode)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestTransparent(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+	}{
+		{"root", "/"},
+		{"path and query", "/v1/items?id=1&id=2&sort=-created"},
+		{"encoded characters", "/a%2Fb/c%20d?q=a+b&x=%252F"},
+		{"url parameter", "/search?url=api.example.com/other&page=2"},
+		{"proxy endpoint name", "/stats?full=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config.Transparent = true
+			var got atomic.Value
+			writeServers(t, newBackend(t, func(ctx *fasthttp.RequestCtx) {
+				got.Store(string(ctx.RequestURI()))
+				ctx.SetContentType("application/json")
+				ctx.SetBodyString(`{}`)
+			}))
+
+			resp := proxyGet(t, tt.uri)
+			if resp.StatusCode() != fasthttp.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+			}
+			if uri, _ := got.Load().(string); uri != tt.uri {
+				t.Errorf("server got %q, want %q", uri, tt.uri)
+			}
+		})
+	}
+}
+
+func TestTransparentNotCached(t *testing.T) {
+	setup(t)
+	config.Transparent = true
+	var requests atomic.Int64
+	writeServers(t, countingBackend(t, `{}`, &requests))
+
+	for i := 0; i < 2; i++ {
+		proxyGet(t, "/v1/items?id=1")
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("server requests = %d, want 2", got)
+	}
+}
+
+func TestTransparentProxyEndpoints(t *testing.T) {
+	setup(t)
+	config.Transparent = true
+	var requests atomic.Int64
+	writeServers(t, countingBackend(t, `{}`, &requests))
+
+	resp := proxyGet(t, transparentPrefix+"/stats")
+	if resp.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+	}
+	if requests.Load() != 0 {
+		t.Errorf("%s/stats went to the server", transparentPrefix)
+	}
+}
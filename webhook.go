@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// serverEvent is POSTed to -webhook when a server changes state.
+type serverEvent struct {
+	Server   string    `json:"server"`
+	Kind     string    `json:"kind"`
+	OldState string    `json:"old_state"`
+	NewState string    `json:"new_state"`
+	Reason   string    `json:"reason,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+var (
+	webhookEvents chan serverEvent
+	webhookClient = &fasthttp.Client{}
+	// webhookSender tracks the goroutine started by startWebhook, which
+	// returns once webhookEvents is closed.
+	webhookSender sync.WaitGroup
+)
+
+// startWebhook starts the goroutine delivering events to -webhook, one at a
+// time from a queue of -webhook-queue events.
+func startWebhook() {
+	if config.Webhook == "" {
+		return
+	}
+
+	webhookEvents = make(chan serverEvent, config.WebhookQueue)
+	webhookSender.Add(1)
+	go func() {
+		defer webhookSender.Done()
+		for event := range webhookEvents {
+			if err := deliverWebhook(event); err != nil {
+				fmt.Printf("Webhook delivery failed for %s %s of %s: %v\n", event.Kind, event.NewState, event.Server, err)
+			}
+		}
+	}()
+}
+
+// emitServerEvent queues an event without blocking, as it is called with the
+// health lock held. When the queue is full the event is dropped and logged.
+func emitServerEvent(server string, kind string, oldState string, newState string, reason string) {
+	if webhookEvents == nil {
+		return
+	}
+
+	event := serverEvent{Server: server, Kind: kind, OldState: oldState, NewState: newState, Reason: reason, Time: time.Now().UTC()}
+	select {
+	case webhookEvents <- event:
+	default:
+		fmt.Printf("Webhook queue full, dropping %s %s event for %s\n", kind, newState, server)
+	}
+}
+
+func deliverWebhook(event serverEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(config.Webhook)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/json")
+	req.SetBody(body)
+
+	if err := webhookClient.DoTimeout(req, resp, config.WebhookTimeout); err != nil {
+		return err
+	}
+	if code := resp.StatusCode(); code < 200 || code >= 300 {
+		return fmt.Errorf("unexpected status code %d", code)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// webhookBackend serves -webhook for the running test with handler, after
+// passing each event it receives to events, and stops the delivery goroutine
+// when the test ends.
+func webhookBackend(t *testing.T, events chan<- serverEvent, handler fasthttp.RequestHandler) {
+	t.Helper()
+	config.Webhook = newBackend(t, func(ctx *fasthttp.RequestCtx) {
+		var event serverEvent
+		if err := json.Unmarshal(ctx.PostBody(), &event); err != nil {
+			t.Errorf("webhook payload %s: %v", ctx.PostBody(), err)
+		}
+		events <- event
+		handler(ctx)
+	}) + "/hook"
+	startWebhook()
+	t.Cleanup(stopWebhook)
+}
+
+// stopWebhook waits for the queued events to be delivered and stops the
+// delivery goroutine.
+func stopWebhook() {
+	if webhookEvents == nil {
+		return
+	}
+	close(webhookEvents)
+	webhookSender.Wait()
+	webhookEvents = nil
+}
+
+func TestWebhookEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		trigger func(server string)
+		want    serverEvent
+	}{
+		{
+			name: "cooldown",
+			trigger: func(server string) {
+				config.Cooldown = time.Minute
+				recordRateLimit(server)
+			},
+			want: serverEvent{Kind: "cooldown", OldState: "available", NewState: "cooldown", Reason: "rate limited"},
+		},
+		{
+			name: "breaker opens",
+			trigger: func(server string) {
+				config.BreakerThreshold = 2
+				recordFailure(server)
+				recordFailure(server)
+			},
+			want: serverEvent{Kind: "breaker", OldState: "closed", NewState: "open", Reason: "2 consecutive failures"},
+		},
+		{
+			name: "breaker closes",
+			trigger: func(server string) {
+				config.BreakerThreshold = 1
+				health.Lock()
+				healthFor(server).Breaker = breakerHalfOpen
+				health.Unlock()
+				recordSuccess(server)
+			},
+			want: serverEvent{Kind: "breaker", OldState: "half-open", NewState: "closed", Reason: "request succeeded"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			events := make(chan serverEvent, 10)
+			webhookBackend(t, events, func(*fasthttp.RequestCtx) {})
+
+			const server = "http://backend.example"
+			before := time.Now().Add(-time.Second)
+			tt.trigger(server)
+			select {
+			case event := <-events:
+				tt.want.Server, tt.want.Time = server, event.Time
+				if event != tt.want {
+					t.Errorf("event = %+v, want %+v", event, tt.want)
+				}
+				if event.Time.Before(before) || event.Time.After(time.Now()) {
+					t.Errorf("event time %s is not now", event.Time)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no event delivered")
+			}
+			select {
+			case event := <-events:
+				t.Errorf("unexpected second event %+v", event)
+			case <-time.After(20 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestWebhookFromTraffic(t *testing.T) {
+	setup(t)
+	config.Cooldown = time.Minute
+	events := make(chan serverEvent, 10)
+	webhookBackend(t, events, func(*fasthttp.RequestCtx) {})
+	limited := statusBackend(t, fasthttp.StatusTooManyRequests, "slow down")
+	writeServers(t, limited, jsonBackend(t, `{}`))
+
+	if resp := proxyGet(t, target("api.example.com/hook")); resp.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode(), resp.Body())
+	}
+	select {
+	case event := <-events:
+		if event.Server != limited || event.Kind != "cooldown" {
+			t.Errorf("event = %+v, want %s cooling down", event, limited)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event delivered")
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	setup(t)
+	config.WebhookQueue = 1
+	events := make(chan serverEvent, 10)
+	release := make(chan struct{})
+	webhookBackend(t, events, func(*fasthttp.RequestCtx) { <-release })
+
+	output := captureOutput(t, func() {
+		emitServerEvent("http://a.example", "cooldown", "available", "cooldown", "")
+		// The first event is being delivered, the second waits in the
+		// queue and the third does not fit.
+		<-events
+		start := time.Now()
+		emitServerEvent("http://b.example", "cooldown", "available", "cooldown", "")
+		emitServerEvent("http://c.example", "cooldown", "available", "cooldown", "")
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("emitting took %s with a blocked webhook", elapsed)
+		}
+		close(release)
+		if event := <-events; event.Server != "http://b.example" {
+			t.Errorf("queued event for %s, want b.example", event.Server)
+		}
+	})
+	if !strings.Contains(output, "Webhook queue full, dropping cooldown cooldown event for http://c.example") {
+		t.Errorf("output %q does not log the dropped event", output)
+	}
+}
+
+func TestWebhookDeliveryFailure(t *testing.T) {
+	setup(t)
+	events := make(chan serverEvent, 10)
+	webhookBackend(t, events, func(ctx *fasthttp.RequestCtx) { ctx.SetStatusCode(fasthttp.StatusInternalServerError) })
+
+	output := captureOutput(t, func() {
+		emitServerEvent("http://a.example", "health", "healthy", "unhealthy", "timeout")
+		emitServerEvent("http://b.example", "health", "healthy", "unhealthy", "timeout")
+		<-events
+		<-events
+		stopWebhook()
+	})
+	if !strings.Contains(output, "Webhook delivery failed for health unhealthy of http://a.example: unexpected status code 500") {
+		t.Errorf("output %q does not log the failed delivery", output)
+	}
+}